@@ -0,0 +1,1048 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The API is served on the plugin socket next to the Scope endpoints,
+// it is used by the ctl command. Requests and responses are JSON.
+//
+//	GET  /api/v1/status                  plugin status
+//	GET  /api/v1/containers?target=...   containers and their settings
+//	POST /api/v1/apply                   apply an impairment or DNS, HTTP and link faults to a target
+//	POST /api/v1/clear                   clear the settings and faults of a target
+//	POST /api/v1/plan                    plan an apply or a clear without doing it
+//	GET  /api/v1/node                    impairment of the node itself
+//	POST /api/v1/node/apply              apply an impairment to the node
+//	POST /api/v1/node/clear              clear the settings of the node
+//	POST /api/v1/node/plan               plan a node apply or clear
+//	GET  /api/v1/captures                packet captures
+//	POST /api/v1/captures/start          capture the packets of a target
+//	POST /api/v1/captures/stop           stop a capture
+//	POST /api/v1/captures/remove         stop a capture and remove its file
+//	GET  /api/v1/captures/pcap?id=...    pcap file of a capture, streamed until it ends
+//	GET  /api/v1/probes                  probes and their results
+//	POST /api/v1/probes/start            probe the peers of a target
+//	POST /api/v1/probes/stop             stop probing the peers of a target
+//	GET  /api/v1/throughput              throughput tests and their results
+//	POST /api/v1/throughput/start        test the throughput from a target to another
+//	GET  /api/v1/interfaces?target=...   interfaces, routes and neighbours of the containers
+//	POST /api/v1/reset                   reset the TCP connections of a target
+//
+// A target is a container ID or ID prefix, a container name, a pod name
+// or a selector: comma separated key=value pairs where the keys are id,
+// name, pod, state or node and the values may be glob patterns.
+const apiPrefix = "/api/v1/"
+
+// APIContainer is a container and its settings
+type APIContainer struct {
+	// Node is the name of the plugin instance
+	Node  string `json:"node"`
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Pod   string `json:"pod,omitempty"`
+	State string `json:"state"`
+	PID   int    `json:"pid"`
+	NetNS string `json:"netns,omitempty"`
+	// Protected tells why the policy protects the container
+	Protected string `json:"protected,omitempty"`
+	Impairment
+	// Expires is when the settings are cleared, if they are temporary
+	Expires *time.Time `json:"expires,omitempty"`
+	// Ramp and Replay are the progress of the ramp or of the trace
+	// replay driving the settings
+	Ramp   *RampStatus   `json:"ramp,omitempty"`
+	Replay *ReplayStatus `json:"replay,omitempty"`
+	// DNS, HTTP and Link are the faults injected in the network
+	// namespace
+	DNS  *DNSImpairment  `json:"dns,omitempty"`
+	HTTP *HTTPImpairment `json:"http,omitempty"`
+	Link *LinkImpairment `json:"link,omitempty"`
+	// Observed are the round trip time and the loss measured by the
+	// probes of the network namespace
+	Observed *ProbeStats `json:"observed,omitempty"`
+	// Reset is the last reset of the TCP connections of the network
+	// namespace
+	Reset *ConnectionReset `json:"reset,omitempty"`
+	// Error is only set by the coordinator, in place of the containers
+	// of a plugin instance it cannot list
+	Error string `json:"error,omitempty"`
+}
+
+// APIStatus is the status of the plugin
+type APIStatus struct {
+	Node    string `json:"node"`
+	Backend string `json:"backend"`
+	// Preflight is "ok" or lists the features the backend misses
+	Preflight  string `json:"preflight"`
+	Controls   bool   `json:"controls"`
+	Containers int    `json:"containers"`
+	Impaired   int    `json:"impaired"`
+	// Nodes is only set by the coordinator
+	Nodes []APINodeStatus `json:"nodes,omitempty"`
+}
+
+// APINodeStatus is the status of a plugin instance seen by the
+// coordinator
+type APINodeStatus struct {
+	Endpoint string     `json:"endpoint"`
+	Status   *APIStatus `json:"status,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// APIApplyRequest applies Impairment, starts Ramp or Replay and injects
+// the DNS, HTTP and link faults to the containers matching Target
+type APIApplyRequest struct {
+	Target string `json:"target"`
+	Impairment
+	Ramp   *Ramp   `json:"ramp,omitempty"`
+	Replay *Replay `json:"replay,omitempty"`
+	// For is a duration after which the settings and the link faults
+	// are cleared, e.g. 5m
+	For  string          `json:"for,omitempty"`
+	DNS  *DNSImpairment  `json:"dns,omitempty"`
+	HTTP *HTTPImpairment `json:"http,omitempty"`
+	Link *LinkImpairment `json:"link,omitempty"`
+}
+
+// APIClearRequest clears the settings of the containers matching Target
+type APIClearRequest struct {
+	Target string `json:"target"`
+}
+
+// APIPlanRequest plans applying Impairment to the containers matching
+// Target or, if Clear is set, clearing their settings
+type APIPlanRequest struct {
+	Target string `json:"target"`
+	Impairment
+	Clear bool `json:"clear,omitempty"`
+}
+
+// APINode is the impairment of the host network namespace
+type APINode struct {
+	Node string `json:"node"`
+	// Enabled tells whether the node may be impaired
+	Enabled      bool   `json:"enabled"`
+	Device       string `json:"device"`
+	ExcludePorts []int  `json:"exclude_ports"`
+	NetNS        string `json:"netns,omitempty"`
+	Impairment
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// APINodeApplyRequest applies Impairment to the node
+type APINodeApplyRequest struct {
+	Impairment
+	For string `json:"for,omitempty"`
+}
+
+// APINodePlanRequest plans applying Impairment to the node or, if Clear
+// is set, clearing its settings
+type APINodePlanRequest struct {
+	Impairment
+	Clear bool `json:"clear,omitempty"`
+}
+
+// APICaptureRequest captures the packets of the network namespace of
+// the container matching Target
+type APICaptureRequest struct {
+	Target string `json:"target"`
+	CaptureOptions
+}
+
+// APICaptureID designates a capture
+type APICaptureID struct {
+	ID string `json:"id"`
+}
+
+// APIProbeRequest probes the peers of the network namespaces of the
+// containers matching Target
+type APIProbeRequest struct {
+	Target string `json:"target"`
+	ProbeOptions
+}
+
+// APIThroughputRequest tests the throughput from the network namespace
+// of the container matching Source to the one of the container matching
+// Destination
+type APIThroughputRequest struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ThroughputOptions
+}
+
+// APIResetRequest resets the TCP connections of the network namespaces
+// of the containers matching Target
+type APIResetRequest struct {
+	Target string `json:"target"`
+	ResetOptions
+}
+
+// APIInterfaces is the network configuration of the network namespace
+// of Containers
+type APIInterfaces struct {
+	Node       string   `json:"node"`
+	Containers []string `json:"containers"`
+	NetworkInventory
+}
+
+// APIResult is the outcome of an operation on a container
+type APIResult struct {
+	Container APIContainer `json:"container"`
+	// SharedWith are the names of the other containers in the network
+	// namespace, the operation applies to them too
+	SharedWith []string `json:"shared_with,omitempty"`
+	// Plan is only set when planning
+	Plan  *Plan  `json:"plan,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// API serves the JSON API
+type API struct {
+	store       *Store
+	preflight   *Preflight
+	controller  *Controller
+	captures    *Captures
+	probes      *Probes
+	throughput  *Throughputs
+	inventories *Inventories
+	resets      *Resets
+	reporter    *Reporter
+}
+
+// NewAPI instantiates a new API
+func NewAPI(store *Store, preflight *Preflight, controller *Controller, captures *Captures, probes *Probes, throughput *Throughputs, inventories *Inventories, resets *Resets, reporter *Reporter) *API {
+	return &API{
+		store:       store,
+		preflight:   preflight,
+		controller:  controller,
+		captures:    captures,
+		probes:      probes,
+		throughput:  throughput,
+		inventories: inventories,
+		resets:      resets,
+		reporter:    reporter,
+	}
+}
+
+// Register adds the API endpoints to mux
+func (a *API) Register(mux *http.ServeMux) {
+	mux.HandleFunc(apiPrefix+"status", apiGet(a.status))
+	mux.HandleFunc(apiPrefix+"containers", apiGet(a.containers))
+	mux.HandleFunc(apiPrefix+"apply", a.post(a.apply))
+	mux.HandleFunc(apiPrefix+"clear", a.post(a.clear))
+	mux.HandleFunc(apiPrefix+"plan", a.post(a.plan))
+	mux.HandleFunc(apiPrefix+"node", apiGet(a.node))
+	mux.HandleFunc(apiPrefix+"node/apply", a.post(a.nodeApply))
+	mux.HandleFunc(apiPrefix+"node/clear", a.post(a.nodeClear))
+	mux.HandleFunc(apiPrefix+"node/plan", a.post(a.nodePlan))
+	mux.HandleFunc(apiPrefix+"captures", apiGet(a.listCaptures))
+	mux.HandleFunc(apiPrefix+"captures/start", a.post(a.startCapture))
+	mux.HandleFunc(apiPrefix+"captures/stop", a.post(a.stopCapture))
+	mux.HandleFunc(apiPrefix+"captures/remove", a.post(a.removeCapture))
+	mux.HandleFunc(apiPrefix+"captures/pcap", a.capturePcap)
+	mux.HandleFunc(apiPrefix+"probes", apiGet(a.listProbes))
+	mux.HandleFunc(apiPrefix+"probes/start", a.post(a.startProbes))
+	mux.HandleFunc(apiPrefix+"probes/stop", a.post(a.stopProbes))
+	mux.HandleFunc(apiPrefix+"throughput", apiGet(a.listThroughput))
+	mux.HandleFunc(apiPrefix+"throughput/start", a.post(a.startThroughput))
+	mux.HandleFunc(apiPrefix+"interfaces", apiGet(a.interfaces))
+	mux.HandleFunc(apiPrefix+"reset", a.post(a.reset))
+}
+
+// apiError is an error with its HTTP status code
+type apiError struct {
+	code int
+	err  error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiError{code: http.StatusBadRequest, err: fmt.Errorf(format, args...)}
+}
+
+func apiGet(handler func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result, err := handler(r)
+		sendAPIResponse(w, result, err)
+	}
+}
+
+func (a *API) post(handler func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result, err := handler(r)
+		a.reporter.Refresh()
+		sendAPIResponse(w, result, err)
+	}
+}
+
+func sendAPIResponse(w http.ResponseWriter, result interface{}, err error) {
+	code := http.StatusOK
+	if err != nil {
+		code = http.StatusInternalServerError
+		if e, ok := err.(*apiError); ok {
+			code = e.code
+		}
+		result = response{Error: err.Error()}
+	}
+	raw, err := json.Marshal(result)
+	if err != nil {
+		log.Debugf("Internal server error: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(raw)
+}
+
+func (a *API) status(r *http.Request) (interface{}, error) {
+	backend := a.controller.Backend()
+	status := APIStatus{
+		Node:      currentConfig().NodeName,
+		Backend:   backend.Name(),
+		Preflight: a.preflight.Status(backend.Requirements()...),
+		Controls:  currentConfig().Features.Controls,
+		Impaired:  len(a.controller.Snapshot()),
+	}
+	a.store.ForEach(func(containerID string, container Container) {
+		status.Containers++
+	})
+	return status, nil
+}
+
+func (a *API) containers(r *http.Request) (interface{}, error) {
+	return a.match(r.URL.Query().Get("target"))
+}
+
+func (a *API) apply(r *http.Request) (interface{}, error) {
+	req := APIApplyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	impair := req.Ramp == nil && req.Replay == nil && req.DNS == nil && req.HTTP == nil && req.Link == nil || req.Impairment != (Impairment{})
+	if impair {
+		if err := req.Impairment.Validate(); err != nil {
+			return nil, badRequest("%v", err)
+		}
+	}
+	if req.Ramp != nil {
+		if impair {
+			return nil, badRequest("a ramp drives the delay, the loss and the rate, they cannot be applied with it")
+		}
+		if err := req.Ramp.Validate(); err != nil {
+			return nil, badRequest("%v", err)
+		}
+	}
+	if req.Replay != nil {
+		switch {
+		case impair || req.Ramp != nil:
+			return nil, badRequest("a trace replay drives the delay, the loss and the rate, they cannot be applied or ramped with it")
+		case req.Replay.File != "":
+			// the files of the host of the plugin are only read for the
+			// presets
+			return nil, badRequest("the trace files are read by the client, send their samples")
+		}
+		if err := req.Replay.Validate(); err != nil {
+			return nil, badRequest("%v", err)
+		}
+	}
+	duration, err := parseFor(req.For)
+	if err != nil {
+		return nil, err
+	}
+	if req.DNS != nil {
+		if err := req.DNS.Validate(); err != nil {
+			return nil, badRequest("%v", err)
+		}
+	}
+	if req.HTTP != nil {
+		if err := req.HTTP.Validate(); err != nil {
+			return nil, badRequest("%v", err)
+		}
+	}
+	if req.Link != nil {
+		if err := req.Link.Validate(); err != nil {
+			return nil, badRequest("%v", err)
+		}
+		if missing := a.preflight.Missing(req.Link.requirements()...); len(missing) > 0 {
+			return nil, fmt.Errorf("link faults cannot work on this host, missing %s", strings.Join(missing, ", "))
+		}
+	}
+	if req.DNS != nil || req.HTTP != nil {
+		if duration > 0 {
+			return nil, badRequest("DNS and HTTP faults cannot be injected for a limited time")
+		}
+		if missing := a.preflight.Missing(proxyRequirements...); len(missing) > 0 {
+			return nil, fmt.Errorf("DNS and HTTP faults cannot work on this host, missing %s", strings.Join(missing, ", "))
+		}
+	}
+	return a.forEach(req.Target, true, func(pid int) (*Plan, error) {
+		if impair {
+			if err := a.controller.Apply(pid, req.Impairment, duration); err != nil {
+				return nil, err
+			}
+		}
+		if req.Ramp != nil {
+			if err := a.controller.ApplyRamp(pid, *req.Ramp, duration); err != nil {
+				return nil, err
+			}
+		}
+		if req.Replay != nil {
+			if err := a.controller.ApplyReplay(pid, *req.Replay, duration); err != nil {
+				return nil, err
+			}
+		}
+		if req.DNS != nil {
+			if err := a.controller.ApplyDNS(pid, *req.DNS); err != nil {
+				return nil, err
+			}
+		}
+		if req.HTTP != nil {
+			if err := a.controller.ApplyHTTP(pid, *req.HTTP); err != nil {
+				return nil, err
+			}
+		}
+		if req.Link != nil {
+			return nil, a.controller.ApplyLink(pid, *req.Link, duration)
+		}
+		return nil, nil
+	})
+}
+
+func (a *API) clear(r *http.Request) (interface{}, error) {
+	req := APIClearRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	return a.forEach(req.Target, false, func(pid int) (*Plan, error) {
+		return nil, a.controller.ClearTrafficControlSettings(pid)
+	})
+}
+
+func (a *API) plan(r *http.Request) (interface{}, error) {
+	req := APIPlanRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	if req.Clear {
+		return a.forEach(req.Target, false, a.controller.PlanClear)
+	}
+	if err := req.Impairment.Validate(); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	return a.forEach(req.Target, true, func(pid int) (*Plan, error) {
+		return a.controller.PlanApply(pid, req.Impairment)
+	})
+}
+
+// parseFor parses the duration of an impairment, 0 if it is empty
+func parseFor(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, badRequest("invalid duration %q", value)
+	}
+	return duration, nil
+}
+
+func (a *API) node(r *http.Request) (interface{}, error) {
+	cfg := currentConfig()
+	node := APINode{
+		Node:         cfg.NodeName,
+		Enabled:      cfg.NodeImpairment.Enabled,
+		Device:       cfg.NodeImpairment.Device,
+		ExcludePorts: cfg.NodeImpairment.ExcludePorts,
+	}
+	netNSID, err := hostNetNSID()
+	if err != nil {
+		return nil, err
+	}
+	iface, err := netInterface("", netNSID)
+	if err != nil {
+		return nil, err
+	}
+	node.ExcludePorts = iface.ExcludePorts
+	node.NetNS = netNSID
+	node.Impairment = impairmentOf(a.controller.Status(netNSID))
+	if deadline, ok := a.controller.Deadline(netNSID); ok {
+		node.Expires = &deadline
+	}
+	return node, nil
+}
+
+func (a *API) nodeApply(r *http.Request) (interface{}, error) {
+	req := APINodeApplyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	if err := req.Impairment.Validate(); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	duration, err := parseFor(req.For)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkNode(); err != nil {
+		return nil, err
+	}
+	if err := a.controller.ApplyNode(req.Impairment, duration); err != nil {
+		return nil, err
+	}
+	return a.node(r)
+}
+
+func (a *API) nodeClear(r *http.Request) (interface{}, error) {
+	if err := a.checkBackend(); err != nil {
+		return nil, err
+	}
+	if err := a.controller.ClearNode(); err != nil {
+		return nil, err
+	}
+	return a.node(r)
+}
+
+func (a *API) nodePlan(r *http.Request) (interface{}, error) {
+	req := APINodePlanRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	if req.Clear {
+		if err := a.checkBackend(); err != nil {
+			return nil, err
+		}
+		return a.controller.PlanClear(hostPID)
+	}
+	if err := req.Impairment.Validate(); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if err := a.checkNode(); err != nil {
+		return nil, err
+	}
+	return a.controller.PlanApplyNode(req.Impairment)
+}
+
+func (a *API) listCaptures(r *http.Request) (interface{}, error) {
+	return a.captures.List(), nil
+}
+
+func (a *API) startCapture(r *http.Request) (interface{}, error) {
+	req := APICaptureRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	if req.Target == "" {
+		return nil, badRequest("no target")
+	}
+	if missing := a.preflight.Missing(captureRequirements...); len(missing) > 0 {
+		return nil, fmt.Errorf("packets cannot be captured on this host, missing %s", strings.Join(missing, ", "))
+	}
+	target, err := a.findNetNS(req.Target)
+	if err != nil {
+		return nil, err
+	}
+	if hostID, err := hostNetNSID(); err == nil && target.container.NetNSID == hostID {
+		return nil, &apiError{code: http.StatusForbidden, err: fmt.Errorf("container %s shares the host network namespace, only the network namespaces of the containers are captured", target.container.Name)}
+	}
+	capture, err := a.captures.Start(a.store.NetNSPID(target.container), target.id, target.container, req.CaptureOptions)
+	if err != nil {
+		return nil, badRequest("%v", err)
+	}
+	return capture, nil
+}
+
+func (a *API) stopCapture(r *http.Request) (interface{}, error) {
+	req := APICaptureID{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	capture, err := a.captures.Stop(req.ID)
+	if err != nil {
+		return nil, &apiError{code: http.StatusNotFound, err: err}
+	}
+	return capture, nil
+}
+
+func (a *API) removeCapture(r *http.Request) (interface{}, error) {
+	req := APICaptureID{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	capture, ok := a.captures.Get(req.ID)
+	if !ok {
+		return nil, &apiError{code: http.StatusNotFound, err: fmt.Errorf("no capture %q", req.ID)}
+	}
+	return capture, a.captures.Remove(req.ID)
+}
+
+// capturePcap streams the pcap file of a capture, while the capture
+// runs the packets are sent as they are written
+func (a *API) capturePcap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	f, done, err := a.captures.Open(id)
+	if err != nil {
+		sendAPIResponse(w, nil, &apiError{code: http.StatusNotFound, err: err})
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".pcap"))
+	flusher, _ := w.(http.Flusher)
+	ticker := time.NewTicker(capturePollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := io.Copy(w, f); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if done == nil {
+			return
+		}
+		select {
+		case <-done:
+			// the rest of the file
+			done = nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *API) listProbes(r *http.Request) (interface{}, error) {
+	return a.probes.List(), nil
+}
+
+func (a *API) startProbes(r *http.Request) (interface{}, error) {
+	req := APIProbeRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	if req.Target == "" {
+		return nil, badRequest("no target")
+	}
+	options := req.ProbeOptions
+	if _, _, err := options.resolve(currentConfig().Probe); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if missing := a.preflight.Missing(probeRequirements...); len(missing) > 0 {
+		return nil, fmt.Errorf("the peers cannot be probed on this host, missing %s", strings.Join(missing, ", "))
+	}
+	return a.forEachNetNS(req.Target, true, func(pid int, c matchedContainer) (*Plan, error) {
+		if hostID, err := hostNetNSID(); err == nil && c.container.NetNSID == hostID {
+			return nil, fmt.Errorf("container %s shares the host network namespace, only the network namespaces of the containers are probed", c.container.Name)
+		}
+		_, err := a.probes.Start(pid, c.id, c.container, req.ProbeOptions)
+		return nil, err
+	})
+}
+
+func (a *API) stopProbes(r *http.Request) (interface{}, error) {
+	req := APIClearRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	if req.Target == "" {
+		return nil, badRequest("no target")
+	}
+	return a.forEachNetNS(req.Target, false, func(pid int, c matchedContainer) (*Plan, error) {
+		a.probes.Stop(c.container.NetNSID)
+		return nil, nil
+	})
+}
+
+func (a *API) listThroughput(r *http.Request) (interface{}, error) {
+	return a.throughput.List(), nil
+}
+
+func (a *API) startThroughput(r *http.Request) (interface{}, error) {
+	req := APIThroughputRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	if req.Source == "" || req.Destination == "" {
+		return nil, badRequest("no source or no destination")
+	}
+	options := req.ThroughputOptions
+	if _, _, err := options.resolve(currentConfig().Throughput); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if missing := a.preflight.Missing(throughputRequirements...); len(missing) > 0 {
+		return nil, fmt.Errorf("the throughput cannot be tested on this host, missing %s", strings.Join(missing, ", "))
+	}
+	// both ends run on this node, the coordinator does not forward the
+	// tests
+	source, err := a.findNetNS(req.Source)
+	if err != nil {
+		return nil, err
+	}
+	destination, err := a.findNetNS(req.Destination)
+	if err != nil {
+		return nil, err
+	}
+	hostID, _ := hostNetNSID()
+	for _, c := range []*matchedContainer{source, destination} {
+		if c.container.NetNSID == hostID {
+			return nil, &apiError{code: http.StatusForbidden, err: fmt.Errorf("container %s shares the host network namespace, only the network namespaces of the containers are tested", c.container.Name)}
+		}
+	}
+	test, err := a.throughput.Start(a.store.NetNSPID(source.container), source.id, source.container, a.store.NetNSPID(destination.container), destination.id, destination.container, req.ThroughputOptions)
+	if err != nil {
+		return nil, badRequest("%v", err)
+	}
+	return test, nil
+}
+
+func (a *API) reset(r *http.Request) (interface{}, error) {
+	req := APIResetRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	if req.Target == "" {
+		return nil, badRequest("no target")
+	}
+	if _, err := req.ResetOptions.resolve(); err != nil {
+		return nil, badRequest("%v", err)
+	}
+	if missing := a.preflight.Missing(resetRequirements...); len(missing) > 0 {
+		return nil, fmt.Errorf("the connections cannot be reset on this host, missing %s", strings.Join(missing, ", "))
+	}
+	return a.forEachNetNS(req.Target, true, func(pid int, c matchedContainer) (*Plan, error) {
+		if hostID, err := hostNetNSID(); err == nil && c.container.NetNSID == hostID {
+			return nil, fmt.Errorf("container %s shares the host network namespace, only the connections of the containers are reset", c.container.Name)
+		}
+		_, err := a.resets.Reset(pid, c.id, c.container, req.ResetOptions)
+		return nil, err
+	})
+}
+
+// interfaces returns the inventories of the network namespaces of the
+// containers matching the target, in the order of their first container
+func (a *API) interfaces(r *http.Request) (interface{}, error) {
+	if !currentConfig().Features.Inventory {
+		return nil, &apiError{code: http.StatusForbidden, err: fmt.Errorf("the inventory is disabled, see features.inventory")}
+	}
+	containers, err := a.find(r.URL.Query().Get("target"))
+	if err != nil {
+		return nil, err
+	}
+	list := []*APIInterfaces{}
+	byNetNS := map[string]*APIInterfaces{}
+	for _, c := range containers {
+		if c.container.State != Running || c.container.NetNSID == "" {
+			continue
+		}
+		if i, ok := byNetNS[c.container.NetNSID]; ok {
+			i.Containers = append(i.Containers, c.container.Name)
+			continue
+		}
+		inventory, ok := a.inventories.Get(c.container.NetNSID)
+		if !ok {
+			continue
+		}
+		i := &APIInterfaces{
+			Node:             currentConfig().NodeName,
+			Containers:       []string{c.container.Name},
+			NetworkInventory: inventory,
+		}
+		byNetNS[c.container.NetNSID] = i
+		list = append(list, i)
+	}
+	return list, nil
+}
+
+// checkNode fails unless the node may be impaired
+func (a *API) checkNode() error {
+	if !currentConfig().NodeImpairment.Enabled {
+		return &apiError{code: http.StatusForbidden, err: fmt.Errorf("node impairment is disabled, see node_impairment.enabled")}
+	}
+	return a.checkBackend()
+}
+
+// checkBackend fails if the backend cannot work on this host
+func (a *API) checkBackend() error {
+	backend := a.controller.Backend()
+	if missing := a.preflight.Missing(backend.Requirements()...); len(missing) > 0 {
+		return fmt.Errorf("the %s backend cannot work on this host, missing %s", backend.Name(), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// forEach runs op on the network namespaces of the running containers
+// matching target with the traffic control backend, see forEachNetNS
+func (a *API) forEach(target string, impair bool, op func(pid int) (*Plan, error)) ([]APIResult, error) {
+	if target == "" {
+		return nil, badRequest("no target")
+	}
+	if err := a.checkBackend(); err != nil {
+		return nil, err
+	}
+	return a.forEachNetNS(target, impair, func(pid int, c matchedContainer) (*Plan, error) {
+		return op(pid)
+	})
+}
+
+// forEachNetNS runs op on the network namespaces of the running
+// containers matching target, once per network namespace. It fails only
+// if the operation cannot be attempted at all. Operations impairing the
+// containers are refused for the network namespaces holding a container
+// protected by the policy.
+func (a *API) forEachNetNS(target string, impair bool, op func(pid int, c matchedContainer) (*Plan, error)) ([]APIResult, error) {
+	containers, err := a.find(target)
+	if err != nil {
+		return nil, err
+	}
+	policy := currentConfig().Policy
+	results := []APIResult{}
+	done := map[string]bool{}
+	for _, c := range containers {
+		if c.container.State != Running {
+			continue
+		}
+		if c.container.NetNSID != "" {
+			if done[c.container.NetNSID] {
+				continue
+			}
+			done[c.container.NetNSID] = true
+		}
+		members := a.store.Members(c.id, c.container)
+		result := APIResult{SharedWith: sharedWith(c.id, members)}
+		var err error
+		if impair {
+			err = policy.ProtectedNetNS(members)
+		}
+		if err == nil {
+			result.Plan, err = op(a.store.NetNSPID(c.container), c)
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		result.Container = a.describe(c.id, c.container)
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		return nil, &apiError{code: http.StatusNotFound, err: fmt.Errorf("no running container matches %q", target)}
+	}
+	return results, nil
+}
+
+// sharedWith returns the sorted names of the members other than
+// containerID
+func sharedWith(containerID string, members map[string]Container) []string {
+	names := []string{}
+	for id, member := range members {
+		if id != containerID {
+			names = append(names, member.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+type matchedContainer struct {
+	id        string
+	container Container
+}
+
+// findNetNS returns the container naming the network namespace of the
+// running containers matching target, there must be one. It is named
+// after a container of the pod rather than after its sandbox. The
+// network namespaces protected by the policy are refused.
+func (a *API) findNetNS(target string) (*matchedContainer, error) {
+	containers, err := a.find(target)
+	if err != nil {
+		return nil, err
+	}
+	var found *matchedContainer
+	for i, c := range containers {
+		if c.container.State != Running || c.container.NetNSID == "" {
+			continue
+		}
+		if found != nil && found.container.NetNSID != c.container.NetNSID {
+			return nil, badRequest("%q matches containers in several network namespaces, expected one", target)
+		}
+		if found == nil || found.container.Sandbox {
+			found = &containers[i]
+		}
+	}
+	if found == nil {
+		return nil, &apiError{code: http.StatusNotFound, err: fmt.Errorf("no running container matches %q", target)}
+	}
+	if err := currentConfig().Policy.ProtectedNetNS(a.store.Members(found.id, found.container)); err != nil {
+		return nil, &apiError{code: http.StatusForbidden, err: err}
+	}
+	return found, nil
+}
+
+// find returns the containers matching target sorted by name, every
+// container if target is empty
+func (a *API) find(target string) ([]matchedContainer, error) {
+	matches, err := targetMatcher(target)
+	if err != nil {
+		return nil, badRequest("%v", err)
+	}
+	containers := []matchedContainer{}
+	a.store.ForEach(func(containerID string, container Container) {
+		if container.State == Created || container.State == Destroyed {
+			return
+		}
+		if matches(containerID, container) {
+			containers = append(containers, matchedContainer{id: containerID, container: container})
+		}
+	})
+	sort.Sort(byName(containers))
+	return containers, nil
+}
+
+// match describes the containers matching target
+func (a *API) match(target string) ([]APIContainer, error) {
+	containers, err := a.find(target)
+	if err != nil {
+		return nil, err
+	}
+	described := []APIContainer{}
+	for _, c := range containers {
+		described = append(described, a.describe(c.id, c.container))
+	}
+	return described, nil
+}
+
+func (a *API) describe(containerID string, container Container) APIContainer {
+	c := APIContainer{
+		Node:  currentConfig().NodeName,
+		ID:    containerID,
+		Name:  container.Name,
+		Pod:   container.Pod,
+		State: container.State.String(),
+		PID:   container.PID,
+	}
+	if err := currentConfig().Policy.ProtectedNetNS(a.store.Members(containerID, container)); err != nil {
+		c.Protected = err.Error()
+	}
+	netNSID := container.NetNSID
+	if container.State != Running || netNSID == "" {
+		return c
+	}
+	c.NetNS = netNSID
+	if hostID, err := hostNetNSID(); err == nil && netNSID == hostID && c.Protected == "" {
+		c.Protected = fmt.Sprintf("container %s shares the host network namespace, impair the node instead", container.Name)
+	}
+	c.Impairment = impairmentOf(a.controller.Status(netNSID))
+	if deadline, ok := a.controller.Deadline(netNSID); ok {
+		c.Expires = &deadline
+	}
+	if ramp, ok := a.controller.RampStatus(netNSID); ok {
+		c.Ramp = &ramp
+	}
+	if replay, ok := a.controller.ReplayStatus(netNSID); ok {
+		c.Replay = &replay
+	}
+	if dns, ok := a.controller.DNSStatus(netNSID); ok {
+		c.DNS = &dns
+	}
+	if faults, ok := a.controller.HTTPStatus(netNSID); ok {
+		c.HTTP = &faults
+	}
+	if link, ok := a.controller.LinkStatus(netNSID); ok {
+		c.Link = &link
+	}
+	if probe, ok := a.probes.Get(netNSID); ok {
+		c.Observed = &probe.ProbeStats
+	}
+	if reset, ok := a.resets.Get(netNSID); ok {
+		c.Reset = &reset
+	}
+	return c
+}
+
+// impairmentOf returns the settings of status which are set
+func impairmentOf(status TrafficControlStatus) Impairment {
+	i := Impairment{}
+	if isSet(status.latency) {
+		i.Delay = status.latency
+	}
+	if isSet(status.packetLoss) {
+		i.Loss = status.packetLoss
+	}
+	if isSet(status.rate) {
+		i.Rate = status.rate
+	}
+	return i
+}
+
+type byName []matchedContainer
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].container.Name < s[j].container.Name }
+
+// targetMatcher returns a function telling whether a container matches
+// target
+func targetMatcher(target string) (func(containerID string, container Container) bool, error) {
+	if target == "" {
+		return func(string, Container) bool { return true }, nil
+	}
+	if !strings.Contains(target, "=") {
+		return func(containerID string, container Container) bool {
+			return strings.HasPrefix(containerID, target) || container.Name == target || container.Pod == target
+		}, nil
+	}
+	selector := map[string]string{}
+	for _, term := range strings.Split(target, ",") {
+		kv := strings.SplitN(term, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid selector term %q", term)
+		}
+		key, pattern := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "id", "name", "pod", "state", "node":
+		default:
+			return nil, fmt.Errorf("unknown selector key %q, expected id, name, pod, state or node", key)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		selector[key] = pattern
+	}
+	return func(containerID string, container Container) bool {
+		values := map[string]string{
+			"id":    containerID,
+			"name":  container.Name,
+			"pod":   container.Pod,
+			"state": container.State.String(),
+			"node":  currentConfig().NodeName,
+		}
+		for key, pattern := range selector {
+			if ok, _ := path.Match(pattern, values[key]); !ok {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+)
+
+// Backend enforces the traffic control settings on the network
+// interface of a network namespace. All the backends behave the same
+// from the API point of view: the operations returned by Apply replace
+// any previous setting with the given status and the ones returned by
+// Clear remove them all, leaving the interface ready for the original
+// configuration to be restored. Backends do not modify anything until
+// their operations are executed.
+type Backend interface {
+	// Name returns the name used to select the backend
+	Name() string
+	// Requirements returns the preflight features the backend needs
+	Requirements() []string
+	// Ingress tells whether the backend attaches to the ingress hook
+	Ingress() bool
+	// Apply returns the operations enforcing status on iface
+	Apply(iface NetInterface, status *TrafficControlStatus) ([]Operation, error)
+	// Clear returns the operations removing the settings from iface,
+	// they are all optional
+	Clear(iface NetInterface) ([]Operation, error)
+}
+
+// NetInterface is the network interface the backends work on
+type NetInterface struct {
+	// NetNS is the path of the network namespace
+	NetNS  string
+	Device string
+	// Host is set for the host network namespace
+	Host bool
+	// ExcludePorts are the TCP and UDP ports whose traffic must be left
+	// unimpaired
+	ExcludePorts []int
+}
+
+const defaultBackend = "netem"
+
+var backends = map[string]func() Backend{
+	"netem": func() Backend { return &netemBackend{} },
+	"ebpf":  func() Backend { return newEBPFBackend() },
+}
+
+// NewBackend instantiates the backend with the given name
+func NewBackend(name string) (Backend, error) {
+	newBackend, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q, available backends: %s", name, strings.Join(backendNames(), ", "))
+	}
+	return newBackend(), nil
+}
+
+func backendNames() []string {
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runCommands executes cmds in the network namespace netNS, stopping at
+// the first failure
+func runCommands(netNS string, cmds [][]string) error {
+	err := ns.WithNetNSPath(netNS, func(hostNS ns.NetNS) error {
+		for _, cmd := range cmds {
+			log.Debugf("%s: %s", netNS, strings.Join(cmd, " "))
+			if output, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+				log.Error(string(output))
+				return fmt.Errorf("failed to execute command %q: %v: %s", strings.Join(cmd, " "), err, strings.TrimSpace(string(output)))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to perform traffic control: %v", err)
+	}
+	return nil
+}
+
+// commandOutput executes cmd in the network namespace netNS and returns
+// its output
+func commandOutput(netNS string, cmd []string) (string, error) {
+	var output []byte
+	err := ns.WithNetNSPath(netNS, func(hostNS ns.NetNS) error {
+		var err error
+		if output, err = exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to execute command %q: %v: %s", strings.Join(cmd, " "), err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	})
+	return string(output), err
+}
+
+// netemBackend replaces the root qdisc with netem. When ports are
+// excluded the root qdisc is a prio qdisc sending all the traffic to
+// netem except the traffic of these ports.
+type netemBackend struct{}
+
+func (b *netemBackend) Name() string {
+	return "netem"
+}
+
+func (b *netemBackend) Requirements() []string {
+	return []string{featureTC, featureNetem, featureCapNetAdmin, featureCapSysAdmin}
+}
+
+func (b *netemBackend) Ingress() bool {
+	return false
+}
+
+func (b *netemBackend) Apply(iface NetInterface, status *TrafficControlStatus) ([]Operation, error) {
+	dev := iface.Device
+	if len(iface.ExcludePorts) == 0 {
+		cmd := []string{"tc", "qdisc", "change", "dev", dev, "root", "handle", "1:", "netem"}
+		return []Operation{
+			commandOperation("replace the root qdisc with netem", "tc", "qdisc", "replace", "dev", dev, "root", "handle", "1:", "netem"),
+			commandOperation("set the netem parameters", append(cmd, netemRules(status)...)...),
+		}, nil
+	}
+
+	// band 1:2 gets all the traffic by default, the filters send the
+	// excluded ports to the unimpaired band 1:1
+	priomap := strings.Fields(strings.Repeat("1 ", 16))
+	cmd := []string{"tc", "qdisc", "change", "dev", dev, "parent", "1:2", "handle", "10:", "netem"}
+	ops := []Operation{
+		commandOperation("replace the root qdisc with prio", append([]string{"tc", "qdisc", "replace", "dev", dev, "root", "handle", "1:", "prio", "bands", "2", "priomap"}, priomap...)...),
+		commandOperation("attach netem to the impaired band", "tc", "qdisc", "replace", "dev", dev, "parent", "1:2", "handle", "10:", "netem"),
+		commandOperation("set the netem parameters", append(cmd, netemRules(status)...)...),
+		{
+			Description: "remove the previous exclusions",
+			Command:     []string{"tc", "filter", "del", "dev", dev, "parent", "1:"},
+			Optional:    true,
+		},
+	}
+	// the filters of a priority share their protocol
+	protocols := []struct{ prio, protocol, match string }{
+		{"1", "ip", "ip"},
+		{"2", "ipv6", "ip6"},
+	}
+	for _, p := range protocols {
+		for _, port := range iface.ExcludePorts {
+			for _, direction := range []string{"sport", "dport"} {
+				ops = append(ops, commandOperation(fmt.Sprintf("exclude the %s traffic with %s %d", p.protocol, direction, port),
+					"tc", "filter", "add", "dev", dev, "parent", "1:", "prio", p.prio, "protocol", p.protocol,
+					"u32", "match", p.match, direction, strconv.Itoa(port), "0xffff", "flowid", "1:1"))
+			}
+		}
+	}
+	return ops, nil
+}
+
+func (b *netemBackend) Clear(iface NetInterface) ([]Operation, error) {
+	op := commandOperation("remove netem", "tc", "qdisc", "del", "dev", iface.Device, "root")
+	op.Optional = true
+	return []Operation{op}, nil
+}
+
+// netemRules translates status into netem parameters, unset ('-')
+// values are omitted
+func netemRules(status *TrafficControlStatus) []string {
+	rules := []string{}
+	if isSet(status.latency) {
+		rules = append(rules, "delay", status.latency)
+	}
+	if isSet(status.packetLoss) {
+		rules = append(rules, "loss", status.packetLoss)
+	}
+	if isSet(status.rate) {
+		rules = append(rules, "rate", status.rate)
+	}
+	return rules
+}
+
+func isSet(value string) bool {
+	return value != "" && value != "-"
+}
@@ -0,0 +1,4 @@
+package main
+
+// sysBPF is the number of the bpf(2) system call
+const sysBPF = 321
@@ -0,0 +1,17 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+)
+
+// bpfSyscall fails on the architectures whose number of the bpf(2)
+// system call is unknown, the preflight checks then report the ebpf
+// backend as unavailable
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	return -1, fmt.Errorf("bpf(2) is not supported on %s", runtime.GOARCH)
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"golang.org/x/net/bpf"
+)
+
+// Packets are captured with an AF_PACKET socket opened in the network
+// namespace of the container and bound to one of its interfaces, the
+// filter runs in the kernel. The packets are written to a pcap file as
+// they arrive, the file can be downloaded while the capture runs. Each
+// capture is described by a JSON file next to its pcap file, so that the
+// list of the captures survives restarts of the plugin.
+
+const (
+	defaultCaptureDir = "/var/run/network-control/captures"
+	// defaultCaptureInterface is the interface captured by default
+	defaultCaptureInterface = "eth0"
+	// maxSnaplen is the default and largest number of bytes kept of
+	// each packet
+	maxSnaplen = 65535
+	// capturePollInterval is how often a capture without traffic checks
+	// whether it must end, and flushes its file
+	capturePollInterval = 200 * time.Millisecond
+	// captureReceiveBuffer is the size of the socket buffer absorbing
+	// the bursts of packets
+	captureReceiveBuffer = 4 << 20
+)
+
+// pcap file format, see https://wiki.wireshark.org/Development/LibpcapFileFormat
+const (
+	pcapMagic            = 0xa1b2c3d4
+	pcapLinkTypeEthernet = 1
+	pcapHeaderLen        = 24
+	pcapRecordHeaderLen  = 16
+)
+
+// Capture states
+const (
+	captureRunning = "running"
+	captureDone    = "done"
+	captureFailed  = "failed"
+)
+
+// captureRequirements are the preflight features the captures need
+var captureRequirements = []string{featureCapNetRaw, featureCapSysAdmin}
+
+var captureID = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}-[0-9a-f]{6}$`)
+
+// CaptureOptions are the settings of a capture
+type CaptureOptions struct {
+	// Interface is the interface of the container, eth0 by default
+	Interface string `json:"interface,omitempty"`
+	// Filter selects the packets, see filter.go
+	Filter string `json:"filter,omitempty"`
+	// Duration ends the capture, the duration of the configuration by
+	// default, e.g. 30s
+	Duration string `json:"duration,omitempty"`
+	// Packets ends the capture after this number of packets
+	Packets int `json:"packets,omitempty"`
+	// Snaplen is the number of bytes kept of each packet
+	Snaplen int `json:"snaplen,omitempty"`
+}
+
+// Capture describes a capture
+type Capture struct {
+	ID          string `json:"id"`
+	Node        string `json:"node"`
+	ContainerID string `json:"container_id"`
+	Container   string `json:"container"`
+	NetNS       string `json:"netns"`
+	CaptureOptions
+	Started time.Time  `json:"started"`
+	Ended   *time.Time `json:"ended,omitempty"`
+	State   string     `json:"state"`
+	// Reason tells why the capture ended or failed
+	Reason string `json:"reason,omitempty"`
+	// Captured is the number of packets written to the file
+	Captured int `json:"captured"`
+	// Size is the size of the file
+	Size int64 `json:"size"`
+}
+
+func (c Capture) String() string {
+	switch c.State {
+	case captureRunning:
+		return fmt.Sprintf("%s running on %s, %d packets", c.ID, c.Interface, c.Captured)
+	case captureFailed:
+		return fmt.Sprintf("%s failed: %s", c.ID, c.Reason)
+	}
+	return fmt.Sprintf("%s %s, %d packets, %s", c.ID, c.Reason, c.Captured, formatSize(c.Size))
+}
+
+// capture is a capture known by the plugin, stop and done are only set
+// while it runs
+type capture struct {
+	info     Capture
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// Captures runs the captures and keeps their files
+type Captures struct {
+	dir string
+
+	lock     sync.Mutex
+	captures map[string]*capture
+}
+
+// NewCaptures instantiates a new Captures keeping the files in dir, the
+// captures interrupted by a restart of the plugin are marked as failed
+func NewCaptures(dir string) (*Captures, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory %q: %v", dir, err)
+	}
+	c := &Captures{
+		dir:      dir,
+		captures: map[string]*capture{},
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		info := Capture{}
+		if err := json.Unmarshal(raw, &info); err != nil || !captureID.MatchString(info.ID) {
+			log.Errorf("ignoring invalid capture %s: %v", file, err)
+			continue
+		}
+		if info.State == captureRunning {
+			info.State = captureFailed
+			info.Reason = "interrupted by a restart of the plugin"
+			if stat, err := os.Stat(c.pcapPath(info.ID)); err == nil {
+				info.Size = stat.Size()
+			}
+			c.save(info)
+		}
+		c.captures[info.ID] = &capture{info: info}
+	}
+	return c, nil
+}
+
+// List returns the captures, the most recent first
+func (c *Captures) List() []Capture {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	list := []Capture{}
+	for _, capture := range c.captures {
+		list = append(list, capture.info)
+	}
+	sort.Sort(byStarted(list))
+	return list
+}
+
+// Get returns the capture id
+func (c *Captures) Get(id string) (Capture, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	capture, ok := c.captures[id]
+	if !ok {
+		return Capture{}, false
+	}
+	return capture.info, true
+}
+
+// Latest returns the most recent capture of a network namespace
+func (c *Captures) Latest(netNSID string) (Capture, bool) {
+	for _, info := range c.List() {
+		if info.NetNS == netNSID {
+			return info, true
+		}
+	}
+	return Capture{}, false
+}
+
+// Open opens the pcap file of the capture id, done is closed when the
+// capture ends and nil if it has ended already
+func (c *Captures) Open(id string) (*os.File, <-chan struct{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	capture, ok := c.captures[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("no capture %q", id)
+	}
+	f, err := os.Open(c.pcapPath(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	if capture.done != nil {
+		return f, capture.done, nil
+	}
+	return f, nil, nil
+}
+
+// Start captures the packets of the network namespace of pid, the
+// capture runs in the background
+func (c *Captures) Start(pid int, containerID string, container Container, options CaptureOptions) (Capture, error) {
+	cfg := currentConfig().Capture
+	duration, err := options.resolve(cfg)
+	if err != nil {
+		return Capture{}, err
+	}
+	maxSize, _ := parseSize(cfg.MaxSize)
+	filter, err := compileFilter(options.Filter)
+	if err != nil {
+		return Capture{}, err
+	}
+	fd, loopback, err := openCaptureSocket(fmt.Sprintf("/proc/%d/ns/net", pid), options.Interface, filter)
+	if err != nil {
+		return Capture{}, err
+	}
+
+	started := time.Now()
+	info := Capture{
+		ID:             fmt.Sprintf("%s-%06x", started.UTC().Format("20060102-150405"), rand.Intn(1<<24)),
+		Node:           currentConfig().NodeName,
+		ContainerID:    containerID,
+		Container:      container.Name,
+		NetNS:          container.NetNSID,
+		CaptureOptions: options,
+		Started:        started,
+		State:          captureRunning,
+		Size:           pcapHeaderLen,
+	}
+	f, err := os.OpenFile(c.pcapPath(info.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		syscall.Close(fd)
+		return Capture{}, fmt.Errorf("failed to create the capture file: %v", err)
+	}
+	if _, err := f.Write(pcapHeader(options.Snaplen)); err != nil {
+		syscall.Close(fd)
+		f.Close()
+		os.Remove(f.Name())
+		return Capture{}, fmt.Errorf("failed to write the capture file: %v", err)
+	}
+	capture := &capture{
+		info: info,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	c.lock.Lock()
+	c.captures[info.ID] = capture
+	c.save(info)
+	c.lock.Unlock()
+	log.Infof("Capturing the packets of %s on %s in capture %s", container.Name, options.Interface, info.ID)
+
+	go c.run(capture, fd, loopback, f, started.Add(duration), options.Packets, maxSize)
+	return info, nil
+}
+
+// Stop ends the capture id
+func (c *Captures) Stop(id string) (Capture, error) {
+	c.lock.Lock()
+	capture, ok := c.captures[id]
+	var stop, done chan struct{}
+	if ok {
+		stop, done = capture.stop, capture.done
+	}
+	c.lock.Unlock()
+	if !ok {
+		return Capture{}, fmt.Errorf("no capture %q", id)
+	}
+	if done != nil {
+		capture.stopOnce.Do(func() { close(stop) })
+		<-done
+	}
+	info, _ := c.Get(id)
+	return info, nil
+}
+
+// Toggle stops the running capture of a network namespace or starts one
+// with the default settings
+func (c *Captures) Toggle(pid int, containerID string, container Container) error {
+	if latest, ok := c.Latest(container.NetNSID); ok && latest.State == captureRunning {
+		_, err := c.Stop(latest.ID)
+		return err
+	}
+	_, err := c.Start(pid, containerID, container, CaptureOptions{})
+	return err
+}
+
+// Remove stops the capture id and removes its files
+func (c *Captures) Remove(id string) error {
+	if _, err := c.Stop(id); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remove(id)
+	return nil
+}
+
+func (c *Captures) remove(id string) {
+	delete(c.captures, id)
+	for _, path := range []string{c.pcapPath(id), c.infoPath(id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to remove capture %s: %v", id, err)
+		}
+	}
+}
+
+// resolve sets the defaults of the options and checks them against the
+// limits of the configuration, it returns the duration of the capture
+func (o *CaptureOptions) resolve(cfg CaptureConfig) (time.Duration, error) {
+	if o.Interface == "" {
+		o.Interface = defaultCaptureInterface
+	}
+	if o.Duration == "" {
+		o.Duration = cfg.Duration
+	}
+	duration, err := time.ParseDuration(o.Duration)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", o.Duration)
+	}
+	if maxDuration, _ := time.ParseDuration(cfg.MaxDuration); duration > maxDuration {
+		return 0, fmt.Errorf("the duration %s exceeds the limit of %s", o.Duration, cfg.MaxDuration)
+	}
+	switch {
+	case o.Packets < 0:
+		return 0, fmt.Errorf("invalid number of packets %d", o.Packets)
+	case o.Packets > cfg.MaxPackets:
+		return 0, fmt.Errorf("the number of packets %d exceeds the limit of %d", o.Packets, cfg.MaxPackets)
+	case o.Packets == 0:
+		o.Packets = cfg.MaxPackets
+	}
+	switch {
+	case o.Snaplen < 0 || o.Snaplen > maxSnaplen:
+		return 0, fmt.Errorf("invalid snaplen %d, it must be at most %d", o.Snaplen, maxSnaplen)
+	case o.Snaplen == 0:
+		o.Snaplen = maxSnaplen
+	}
+	return duration, nil
+}
+
+// openCaptureSocket opens a packet socket in the network namespace
+// netNS, bound to dev and filtered by filter. It tells whether dev is a
+// loopback interface.
+func openCaptureSocket(netNS, dev string, filter []bpf.RawInstruction) (int, bool, error) {
+	fd := -1
+	loopback := false
+	err := ns.WithNetNSPath(netNS, func(ns.NetNS) error {
+		iface, err := net.InterfaceByName(dev)
+		if err != nil {
+			return fmt.Errorf("no interface %s in the network namespace", dev)
+		}
+		loopback = iface.Flags&net.FlagLoopback != 0
+		// the filters expect Ethernet headers, which the loopback
+		// interface has too
+		if len(iface.HardwareAddr) != 6 && !loopback {
+			return fmt.Errorf("%s is not an Ethernet interface", dev)
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			return fmt.Errorf("%s is down", dev)
+		}
+		// no packet is received before the socket is bound, so none
+		// escapes the filter
+		fd, err = syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return os.NewSyscallError("socket", err)
+		}
+		sockFilter := []syscall.SockFilter{}
+		for _, i := range filter {
+			sockFilter = append(sockFilter, syscall.SockFilter{Code: i.Op, Jt: i.Jt, Jf: i.Jf, K: i.K})
+		}
+		if err := syscall.AttachLsf(fd, sockFilter); err != nil {
+			return fmt.Errorf("failed to attach the filter: %v", err)
+		}
+		syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, captureReceiveBuffer)
+		tv := syscall.NsecToTimeval(int64(capturePollInterval))
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+		sa := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: iface.Index}
+		if err := syscall.Bind(fd, sa); err != nil {
+			return os.NewSyscallError("bind", err)
+		}
+		return nil
+	})
+	if err != nil {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+		return -1, false, fmt.Errorf("failed to open the capture socket: %v", err)
+	}
+	return fd, loopback, nil
+}
+
+// run writes the packets received on fd to f until the capture is
+// stopped or reaches one of its limits
+func (c *Captures) run(capture *capture, fd int, loopback bool, f *os.File, deadline time.Time, maxPackets int, maxSize int64) {
+	snaplen := capture.info.Snaplen
+	w := bufio.NewWriterSize(f, 64<<10)
+	buf := make([]byte, snaplen)
+	record := make([]byte, pcapRecordHeaderLen)
+	size := int64(pcapHeaderLen)
+	captured := 0
+	reason := ""
+	var err error
+	for reason == "" && err == nil {
+		select {
+		case <-capture.stop:
+			reason = "stopped"
+			continue
+		default:
+		}
+		if !time.Now().Before(deadline) {
+			reason = "duration reached"
+			continue
+		}
+		// MSG_TRUNC returns the length of the packet rather than the
+		// length received
+		n, from, recvErr := syscall.Recvfrom(fd, buf, syscall.MSG_TRUNC)
+		if recvErr == syscall.EAGAIN || recvErr == syscall.EINTR {
+			err = w.Flush()
+			c.update(capture, captured, size)
+			continue
+		}
+		if recvErr != nil {
+			err = os.NewSyscallError("recvfrom", recvErr)
+			continue
+		}
+		// the packets sent on a loopback interface are received too
+		if sa, ok := from.(*syscall.SockaddrLinklayer); ok && loopback && sa.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		length := n
+		if length > snaplen {
+			length = snaplen
+		}
+		if size+pcapRecordHeaderLen+int64(length) > maxSize {
+			reason = "size limit reached"
+			continue
+		}
+		now := time.Now()
+		binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+		binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(length))
+		binary.LittleEndian.PutUint32(record[12:], uint32(n))
+		if _, err = w.Write(record); err == nil {
+			_, err = w.Write(buf[:length])
+		}
+		size += pcapRecordHeaderLen + int64(length)
+		if captured++; captured >= maxPackets {
+			reason = "packet limit reached"
+		}
+	}
+	syscall.Close(fd)
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ended := time.Now()
+	info := &capture.info
+	info.Ended = &ended
+	info.Captured = captured
+	info.Size = size
+	info.State = captureDone
+	info.Reason = reason
+	if err != nil {
+		info.State = captureFailed
+		info.Reason = err.Error()
+		log.Errorf("Capture %s of %s failed: %v", info.ID, info.Container, err)
+	} else {
+		log.Infof("Capture %s of %s ended, %s: %d packets", info.ID, info.Container, reason, captured)
+	}
+	c.save(*info)
+	close(capture.done)
+	capture.stop, capture.done = nil, nil
+	c.prune()
+}
+
+// update records the progress of a capture
+func (c *Captures) update(capture *capture, captured int, size int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	capture.info.Captured = captured
+	capture.info.Size = size
+}
+
+// prune removes the oldest finished captures beyond the number kept
+func (c *Captures) prune() {
+	finished := []Capture{}
+	for _, capture := range c.captures {
+		if capture.info.State != captureRunning {
+			finished = append(finished, capture.info)
+		}
+	}
+	sort.Sort(byStarted(finished))
+	for i := currentConfig().Capture.Keep; i < len(finished); i++ {
+		log.Infof("Removing capture %s, %d captures are kept", finished[i].ID, currentConfig().Capture.Keep)
+		c.remove(finished[i].ID)
+	}
+}
+
+// save writes the description of a capture
+func (c *Captures) save(info Capture) {
+	raw, err := json.Marshal(info)
+	if err == nil {
+		err = ioutil.WriteFile(c.infoPath(info.ID), raw, 0600)
+	}
+	if err != nil {
+		log.Errorf("failed to save capture %s: %v", info.ID, err)
+	}
+}
+
+func (c *Captures) pcapPath(id string) string {
+	return filepath.Join(c.dir, id+".pcap")
+}
+
+func (c *Captures) infoPath(id string) string {
+	return filepath.Join(c.dir, id+".json")
+}
+
+// pcapHeader returns the header of a pcap file of Ethernet frames
+func pcapHeader(snaplen int) []byte {
+	header := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], uint32(snaplen))
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeEthernet)
+	return header
+}
+
+// htons converts a short to the network byte order, the supported
+// architectures are little endian
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+type byStarted []Capture
+
+func (s byStarted) Len() int           { return len(s) }
+func (s byStarted) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStarted) Less(i, j int) bool { return s[i].Started.After(s[j].Started) }
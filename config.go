@@ -0,0 +1,846 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// The configuration is read from a YAML file, then overridden by the
+// environment variables and finally by the command line flags. Sending
+// SIGHUP to the plugin reloads it: the settings marked as reloadable
+// take effect immediately, changing the others requires a restart.
+
+const (
+	defaultConfigPath = "/etc/network-control/config.yaml"
+	configEnvPrefix   = "NETWORK_CONTROL_"
+)
+
+// Metrics sources
+const (
+	metricsNone     = "none"
+	metricsRandom   = "random"
+	metricsInfluxDB = "influxdb"
+)
+
+// Config is the plugin configuration
+type Config struct {
+	// NodeName identifies the plugin instance, it defaults to the host
+	// name
+	NodeName string `yaml:"node_name"`
+	// Socket is the path of the unix socket serving Scope
+	Socket string `yaml:"socket"`
+	// DockerEndpoint is the address of the Docker daemon
+	DockerEndpoint string `yaml:"docker_endpoint"`
+	// Backend is the traffic control backend
+	Backend string `yaml:"backend"`
+	// SnapshotDir keeps the snapshots of the original qdiscs
+	SnapshotDir string `yaml:"snapshot_dir"`
+	// LogLevel is reloadable
+	LogLevel string `yaml:"log_level"`
+	// Metrics is reloadable
+	Metrics MetricsConfig `yaml:"metrics"`
+	// Features toggles optional behaviours
+	Features FeaturesConfig `yaml:"features"`
+	// Presets are the controls shown in Scope, reloadable
+	Presets []Preset `yaml:"presets"`
+	// DryRun logs the changes instead of making them, reloadable
+	DryRun bool `yaml:"dry_run"`
+	// Listen is the optional TCP listener
+	Listen ListenConfig `yaml:"listen"`
+	// Policy protects containers from the impairments, reloadable
+	Policy PolicyConfig `yaml:"policy"`
+	// NodeImpairment allows impairing the host network namespace
+	NodeImpairment NodeImpairmentConfig `yaml:"node_impairment"`
+	// Kubernetes is the watcher of the pods of the node
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+	// Capture bounds the packet captures, reloadable except the
+	// directory
+	Capture CaptureConfig `yaml:"capture"`
+	// Probe sets the probes measuring the round trip time and the loss,
+	// reloadable
+	Probe ProbeConfig `yaml:"probe"`
+	// Throughput bounds the throughput tests, reloadable
+	Throughput ThroughputConfig `yaml:"throughput"`
+}
+
+// ThroughputConfig bounds the throughput tests between the containers
+type ThroughputConfig struct {
+	// Duration is the duration of the tests that do not set it
+	Duration string `yaml:"duration"`
+	// MaxDuration bounds every test
+	MaxDuration string `yaml:"max_duration"`
+	// UDPRate is the sending rate of the UDP tests that do not set it,
+	// and MaxUDPRate bounds every UDP test
+	UDPRate    string `yaml:"udp_rate"`
+	MaxUDPRate string `yaml:"max_udp_rate"`
+	// Keep is the number of finished tests kept
+	Keep int `yaml:"keep"`
+}
+
+// Validate checks the throughput settings
+func (t *ThroughputConfig) Validate() error {
+	maxDuration, err := time.ParseDuration(t.MaxDuration)
+	if err != nil || maxDuration <= 0 {
+		return fmt.Errorf("invalid max_duration %q", t.MaxDuration)
+	}
+	duration, err := time.ParseDuration(t.Duration)
+	if err != nil || duration <= 0 || duration > maxDuration {
+		return fmt.Errorf("invalid duration %q, it must be positive and at most max_duration", t.Duration)
+	}
+	maxRate, err := parseTCRate(t.MaxUDPRate)
+	if err != nil {
+		return fmt.Errorf("invalid max_udp_rate: %v", err)
+	}
+	if rate, err := parseTCRate(t.UDPRate); err != nil || rate > maxRate {
+		return fmt.Errorf("invalid udp_rate %q, it must be at most max_udp_rate", t.UDPRate)
+	}
+	if t.Keep <= 0 {
+		return fmt.Errorf("invalid keep %d", t.Keep)
+	}
+	return nil
+}
+
+// ProbeConfig sets the probes of the peers of the containers
+type ProbeConfig struct {
+	// Interval is the default time between two probes of a peer
+	Interval string `yaml:"interval"`
+	// Timeout is the time after which a probe is lost
+	Timeout string `yaml:"timeout"`
+	// Window is the number of probes of a peer the statistics are
+	// computed on
+	Window int `yaml:"window"`
+	// MaxPeers is the number of peers probed in a network namespace
+	MaxPeers int `yaml:"max_peers"`
+}
+
+// Validate checks the probe settings
+func (p *ProbeConfig) Validate() error {
+	interval, err := time.ParseDuration(p.Interval)
+	if err != nil || interval < minProbeInterval {
+		return fmt.Errorf("invalid interval %q, it must be at least %s", p.Interval, minProbeInterval)
+	}
+	timeout, err := time.ParseDuration(p.Timeout)
+	if err != nil || timeout <= 0 {
+		return fmt.Errorf("invalid timeout %q", p.Timeout)
+	}
+	if p.Window <= 0 {
+		return fmt.Errorf("invalid window %d", p.Window)
+	}
+	if p.MaxPeers <= 0 {
+		return fmt.Errorf("invalid max_peers %d", p.MaxPeers)
+	}
+	return nil
+}
+
+// CaptureConfig bounds the packet captures taken in the network
+// namespaces of the containers
+type CaptureConfig struct {
+	// Dir keeps the pcap files of the captures
+	Dir string `yaml:"dir"`
+	// Duration is the duration of the captures started from Scope, and
+	// of the ones started with the API when they do not set it
+	Duration string `yaml:"duration"`
+	// MaxDuration, MaxPackets and MaxSize bound every capture
+	MaxDuration string `yaml:"max_duration"`
+	MaxPackets  int    `yaml:"max_packets"`
+	MaxSize     string `yaml:"max_size"`
+	// Keep is the number of finished captures kept, the oldest ones are
+	// removed
+	Keep int `yaml:"keep"`
+}
+
+// Validate checks the capture settings
+func (c *CaptureConfig) Validate() error {
+	if !filepath.IsAbs(c.Dir) {
+		return fmt.Errorf("directory %q is not an absolute path", c.Dir)
+	}
+	maxDuration, err := time.ParseDuration(c.MaxDuration)
+	if err != nil || maxDuration <= 0 {
+		return fmt.Errorf("invalid max_duration %q", c.MaxDuration)
+	}
+	duration, err := time.ParseDuration(c.Duration)
+	if err != nil || duration <= 0 || duration > maxDuration {
+		return fmt.Errorf("invalid duration %q, it must be positive and at most max_duration", c.Duration)
+	}
+	if c.MaxPackets <= 0 {
+		return fmt.Errorf("invalid max_packets %d", c.MaxPackets)
+	}
+	if _, err := parseSize(c.MaxSize); err != nil {
+		return fmt.Errorf("invalid max_size: %v", err)
+	}
+	if c.Keep <= 0 {
+		return fmt.Errorf("invalid keep %d", c.Keep)
+	}
+	return nil
+}
+
+// KubernetesConfig is the watcher of the pods of the node, it reads
+// their annotations from the API server
+type KubernetesConfig struct {
+	Watch bool `yaml:"watch"`
+	// URL is the address of the API server, the in-cluster address by
+	// default
+	URL string `yaml:"url"`
+	// TokenFile and CA authenticate the plugin and the API server, the
+	// service account of the pod by default
+	TokenFile string `yaml:"token_file"`
+	CA        string `yaml:"ca"`
+}
+
+// Validate checks the watcher settings
+func (k *KubernetesConfig) Validate() error {
+	if !k.Watch || k.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(k.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid URL %q", k.URL)
+	}
+	return nil
+}
+
+// NodeImpairmentConfig is the impairment of the node itself. The host
+// network namespace, shared by the containers of the host network, is
+// never impaired through the containers: it takes the node endpoints of
+// the API, which are disabled by default and require the node
+// permission on the TCP listener.
+type NodeImpairmentConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Device is the interface of the host to impair
+	Device string `yaml:"device"`
+	// ExcludePorts are the TCP and UDP ports of the management traffic,
+	// which is left unimpaired. The port of the TCP listener is always
+	// excluded.
+	ExcludePorts []int `yaml:"exclude_ports"`
+}
+
+// Validate checks the node impairment settings
+func (n *NodeImpairmentConfig) Validate() error {
+	if !n.Enabled {
+		return nil
+	}
+	if n.Device == "" {
+		return fmt.Errorf("no device")
+	}
+	for _, port := range n.ExcludePorts {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	return nil
+}
+
+// PolicyConfig decides which containers may be impaired. A container
+// matching a deny rule is protected, and so is a container matching no
+// allow rule when there are allow rules.
+type PolicyConfig struct {
+	Allow []PolicyRule `yaml:"allow"`
+	Deny  []PolicyRule `yaml:"deny"`
+}
+
+// PolicyRule matches the containers whose fields match all the glob
+// patterns it sets
+type PolicyRule struct {
+	// Namespace is the Kubernetes namespace of the pod
+	Namespace string `yaml:"namespace"`
+	// Name is the container name as given by the runtime
+	Name  string `yaml:"name"`
+	Image string `yaml:"image"`
+	// Labels are the container labels, the values are patterns
+	Labels map[string]string `yaml:"labels"`
+}
+
+// Validate checks the rule
+func (r *PolicyRule) Validate() error {
+	patterns := []string{r.Namespace, r.Name, r.Image}
+	for _, value := range r.Labels {
+		patterns = append(patterns, value)
+	}
+	set := len(r.Labels) > 0
+	for _, pattern := range patterns {
+		if pattern == "" {
+			continue
+		}
+		set = true
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	if !set {
+		return fmt.Errorf("the rule matches every container, set namespace, name, image or labels")
+	}
+	return nil
+}
+
+// ListenConfig is the TCP listener serving the Scope endpoints and the
+// API to remote clients, always over TLS and always authenticated
+type ListenConfig struct {
+	// Address is the TCP address, e.g. :8443, empty disables the
+	// listener
+	Address string `yaml:"address"`
+	// Cert and Key are the PEM files of the server certificate
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ClientCA is the PEM file of the CA verifying the client
+	// certificates, required by the credentials with a common name
+	ClientCA string `yaml:"client_ca"`
+	// Credentials are reloadable
+	Credentials []Credential `yaml:"credentials"`
+}
+
+// Permissions of the credentials, each one includes the previous ones
+const (
+	// permissionRead allows the report, the status, the list of the
+	// containers and the plans
+	permissionRead = "read"
+	// permissionApply allows impairing the containers
+	permissionApply = "apply"
+	// permissionNode allows impairing the node itself
+	permissionNode = "node"
+)
+
+var permissionRanks = map[string]int{
+	permissionRead:  0,
+	permissionApply: 1,
+	permissionNode:  2,
+}
+
+// Credential authenticates a client of the TCP listener, with a bearer
+// token or with a client certificate
+type Credential struct {
+	// Name identifies the client in the logs
+	Name string `yaml:"name"`
+	// Token is the bearer token, or it is read from TokenFile
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	// CommonName is the common name of the client certificate
+	CommonName string `yaml:"common_name"`
+	// Permission is read, apply or node
+	Permission string `yaml:"permission"`
+}
+
+// Validate checks the credential
+func (c *Credential) Validate(clientCA bool) error {
+	if c.Name == "" {
+		return fmt.Errorf("no name")
+	}
+	if (c.Token == "") == (c.CommonName == "") {
+		return fmt.Errorf("exactly one of token, token_file or common_name must be set")
+	}
+	if c.CommonName != "" && !clientCA {
+		return fmt.Errorf("common_name requires client_ca")
+	}
+	if _, ok := permissionRanks[c.Permission]; !ok {
+		return fmt.Errorf("invalid permission %q, expected %s, %s or %s", c.Permission, permissionRead, permissionApply, permissionNode)
+	}
+	return nil
+}
+
+// readTokens reads the token files of the credentials
+func (l *ListenConfig) readTokens() error {
+	for i := range l.Credentials {
+		c := &l.Credentials[i]
+		if c.TokenFile == "" {
+			continue
+		}
+		if c.Token != "" {
+			return fmt.Errorf("credential %q: both token and token_file are set", c.Name)
+		}
+		raw, err := ioutil.ReadFile(c.TokenFile)
+		if err != nil {
+			return fmt.Errorf("credential %q: %v", c.Name, err)
+		}
+		if c.Token = strings.TrimSpace(string(raw)); c.Token == "" {
+			return fmt.Errorf("credential %q: %s is empty", c.Name, c.TokenFile)
+		}
+	}
+	return nil
+}
+
+// Validate checks the listener settings, credentials are required
+func (l *ListenConfig) Validate() error {
+	if l.Address == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(l.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %v", l.Address, err)
+	}
+	if l.Cert == "" || l.Key == "" {
+		return fmt.Errorf("the TCP listener requires a TLS certificate and key")
+	}
+	if len(l.Credentials) == 0 {
+		return fmt.Errorf("the TCP listener requires credentials")
+	}
+	names := map[string]bool{}
+	for i := range l.Credentials {
+		c := &l.Credentials[i]
+		if err := c.Validate(l.ClientCA != ""); err != nil {
+			return fmt.Errorf("credential %d: %v", i+1, err)
+		}
+		if names[c.Name] {
+			return fmt.Errorf("credential %d: duplicate name %q", i+1, c.Name)
+		}
+		names[c.Name] = true
+	}
+	return nil
+}
+
+// MetricsConfig selects where the values of the Network Control table
+// come from
+type MetricsConfig struct {
+	// Source is one of none, random or influxdb
+	Source   string         `yaml:"source"`
+	InfluxDB InfluxDBConfig `yaml:"influxdb"`
+}
+
+// InfluxDBConfig is the InfluxDB metrics source
+type InfluxDBConfig struct {
+	URL      string `yaml:"url"`
+	Database string `yaml:"database"`
+}
+
+// FeaturesConfig toggles optional behaviours
+type FeaturesConfig struct {
+	// Controls exposes the controls in Scope, reloadable
+	Controls bool `yaml:"controls"`
+	// Preflight probes the host at startup
+	Preflight bool `yaml:"preflight"`
+	// AutoApply applies the impairments declared in the labels of the
+	// containers and in the annotations of the pods
+	AutoApply bool `yaml:"auto_apply"`
+	// Inventory reads the interfaces, addresses, routes and neighbours
+	// of the containers over netlink
+	Inventory bool `yaml:"inventory"`
+}
+
+// Preset is a control applying an impairment to a container
+type Preset struct {
+	// ID identifies the control, it is unique
+	ID string `yaml:"id"`
+	// Label is shown in the tooltip of the control
+	Label string `yaml:"label"`
+	// Icon is the Font Awesome icon of the control, e.g. fa-hourglass-1
+	Icon string `yaml:"icon"`
+	// Rank orders the controls
+	Rank       int `yaml:"rank"`
+	Impairment `yaml:",inline"`
+	// Ramp, Replay, DNS, HTTP and Link make the control toggle a ramp, a
+	// trace replay or DNS, HTTP or link faults instead of applying the
+	// impairment
+	Ramp   *Ramp           `yaml:"ramp,omitempty"`
+	Replay *Replay         `yaml:"replay,omitempty"`
+	DNS    *DNSImpairment  `yaml:"dns,omitempty"`
+	HTTP   *HTTPImpairment `yaml:"http,omitempty"`
+	Link   *LinkImpairment `yaml:"link,omitempty"`
+}
+
+var presetID = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// Validate checks the preset
+func (p *Preset) Validate() error {
+	if !presetID.MatchString(p.ID) {
+		return fmt.Errorf("invalid ID %q, only lower case letters, digits and dashes are allowed", p.ID)
+	}
+	if p.ID == clearControlID || p.ID == captureControlID || p.ID == probeControlID || p.ID == resetControlID {
+		return fmt.Errorf("ID %q is reserved", p.ID)
+	}
+	if p.Label == "" {
+		return fmt.Errorf("no label")
+	}
+	if !strings.HasPrefix(p.Icon, "fa-") {
+		return fmt.Errorf("icon %q is not a Font Awesome icon", p.Icon)
+	}
+	set := 0
+	for _, ok := range []bool{p.Impairment != (Impairment{}), p.Ramp != nil, p.Replay != nil, p.DNS != nil, p.HTTP != nil, p.Link != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set > 1 {
+		return fmt.Errorf("a preset sets either delay, loss and rate, a ramp, a trace replay, DNS faults, HTTP faults or link faults")
+	}
+	switch {
+	case p.Ramp != nil:
+		return p.Ramp.Validate()
+	case p.Replay != nil:
+		return p.Replay.Validate()
+	case p.DNS != nil:
+		return p.DNS.Validate()
+	case p.HTTP != nil:
+		return p.HTTP.Validate()
+	case p.Link != nil:
+		return p.Link.Validate()
+	}
+	return p.Impairment.Validate()
+}
+
+// DefaultConfig returns the configuration used when nothing is set
+func DefaultConfig() *Config {
+	hostname, _ := os.Hostname()
+	return &Config{
+		NodeName: hostname,
+		// We put the socket in a sub-directory to have more control on the permissions
+		Socket:         "/var/run/scope/plugins/network-control/network-control.sock",
+		DockerEndpoint: "unix:///var/run/docker.sock",
+		Backend:        defaultBackend,
+		SnapshotDir:    defaultSnapshotDir,
+		LogLevel:       "info",
+		Metrics: MetricsConfig{
+			Source: metricsRandom,
+			InfluxDB: InfluxDBConfig{
+				URL:      "http://localhost:8086",
+				Database: "ican",
+			},
+		},
+		Features: FeaturesConfig{
+			Controls:  true,
+			Preflight: true,
+			AutoApply: true,
+			Inventory: true,
+		},
+		Kubernetes: KubernetesConfig{
+			TokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token",
+			CA:        "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt",
+		},
+		Capture: CaptureConfig{
+			Dir:         defaultCaptureDir,
+			Duration:    "30s",
+			MaxDuration: "10m",
+			MaxPackets:  1000000,
+			MaxSize:     "100MB",
+			Keep:        20,
+		},
+		Probe: ProbeConfig{
+			Interval: "1s",
+			Timeout:  "1s",
+			Window:   60,
+			MaxPeers: 8,
+		},
+		Throughput: ThroughputConfig{
+			Duration:    "10s",
+			MaxDuration: "60s",
+			UDPRate:     "10mbit",
+			MaxUDPRate:  "1gbit",
+			Keep:        20,
+		},
+		Presets: []Preset{
+			{ID: "slow", Label: "Traffic speed: slow", Icon: "fa-hourglass-1", Rank: 20, Impairment: Impairment{Delay: "2000ms"}},
+			{ID: "medium", Label: "Traffic speed: medium", Icon: "fa-hourglass-2", Rank: 21, Impairment: Impairment{Delay: "1000ms"}},
+			{ID: "fast", Label: "Traffic speed: fast", Icon: "fa-hourglass-3", Rank: 22, Impairment: Impairment{Delay: "500ms"}},
+			{ID: "pkt-drop-low", Label: "Packet drop: low", Icon: "fa-cut", Rank: 23, Impairment: Impairment{Loss: "10%"}},
+			{ID: "dns-faults", Label: "DNS faults: slow and lost answers", Icon: "fa-question-circle", Rank: 24, DNS: &DNSImpairment{Delay: "1000ms", Drop: "20%"}},
+			{ID: "http-errors", Label: "HTTP faults: 503 on a fifth of the requests", Icon: "fa-exclamation-triangle", Rank: 25, HTTP: &HTTPImpairment{Faults: []HTTPFault{{Percentage: "20%", Status: 503}}}},
+			{ID: "link-flap", Label: "Link faults: interface flapping every 10s", Icon: "fa-chain-broken", Rank: 26, Link: &LinkImpairment{FlapPeriod: "10s"}},
+			{ID: "creeping-latency", Label: "Traffic speed: degrading over 5m", Icon: "fa-line-chart", Rank: 27, Ramp: &Ramp{Delay: &RampRange{From: "10ms", To: "2000ms"}, Duration: "5m", Curve: rampExponential}},
+			{ID: "lte", Label: "Network profile: LTE", Icon: "fa-mobile", Rank: 28, Replay: &Replay{Profile: "lte", Loop: true}},
+			{ID: "satellite", Label: "Network profile: satellite", Icon: "fa-globe", Rank: 29, Replay: &Replay{Profile: "satellite", Loop: true}},
+		},
+		NodeImpairment: NodeImpairmentConfig{
+			Device: "eth0",
+			// SSH, the API server and the kubelet
+			ExcludePorts: []int{22, 6443, 10250},
+		},
+		Policy: PolicyConfig{
+			Deny: []PolicyRule{
+				{Namespace: "kube-system"},
+				{Image: "weaveworks/scope*"},
+				{Image: "*/scope-network-control*"},
+			},
+		},
+	}
+}
+
+// configOption is a setting which can be given as a flag or as an
+// environment variable, the variable name is the flag name in upper
+// case prefixed by NETWORK_CONTROL_
+type configOption struct {
+	name  string
+	usage string
+	set   func(c *Config, value string) error
+	// boolean options can be given as flags without value
+	boolean bool
+}
+
+func stringOption(name, usage string, field func(c *Config) *string) configOption {
+	return configOption{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, v string) error {
+			*field(c) = v
+			return nil
+		},
+	}
+}
+
+func boolOption(name, usage string, field func(c *Config) *bool) configOption {
+	return configOption{
+		name:  name,
+		usage: usage,
+		set: func(c *Config, v string) error {
+			parsed, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			*field(c) = parsed
+			return nil
+		},
+		boolean: true,
+	}
+}
+
+var configOptions = []configOption{
+	stringOption("node-name", "name of the plugin instance, defaults to the host name", func(c *Config) *string { return &c.NodeName }),
+	stringOption("socket", "path of the unix socket serving Scope", func(c *Config) *string { return &c.Socket }),
+	stringOption("docker-endpoint", "address of the Docker daemon", func(c *Config) *string { return &c.DockerEndpoint }),
+	stringOption("backend", fmt.Sprintf("traffic control backend (%s)", strings.Join(backendNames(), ", ")), func(c *Config) *string { return &c.Backend }),
+	stringOption("snapshot-dir", "directory keeping the snapshots of the original qdiscs", func(c *Config) *string { return &c.SnapshotDir }),
+	stringOption("capture-dir", "directory keeping the packet captures", func(c *Config) *string { return &c.Capture.Dir }),
+	stringOption("listen-address", "TCP address of the authenticated listener, e.g. :8443", func(c *Config) *string { return &c.Listen.Address }),
+	stringOption("log-level", "log level (debug, info, warning, error)", func(c *Config) *string { return &c.LogLevel }),
+	stringOption("metrics-source", "source of the Network Control table values (none, random, influxdb)", func(c *Config) *string { return &c.Metrics.Source }),
+	stringOption("influxdb-url", "URL of InfluxDB", func(c *Config) *string { return &c.Metrics.InfluxDB.URL }),
+	stringOption("influxdb-database", "InfluxDB database", func(c *Config) *string { return &c.Metrics.InfluxDB.Database }),
+	boolOption("controls", "expose the controls in Scope", func(c *Config) *bool { return &c.Features.Controls }),
+	boolOption("preflight", "probe the host at startup", func(c *Config) *bool { return &c.Features.Preflight }),
+	boolOption("auto-apply", "apply the impairments declared in container labels and pod annotations", func(c *Config) *bool { return &c.Features.AutoApply }),
+	boolOption("inventory", "read the network configuration of the containers over netlink", func(c *Config) *bool { return &c.Features.Inventory }),
+	boolOption("kubernetes-watch", "watch the pods of the node for their annotations", func(c *Config) *bool { return &c.Kubernetes.Watch }),
+	stringOption("kubernetes-url", "URL of the Kubernetes API server, the in-cluster address by default", func(c *Config) *string { return &c.Kubernetes.URL }),
+	boolOption("dry-run", "log the traffic control changes instead of making them", func(c *Config) *bool { return &c.DryRun }),
+	boolOption("node-impairment", "allow impairing the host network namespace through the node endpoints of the API", func(c *Config) *bool { return &c.NodeImpairment.Enabled }),
+	stringOption("node-device", "interface of the host impaired by the node impairments", func(c *Config) *string { return &c.NodeImpairment.Device }),
+}
+
+// optionFlag is the command line flag of a configOption
+type optionFlag struct {
+	value   string
+	boolean bool
+}
+
+func (f *optionFlag) String() string {
+	return f.value
+}
+
+func (f *optionFlag) Set(value string) error {
+	f.value = value
+	return nil
+}
+
+// IsBoolFlag allows boolean flags to be given without value
+func (f *optionFlag) IsBoolFlag() bool {
+	return f.boolean
+}
+
+func (o configOption) env() string {
+	return configEnvPrefix + strings.ToUpper(strings.Replace(o.name, "-", "_", -1))
+}
+
+// ConfigLoader loads the configuration from the file, the environment
+// and the flags given at startup
+type ConfigLoader struct {
+	path         string
+	pathRequired bool
+	flags        map[string]string
+}
+
+// NewConfigLoader instantiates a ConfigLoader, if pathRequired is not
+// set a missing file is ignored. flags are the flags set on the command
+// line by name.
+func NewConfigLoader(path string, pathRequired bool, flags map[string]string) *ConfigLoader {
+	return &ConfigLoader{
+		path:         path,
+		pathRequired: pathRequired,
+		flags:        flags,
+	}
+}
+
+// Load reads and validates the configuration
+func (l *ConfigLoader) Load() (*Config, error) {
+	c := DefaultConfig()
+	raw, err := ioutil.ReadFile(l.path)
+	switch {
+	case err == nil:
+		if err := yaml.UnmarshalStrict(raw, c); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", l.path, err)
+		}
+	case os.IsNotExist(err) && !l.pathRequired:
+		log.Debugf("no configuration file %s", l.path)
+	default:
+		return nil, fmt.Errorf("failed to read %s: %v", l.path, err)
+	}
+	for _, o := range configOptions {
+		if value, ok := os.LookupEnv(o.env()); ok {
+			if err := o.set(c, value); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", o.env(), err)
+			}
+		}
+	}
+	for _, o := range configOptions {
+		if value, ok := l.flags[o.name]; ok {
+			if err := o.set(c, value); err != nil {
+				return nil, fmt.Errorf("invalid -%s: %v", o.name, err)
+			}
+		}
+	}
+	if err := c.Listen.readTokens(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return c, nil
+}
+
+// Validate checks the configuration
+func (c *Config) Validate() error {
+	if c.NodeName == "" {
+		return fmt.Errorf("no node name")
+	}
+	if !filepath.IsAbs(c.Socket) {
+		return fmt.Errorf("socket %q is not an absolute path", c.Socket)
+	}
+	if !filepath.IsAbs(c.SnapshotDir) {
+		return fmt.Errorf("snapshot directory %q is not an absolute path", c.SnapshotDir)
+	}
+	endpoint, err := url.Parse(c.DockerEndpoint)
+	if err != nil || (endpoint.Scheme != "unix" && endpoint.Scheme != "tcp") {
+		return fmt.Errorf("docker endpoint %q is not a unix:// or tcp:// address", c.DockerEndpoint)
+	}
+	if _, ok := backends[c.Backend]; !ok {
+		return fmt.Errorf("unknown backend %q, available backends: %s", c.Backend, strings.Join(backendNames(), ", "))
+	}
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		return err
+	}
+	switch c.Metrics.Source {
+	case metricsNone, metricsRandom:
+	case metricsInfluxDB:
+		u, err := url.Parse(c.Metrics.InfluxDB.URL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid InfluxDB URL %q", c.Metrics.InfluxDB.URL)
+		}
+		if c.Metrics.InfluxDB.Database == "" {
+			return fmt.Errorf("no InfluxDB database")
+		}
+	default:
+		return fmt.Errorf("unknown metrics source %q", c.Metrics.Source)
+	}
+	ids := map[string]bool{}
+	for i := range c.Presets {
+		preset := &c.Presets[i]
+		if err := preset.Validate(); err != nil {
+			return fmt.Errorf("preset %d: %v", i+1, err)
+		}
+		if ids[preset.ID] {
+			return fmt.Errorf("preset %d: duplicate ID %q", i+1, preset.ID)
+		}
+		ids[preset.ID] = true
+	}
+	if err := c.Listen.Validate(); err != nil {
+		return fmt.Errorf("listen: %v", err)
+	}
+	if err := c.Kubernetes.Validate(); err != nil {
+		return fmt.Errorf("kubernetes: %v", err)
+	}
+	if err := c.NodeImpairment.Validate(); err != nil {
+		return fmt.Errorf("node_impairment: %v", err)
+	}
+	if err := c.Capture.Validate(); err != nil {
+		return fmt.Errorf("capture: %v", err)
+	}
+	if err := c.Probe.Validate(); err != nil {
+		return fmt.Errorf("probe: %v", err)
+	}
+	if err := c.Throughput.Validate(); err != nil {
+		return fmt.Errorf("throughput: %v", err)
+	}
+	for i := range c.Policy.Allow {
+		if err := c.Policy.Allow[i].Validate(); err != nil {
+			return fmt.Errorf("policy allow rule %d: %v", i+1, err)
+		}
+	}
+	for i := range c.Policy.Deny {
+		if err := c.Policy.Deny[i].Validate(); err != nil {
+			return fmt.Errorf("policy deny rule %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// reloadable returns a copy of c where the settings which cannot be
+// changed at runtime are taken from running
+func (c *Config) reloadable(running *Config) *Config {
+	reloaded := *c
+	reloaded.NodeName = running.NodeName
+	reloaded.Socket = running.Socket
+	reloaded.DockerEndpoint = running.DockerEndpoint
+	reloaded.Backend = running.Backend
+	reloaded.SnapshotDir = running.SnapshotDir
+	reloaded.Features.Preflight = running.Features.Preflight
+	reloaded.Features.AutoApply = running.Features.AutoApply
+	reloaded.Features.Inventory = running.Features.Inventory
+	reloaded.Kubernetes = running.Kubernetes
+	reloaded.NodeImpairment = running.NodeImpairment
+	reloaded.Capture.Dir = running.Capture.Dir
+	credentials := reloaded.Listen.Credentials
+	reloaded.Listen = running.Listen
+	reloaded.Listen.Credentials = credentials
+	return &reloaded
+}
+
+var (
+	configLock sync.RWMutex
+	config     = DefaultConfig()
+)
+
+// currentConfig returns the running configuration, it must not be
+// modified
+func currentConfig() *Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config
+}
+
+// setConfig replaces the running configuration
+func setConfig(c *Config) {
+	level, _ := log.ParseLevel(c.LogLevel)
+	log.SetLevel(level)
+	configLock.Lock()
+	defer configLock.Unlock()
+	config = c
+}
+
+// Reload loads the configuration again and applies the reloadable
+// settings, on failure the running configuration is kept
+func (l *ConfigLoader) Reload() {
+	running := currentConfig()
+	c, err := l.Load()
+	if err != nil {
+		log.Errorf("Failed to reload the configuration, keeping the running one: %v", err)
+		return
+	}
+	reloaded := c.reloadable(running)
+	if err := reloaded.Listen.Validate(); err != nil {
+		log.Errorf("Failed to reload the configuration, keeping the running one: listen: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(reloaded, c) {
+		log.Warnf("Some settings of the configuration changed, they will be applied at the next restart")
+	}
+	setConfig(reloaded)
+	log.Infof("Configuration reloaded")
+}
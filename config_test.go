@@ -0,0 +1,335 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	listener := func(c *Config) {
+		c.Listen = ListenConfig{
+			Address:     ":8443",
+			Cert:        "/etc/network-control/tls.crt",
+			Key:         "/etc/network-control/tls.key",
+			Credentials: []Credential{{Name: "ci", Token: "secret", Permission: permissionApply}},
+		}
+	}
+	for _, test := range []struct {
+		name    string
+		change  func(c *Config)
+		invalid bool
+	}{
+		{name: "default", change: func(c *Config) {}},
+		{name: "no node name", change: func(c *Config) { c.NodeName = "" }, invalid: true},
+		{name: "relative socket", change: func(c *Config) { c.Socket = "plugin.sock" }, invalid: true},
+		{name: "relative snapshot directory", change: func(c *Config) { c.SnapshotDir = "snapshots" }, invalid: true},
+		{name: "tcp docker endpoint", change: func(c *Config) { c.DockerEndpoint = "tcp://127.0.0.1:2375" }},
+		{name: "http docker endpoint", change: func(c *Config) { c.DockerEndpoint = "http://127.0.0.1:2375" }, invalid: true},
+		{name: "ebpf backend", change: func(c *Config) { c.Backend = "ebpf" }},
+		{name: "unknown backend", change: func(c *Config) { c.Backend = "iptables" }, invalid: true},
+		{name: "unknown log level", change: func(c *Config) { c.LogLevel = "verbose" }, invalid: true},
+		{name: "no metrics", change: func(c *Config) { c.Metrics.Source = metricsNone }},
+		{name: "influxdb metrics", change: func(c *Config) { c.Metrics.Source = metricsInfluxDB }},
+		{
+			name: "influxdb metrics without database",
+			change: func(c *Config) {
+				c.Metrics.Source = metricsInfluxDB
+				c.Metrics.InfluxDB.Database = ""
+			},
+			invalid: true,
+		},
+		{
+			name: "influxdb metrics without host",
+			change: func(c *Config) {
+				c.Metrics.Source = metricsInfluxDB
+				c.Metrics.InfluxDB.URL = "influxdb"
+			},
+			invalid: true,
+		},
+		{name: "unknown metrics source", change: func(c *Config) { c.Metrics.Source = "prometheus" }, invalid: true},
+		{name: "no preset", change: func(c *Config) { c.Presets = nil }},
+		{name: "invalid preset ID", change: func(c *Config) { c.Presets[0].ID = "Slow" }, invalid: true},
+		{name: "reserved preset ID", change: func(c *Config) { c.Presets[0].ID = clearControlID }, invalid: true},
+		{name: "duplicate preset ID", change: func(c *Config) { c.Presets[1].ID = c.Presets[0].ID }, invalid: true},
+		{name: "preset without label", change: func(c *Config) { c.Presets[0].Label = "" }, invalid: true},
+		{name: "preset icon", change: func(c *Config) { c.Presets[0].Icon = "hourglass" }, invalid: true},
+		{
+			name: "preset with a delay and a ramp",
+			change: func(c *Config) {
+				c.Presets[0].Ramp = c.Presets[7].Ramp
+			},
+			invalid: true,
+		},
+		{name: "listener", change: listener},
+		{
+			name: "listener without certificate",
+			change: func(c *Config) {
+				listener(c)
+				c.Listen.Cert = ""
+			},
+			invalid: true,
+		},
+		{
+			name: "listener without credentials",
+			change: func(c *Config) {
+				listener(c)
+				c.Listen.Credentials = nil
+			},
+			invalid: true,
+		},
+		{
+			name: "listener address",
+			change: func(c *Config) {
+				listener(c)
+				c.Listen.Address = "8443"
+			},
+			invalid: true,
+		},
+		{
+			name: "duplicate credential",
+			change: func(c *Config) {
+				listener(c)
+				c.Listen.Credentials = append(c.Listen.Credentials, Credential{Name: "ci", Token: "other", Permission: permissionRead})
+			},
+			invalid: true,
+		},
+		{
+			name: "common name without client CA",
+			change: func(c *Config) {
+				listener(c)
+				c.Listen.Credentials[0] = Credential{Name: "ci", CommonName: "ci.example.com", Permission: permissionRead}
+			},
+			invalid: true,
+		},
+		{
+			name: "common name",
+			change: func(c *Config) {
+				listener(c)
+				c.Listen.ClientCA = "/etc/network-control/ca.crt"
+				c.Listen.Credentials[0] = Credential{Name: "ci", CommonName: "ci.example.com", Permission: permissionNode}
+			},
+		},
+		{
+			name: "token and common name",
+			change: func(c *Config) {
+				listener(c)
+				c.Listen.ClientCA = "/etc/network-control/ca.crt"
+				c.Listen.Credentials[0].CommonName = "ci.example.com"
+			},
+			invalid: true,
+		},
+		{
+			name: "unknown permission",
+			change: func(c *Config) {
+				listener(c)
+				c.Listen.Credentials[0].Permission = "admin"
+			},
+			invalid: true,
+		},
+		{
+			name: "kubernetes URL",
+			change: func(c *Config) {
+				c.Kubernetes.Watch = true
+				c.Kubernetes.URL = "https://10.96.0.1:443"
+			},
+		},
+		{
+			name: "kubernetes URL without scheme",
+			change: func(c *Config) {
+				c.Kubernetes.Watch = true
+				c.Kubernetes.URL = "10.96.0.1:443"
+			},
+			invalid: true,
+		},
+		{name: "node impairment", change: func(c *Config) { c.NodeImpairment.Enabled = true }},
+		{
+			name: "node impairment without device",
+			change: func(c *Config) {
+				c.NodeImpairment.Enabled = true
+				c.NodeImpairment.Device = ""
+			},
+			invalid: true,
+		},
+		{
+			name: "node impairment port",
+			change: func(c *Config) {
+				c.NodeImpairment.Enabled = true
+				c.NodeImpairment.ExcludePorts = []int{70000}
+			},
+			invalid: true,
+		},
+		{name: "relative capture directory", change: func(c *Config) { c.Capture.Dir = "captures" }, invalid: true},
+		{name: "capture longer than its bound", change: func(c *Config) { c.Capture.Duration = "1h" }, invalid: true},
+		{name: "capture size", change: func(c *Config) { c.Capture.MaxSize = "lots" }, invalid: true},
+		{name: "probe interval", change: func(c *Config) { c.Probe.Interval = "10ms" }, invalid: true},
+		{name: "probe window", change: func(c *Config) { c.Probe.Window = 0 }, invalid: true},
+		{name: "throughput longer than its bound", change: func(c *Config) { c.Throughput.Duration = "2m" }, invalid: true},
+		{name: "throughput rate above its bound", change: func(c *Config) { c.Throughput.UDPRate = "10gbit" }, invalid: true},
+		{name: "allow rule", change: func(c *Config) { c.Policy.Allow = []PolicyRule{{Labels: map[string]string{"chaos": "enabled"}}} }},
+		{name: "empty allow rule", change: func(c *Config) { c.Policy.Allow = []PolicyRule{{}} }, invalid: true},
+		{name: "deny rule pattern", change: func(c *Config) { c.Policy.Deny = []PolicyRule{{Image: "[scope"}} }, invalid: true},
+	} {
+		c := DefaultConfig()
+		c.NodeName = "node-1"
+		test.change(c)
+		err := c.Validate()
+		if test.invalid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		if !test.invalid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestConfigReloadable(t *testing.T) {
+	running := DefaultConfig()
+	running.Listen = ListenConfig{
+		Address:     ":8443",
+		Cert:        "/etc/network-control/tls.crt",
+		Key:         "/etc/network-control/tls.key",
+		Credentials: []Credential{{Name: "ci", Token: "secret", Permission: permissionApply}},
+	}
+	loaded := DefaultConfig()
+	loaded.NodeName = "node-2"
+	loaded.Socket = "/run/plugin.sock"
+	loaded.DockerEndpoint = "tcp://127.0.0.1:2375"
+	loaded.Backend = "ebpf"
+	loaded.SnapshotDir = "/run/snapshots"
+	loaded.LogLevel = "debug"
+	loaded.Metrics.Source = metricsNone
+	loaded.Features = FeaturesConfig{}
+	loaded.Presets = loaded.Presets[:1]
+	loaded.DryRun = true
+	loaded.Listen = ListenConfig{
+		Address:     ":9443",
+		Cert:        "/run/tls.crt",
+		Key:         "/run/tls.key",
+		Credentials: []Credential{{Name: "ops", Token: "other", Permission: permissionNode}},
+	}
+	loaded.Policy.Deny = nil
+	loaded.NodeImpairment.Enabled = true
+	loaded.Kubernetes.Watch = true
+	loaded.Capture.Dir = "/run/captures"
+	loaded.Capture.Keep = 5
+	loaded.Probe.Window = 10
+	loaded.Throughput.Keep = 5
+
+	reloaded := loaded.reloadable(running)
+	for _, test := range []struct {
+		setting    string
+		value      func(c *Config) interface{}
+		reloadable bool
+	}{
+		{"node_name", func(c *Config) interface{} { return c.NodeName }, false},
+		{"socket", func(c *Config) interface{} { return c.Socket }, false},
+		{"docker_endpoint", func(c *Config) interface{} { return c.DockerEndpoint }, false},
+		{"backend", func(c *Config) interface{} { return c.Backend }, false},
+		{"snapshot_dir", func(c *Config) interface{} { return c.SnapshotDir }, false},
+		{"log_level", func(c *Config) interface{} { return c.LogLevel }, true},
+		{"metrics", func(c *Config) interface{} { return c.Metrics }, true},
+		{"features.controls", func(c *Config) interface{} { return c.Features.Controls }, true},
+		{"features.preflight", func(c *Config) interface{} { return c.Features.Preflight }, false},
+		{"features.auto_apply", func(c *Config) interface{} { return c.Features.AutoApply }, false},
+		{"features.inventory", func(c *Config) interface{} { return c.Features.Inventory }, false},
+		{"presets", func(c *Config) interface{} { return c.Presets }, true},
+		{"dry_run", func(c *Config) interface{} { return c.DryRun }, true},
+		{"listen.address", func(c *Config) interface{} { return c.Listen.Address }, false},
+		{"listen.cert", func(c *Config) interface{} { return c.Listen.Cert }, false},
+		{"listen.credentials", func(c *Config) interface{} { return c.Listen.Credentials }, true},
+		{"policy", func(c *Config) interface{} { return c.Policy }, true},
+		{"node_impairment", func(c *Config) interface{} { return c.NodeImpairment }, false},
+		{"kubernetes", func(c *Config) interface{} { return c.Kubernetes }, false},
+		{"capture.dir", func(c *Config) interface{} { return c.Capture.Dir }, false},
+		{"capture.keep", func(c *Config) interface{} { return c.Capture.Keep }, true},
+		{"probe", func(c *Config) interface{} { return c.Probe }, true},
+		{"throughput", func(c *Config) interface{} { return c.Throughput }, true},
+	} {
+		expected := running
+		if test.reloadable {
+			expected = loaded
+		}
+		if value := test.value(reloaded); !reflect.DeepEqual(value, test.value(expected)) {
+			t.Errorf("%s: expected %v, got %v", test.setting, test.value(expected), value)
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "network-control-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	previous := currentConfig()
+	defer setConfig(previous)
+
+	running := DefaultConfig()
+	running.Listen = ListenConfig{
+		Address:     ":8443",
+		Cert:        "/etc/network-control/tls.crt",
+		Key:         "/etc/network-control/tls.key",
+		Credentials: []Credential{{Name: "ci", Token: "secret", Permission: permissionApply}},
+	}
+	path := filepath.Join(dir, "config.yaml")
+	credentials := "listen:\n  credentials:\n  - name: ci\n    token: secret\n    permission: apply\n"
+	for _, test := range []struct {
+		name     string
+		file     string
+		expected func(c *Config)
+	}{
+		{
+			name: "reloadable settings",
+			file: credentials + "dry_run: true\npresets: []\n",
+			expected: func(c *Config) {
+				c.DryRun = true
+				c.Presets = []Preset{}
+			},
+		},
+		{
+			name:     "settings requiring a restart",
+			file:     credentials + "backend: ebpf\nsnapshot_dir: /run/snapshots\n",
+			expected: func(c *Config) {},
+		},
+		{
+			name: "credentials",
+			file: "listen:\n  credentials:\n  - name: ops\n    token: other\n    permission: read\n",
+			expected: func(c *Config) {
+				c.Listen.Credentials = []Credential{{Name: "ops", Token: "other", Permission: permissionRead}}
+			},
+		},
+		{
+			// the running listener requires credentials
+			name:     "no credentials",
+			file:     "dry_run: true\n",
+			expected: nil,
+		},
+		{
+			name:     "invalid file",
+			file:     credentials + "dry_run: maybe\n",
+			expected: nil,
+		},
+		{
+			name:     "invalid configuration",
+			file:     credentials + "log_level: verbose\n",
+			expected: nil,
+		},
+	} {
+		setConfig(running)
+		if err := ioutil.WriteFile(path, []byte(test.file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		NewConfigLoader(path, true, map[string]string{}).Reload()
+
+		expected := *running
+		if test.expected != nil {
+			test.expected(&expected)
+		}
+		if c := currentConfig(); !reflect.DeepEqual(*c, expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, expected, *c)
+		}
+	}
+}
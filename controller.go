@@ -0,0 +1,1191 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Controller performs the traffic control operations and owns the
+// status of every network namespace. Operations on the same network
+// namespace are queued and executed one at a time by a goroutine that
+// lives as long as its queue is not empty, so concurrent requests never
+// race on the qdiscs.
+type Controller struct {
+	backend   Backend
+	snapshots *SnapshotStore
+
+	lock   sync.Mutex
+	queues map[string][]func()
+	status map[string]TrafficControlStatus
+	// deadlines of the settings applied for a limited time
+	deadlines map[string]time.Time
+	// dns and http are the DNS and HTTP proxies by network namespace
+	dns  map[string]*dnsProxy
+	http map[string]*httpProxy
+	// link are the link faults by network namespace
+	link map[string]*linkFault
+	// ramps and replays are the ramps and the trace replays running by
+	// network namespace, their steps are notified on changes
+	ramps   map[string]*ramp
+	replays map[string]*replay
+	changes chan struct{}
+}
+
+// NewController instantiates a new Controller
+func NewController(backend Backend, snapshots *SnapshotStore) *Controller {
+	return &Controller{
+		backend:   backend,
+		snapshots: snapshots,
+		queues:    map[string][]func(){},
+		status:    map[string]TrafficControlStatus{},
+		deadlines: map[string]time.Time{},
+		dns:       map[string]*dnsProxy{},
+		http:      map[string]*httpProxy{},
+		link:      map[string]*linkFault{},
+		ramps:     map[string]*ramp{},
+		replays:   map[string]*replay{},
+		changes:   make(chan struct{}, 1),
+	}
+}
+
+// Backend returns the backend enforcing the settings
+func (c *Controller) Backend() Backend {
+	return c.backend
+}
+
+// Changes notifies the changes of the settings made by the controller
+// itself, the steps of the ramps and of the replays
+func (c *Controller) Changes() <-chan struct{} {
+	return c.changes
+}
+
+func (c *Controller) notify() {
+	select {
+	case c.changes <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the status of a network namespace, values that are
+// not set are '-'
+func (c *Controller) Status(netNSID string) TrafficControlStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if status, ok := c.status[netNSID]; ok {
+		return status
+	}
+	return *TrafficControlStatusInit()
+}
+
+// Deadline returns when the settings of a network namespace expire,
+// false if they do not
+func (c *Controller) Deadline(netNSID string) (time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	deadline, ok := c.deadlines[netNSID]
+	return deadline, ok
+}
+
+// Snapshot returns a copy of the status of the network namespaces
+// having settings
+func (c *Controller) Snapshot() map[string]TrafficControlStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	snapshot := make(map[string]TrafficControlStatus, len(c.status))
+	for netNSID, status := range c.status {
+		snapshot[netNSID] = status
+	}
+	return snapshot
+}
+
+// Impairment is a set of traffic control settings, the empty ones are
+// left unchanged when it is applied
+type Impairment struct {
+	// Delay is a tc time, e.g. 100ms
+	Delay string `yaml:"delay,omitempty" json:"delay,omitempty"`
+	// Loss is a percentage, e.g. 10%
+	Loss string `yaml:"loss,omitempty" json:"loss,omitempty"`
+	// Rate is a tc rate, e.g. 1mbit
+	Rate string `yaml:"rate,omitempty" json:"rate,omitempty"`
+}
+
+// Validate checks that the settings can be understood by every backend
+func (i *Impairment) Validate() error {
+	if i.Delay == "" && i.Loss == "" && i.Rate == "" {
+		return fmt.Errorf("no delay, loss or rate")
+	}
+	if i.Delay != "" {
+		if _, err := parseTCTime(i.Delay); err != nil {
+			return err
+		}
+	}
+	if i.Loss != "" {
+		if _, err := parsePercentage(i.Loss); err != nil {
+			return err
+		}
+	}
+	if i.Rate != "" {
+		if _, err := parseTCRate(i.Rate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply sets the non empty settings of impairment, they are cleared
+// after duration unless it is 0. Applying settings again replaces the
+// previous deadline. It refuses to impair the host network namespace.
+func (c *Controller) Apply(pid int, impairment Impairment, duration time.Duration) error {
+	return c.apply(pid, false, impairment, duration)
+}
+
+// ApplyNode is Apply for the host network namespace, leaving the
+// management traffic unimpaired
+func (c *Controller) ApplyNode(impairment Impairment, duration time.Duration) error {
+	return c.apply(hostPID, true, impairment, duration)
+}
+
+func (c *Controller) apply(pid int, node bool, impairment Impairment, duration time.Duration) error {
+	if err := impairment.Validate(); err != nil {
+		return err
+	}
+	var deadline time.Time
+	if duration > 0 {
+		deadline = time.Now().Add(duration)
+	}
+	return c.update(pid, node, deadline, impairment.change)
+}
+
+// hostPID is a process of the host network namespace, the plugin must
+// share the PID namespace of the host
+const hostPID = 1
+
+// containerDevice is the interface impaired in the network namespaces
+// of the containers
+const containerDevice = "eth0"
+
+// hostNetNSID returns the ID of the host network namespace
+func hostNetNSID() (string, error) {
+	netNSID, err := getNSID(fmt.Sprintf("/proc/%d/ns/net", hostPID))
+	if err != nil {
+		return "", fmt.Errorf("failed to get the host network namespace ID: %v", err)
+	}
+	return netNSID, nil
+}
+
+// netInterface returns the interface to impair in netNS
+func netInterface(netNS, netNSID string) (NetInterface, error) {
+	hostID, err := hostNetNSID()
+	if err != nil {
+		return NetInterface{}, err
+	}
+	if netNSID != hostID {
+		return NetInterface{NetNS: netNS, Device: containerDevice}, nil
+	}
+	cfg := currentConfig()
+	iface := NetInterface{
+		NetNS:        netNS,
+		Device:       cfg.NodeImpairment.Device,
+		Host:         true,
+		ExcludePorts: cfg.NodeImpairment.ExcludePorts,
+	}
+	// never lock the remote clients out
+	if cfg.Listen.Address != "" {
+		_, port, _ := net.SplitHostPort(cfg.Listen.Address)
+		if p, err := strconv.Atoi(port); err == nil {
+			iface.ExcludePorts = append(append([]int{}, iface.ExcludePorts...), p)
+		}
+	}
+	return iface, nil
+}
+
+// checkImpairment refuses to impair the host network namespace unless
+// node is set and the node impairment is enabled
+func checkImpairment(iface NetInterface, node bool) error {
+	switch {
+	case iface.Host && !node:
+		return fmt.Errorf("the network namespace is the host's, impairing it would impair the whole node: use a node impairment")
+	case node && !currentConfig().NodeImpairment.Enabled:
+		return fmt.Errorf("node impairment is disabled, see node_impairment.enabled")
+	case node && !iface.Host:
+		return fmt.Errorf("process %d is not in the host network namespace, the plugin must share the PID namespace of the host", hostPID)
+	}
+	return nil
+}
+
+// Set replaces the settings of the network namespace of pid with
+// impairment, the empty settings are removed
+func (c *Controller) Set(pid int, impairment Impairment) error {
+	if err := impairment.Validate(); err != nil {
+		return err
+	}
+	return c.update(pid, false, time.Time{}, impairment.set)
+}
+
+// set replaces the settings of status
+func (i Impairment) set(status *TrafficControlStatus) {
+	status.SetLatency(i.Delay)
+	status.SetPacketLoss(i.Loss)
+	status.SetRate(i.Rate)
+}
+
+// change sets the non empty settings in status
+func (i Impairment) change(status *TrafficControlStatus) {
+	if i.Delay != "" {
+		status.SetLatency(i.Delay)
+	}
+	if i.Loss != "" {
+		status.SetPacketLoss(i.Loss)
+	}
+	if i.Rate != "" {
+		status.SetRate(i.Rate)
+	}
+}
+
+// ClearTrafficControlSettings removes the settings and the DNS, HTTP
+// and link faults and restores the original configuration of the
+// interface
+func (c *Controller) ClearTrafficControlSettings(pid int) error {
+	return c.do(pid, func(iface NetInterface, netNSID string) error {
+		if err := c.clearDNS(iface, netNSID); err != nil {
+			return err
+		}
+		if err := c.clearHTTP(iface, netNSID); err != nil {
+			return err
+		}
+		if err := c.clearLink(iface, netNSID); err != nil {
+			return err
+		}
+		return c.clear(iface, netNSID)
+	})
+}
+
+// DNSStatus returns the DNS faults of a network namespace, false if it
+// has none
+func (c *Controller) DNSStatus(netNSID string) (DNSImpairment, bool) {
+	c.lock.Lock()
+	proxy, ok := c.dns[netNSID]
+	c.lock.Unlock()
+	if !ok {
+		return DNSImpairment{}, false
+	}
+	return proxy.Impairment(), true
+}
+
+// DNSSnapshot returns the DNS faults of the network namespaces having
+// some
+func (c *Controller) DNSSnapshot() map[string]DNSImpairment {
+	c.lock.Lock()
+	proxies := make(map[string]*dnsProxy, len(c.dns))
+	for netNSID, proxy := range c.dns {
+		proxies[netNSID] = proxy
+	}
+	c.lock.Unlock()
+	snapshot := make(map[string]DNSImpairment, len(proxies))
+	for netNSID, proxy := range proxies {
+		snapshot[netNSID] = proxy.Impairment()
+	}
+	return snapshot
+}
+
+// ApplyDNS injects the DNS faults of impairment in the network namespace
+// of pid, replacing the previous ones
+func (c *Controller) ApplyDNS(pid int, impairment DNSImpairment) error {
+	if err := impairment.Validate(); err != nil {
+		return err
+	}
+	return c.do(pid, func(iface NetInterface, netNSID string) error {
+		return c.applyDNS(pid, iface, netNSID, impairment)
+	})
+}
+
+// ToggleDNS removes the DNS faults of the network namespace of pid if
+// they are impairment and injects impairment otherwise
+func (c *Controller) ToggleDNS(pid int, impairment DNSImpairment) error {
+	if err := impairment.Validate(); err != nil {
+		return err
+	}
+	return c.do(pid, func(iface NetInterface, netNSID string) error {
+		if current, ok := c.DNSStatus(netNSID); ok && reflect.DeepEqual(current, impairment) {
+			return c.clearDNS(iface, netNSID)
+		}
+		return c.applyDNS(pid, iface, netNSID, impairment)
+	})
+}
+
+// ClearDNS removes the DNS faults of the network namespace of pid
+func (c *Controller) ClearDNS(pid int) error {
+	return c.do(pid, c.clearDNS)
+}
+
+func (c *Controller) applyDNS(pid int, iface NetInterface, netNSID string, impairment DNSImpairment) error {
+	if err := checkImpairment(iface, false); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	proxy, ok := c.dns[netNSID]
+	c.lock.Unlock()
+	if ok {
+		return proxy.set(impairment)
+	}
+	if currentConfig().DryRun {
+		log.Infof("dry-run: inject DNS faults in network namespace %s: %s", netNSID, impairment)
+		for i, cmd := range redirectCommands(dnsTable, dnsRedirectRules("<proxy port>")) {
+			log.Infof("dry-run:   %d. redirect the DNS traffic to the proxy: %s", i+1, strings.Join(cmd, " "))
+		}
+		return nil
+	}
+	proxy, err := startDNSProxy(pid, netNSID, impairment, c.forgetDNS)
+	if err != nil {
+		return fmt.Errorf("failed to start the DNS proxy: %v", err)
+	}
+	c.lock.Lock()
+	c.dns[netNSID] = proxy
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *Controller) clearDNS(iface NetInterface, netNSID string) error {
+	c.lock.Lock()
+	proxy, ok := c.dns[netNSID]
+	c.lock.Unlock()
+	if currentConfig().DryRun {
+		if ok {
+			log.Infof("dry-run: remove the DNS faults of network namespace %s: %s", netNSID, strings.Join(removeRedirectCommand(dnsTable), " "))
+		}
+		return nil
+	}
+	if !ok {
+		// the plugin may have restarted without stopping its proxy
+		removeStaleRedirect(iface.NetNS, dnsTable)
+		return nil
+	}
+	err := proxy.Stop()
+	c.forgetDNS(proxy)
+	return err
+}
+
+// forgetDNS forgets proxy, once stopped
+func (c *Controller) forgetDNS(proxy *dnsProxy) {
+	c.lock.Lock()
+	if c.dns[proxy.netNSID] == proxy {
+		delete(c.dns, proxy.netNSID)
+	}
+	c.lock.Unlock()
+}
+
+// ClearNode removes the settings of the host network namespace
+func (c *Controller) ClearNode() error {
+	return c.ClearTrafficControlSettings(hostPID)
+}
+
+// HTTPStatus returns the HTTP faults of a network namespace, false if
+// it has none
+func (c *Controller) HTTPStatus(netNSID string) (HTTPImpairment, bool) {
+	c.lock.Lock()
+	proxy, ok := c.http[netNSID]
+	c.lock.Unlock()
+	if !ok {
+		return HTTPImpairment{}, false
+	}
+	return proxy.Impairment(), true
+}
+
+// HTTPSnapshot returns the HTTP faults of the network namespaces having
+// some
+func (c *Controller) HTTPSnapshot() map[string]HTTPImpairment {
+	c.lock.Lock()
+	proxies := make(map[string]*httpProxy, len(c.http))
+	for netNSID, proxy := range c.http {
+		proxies[netNSID] = proxy
+	}
+	c.lock.Unlock()
+	snapshot := make(map[string]HTTPImpairment, len(proxies))
+	for netNSID, proxy := range proxies {
+		snapshot[netNSID] = proxy.Impairment()
+	}
+	return snapshot
+}
+
+// ApplyHTTP injects the HTTP faults of impairment in the network
+// namespace of pid, replacing the previous ones
+func (c *Controller) ApplyHTTP(pid int, impairment HTTPImpairment) error {
+	if err := impairment.Validate(); err != nil {
+		return err
+	}
+	return c.do(pid, func(iface NetInterface, netNSID string) error {
+		return c.applyHTTP(pid, iface, netNSID, impairment)
+	})
+}
+
+// ToggleHTTP removes the HTTP faults of the network namespace of pid if
+// they are impairment and injects impairment otherwise
+func (c *Controller) ToggleHTTP(pid int, impairment HTTPImpairment) error {
+	if err := impairment.Validate(); err != nil {
+		return err
+	}
+	return c.do(pid, func(iface NetInterface, netNSID string) error {
+		if current, ok := c.HTTPStatus(netNSID); ok && reflect.DeepEqual(current, impairment) {
+			return c.clearHTTP(iface, netNSID)
+		}
+		return c.applyHTTP(pid, iface, netNSID, impairment)
+	})
+}
+
+func (c *Controller) applyHTTP(pid int, iface NetInterface, netNSID string, impairment HTTPImpairment) error {
+	if err := checkImpairment(iface, false); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	proxy, ok := c.http[netNSID]
+	c.lock.Unlock()
+	if ok {
+		return proxy.set(impairment)
+	}
+	if currentConfig().DryRun {
+		log.Infof("dry-run: inject HTTP faults in network namespace %s: %s", netNSID, impairment)
+		for i, cmd := range redirectCommands(httpTable, httpRedirectRules(impairment.ports(), "<proxy port>")) {
+			log.Infof("dry-run:   %d. redirect the HTTP traffic to the proxy: %s", i+1, strings.Join(cmd, " "))
+		}
+		return nil
+	}
+	proxy, err := startHTTPProxy(pid, netNSID, impairment, c.forgetHTTP)
+	if err != nil {
+		return fmt.Errorf("failed to start the HTTP proxy: %v", err)
+	}
+	c.lock.Lock()
+	c.http[netNSID] = proxy
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *Controller) clearHTTP(iface NetInterface, netNSID string) error {
+	c.lock.Lock()
+	proxy, ok := c.http[netNSID]
+	c.lock.Unlock()
+	if currentConfig().DryRun {
+		if ok {
+			log.Infof("dry-run: remove the HTTP faults of network namespace %s: %s", netNSID, strings.Join(removeRedirectCommand(httpTable), " "))
+		}
+		return nil
+	}
+	if !ok {
+		// the plugin may have restarted without stopping its proxy
+		removeStaleRedirect(iface.NetNS, httpTable)
+		return nil
+	}
+	err := proxy.Stop()
+	c.forgetHTTP(proxy)
+	return err
+}
+
+// forgetHTTP forgets proxy, once stopped
+func (c *Controller) forgetHTTP(proxy *httpProxy) {
+	c.lock.Lock()
+	if c.http[proxy.netNSID] == proxy {
+		delete(c.http, proxy.netNSID)
+	}
+	c.lock.Unlock()
+}
+
+// LinkStatus returns the link faults of a network namespace, false if
+// it has none
+func (c *Controller) LinkStatus(netNSID string) (LinkImpairment, bool) {
+	c.lock.Lock()
+	fault, ok := c.link[netNSID]
+	c.lock.Unlock()
+	if !ok {
+		return LinkImpairment{}, false
+	}
+	return fault.Impairment(), true
+}
+
+// LinkSnapshot returns the link faults of the network namespaces having
+// some
+func (c *Controller) LinkSnapshot() map[string]LinkImpairment {
+	c.lock.Lock()
+	faults := make(map[string]*linkFault, len(c.link))
+	for netNSID, fault := range c.link {
+		faults[netNSID] = fault
+	}
+	c.lock.Unlock()
+	snapshot := make(map[string]LinkImpairment, len(faults))
+	for netNSID, fault := range faults {
+		snapshot[netNSID] = fault.Impairment()
+	}
+	return snapshot
+}
+
+// ApplyLink injects the link faults of impairment in the network
+// namespace of pid, replacing the previous ones after restoring the
+// interface. They are cleared after duration unless it is 0.
+func (c *Controller) ApplyLink(pid int, impairment LinkImpairment, duration time.Duration) error {
+	if err := impairment.Validate(); err != nil {
+		return err
+	}
+	return c.do(pid, func(iface NetInterface, netNSID string) error {
+		return c.applyLink(pid, iface, netNSID, impairment, duration)
+	})
+}
+
+// ToggleLink removes the link faults of the network namespace of pid if
+// they are impairment and injects impairment otherwise
+func (c *Controller) ToggleLink(pid int, impairment LinkImpairment) error {
+	if err := impairment.Validate(); err != nil {
+		return err
+	}
+	return c.do(pid, func(iface NetInterface, netNSID string) error {
+		if current, ok := c.LinkStatus(netNSID); ok && current == impairment {
+			return c.clearLink(iface, netNSID)
+		}
+		return c.applyLink(pid, iface, netNSID, impairment, 0)
+	})
+}
+
+func (c *Controller) applyLink(pid int, iface NetInterface, netNSID string, impairment LinkImpairment, duration time.Duration) error {
+	if err := checkImpairment(iface, false); err != nil {
+		return err
+	}
+	if currentConfig().DryRun {
+		log.Infof("dry-run: inject link faults in network namespace %s: %s", netNSID, impairment)
+		for i, cmd := range plannedLinkCommands(iface.Device, impairment) {
+			log.Infof("dry-run:   %d. %s", i+1, strings.Join(cmd, " "))
+		}
+		return nil
+	}
+	// the original state is read from the restored interface
+	if err := c.clearLink(iface, netNSID); err != nil {
+		return err
+	}
+	fault, err := startLinkFault(iface, netNSID, impairment, c.forgetLink)
+	if err != nil {
+		return fmt.Errorf("failed to inject the link faults: %v", err)
+	}
+	c.lock.Lock()
+	c.link[netNSID] = fault
+	c.lock.Unlock()
+	if duration > 0 {
+		time.AfterFunc(duration, func() {
+			c.expireLink(pid, fault)
+		})
+	}
+	return nil
+}
+
+// ClearLink removes the link faults of the network namespace of pid and
+// restores its interface
+func (c *Controller) ClearLink(pid int) error {
+	return c.do(pid, c.clearLink)
+}
+
+func (c *Controller) clearLink(iface NetInterface, netNSID string) error {
+	c.lock.Lock()
+	fault, ok := c.link[netNSID]
+	c.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	if currentConfig().DryRun {
+		log.Infof("dry-run: remove the link faults of network namespace %s and restore %s", netNSID, fault.device)
+		return nil
+	}
+	err := fault.Stop()
+	c.forgetLink(fault)
+	return err
+}
+
+// forgetLink forgets fault, once over
+func (c *Controller) forgetLink(fault *linkFault) {
+	c.lock.Lock()
+	if c.link[fault.netNSID] == fault {
+		delete(c.link, fault.netNSID)
+	}
+	c.lock.Unlock()
+}
+
+// expireLink clears the link faults of the network namespace of pid if
+// they are still fault
+func (c *Controller) expireLink(pid int, fault *linkFault) {
+	err := c.do(pid, func(iface NetInterface, netNSID string) error {
+		c.lock.Lock()
+		current := c.link[netNSID]
+		c.lock.Unlock()
+		if current != fault {
+			// the faults were replaced or cleared meanwhile
+			return nil
+		}
+		log.Infof("link faults of network namespace %s expired", netNSID)
+		return c.clearLink(iface, netNSID)
+	})
+	if err != nil {
+		log.Errorf("failed to clear expired link faults of process %d: %v", pid, err)
+	}
+}
+
+// Shutdown restores the interfaces having link faults and stops the DNS
+// and HTTP proxies, the plugin is stopping and would leave the
+// interfaces down or flapping and the traffic redirected to proxies
+// which are gone
+func (c *Controller) Shutdown() {
+	c.lock.Lock()
+	faults := make([]*linkFault, 0, len(c.link))
+	for _, fault := range c.link {
+		faults = append(faults, fault)
+	}
+	dns := make([]*dnsProxy, 0, len(c.dns))
+	for _, proxy := range c.dns {
+		dns = append(dns, proxy)
+	}
+	http := make([]*httpProxy, 0, len(c.http))
+	for _, proxy := range c.http {
+		http = append(http, proxy)
+	}
+	c.lock.Unlock()
+	for _, proxy := range dns {
+		log.Infof("stopping the DNS proxy of network namespace %s", proxy.netNSID)
+		if err := proxy.Stop(); err != nil {
+			log.Error(err)
+		}
+		c.forgetDNS(proxy)
+	}
+	for _, proxy := range http {
+		log.Infof("stopping the HTTP proxy of network namespace %s", proxy.netNSID)
+		if err := proxy.Stop(); err != nil {
+			log.Error(err)
+		}
+		c.forgetHTTP(proxy)
+	}
+	for _, fault := range faults {
+		log.Infof("restoring the link of network namespace %s", fault.netNSID)
+		if err := fault.Stop(); err != nil {
+			log.Error(err)
+		}
+		c.forgetLink(fault)
+	}
+}
+
+// Prune forgets the settings, the deadlines and the snapshots of the
+// network namespaces which are gone and stops their ramps and replays,
+// the kernel reuses their inodes for new network namespaces
+func (c *Controller) Prune() {
+	live, err := liveNetNSIDs()
+	if err != nil {
+		log.Errorf("failed to list the network namespaces: %v", err)
+		return
+	}
+	if hostID, err := hostNetNSID(); err == nil {
+		live[hostID] = true
+	}
+	c.lock.Lock()
+	dead := map[string]bool{}
+	for netNSID := range c.status {
+		dead[netNSID] = !live[netNSID]
+	}
+	for netNSID := range c.deadlines {
+		dead[netNSID] = !live[netNSID]
+	}
+	for netNSID := range c.ramps {
+		dead[netNSID] = !live[netNSID]
+	}
+	for netNSID := range c.replays {
+		dead[netNSID] = !live[netNSID]
+	}
+	for netNSID, gone := range dead {
+		if gone {
+			delete(c.status, netNSID)
+			delete(c.deadlines, netNSID)
+		}
+	}
+	c.lock.Unlock()
+	for netNSID, gone := range dead {
+		if gone {
+			log.Infof("forgetting the settings of network namespace %s, it is gone", netNSID)
+			c.stopRamp(netNSID)
+			c.stopReplay(netNSID)
+		}
+	}
+	c.snapshots.Prune(live)
+	c.notify()
+}
+
+// RampStatus returns the progress of the ramp of a network namespace,
+// false if it has none running
+func (c *Controller) RampStatus(netNSID string) (RampStatus, bool) {
+	c.lock.Lock()
+	r, ok := c.ramps[netNSID]
+	c.lock.Unlock()
+	if !ok {
+		return RampStatus{}, false
+	}
+	return r.Status(), true
+}
+
+// RampSnapshot returns the progress of the ramps running
+func (c *Controller) RampSnapshot() map[string]RampStatus {
+	c.lock.Lock()
+	ramps := make(map[string]*ramp, len(c.ramps))
+	for netNSID, r := range c.ramps {
+		ramps[netNSID] = r
+	}
+	c.lock.Unlock()
+	snapshot := make(map[string]RampStatus, len(ramps))
+	for netNSID, r := range ramps {
+		snapshot[netNSID] = r.Status()
+	}
+	return snapshot
+}
+
+// ApplyRamp starts spec in the network namespace of pid, replacing the
+// ramp or the replay running there. The first step, at the start values, is applied
+// before it returns. The settings are cleared after duration unless it
+// is 0, stopping the ramp if it still runs.
+func (c *Controller) ApplyRamp(pid int, spec Ramp, duration time.Duration) error {
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+	var deadline time.Time
+	if duration > 0 {
+		deadline = time.Now().Add(duration)
+	}
+	return c.do(pid, func(iface NetInterface, netNSID string) error {
+		return c.startRamp(pid, iface, netNSID, spec, deadline)
+	})
+}
+
+// ToggleRamp stops the ramp of the network namespace of pid and removes
+// the settings it drives if it is spec, and starts spec otherwise
+func (c *Controller) ToggleRamp(pid int, spec Ramp) error {
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+	return c.do(pid, func(iface NetInterface, netNSID string) error {
+		if current, ok := c.RampStatus(netNSID); ok && reflect.DeepEqual(current.Ramp, spec) {
+			c.stopRamp(netNSID)
+			return c.enforce(pid, iface, netNSID, false, nil, spec.clears())
+		}
+		return c.startRamp(pid, iface, netNSID, spec, time.Time{})
+	})
+}
+
+func (c *Controller) startRamp(pid int, iface NetInterface, netNSID string, spec Ramp, deadline time.Time) error {
+	c.stopRamp(netNSID)
+	c.stopReplay(netNSID)
+	r := newRamp(pid, spec)
+	first := spec.at(0)
+	if err := c.enforce(pid, iface, netNSID, false, &deadline, first.change); err != nil {
+		return err
+	}
+	log.Infof("ramp of network namespace %s started: %s", netNSID, spec)
+	r.stepped(0, first)
+	c.lock.Lock()
+	c.ramps[netNSID] = r
+	c.lock.Unlock()
+	go r.run(c)
+	return nil
+}
+
+// rampStep applies step of r, unless r was stopped meanwhile
+func (c *Controller) rampStep(r *ramp, step int) error {
+	impairment := r.spec.at(step)
+	err := c.do(r.pid, func(iface NetInterface, netNSID string) error {
+		c.lock.Lock()
+		current := c.ramps[netNSID]
+		c.lock.Unlock()
+		if current != r {
+			return nil
+		}
+		if err := c.enforce(r.pid, iface, netNSID, false, nil, impairment.change); err != nil {
+			return err
+		}
+		r.stepped(step, impairment)
+		return nil
+	})
+	if err == nil {
+		c.notify()
+	}
+	return err
+}
+
+// stopRamp stops the ramp of a network namespace, the settings stay
+func (c *Controller) stopRamp(netNSID string) {
+	c.lock.Lock()
+	r, ok := c.ramps[netNSID]
+	delete(c.ramps, netNSID)
+	c.lock.Unlock()
+	if ok {
+		r.stop()
+	}
+}
+
+// endRamp forgets r, once over
+func (c *Controller) endRamp(r *ramp) {
+	c.lock.Lock()
+	for netNSID, current := range c.ramps {
+		if current == r {
+			delete(c.ramps, netNSID)
+		}
+	}
+	c.lock.Unlock()
+	c.notify()
+}
+
+// ReplayStatus returns the progress of the replay of a network
+// namespace, false if it has none running
+func (c *Controller) ReplayStatus(netNSID string) (ReplayStatus, bool) {
+	c.lock.Lock()
+	r, ok := c.replays[netNSID]
+	c.lock.Unlock()
+	if !ok {
+		return ReplayStatus{}, false
+	}
+	return r.Status(), true
+}
+
+// ReplaySnapshot returns the progress of the replays running
+func (c *Controller) ReplaySnapshot() map[string]ReplayStatus {
+	c.lock.Lock()
+	replays := make(map[string]*replay, len(c.replays))
+	for netNSID, r := range c.replays {
+		replays[netNSID] = r
+	}
+	c.lock.Unlock()
+	snapshot := make(map[string]ReplayStatus, len(replays))
+	for netNSID, r := range replays {
+		snapshot[netNSID] = r.Status()
+	}
+	return snapshot
+}
+
+// ApplyReplay replays the trace of spec in the network namespace of
+// pid, replacing the ramp or the replay running there. The first sample
+// is applied before it returns. The settings are cleared after duration
+// unless it is 0, stopping the replay if it still runs.
+func (c *Controller) ApplyReplay(pid int, spec Replay, duration time.Duration) error {
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+	var deadline time.Time
+	if duration > 0 {
+		deadline = time.Now().Add(duration)
+	}
+	return c.do(pid, func(iface NetInterface, netNSID string) error {
+		return c.startReplay(pid, iface, netNSID, spec, deadline)
+	})
+}
+
+// ToggleReplay stops the replay of the network namespace of pid and
+// removes the settings of its trace if it replays spec, and replays spec
+// otherwise
+func (c *Controller) ToggleReplay(pid int, spec Replay) error {
+	t, err := spec.trace()
+	if err != nil {
+		return err
+	}
+	return c.do(pid, func(iface NetInterface, netNSID string) error {
+		c.lock.Lock()
+		current, ok := c.replays[netNSID]
+		c.lock.Unlock()
+		if ok && reflect.DeepEqual(current.spec, spec) {
+			c.stopReplay(netNSID)
+			return c.enforce(pid, iface, netNSID, false, nil, t.clears())
+		}
+		return c.startReplay(pid, iface, netNSID, spec, time.Time{})
+	})
+}
+
+func (c *Controller) startReplay(pid int, iface NetInterface, netNSID string, spec Replay, deadline time.Time) error {
+	t, err := spec.trace()
+	if err != nil {
+		return err
+	}
+	c.stopRamp(netNSID)
+	c.stopReplay(netNSID)
+	r := newReplay(pid, spec, t)
+	if err := c.enforce(pid, iface, netNSID, false, &deadline, r.sample(0).change); err != nil {
+		return err
+	}
+	log.Infof("replay of %s in network namespace %s started", t.name, netNSID)
+	r.replayed(0)
+	c.lock.Lock()
+	c.replays[netNSID] = r
+	c.lock.Unlock()
+	go r.run(c)
+	return nil
+}
+
+// replayStep applies the sample at the position k of r, unless r was
+// stopped meanwhile
+func (c *Controller) replayStep(r *replay, k int) error {
+	err := c.do(r.pid, func(iface NetInterface, netNSID string) error {
+		c.lock.Lock()
+		current := c.replays[netNSID]
+		c.lock.Unlock()
+		if current != r {
+			return nil
+		}
+		if err := c.enforce(r.pid, iface, netNSID, false, nil, r.sample(k).change); err != nil {
+			return err
+		}
+		r.replayed(k)
+		return nil
+	})
+	if err == nil {
+		c.notify()
+	}
+	return err
+}
+
+// stopReplay stops the replay of a network namespace, the settings stay
+func (c *Controller) stopReplay(netNSID string) {
+	c.lock.Lock()
+	r, ok := c.replays[netNSID]
+	delete(c.replays, netNSID)
+	c.lock.Unlock()
+	if ok {
+		r.stop()
+	}
+}
+
+// endReplay forgets r, once over
+func (c *Controller) endReplay(r *replay) {
+	c.lock.Lock()
+	for netNSID, current := range c.replays {
+		if current == r {
+			delete(c.replays, netNSID)
+		}
+	}
+	c.lock.Unlock()
+	c.notify()
+}
+
+// expire clears the settings of the network namespace of pid if they
+// still have the given deadline
+func (c *Controller) expire(pid int, deadline time.Time) {
+	err := c.do(pid, func(iface NetInterface, netNSID string) error {
+		if current, ok := c.Deadline(netNSID); !ok || !current.Equal(deadline) {
+			// the settings were replaced or cleared meanwhile
+			return nil
+		}
+		log.Infof("settings of network namespace %s expired", netNSID)
+		return c.clear(iface, netNSID)
+	})
+	if err != nil {
+		log.Errorf("failed to clear expired settings of process %d: %v", pid, err)
+	}
+}
+
+// PlanApply returns what applying impairment to the network namespace
+// of pid would do, without doing it
+func (c *Controller) PlanApply(pid int, impairment Impairment) (*Plan, error) {
+	return c.planApply(pid, false, impairment)
+}
+
+// PlanApplyNode is PlanApply for the host network namespace
+func (c *Controller) PlanApplyNode(impairment Impairment) (*Plan, error) {
+	return c.planApply(hostPID, true, impairment)
+}
+
+func (c *Controller) planApply(pid int, node bool, impairment Impairment) (*Plan, error) {
+	if err := impairment.Validate(); err != nil {
+		return nil, err
+	}
+	var plan *Plan
+	err := c.do(pid, func(iface NetInterface, netNSID string) error {
+		if err := checkImpairment(iface, node); err != nil {
+			return err
+		}
+		status := c.Status(netNSID)
+		impairment.change(&status)
+		var err error
+		plan, err = c.planUpdate(iface, netNSID, &status)
+		return err
+	})
+	return plan, err
+}
+
+// PlanClear returns what clearing the settings of the network namespace
+// of pid would do, without doing it
+func (c *Controller) PlanClear(pid int) (*Plan, error) {
+	var plan *Plan
+	err := c.do(pid, func(iface NetInterface, netNSID string) error {
+		var err error
+		plan, err = c.planClear(iface, netNSID)
+		return err
+	})
+	return plan, err
+}
+
+func (c *Controller) planUpdate(iface NetInterface, netNSID string, status *TrafficControlStatus) (*Plan, error) {
+	if !c.snapshots.Has(netNSID) {
+		// the snapshot would be taken first, make sure it can
+		snapshot, err := takeSnapshot(iface.NetNS, netNSID, iface.Device, c.backend.Ingress())
+		if err != nil {
+			return nil, err
+		}
+		snapshot.unpinPrograms()
+	}
+	ops, err := c.backend.Apply(iface, status)
+	if err != nil {
+		return nil, err
+	}
+	return newPlan(iface.NetNS, netNSID, iface.Device, ops)
+}
+
+// planClear plans the removal of the settings and the restoration of
+// the original configuration, nothing if the plugin never touched the
+// interface
+func (c *Controller) planClear(iface NetInterface, netNSID string) (*Plan, error) {
+	ops := []Operation{}
+	if snapshot, ok := c.snapshots.Get(netNSID); ok {
+		// the settings are removed from the interface they were
+		// applied to
+		iface.Device = snapshot.Device
+		var err error
+		if ops, err = c.backend.Clear(iface); err != nil {
+			return nil, err
+		}
+		for _, cmd := range snapshot.restoreCommands(snapshot.Device) {
+			ops = append(ops, commandOperation("restore the original configuration", cmd...))
+		}
+	}
+	return newPlan(iface.NetNS, netNSID, iface.Device, ops)
+}
+
+func (c *Controller) clear(iface NetInterface, netNSID string) error {
+	c.stopRamp(netNSID)
+	c.stopReplay(netNSID)
+	if currentConfig().DryRun {
+		plan, err := c.planClear(iface, netNSID)
+		if err != nil {
+			return err
+		}
+		plan.Log("clear")
+		return nil
+	}
+	if snapshot, ok := c.snapshots.Get(netNSID); ok {
+		iface.Device = snapshot.Device
+		ops, err := c.backend.Clear(iface)
+		if err != nil {
+			return err
+		}
+		// the settings may have been removed by someone else, the
+		// operations are optional and restoring tells whether the
+		// interface is in a sane state
+		if err := execute(iface.NetNS, ops); err != nil {
+			return err
+		}
+		if _, err := c.snapshots.Restore(iface.NetNS, netNSID); err != nil {
+			return err
+		}
+	}
+	c.lock.Lock()
+	delete(c.status, netNSID)
+	delete(c.deadlines, netNSID)
+	c.lock.Unlock()
+	return nil
+}
+
+// update enforces the current status of the network namespace of pid
+// modified by change, until deadline unless it is zero. node must be set
+// to impair the host network namespace. In dry-run mode the plan is
+// logged instead.
+func (c *Controller) update(pid int, node bool, deadline time.Time, change func(status *TrafficControlStatus)) error {
+	return c.do(pid, func(iface NetInterface, netNSID string) error {
+		return c.enforce(pid, iface, netNSID, node, &deadline, change)
+	})
+}
+
+// enforce is update for the network namespace netNSID, a nil deadline
+// leaves the deadline of the settings unchanged
+func (c *Controller) enforce(pid int, iface NetInterface, netNSID string, node bool, deadline *time.Time, change func(status *TrafficControlStatus)) error {
+	if err := checkImpairment(iface, node); err != nil {
+		return err
+	}
+	status := c.Status(netNSID)
+	change(&status)
+	if currentConfig().DryRun {
+		plan, err := c.planUpdate(iface, netNSID, &status)
+		if err != nil {
+			return err
+		}
+		plan.Log("apply " + status.String() + " to")
+		return nil
+	}
+	// keep the original configuration before touching the interface
+	if err := c.snapshots.Ensure(iface.NetNS, netNSID, iface.Device, c.backend.Ingress()); err != nil {
+		return err
+	}
+	ops, err := c.backend.Apply(iface, &status)
+	if err != nil {
+		return err
+	}
+	if err := execute(iface.NetNS, ops); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	c.status[netNSID] = status
+	switch {
+	case deadline == nil:
+	case deadline.IsZero():
+		delete(c.deadlines, netNSID)
+	default:
+		expires := *deadline
+		c.deadlines[netNSID] = expires
+		time.AfterFunc(expires.Sub(time.Now()), func() {
+			c.expire(pid, expires)
+		})
+	}
+	c.lock.Unlock()
+	return nil
+}
+
+// do queues op on the interface of the network namespace of pid and
+// waits for its result
+func (c *Controller) do(pid int, op func(iface NetInterface, netNSID string) error) error {
+	netNS := fmt.Sprintf("/proc/%d/ns/net", pid)
+	netNSID, err := getNSID(netNS)
+	if err != nil {
+		return fmt.Errorf("failed to get network namespace ID: %v", err)
+	}
+	iface, err := netInterface(netNS, netNSID)
+	if err != nil {
+		return err
+	}
+	result := make(chan error, 1)
+	c.lock.Lock()
+	queue, running := c.queues[netNSID]
+	c.queues[netNSID] = append(queue, func() {
+		result <- op(iface, netNSID)
+	})
+	if !running {
+		go c.run(netNSID)
+	}
+	c.lock.Unlock()
+	return <-result
+}
+
+// run executes the operations queued for netNSID until there are none
+func (c *Controller) run(netNSID string) {
+	log.Debugf("start processing operations for network namespace %s", netNSID)
+	for {
+		c.lock.Lock()
+		queue := c.queues[netNSID]
+		if len(queue) == 0 {
+			delete(c.queues, netNSID)
+			c.lock.Unlock()
+			log.Debugf("stop processing operations for network namespace %s", netNSID)
+			return
+		}
+		op := queue[0]
+		c.queues[netNSID] = queue[1:]
+		c.lock.Unlock()
+		op()
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The coordinator serves the API of the plugin for a whole cluster: it
+// fans the requests out to the plugin instances and aggregates their
+// answers, so that the ctl command works the same against both. The
+// instances are given explicitly, discovered by globbing their sockets
+// or discovered among the pods of their DaemonSet through the
+// Kubernetes API server, they are looked up again for every request.
+// The node key of the selectors routes the requests to the instances
+// with that node name, the other keys are evaluated by the instances.
+
+const (
+	coordinatorUsage = `Usage: network-control coordinator [flags]
+
+Serves the network-control API for several plugin instances, e.g.
+  network-control coordinator -plugins https://node-1:8443,/var/run/nc-2.sock -token-file /etc/nc/token
+  network-control coordinator -pods weavescope-component=envi-network-plugin -pods-port 8443 -ca ca.crt -token-file /etc/nc/token
+  network-control ctl -socket /var/run/network-control/coordinator.sock apply 'node=node-*,pod=web-*' -delay 100ms
+
+Flags:
+`
+	defaultCoordinatorSocket = "/var/run/network-control/coordinator.sock"
+)
+
+// Coordinator aggregates the API of the plugin instances
+type Coordinator struct {
+	endpoints   []string
+	discover    string
+	pods        *podDiscovery
+	credentials *clientCredentials
+}
+
+// NewCoordinator instantiates a new Coordinator, endpoints are the
+// plugin API endpoints, discover a glob pattern matching the sockets of
+// other instances and pods, if not nil, finds the instances running in
+// Kubernetes. credentials authenticate the coordinator to the https://
+// endpoints.
+func NewCoordinator(endpoints []string, discover string, pods *podDiscovery, credentials *clientCredentials) *Coordinator {
+	return &Coordinator{
+		endpoints:   endpoints,
+		discover:    discover,
+		pods:        pods,
+		credentials: credentials,
+	}
+}
+
+// podDiscovery finds the plugin instances among the running pods
+// matching a label selector, they are reached on the TCP listener of
+// the plugin at the address of their pod
+type podDiscovery struct {
+	api      *k8sAPI
+	selector string
+	port     int
+}
+
+// endpoints returns the https:// URLs of the plugin instances
+func (d *podDiscovery) endpoints() ([]string, error) {
+	resp, err := d.api.get("/api/v1/pods", url.Values{"labelSelector": {d.selector}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the pods of the plugin: %v", err)
+	}
+	defer resp.Body.Close()
+	list := k8sPodList{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("invalid pod list: %v", err)
+	}
+	endpoints := []string{}
+	for _, pod := range list.Items {
+		// the pods being scheduled have no address yet
+		if pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+			continue
+		}
+		endpoints = append(endpoints, "https://"+net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(d.port)))
+	}
+	return endpoints, nil
+}
+
+// pluginInstance is a plugin known by the coordinator
+type pluginInstance struct {
+	endpoint string
+	client   *apiClient
+	status   *APIStatus
+	err      error
+}
+
+// node returns the name of the instance, its endpoint if it is
+// unreachable
+func (i *pluginInstance) node() string {
+	if i.status == nil {
+		return i.endpoint
+	}
+	return i.status.Node
+}
+
+// instances returns the plugin instances and their status
+func (c *Coordinator) instances() []*pluginInstance {
+	endpoints := append([]string{}, c.endpoints...)
+	if c.discover != "" {
+		sockets, err := filepath.Glob(c.discover)
+		if err != nil {
+			log.Errorf("failed to discover plugins with %q: %v", c.discover, err)
+		}
+		endpoints = append(endpoints, sockets...)
+	}
+	instances := []*pluginInstance{}
+	if c.pods != nil {
+		found, err := c.pods.endpoints()
+		if err != nil {
+			// reported like an unreachable instance
+			instances = append(instances, &pluginInstance{endpoint: c.pods.api.url, err: err})
+		}
+		endpoints = append(endpoints, found...)
+	}
+	sort.Strings(endpoints)
+
+	for i, endpoint := range endpoints {
+		if i > 0 && endpoint == endpoints[i-1] {
+			continue
+		}
+		instances = append(instances, &pluginInstance{endpoint: endpoint})
+	}
+	fanOut(instances, func(i *pluginInstance) {
+		if i.err != nil {
+			return
+		}
+		if i.client, i.err = newAPIClient(i.endpoint, c.credentials); i.err != nil {
+			return
+		}
+		status := &APIStatus{}
+		if i.err = i.client.get("status", nil, status); i.err == nil {
+			i.status = status
+		}
+	})
+	return instances
+}
+
+// fanOut calls f on every instance concurrently
+func fanOut(instances []*pluginInstance, f func(i *pluginInstance)) {
+	var wg sync.WaitGroup
+	for _, i := range instances {
+		wg.Add(1)
+		go func(i *pluginInstance) {
+			defer wg.Done()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// route returns the reachable instances whose node name matches the
+// node key of target and an error result for the unreachable ones
+func route(instances []*pluginInstance, target string) ([]*pluginInstance, []APIResult, error) {
+	// the instances match the same way
+	if _, err := targetMatcher(target); err != nil {
+		return nil, nil, badRequest("%v", err)
+	}
+	pattern := nodePattern(target)
+	selected := []*pluginInstance{}
+	failed := []APIResult{}
+	for _, i := range instances {
+		if i.err != nil {
+			failed = append(failed, APIResult{Container: APIContainer{Node: i.node()}, Error: i.err.Error()})
+			continue
+		}
+		if ok, _ := path.Match(pattern, i.node()); ok {
+			selected = append(selected, i)
+		}
+	}
+	return selected, failed, nil
+}
+
+// nodePattern returns the pattern of the node key of a valid target, *
+// if it has none
+func nodePattern(target string) string {
+	if !strings.Contains(target, "=") {
+		return "*"
+	}
+	for _, term := range strings.Split(target, ",") {
+		kv := strings.SplitN(term, "=", 2)
+		if strings.TrimSpace(kv[0]) == "node" {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return "*"
+}
+
+// Register adds the API endpoints to mux
+func (c *Coordinator) Register(mux *http.ServeMux) {
+	mux.HandleFunc(apiPrefix+"status", apiGet(c.status))
+	mux.HandleFunc(apiPrefix+"containers", apiGet(c.containers))
+	for _, endpoint := range []string{"apply", "clear", "plan", "probes/start", "probes/stop", "reset"} {
+		mux.HandleFunc(apiPrefix+endpoint, c.forward(endpoint))
+	}
+}
+
+func (c *Coordinator) status(r *http.Request) (interface{}, error) {
+	status := APIStatus{
+		Controls: true,
+		Nodes:    []APINodeStatus{},
+	}
+	backends := map[string]bool{}
+	preflight := []string{}
+	for _, i := range c.instances() {
+		node := APINodeStatus{Endpoint: i.endpoint, Status: i.status}
+		if i.err != nil {
+			node.Error = i.err.Error()
+			status.Nodes = append(status.Nodes, node)
+			continue
+		}
+		status.Nodes = append(status.Nodes, node)
+		backends[i.status.Backend] = true
+		if i.status.Preflight != "ok" {
+			preflight = append(preflight, fmt.Sprintf("%s: %s", i.status.Node, i.status.Preflight))
+		}
+		status.Controls = status.Controls && i.status.Controls
+		status.Containers += i.status.Containers
+		status.Impaired += i.status.Impaired
+	}
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	status.Backend = strings.Join(names, ", ")
+	status.Preflight = "ok"
+	if len(preflight) > 0 {
+		status.Preflight = strings.Join(preflight, "; ")
+	}
+	return status, nil
+}
+
+func (c *Coordinator) containers(r *http.Request) (interface{}, error) {
+	target := r.URL.Query().Get("target")
+	selected, failed, err := route(c.instances(), target)
+	if err != nil {
+		return nil, err
+	}
+	all := []APIContainer{}
+	for _, f := range failed {
+		all = append(all, APIContainer{Node: f.Container.Node, Error: f.Error})
+	}
+	containers := c.find(selected, target)
+	for _, i := range selected {
+		if i.err != nil {
+			all = append(all, APIContainer{Node: i.node(), Error: i.err.Error()})
+			continue
+		}
+		all = append(all, containers[i]...)
+	}
+	return all, nil
+}
+
+// find returns the containers matching target of every instance, the
+// error of the instances failing is kept in their err
+func (c *Coordinator) find(instances []*pluginInstance, target string) map[*pluginInstance][]APIContainer {
+	var lock sync.Mutex
+	containers := map[*pluginInstance][]APIContainer{}
+	fanOut(instances, func(i *pluginInstance) {
+		found, err := i.client.containers(target)
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			i.err = err
+			return
+		}
+		containers[i] = found
+	})
+	return containers
+}
+
+// forward sends the apply, clear, plan, probes or reset request to the
+// instances having running containers matching its target
+func (c *Coordinator) forward(endpoint string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		results, err := c.fanOutRequest(endpoint, r)
+		sendAPIResponse(w, results, err)
+	}
+}
+
+func (c *Coordinator) fanOutRequest(endpoint string, r *http.Request) ([]APIResult, error) {
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	req := APIClearRequest{}
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return nil, badRequest("invalid request: %v", err)
+	}
+	if req.Target == "" {
+		return nil, badRequest("no target")
+	}
+	selected, results, err := route(c.instances(), req.Target)
+	if err != nil {
+		return nil, err
+	}
+	containers := c.find(selected, req.Target)
+	targeted := []*pluginInstance{}
+	for _, i := range selected {
+		if i.err != nil {
+			results = append(results, APIResult{Container: APIContainer{Node: i.node()}, Error: i.err.Error()})
+			continue
+		}
+		for _, container := range containers[i] {
+			if container.State == Running.String() {
+				targeted = append(targeted, i)
+				break
+			}
+		}
+	}
+
+	var lock sync.Mutex
+	fanOut(targeted, func(i *pluginInstance) {
+		nodeResults := []APIResult{}
+		err := i.client.post(endpoint, json.RawMessage(raw), &nodeResults)
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			nodeResults = []APIResult{{Container: APIContainer{Node: i.node()}, Error: err.Error()}}
+		}
+		results = append(results, nodeResults...)
+	})
+	if len(results) == 0 {
+		return nil, &apiError{code: http.StatusNotFound, err: fmt.Errorf("no running container matches %q", req.Target)}
+	}
+	sort.Sort(byNode(results))
+	return results, nil
+}
+
+type byNode []APIResult
+
+func (s byNode) Len() int      { return len(s) }
+func (s byNode) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byNode) Less(i, j int) bool {
+	if s[i].Container.Node != s[j].Container.Node {
+		return s[i].Container.Node < s[j].Container.Node
+	}
+	return s[i].Container.Name < s[j].Container.Name
+}
+
+// runCoordinator executes the coordinator command and returns the exit
+// code
+func runCoordinator(args []string) int {
+	fs := flag.NewFlagSet("coordinator", flag.ContinueOnError)
+	listen := fs.String("listen", defaultCoordinatorSocket, "unix socket path or loopback TCP address serving the API, it is not authenticated")
+	plugins := fs.String("plugins", "", "comma separated plugin API endpoints, socket paths or http:// URLs")
+	discover := fs.String("discover", "", "glob pattern matching plugin sockets, e.g. /var/run/nc/*/network-control.sock")
+	pods := fs.String("pods", "", "label selector of the plugin pods to discover through the Kubernetes API server, e.g. weavescope-component=envi-network-plugin")
+	podsPort := fs.Int("pods-port", 8443, "port of the TCP listener of the discovered plugin pods")
+	kubernetes := KubernetesConfig{}
+	fs.StringVar(&kubernetes.URL, "kubernetes-url", "", "URL of the Kubernetes API server, the in-cluster address by default")
+	fs.StringVar(&kubernetes.TokenFile, "kubernetes-token-file", "", "file containing the bearer token of the Kubernetes API server")
+	fs.StringVar(&kubernetes.CA, "kubernetes-ca", "", "CA verifying the certificate of the Kubernetes API server")
+	logLevel := fs.String("log-level", "info", "log level (debug, info, warning, error)")
+	credentials := &clientCredentials{}
+	credentials.register(fs)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, coordinatorUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid log level: %v\n", err)
+		return 2
+	}
+	log.SetLevel(level)
+
+	endpoints := []string{}
+	for _, endpoint := range strings.Split(*plugins, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint == "" {
+			continue
+		}
+		if _, err := newAPIClient(endpoint, credentials); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -plugins: %v\n", err)
+			return 2
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	if len(endpoints) == 0 && *discover == "" && *pods == "" {
+		fmt.Fprintln(os.Stderr, "no plugins, use -plugins, -discover or -pods")
+		return 2
+	}
+	if *discover != "" {
+		if _, err := filepath.Match(*discover, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -discover: %v\n", err)
+			return 2
+		}
+	}
+
+	var listener net.Listener
+	if filepath.IsAbs(*listen) {
+		os.Remove(*listen)
+		if err = os.MkdirAll(filepath.Dir(*listen), 0700); err == nil {
+			listener, err = net.Listen("unix", *listen)
+		}
+	} else if err = checkLoopback(*listen); err == nil {
+		listener, err = net.Listen("tcp", *listen)
+	}
+	if err != nil {
+		log.Errorf("Failed to listen on %s: %v", *listen, err)
+		return 1
+	}
+
+	var discovery *podDiscovery
+	if *pods != "" {
+		if *podsPort <= 0 || *podsPort > 65535 {
+			fmt.Fprintf(os.Stderr, "invalid -pods-port %d\n", *podsPort)
+			return 2
+		}
+		kubernetes.Watch = true
+		if err := kubernetes.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -kubernetes-url: %v\n", err)
+			return 2
+		}
+		api, err := newK8sAPI(kubernetes)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid Kubernetes settings: %v\n", err)
+			return 2
+		}
+		discovery = &podDiscovery{api: api, selector: *pods, port: *podsPort}
+	}
+
+	mux := http.NewServeMux()
+	NewCoordinator(endpoints, *discover, discovery, credentials).Register(mux)
+	if *discover != "" {
+		log.Infof("Discovering plugins with %s", *discover)
+	}
+	if discovery != nil {
+		log.Infof("Discovering the plugin pods %s on %s", discovery.selector, discovery.api.url)
+	}
+	log.Infof("Listening on %s", *listen)
+	if err := http.Serve(listener, mux); err != nil {
+		log.Errorf("failed to serve: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// checkLoopback makes sure the coordinator, which holds credentials of
+// the plugins but does not authenticate its own clients, is only
+// reachable locally
+func checkLoopback(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%s is not a loopback address, the coordinator does not authenticate its clients", address)
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePlugin serves the status, the containers and the apply endpoint
+// of a plugin instance and records the targets it is asked to impair
+type fakePlugin struct {
+	node       string
+	containers []APIContainer
+
+	lock    sync.Mutex
+	applied []string
+}
+
+func (p *fakePlugin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"status", apiGet(func(r *http.Request) (interface{}, error) {
+		return APIStatus{Node: p.node, Backend: "netem", Preflight: "ok", Controls: true, Containers: len(p.containers)}, nil
+	}))
+	mux.HandleFunc(apiPrefix+"containers", apiGet(func(r *http.Request) (interface{}, error) {
+		return p.match(r.URL.Query().Get("target")), nil
+	}))
+	mux.HandleFunc(apiPrefix+"apply", func(w http.ResponseWriter, r *http.Request) {
+		req := APIApplyRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendAPIResponse(w, nil, badRequest("invalid request: %v", err))
+			return
+		}
+		p.lock.Lock()
+		p.applied = append(p.applied, req.Target)
+		p.lock.Unlock()
+		results := []APIResult{}
+		for _, c := range p.match(req.Target) {
+			results = append(results, APIResult{Container: c})
+		}
+		sendAPIResponse(w, results, nil)
+	})
+	return mux
+}
+
+// match returns the containers whose pod matches the pod key of target,
+// the node key is the coordinator's business
+func (p *fakePlugin) match(target string) []APIContainer {
+	pattern := "*"
+	for _, term := range strings.Split(target, ",") {
+		if kv := strings.SplitN(term, "=", 2); len(kv) == 2 && kv[0] == "pod" {
+			pattern = kv[1]
+		}
+	}
+	found := []APIContainer{}
+	for _, c := range p.containers {
+		if ok, _ := path.Match(pattern, c.Pod); ok {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+func (p *fakePlugin) appliedTargets() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string{}, p.applied...)
+}
+
+func newFakePlugin(node string, pods ...string) *fakePlugin {
+	p := &fakePlugin{node: node}
+	for _, pod := range pods {
+		p.containers = append(p.containers, APIContainer{Node: node, Name: pod + "-app", Pod: pod, State: Running.String()})
+	}
+	return p
+}
+
+// startCoordinator starts node-1 over TCP, node-2 on a unix socket
+// found by discovery and a stale socket of an instance which is gone,
+// and returns a client of the coordinator
+func startCoordinator(t *testing.T, node1, node2 *fakePlugin) (*apiClient, string, func()) {
+	dir, err := ioutil.TempDir("", "coordinator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := httptest.NewServer(node1.handler())
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "node-2.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix := &httptest.Server{Listener: listener, Config: &http.Server{Handler: node2.handler()}}
+	unix.Start()
+
+	stale := filepath.Join(dir, "node-3.sock")
+	if err := ioutil.WriteFile(stale, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	NewCoordinator([]string{tcp.URL}, filepath.Join(dir, "*.sock"), nil, nil).Register(mux)
+	coordinator := httptest.NewServer(mux)
+	client, err := newAPIClient(coordinator.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, stale, func() {
+		coordinator.Close()
+		unix.Close()
+		tcp.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCoordinatorStatus(t *testing.T) {
+	client, stale, stop := startCoordinator(t, newFakePlugin("node-1", "web-1", "db-1"), newFakePlugin("node-2", "web-2"))
+	defer stop()
+
+	status := APIStatus{}
+	if err := client.get("status", nil, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Containers != 3 || status.Backend != "netem" || status.Preflight != "ok" {
+		t.Errorf("unexpected aggregated status %+v", status)
+	}
+	nodes := map[string]string{}
+	for _, node := range status.Nodes {
+		name := node.Endpoint
+		if node.Status != nil {
+			name = node.Status.Node
+		}
+		nodes[name] = node.Error
+	}
+	if len(nodes) != 3 || nodes["node-1"] != "" || nodes["node-2"] != "" || nodes[stale] == "" {
+		t.Errorf("expected node-1 and node-2 and an error for %s, got %v", stale, nodes)
+	}
+}
+
+func TestCoordinatorContainers(t *testing.T) {
+	client, stale, stop := startCoordinator(t, newFakePlugin("node-1", "web-1", "db-1"), newFakePlugin("node-2", "web-2"))
+	defer stop()
+
+	// the unreachable instances come first, then the instances in the
+	// order of their endpoints, the socket of node-2 before the URL of
+	// node-1
+	for _, test := range []struct {
+		target string
+		names  []string
+	}{
+		{"", []string{"node-3.sock: error", "web-2-app", "web-1-app", "db-1-app"}},
+		{"pod=web-*", []string{"node-3.sock: error", "web-2-app", "web-1-app"}},
+		{"node=node-2", []string{"node-3.sock: error", "web-2-app"}},
+		{"node=node-9", []string{"node-3.sock: error"}},
+	} {
+		containers, err := client.containers(test.target)
+		if err != nil {
+			t.Errorf("%q: %v", test.target, err)
+			continue
+		}
+		names := []string{}
+		for _, c := range containers {
+			if c.Error != "" {
+				names = append(names, strings.TrimPrefix(c.Node, filepath.Dir(stale)+"/")+": error")
+				continue
+			}
+			names = append(names, c.Name)
+		}
+		if !reflect.DeepEqual(names, test.names) {
+			t.Errorf("%q: expected %v, got %v", test.target, test.names, names)
+		}
+	}
+}
+
+func TestCoordinatorApply(t *testing.T) {
+	for _, test := range []struct {
+		target  string
+		results []string
+		node1   []string
+		node2   []string
+	}{
+		{
+			target:  "pod=web-*",
+			results: []string{"node-3.sock: error", "node-1/web-1-app", "node-2/web-2-app"},
+			node1:   []string{"pod=web-*"},
+			node2:   []string{"pod=web-*"},
+		},
+		{
+			// node-1 has no matching container, it is not asked
+			target:  "pod=web-2",
+			results: []string{"node-3.sock: error", "node-2/web-2-app"},
+			node1:   []string{},
+			node2:   []string{"pod=web-2"},
+		},
+		{
+			target:  "node=node-1,pod=*",
+			results: []string{"node-3.sock: error", "node-1/db-1-app", "node-1/web-1-app"},
+			node1:   []string{"node=node-1,pod=*"},
+			node2:   []string{},
+		},
+	} {
+		node1, node2 := newFakePlugin("node-1", "web-1", "db-1"), newFakePlugin("node-2", "web-2")
+		client, stale, stop := startCoordinator(t, node1, node2)
+
+		results := []APIResult{}
+		if err := client.post("apply", APIApplyRequest{Target: test.target, Impairment: Impairment{Delay: "100ms"}}, &results); err != nil {
+			t.Errorf("%q: %v", test.target, err)
+			stop()
+			continue
+		}
+		described := []string{}
+		for _, result := range results {
+			if result.Error != "" {
+				// the failed instance is named after its endpoint
+				described = append(described, strings.TrimPrefix(result.Container.Node, filepath.Dir(stale)+"/")+": error")
+				continue
+			}
+			described = append(described, result.Container.Node+"/"+result.Container.Name)
+		}
+		if !reflect.DeepEqual(described, test.results) {
+			t.Errorf("%q: expected results %v, got %v", test.target, test.results, described)
+		}
+		if applied := node1.appliedTargets(); !reflect.DeepEqual(applied, test.node1) {
+			t.Errorf("%q: expected node-1 to apply %v, got %v", test.target, test.node1, applied)
+		}
+		if applied := node2.appliedTargets(); !reflect.DeepEqual(applied, test.node2) {
+			t.Errorf("%q: expected node-2 to apply %v, got %v", test.target, test.node2, applied)
+		}
+		stop()
+	}
+}
+
+func TestCoordinatorPods(t *testing.T) {
+	plugin := httptest.NewTLSServer(newFakePlugin("node-4", "web-4").handler())
+	defer plugin.Close()
+	_, port, err := net.SplitHostPort(plugin.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ca.Name())
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: plugin.Certificate().Raw})
+	ca.Close()
+
+	selector := "weavescope-component=envi-network-plugin"
+	pods := k8sPodList{Items: []k8sPod{
+		{Metadata: k8sObjectMeta{Name: "plugin-4"}, Status: k8sPodStatus{Phase: "Running", PodIP: "127.0.0.1"}},
+		{Metadata: k8sObjectMeta{Name: "plugin-5"}, Status: k8sPodStatus{Phase: "Pending"}},
+		// nothing listens there
+		{Metadata: k8sObjectMeta{Name: "plugin-6"}, Status: k8sPodStatus{Phase: "Running", PodIP: "127.0.0.2"}},
+	}}
+	for _, test := range []struct {
+		name   string
+		status int
+		// nodes tells whether the instances, named after their
+		// endpoint when they are unreachable, answered
+		nodes map[string]bool
+	}{
+		{name: "listed", status: http.StatusOK, nodes: map[string]bool{"node-4": true, "https://127.0.0.2:" + port: false}},
+		// the failure of the discovery is reported like an
+		// unreachable instance
+		{name: "forbidden", status: http.StatusForbidden},
+	} {
+		apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/api/v1/pods" || r.URL.Query().Get("labelSelector") != selector {
+				t.Errorf("%s: unexpected request %s", test.name, r.URL)
+			}
+			if test.status != http.StatusOK {
+				w.WriteHeader(test.status)
+				json.NewEncoder(w).Encode(k8sStatus{Message: "pods is forbidden", Code: test.status})
+				return
+			}
+			json.NewEncoder(w).Encode(pods)
+		}))
+		if test.nodes == nil {
+			test.nodes = map[string]bool{apiServer.URL: false}
+		}
+		api, err := newK8sAPI(KubernetesConfig{URL: apiServer.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		podsPort, _ := strconv.Atoi(port)
+		mux := http.NewServeMux()
+		NewCoordinator(nil, "", &podDiscovery{api: api, selector: selector, port: podsPort}, &clientCredentials{ca: ca.Name()}).Register(mux)
+		coordinator := httptest.NewServer(mux)
+		client, err := newAPIClient(coordinator.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		status := APIStatus{}
+		if err := client.get("status", nil, &status); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		nodes := map[string]bool{}
+		for _, node := range status.Nodes {
+			if node.Status != nil {
+				nodes[node.Status.Node] = true
+			} else {
+				nodes[node.Endpoint] = node.Error == ""
+			}
+		}
+		if !reflect.DeepEqual(nodes, test.nodes) {
+			t.Errorf("%s: expected the instances %v, got %v", test.name, test.nodes, nodes)
+		}
+		coordinator.Close()
+		apiServer.Close()
+	}
+}
@@ -0,0 +1,1207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The ctl command is a client of the API served by the plugin on its
+// socket:
+//
+//	network-control ctl [flags] ls [target]
+//	network-control ctl [flags] apply <target> [-delay 100ms] [-loss 1%] [-rate 1mbit] [-for 5m] [-dry-run]
+//	network-control ctl [flags] apply <target> [-ramp-delay 10ms:2000ms] [-ramp-loss 0%:20%] [-ramp-rate 10mbit:500kbit] -ramp-duration 10m [-ramp-step 5s] [-ramp-curve linear] [-for 15m]
+//	network-control ctl [flags] apply <target> [-dns-delay 500ms] [-dns-drop 10%] [-dns-servfail names] [-dns-nxdomain names] [-dns-truncate]
+//	network-control ctl [flags] apply <target> [-http-status 503] [-http-delay 2s] [-http-abort] [-http-rate 100kbit] [-http-percentage 20%] [-http-host host] [-http-path /path] [-http-ports 80,8080]
+//	network-control ctl [flags] apply <target> -trace <file|profile> [-trace-loop] [-trace-speed 2] [-for 1h]
+//	network-control ctl [flags] apply <target> [-link-down 30s] [-link-flap 10s] [-link-flap-duty 50%] [-mtu 1280] [-block-frag-needed] [-for 5m]
+//	network-control ctl [flags] clear <target> [-dry-run]
+//	network-control ctl [flags] status
+//	network-control ctl [flags] watch [target] [-interval 2s]
+//	network-control ctl [flags] node [apply|clear] [-delay 100ms] [-loss 1%] [-rate 1mbit] [-for 5m] [-dry-run]
+//	network-control ctl [flags] capture [start <target>|get <id>|stop <id>|rm <id>] [-i eth0] [-filter expr] [-duration 30s] [-packets n] [-snaplen n] [-w file]
+//	network-control ctl [flags] probe [start <target>|stop <target>] [-peers addresses] [-interval 1s]
+//	network-control ctl [flags] throughput [<source> <destination>] [-udp] [-duration 10s] [-rate 10mbit]
+//	network-control ctl [flags] interfaces [target]
+//	network-control ctl [flags] reset <target> [-peer address] [-port n]
+//	network-control ctl [flags] profiles [name]
+
+const ctlUsage = `Usage: network-control ctl [flags] <command> [arguments]
+
+Commands:
+  ls [target]       list the containers and their settings
+  apply <target>    apply an impairment, see -delay, -loss, -rate and -for,
+                    ramp it over time, see the -ramp-* flags, replay a
+                    trace, see the -trace-* flags, or inject DNS, HTTP and
+                    link faults, see the -dns-*, -http-* and -link-* flags,
+                    -mtu and -block-frag-needed
+  clear <target>    clear the settings and the faults and restore the
+                    original qdiscs
+  status            show the status of the plugin
+  watch [target]    list the containers whenever their settings change
+  node              show the impairment of the node itself
+  node apply        impair the node, the management traffic is excluded
+  node clear        clear the settings of the node
+  capture           list the packet captures
+  capture start <target>
+                    capture the packets of a target, see -i, -filter,
+                    -duration, -packets and -snaplen, with -w the pcap file
+                    is downloaded while the capture runs
+  capture get <id>  download the pcap file of a capture to -w
+  capture stop <id> stop a capture
+  capture rm <id>   stop a capture and remove its file
+  probe             list the probes and their round trip times and loss
+  probe start <target>
+                    probe the peers of a target, see -peers and -interval,
+                    ls shows the results next to the settings
+  probe stop <target>
+                    stop probing the peers of a target
+  throughput        list the throughput tests
+  throughput <source> <destination>
+                    test the throughput from a target to another one of the
+                    same node and wait for the result, see -udp, -duration
+                    and -rate
+  interfaces [target]
+                    list the interfaces, routes and neighbours of the
+                    containers
+  reset <target>    reset the TCP connections of a target, see -peer and
+                    -port
+  profiles [name]   list the built-in traces, or print one in CSV
+
+With -dry-run, apply and clear show the current qdiscs, the intended ones
+and the operations without making any change.
+
+A target is a container ID or ID prefix, a container name, a pod name or
+a selector of comma separated key=value pairs where the keys are id, name,
+pod, state or node and the values may be glob patterns, e.g. pod=web-*.
+The node is the name of the plugin instance, through a coordinator it
+selects the instances the request is sent to.
+
+Flags:
+`
+
+// ctlOptions are the flags accepted before and after the command
+type ctlOptions struct {
+	config      string
+	socket      string
+	output      string
+	credentials clientCredentials
+}
+
+func (o *ctlOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.config, "config", defaultConfigPath, "path of the configuration file of the plugin, used to find its socket")
+	fs.StringVar(&o.socket, "socket", o.socket, "path of the plugin socket or https:// URL of its API, overrides the configuration")
+	fs.StringVar(&o.output, "o", o.output, "output format (table, json)")
+	o.credentials.register(fs)
+}
+
+// runCtl executes the ctl command and returns the exit code
+func runCtl(args []string) int {
+	options := &ctlOptions{output: "table"}
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	options.register(fs)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, ctlUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	command := fs.Arg(0)
+	cmdFlags := flag.NewFlagSet(command, flag.ContinueOnError)
+	options.register(cmdFlags)
+	var run func(c *apiClient, args []string) error
+	switch command {
+	case "ls":
+		run = func(c *apiClient, args []string) error {
+			containers, err := c.containers(optionalArg(args))
+			if err != nil {
+				return err
+			}
+			if err := options.print(containers, containerTable(containers)); err != nil {
+				return err
+			}
+			return unreachableNodes(containers)
+		}
+	case "apply":
+		req := APIApplyRequest{}
+		cmdFlags.StringVar(&req.Delay, "delay", "", "delay, e.g. 100ms")
+		cmdFlags.StringVar(&req.Loss, "loss", "", "packet loss, e.g. 1%")
+		cmdFlags.StringVar(&req.Rate, "rate", "", "bandwidth limit, e.g. 1mbit")
+		cmdFlags.StringVar(&req.For, "for", "", "clear the settings after this duration, e.g. 5m")
+		ramp := Ramp{}
+		rampDelay := cmdFlags.String("ramp-delay", "", "ramp the delay from a value to another, e.g. 10ms:2000ms")
+		rampLoss := cmdFlags.String("ramp-loss", "", "ramp the packet loss from a value to another, e.g. 0%:20%")
+		rampRate := cmdFlags.String("ramp-rate", "", "ramp the bandwidth limit from a value to another, e.g. 10mbit:500kbit")
+		cmdFlags.StringVar(&ramp.Duration, "ramp-duration", "", "how long the ramp takes, e.g. 10m")
+		cmdFlags.StringVar(&ramp.Step, "ramp-step", "", "interval between two changes of the ramp, 5s by default")
+		cmdFlags.StringVar(&ramp.Curve, "ramp-curve", "", "curve of the ramp: linear, exponential or sine, linear by default")
+		traceFile := cmdFlags.String("trace", "", "replay a CSV or JSON trace file or a built-in profile, see profiles")
+		traceLoop := cmdFlags.Bool("trace-loop", false, "restart the trace once over")
+		traceSpeed := cmdFlags.Float64("trace-speed", 1, "speed the trace up, e.g. 10")
+		dns := DNSImpairment{}
+		cmdFlags.StringVar(&dns.Delay, "dns-delay", "", "delay of the DNS queries, e.g. 500ms")
+		cmdFlags.StringVar(&dns.Drop, "dns-drop", "", "DNS queries left unanswered, e.g. 10%")
+		servFail := cmdFlags.String("dns-servfail", "", "comma separated names answered with SERVFAIL, e.g. '*.example.com'")
+		nxDomain := cmdFlags.String("dns-nxdomain", "", "comma separated names answered with NXDOMAIN")
+		cmdFlags.BoolVar(&dns.Truncate, "dns-truncate", false, "truncate the DNS answers over UDP")
+		fault := HTTPFault{}
+		cmdFlags.IntVar(&fault.Status, "http-status", 0, "status code answered to the HTTP requests, e.g. 503")
+		cmdFlags.StringVar(&fault.Delay, "http-delay", "", "delay of the HTTP requests, e.g. 2s")
+		cmdFlags.BoolVar(&fault.Abort, "http-abort", false, "close the connection of the HTTP requests")
+		cmdFlags.StringVar(&fault.Rate, "http-rate", "", "throttle the HTTP responses, e.g. 100kbit")
+		cmdFlags.StringVar(&fault.Percentage, "http-percentage", "", "HTTP requests impaired, e.g. 20%, all of them by default")
+		cmdFlags.StringVar(&fault.Host, "http-host", "", "impair the HTTP requests to this host only, e.g. '*.example.com'")
+		cmdFlags.StringVar(&fault.Path, "http-path", "", "impair the HTTP requests under this path only")
+		httpPorts := cmdFlags.String("http-ports", "", "comma separated destination ports of the HTTP traffic, 80 by default")
+		link := LinkImpairment{}
+		cmdFlags.StringVar(&link.Down, "link-down", "", "set the interface down for this duration, e.g. 30s")
+		cmdFlags.StringVar(&link.FlapPeriod, "link-flap", "", "set the interface down and up every period, e.g. 10s")
+		cmdFlags.StringVar(&link.FlapDuty, "link-flap-duty", "", "part of the flap period the interface is down, 50% by default")
+		cmdFlags.IntVar(&link.MTU, "mtu", 0, "lower the MTU of the interface, e.g. 1280")
+		cmdFlags.BoolVar(&link.BlockFragNeeded, "block-frag-needed", false, "drop the ICMP fragmentation-needed messages")
+		dryRun := cmdFlags.Bool("dry-run", false, "show the plan without applying it")
+		run = func(c *apiClient, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("apply takes one target")
+			}
+			req.Target = args[0]
+			ranges := []struct {
+				value string
+				set   **RampRange
+			}{{*rampDelay, &ramp.Delay}, {*rampLoss, &ramp.Loss}, {*rampRate, &ramp.Rate}}
+			for _, r := range ranges {
+				if r.value == "" {
+					continue
+				}
+				rampRange, err := parseRampRange(r.value)
+				if err != nil {
+					return err
+				}
+				*r.set = rampRange
+			}
+			if ramp != (Ramp{}) {
+				if *dryRun {
+					return fmt.Errorf("ramps cannot be planned")
+				}
+				req.Ramp = &ramp
+			}
+			if *traceFile != "" {
+				if *dryRun {
+					return fmt.Errorf("trace replays cannot be planned")
+				}
+				replay, err := readTraceFile(*traceFile)
+				if err != nil {
+					return err
+				}
+				replay.Loop = *traceLoop
+				replay.Speed = *traceSpeed
+				if err := replay.Validate(); err != nil {
+					return err
+				}
+				req.Replay = replay
+			}
+			dns.ServFail = splitNames(*servFail)
+			dns.NXDomain = splitNames(*nxDomain)
+			if dns.Delay != "" || dns.Drop != "" || len(dns.ServFail) > 0 || len(dns.NXDomain) > 0 || dns.Truncate {
+				if *dryRun {
+					return fmt.Errorf("DNS faults cannot be planned")
+				}
+				req.DNS = &dns
+			}
+			if fault != (HTTPFault{}) || *httpPorts != "" {
+				if *dryRun {
+					return fmt.Errorf("HTTP faults cannot be planned")
+				}
+				impairment := HTTPImpairment{Faults: []HTTPFault{fault}}
+				for _, port := range splitNames(*httpPorts) {
+					p, err := strconv.Atoi(port)
+					if err != nil {
+						return fmt.Errorf("invalid port %q", port)
+					}
+					impairment.Ports = append(impairment.Ports, p)
+				}
+				req.HTTP = &impairment
+			}
+			if link != (LinkImpairment{}) {
+				if *dryRun {
+					return fmt.Errorf("link faults cannot be planned")
+				}
+				req.Link = &link
+			}
+			if *dryRun {
+				return options.plan(c, APIPlanRequest{Target: req.Target, Impairment: req.Impairment})
+			}
+			results := []APIResult{}
+			if err := c.post("apply", req, &results); err != nil {
+				return err
+			}
+			return options.printResults(results)
+		}
+	case "clear":
+		dryRun := cmdFlags.Bool("dry-run", false, "show the plan without clearing")
+		run = func(c *apiClient, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("clear takes one target")
+			}
+			if *dryRun {
+				return options.plan(c, APIPlanRequest{Target: args[0], Clear: true})
+			}
+			results := []APIResult{}
+			if err := c.post("clear", APIClearRequest{Target: args[0]}, &results); err != nil {
+				return err
+			}
+			return options.printResults(results)
+		}
+	case "status":
+		run = func(c *apiClient, args []string) error {
+			status := APIStatus{}
+			if err := c.get("status", nil, &status); err != nil {
+				return err
+			}
+			return options.print(status, func(w io.Writer) {
+				if status.Node != "" {
+					fmt.Fprintf(w, "Node:\t%s\n", status.Node)
+				}
+				fmt.Fprintf(w, "Backend:\t%s\n", status.Backend)
+				fmt.Fprintf(w, "Preflight:\t%s\n", status.Preflight)
+				fmt.Fprintf(w, "Controls:\t%t\n", status.Controls)
+				fmt.Fprintf(w, "Containers:\t%d\n", status.Containers)
+				fmt.Fprintf(w, "Impaired:\t%d\n", status.Impaired)
+				if status.Nodes == nil {
+					return
+				}
+				fmt.Fprintln(w, "\nNODE\tENDPOINT\tBACKEND\tPREFLIGHT\tCONTAINERS\tIMPAIRED\tERROR")
+				for _, n := range status.Nodes {
+					if n.Error != "" {
+						fmt.Fprintf(w, "-\t%s\t-\t-\t-\t-\t%s\n", n.Endpoint, n.Error)
+						continue
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t-\n", n.Status.Node, n.Endpoint, n.Status.Backend, n.Status.Preflight, n.Status.Containers, n.Status.Impaired)
+				}
+			})
+		}
+	case "node":
+		req := APINodeApplyRequest{}
+		cmdFlags.StringVar(&req.Delay, "delay", "", "delay, e.g. 100ms")
+		cmdFlags.StringVar(&req.Loss, "loss", "", "packet loss, e.g. 1%")
+		cmdFlags.StringVar(&req.Rate, "rate", "", "bandwidth limit, e.g. 1mbit")
+		cmdFlags.StringVar(&req.For, "for", "", "clear the settings after this duration, e.g. 5m")
+		dryRun := cmdFlags.Bool("dry-run", false, "show the plan without making any change")
+		run = func(c *apiClient, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("node takes at most one command")
+			}
+			node := APINode{}
+			switch action := optionalArg(args); {
+			case action == "":
+				if err := c.get("node", nil, &node); err != nil {
+					return err
+				}
+			case (action == "apply" || action == "clear") && *dryRun:
+				plan := Plan{}
+				if err := c.post("node/plan", APINodePlanRequest{Impairment: req.Impairment, Clear: action == "clear"}, &plan); err != nil {
+					return err
+				}
+				return options.print(plan, func(w io.Writer) {
+					printPlan(w, &plan)
+				})
+			case action == "apply":
+				if err := c.post("node/apply", req, &node); err != nil {
+					return err
+				}
+			case action == "clear":
+				if err := c.post("node/clear", struct{}{}, &node); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unknown node command %q, expected apply or clear", action)
+			}
+			return options.print(node, nodeTable(node))
+		}
+	case "capture":
+		req := APICaptureRequest{}
+		cmdFlags.StringVar(&req.Interface, "i", "", "interface of the container, eth0 by default")
+		cmdFlags.StringVar(&req.Filter, "filter", "", "filter of the packets, e.g. 'tcp and port 80'")
+		cmdFlags.StringVar(&req.Duration, "duration", "", "duration of the capture, e.g. 30s")
+		cmdFlags.IntVar(&req.Packets, "packets", 0, "stop the capture after this number of packets")
+		cmdFlags.IntVar(&req.Snaplen, "snaplen", 0, "bytes kept of each packet")
+		file := cmdFlags.String("w", "", "write the pcap file there, - for the standard output")
+		run = func(c *apiClient, args []string) error {
+			action := optionalArg(args)
+			if action == "" {
+				captures := []Capture{}
+				if err := c.get("captures", nil, &captures); err != nil {
+					return err
+				}
+				return options.print(captures, captureTable(captures))
+			}
+			if len(args) != 2 {
+				return fmt.Errorf("capture %s takes one argument", action)
+			}
+			capture := Capture{}
+			switch action {
+			case "start":
+				req.Target = args[1]
+				if err := c.post("captures/start", req, &capture); err != nil {
+					return err
+				}
+				if *file == "" {
+					break
+				}
+				if *file != "-" {
+					if err := options.print(capture, captureTable([]Capture{capture})); err != nil {
+						return err
+					}
+				}
+				return c.downloadCapture(capture.ID, *file)
+			case "get":
+				if *file == "" {
+					return fmt.Errorf("capture get requires -w")
+				}
+				return c.downloadCapture(args[1], *file)
+			case "stop":
+				if err := c.post("captures/stop", APICaptureID{ID: args[1]}, &capture); err != nil {
+					return err
+				}
+			case "rm":
+				if err := c.post("captures/remove", APICaptureID{ID: args[1]}, &capture); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unknown capture command %q, expected start, get, stop or rm", action)
+			}
+			return options.print(capture, captureTable([]Capture{capture}))
+		}
+	case "probe":
+		req := APIProbeRequest{}
+		peers := cmdFlags.String("peers", "", "comma separated peers, address for ICMP or address:port for TCP, the peers seen in conntrack by default")
+		cmdFlags.StringVar(&req.Interval, "interval", "", "time between two probes of a peer, e.g. 1s")
+		run = func(c *apiClient, args []string) error {
+			action := optionalArg(args)
+			if action == "" {
+				probes := []Probe{}
+				if err := c.get("probes", nil, &probes); err != nil {
+					return err
+				}
+				return options.print(probes, probeTable(probes))
+			}
+			if len(args) != 2 {
+				return fmt.Errorf("probe %s takes one target", action)
+			}
+			results := []APIResult{}
+			switch action {
+			case "start":
+				req.Target = args[1]
+				req.Peers = splitNames(*peers)
+				if err := c.post("probes/start", req, &results); err != nil {
+					return err
+				}
+			case "stop":
+				if err := c.post("probes/stop", APIClearRequest{Target: args[1]}, &results); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unknown probe command %q, expected start or stop", action)
+			}
+			return options.printResults(results)
+		}
+	case "throughput":
+		req := APIThroughputRequest{}
+		udp := cmdFlags.Bool("udp", false, "send UDP datagrams at -rate instead of TCP")
+		cmdFlags.StringVar(&req.Duration, "duration", "", "duration of the test, e.g. 10s")
+		cmdFlags.StringVar(&req.Rate, "rate", "", "sending rate of a UDP test, e.g. 10mbit")
+		run = func(c *apiClient, args []string) error {
+			tests := []ThroughputTest{}
+			switch len(args) {
+			case 0:
+				if err := c.get("throughput", nil, &tests); err != nil {
+					return err
+				}
+				return options.print(tests, throughputTable(tests))
+			case 2:
+			default:
+				return fmt.Errorf("throughput takes a source and a destination")
+			}
+			req.Source, req.Destination = args[0], args[1]
+			if *udp {
+				req.Protocol = throughputUDP
+			}
+			test := ThroughputTest{}
+			if err := c.post("throughput/start", req, &test); err != nil {
+				return err
+			}
+			for test.State == throughputRunning {
+				time.Sleep(throughputPollInterval)
+				if err := c.get("throughput", nil, &tests); err != nil {
+					return err
+				}
+				found := false
+				for _, t := range tests {
+					if t.ID == test.ID {
+						test, found = t, true
+					}
+				}
+				if !found {
+					return fmt.Errorf("throughput test %s is gone", test.ID)
+				}
+			}
+			return options.print(test, throughputTable([]ThroughputTest{test}))
+		}
+	case "reset":
+		req := APIResetRequest{}
+		cmdFlags.StringVar(&req.Peer, "peer", "", "reset the connections to this address or CIDR only, e.g. 10.0.0.0/8")
+		cmdFlags.IntVar(&req.Port, "port", 0, "reset the connections with this local or remote port only")
+		run = func(c *apiClient, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("reset takes one target")
+			}
+			req.Target = args[0]
+			results := []APIResult{}
+			if err := c.post("reset", req, &results); err != nil {
+				return err
+			}
+			if err := options.print(results, resetTable(results)); err != nil {
+				return err
+			}
+			return failedResults(results)
+		}
+	case "interfaces":
+		run = func(c *apiClient, args []string) error {
+			inventories := []APIInterfaces{}
+			query := url.Values{}
+			if target := optionalArg(args); target != "" {
+				query.Set("target", target)
+			}
+			if err := c.get("interfaces", query, &inventories); err != nil {
+				return err
+			}
+			return options.print(inventories, interfacesTable(inventories))
+		}
+	case "profiles":
+		run = func(c *apiClient, args []string) error {
+			name := optionalArg(args)
+			if name == "" {
+				return options.print(traceProfiles, profilesTable)
+			}
+			samples, ok := traceProfiles[name]
+			if !ok {
+				return fmt.Errorf("unknown profile %q, expected one of %s", name, strings.Join(profileNames(), ", "))
+			}
+			if options.output == "json" {
+				return options.print(samples, nil)
+			}
+			return writeCSVTrace(os.Stdout, samples)
+		}
+	case "watch":
+		interval := cmdFlags.Duration("interval", 2*time.Second, "polling interval")
+		run = func(c *apiClient, args []string) error {
+			if *interval <= 0 {
+				return fmt.Errorf("invalid -interval %s, it must be positive", *interval)
+			}
+			return options.watch(c, optionalArg(args), *interval)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", command)
+		fs.Usage()
+		return 2
+	}
+
+	args, err := parseInterspersed(cmdFlags, fs.Args()[1:])
+	if err != nil {
+		return 2
+	}
+	if options.output != "table" && options.output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", options.output)
+		return 2
+	}
+	client, err := options.client()
+	if err == nil {
+		err = run(client, args)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// parseInterspersed parses flags placed anywhere among the arguments
+// and returns the positional arguments
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// splitNames splits a comma separated list of names
+func splitNames(value string) []string {
+	names := []string{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return names
+}
+
+func optionalArg(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return ""
+}
+
+// client connects to the socket given by -socket or by the
+// configuration of the plugin
+func (o *ctlOptions) client() (*apiClient, error) {
+	socket := o.socket
+	if socket == "" {
+		configPathSet := o.config != defaultConfigPath
+		cfg, err := NewConfigLoader(o.config, configPathSet, nil).Load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the plugin socket: %v", err)
+		}
+		socket = cfg.Socket
+	}
+	return newAPIClient(socket, &o.credentials)
+}
+
+// print writes v as JSON or as a table
+func (o *ctlOptions) print(v interface{}, table func(w io.Writer)) error {
+	if o.output == "json" {
+		raw, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(raw))
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+// printResults prints the results of an operation, it fails if the
+// operation failed on any container
+func (o *ctlOptions) printResults(results []APIResult) error {
+	err := o.print(results, func(w io.Writer) {
+		fmt.Fprintln(w, "NODE\tCONTAINER\tNAME\tDELAY\tLOSS\tRATE\tPROGRESS\tEXPIRES\tDNS\tHTTP\tLINK\tRESULT")
+		for _, r := range results {
+			result := "ok"
+			if r.Error != "" {
+				result = r.Error
+			}
+			c := r.Container
+			name := orDash(c.Name)
+			if len(r.SharedWith) > 0 {
+				// the settings apply to the whole network namespace
+				name = fmt.Sprintf("%s (with %s)", name, strings.Join(r.SharedWith, ", "))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.Node, orDash(shortID(c.ID)), name, orDash(c.Delay), orDash(c.Loss), orDash(c.Rate), progress(c.Ramp, c.Replay), expiresIn(c.Expires), dnsFaults(c.DNS), httpFaults(c.HTTP), linkFaults(c.Link), result)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return failedResults(results)
+}
+
+// failedResults fails if the operation failed on any container
+func failedResults(results []APIResult) error {
+	failed := 0
+	for _, r := range results {
+		if r.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed on %d of %d containers", failed, len(results))
+	}
+	return nil
+}
+
+// unreachableNodes fails if the coordinator could not list the
+// containers of some plugin instances
+func unreachableNodes(containers []APIContainer) error {
+	nodes := []string{}
+	for _, c := range containers {
+		if c.Error != "" {
+			nodes = append(nodes, c.Node)
+		}
+	}
+	if len(nodes) > 0 {
+		return fmt.Errorf("failed to list the containers of %s", strings.Join(nodes, ", "))
+	}
+	return nil
+}
+
+// plan prints the plans of req
+func (o *ctlOptions) plan(c *apiClient, req APIPlanRequest) error {
+	results := []APIResult{}
+	if err := c.post("plan", req, &results); err != nil {
+		return err
+	}
+	if o.output == "json" {
+		return o.printResults(results)
+	}
+	failed := 0
+	for i, r := range results {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("Container %s (%s) on %s\n", orDash(shortID(r.Container.ID)), orDash(r.Container.Name), r.Container.Node)
+		if len(r.SharedWith) > 0 {
+			fmt.Printf("  Network namespace shared with %s\n", strings.Join(r.SharedWith, ", "))
+		}
+		if r.Error != "" {
+			fmt.Printf("  error: %s\n", r.Error)
+			failed++
+			continue
+		}
+		printPlan(os.Stdout, r.Plan)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed on %d of %d containers", failed, len(results))
+	}
+	return nil
+}
+
+// printPlan writes the trees and the operations of p, indented
+func printPlan(w io.Writer, p *Plan) {
+	fmt.Fprintf(w, "  Network namespace %s, %s\n", p.NetNS, p.Device)
+	printPlanLines(w, "Current", p.Current)
+	printPlanLines(w, "Intended", p.Intended)
+	fmt.Fprintln(w, "  Operations:")
+	if len(p.Operations) == 0 {
+		fmt.Fprintln(w, "    none")
+	}
+	for j, op := range p.Operations {
+		fmt.Fprintf(w, "    %d. %s\n", j+1, op)
+	}
+}
+
+func printPlanLines(w io.Writer, title string, lines []string) {
+	fmt.Fprintf(w, "  %s:\n", title)
+	for _, line := range lines {
+		fmt.Fprintf(w, "    %s\n", line)
+	}
+}
+
+func nodeTable(node APINode) func(w io.Writer) {
+	return func(w io.Writer) {
+		ports := []string{}
+		for _, port := range node.ExcludePorts {
+			ports = append(ports, strconv.Itoa(port))
+		}
+		fmt.Fprintf(w, "Node:\t%s\n", node.Node)
+		enabled := "disabled"
+		if node.Enabled {
+			enabled = "enabled"
+		}
+		fmt.Fprintf(w, "Node impairment:\t%s\n", enabled)
+		fmt.Fprintf(w, "Device:\t%s\n", node.Device)
+		fmt.Fprintf(w, "Excluded ports:\t%s\n", orDash(strings.Join(ports, ", ")))
+		fmt.Fprintf(w, "Network namespace:\t%s\n", orDash(node.NetNS))
+		fmt.Fprintf(w, "Delay:\t%s\n", orDash(node.Delay))
+		fmt.Fprintf(w, "Loss:\t%s\n", orDash(node.Loss))
+		fmt.Fprintf(w, "Rate:\t%s\n", orDash(node.Rate))
+		fmt.Fprintf(w, "Expires:\t%s\n", expiresIn(node.Expires))
+	}
+}
+
+// watch prints the containers matching target whenever they change
+func (o *ctlOptions) watch(c *apiClient, target string, interval time.Duration) error {
+	last := ""
+	for {
+		containers, err := c.containers(target)
+		current := ""
+		if err != nil {
+			current = fmt.Sprintf("error: %v\n", err)
+		} else {
+			// the expiry times are absolute so that the count
+			// down does not count as a change
+			raw, err := json.Marshal(containers)
+			if err != nil {
+				return err
+			}
+			current = string(raw) + "\n"
+		}
+		if current != last {
+			last = current
+			switch {
+			case err != nil:
+				fmt.Fprint(os.Stderr, current)
+			case o.output == "json":
+				fmt.Print(current)
+			default:
+				fmt.Printf("--- %s\n", time.Now().Format(time.RFC3339))
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				containerTable(containers)(w)
+				w.Flush()
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func containerTable(containers []APIContainer) func(w io.Writer) {
+	return func(w io.Writer) {
+		fmt.Fprintln(w, "NODE\tCONTAINER\tNAME\tPOD\tSTATE\tDELAY\tLOSS\tRATE\tPROGRESS\tEXPIRES\tDNS\tHTTP\tLINK\tOBSERVED")
+		for _, c := range containers {
+			if c.Error != "" {
+				fmt.Fprintf(w, "%s\t-\t-\t-\terror: %s\t-\t-\t-\t-\t-\t-\t-\t-\t-\n", c.Node, c.Error)
+				continue
+			}
+			state := c.State
+			if c.Protected != "" {
+				state += ",protected"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.Node, shortID(c.ID), c.Name, orDash(c.Pod), state, orDash(c.Delay), orDash(c.Loss), orDash(c.Rate), progress(c.Ramp, c.Replay), expiresIn(c.Expires), dnsFaults(c.DNS), httpFaults(c.HTTP), linkFaults(c.Link), observed(c.Observed))
+		}
+	}
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func captureTable(captures []Capture) func(w io.Writer) {
+	return func(w io.Writer) {
+		fmt.Fprintln(w, "CAPTURE\tNODE\tCONTAINER\tINTERFACE\tFILTER\tSTARTED\tSTATE\tPACKETS\tSIZE\tREASON")
+		for _, c := range captures {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", c.ID, c.Node, c.Container, c.Interface, orDash(c.Filter), c.Started.Format(time.RFC3339), c.State, c.Captured, formatSize(c.Size), orDash(c.Reason))
+		}
+	}
+}
+
+func probeTable(probes []Probe) func(w io.Writer) {
+	return func(w io.Writer) {
+		fmt.Fprintln(w, "NODE\tCONTAINER\tPEER\tMETHOD\tSENT\tLOSS\tP50\tP90\tP99\tERROR")
+		for _, p := range probes {
+			// the results of all the peers first
+			peers := append([]PeerStats{{Peer: "all", Method: "-", ProbeStats: p.ProbeStats}}, p.Results...)
+			for _, s := range peers {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", p.Node, p.Container, s.Peer, s.Method, s.Sent, orDash(s.Loss), orDash(s.P50), orDash(s.P90), orDash(s.P99), orDash(s.Error))
+			}
+		}
+	}
+}
+
+func throughputTable(tests []ThroughputTest) func(w io.Writer) {
+	return func(w io.Writer) {
+		fmt.Fprintln(w, "TEST\tNODE\tSOURCE\tDESTINATION\tPROTOCOL\tSTARTED\tSTATE\tGOODPUT\tRETRANSMITS\tLOSS\tJITTER\tERROR")
+		for _, t := range tests {
+			retransmits := "-"
+			if t.Protocol == throughputTCP && t.State != throughputRunning {
+				retransmits = strconv.Itoa(t.Retransmits)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Node, t.Source, t.Destination, t.Protocol, t.Started.Format(time.RFC3339), t.State, orDash(t.Goodput), retransmits, orDash(t.Loss), orDash(t.Jitter), orDash(t.Error))
+		}
+	}
+}
+
+func interfacesTable(inventories []APIInterfaces) func(w io.Writer) {
+	return func(w io.Writer) {
+		fmt.Fprintln(w, "CONTAINERS\tINTERFACE\tSTATE\tMTU\tADDRESSES\tMAC\tDRIVER")
+		for _, i := range inventories {
+			containers := strings.Join(i.Containers, ",")
+			for _, iface := range i.Interfaces {
+				driver := orDash(iface.Driver)
+				if iface.Master != "" {
+					driver += ", master " + iface.Master
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", containers, iface.Name, iface.State, iface.MTU, orDash(strings.Join(iface.Addresses, ",")), orDash(iface.MAC), driver)
+			}
+			if i.Error != "" {
+				fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t%s\n", containers, i.Error)
+			}
+		}
+		fmt.Fprintln(w, "\nCONTAINERS\tDESTINATION\tGATEWAY\tDEVICE\tSOURCE\tMETRIC\tTABLE")
+		for _, i := range inventories {
+			for _, r := range i.Routes {
+				table := "main"
+				if r.Table != 0 {
+					table = strconv.Itoa(r.Table)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", strings.Join(i.Containers, ","), r.Destination, orDash(r.Gateway), orDash(r.Device), orDash(r.Source), r.Metric, table)
+			}
+		}
+		fmt.Fprintln(w, "\nCONTAINERS\tNEIGHBOUR\tMAC\tDEVICE\tSTATE")
+		for _, i := range inventories {
+			for _, n := range i.Neighbours {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", strings.Join(i.Containers, ","), n.Address, orDash(n.MAC), n.Device, n.State)
+			}
+		}
+	}
+}
+
+// observed describes the round trip time and the loss measured by the
+// probes of a container
+func observed(stats *ProbeStats) string {
+	if stats == nil {
+		return "-"
+	}
+	return stats.String()
+}
+
+// resetTable prints the connections matched by the resets, one line per
+// connection
+func resetTable(results []APIResult) func(w io.Writer) {
+	return func(w io.Writer) {
+		fmt.Fprintln(w, "NODE\tCONTAINER\tNAME\tLOCAL\tREMOTE\tSTATE\tRESULT")
+		for _, r := range results {
+			c := r.Container
+			switch {
+			case r.Error != "":
+				fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t-\t%s\n", c.Node, orDash(shortID(c.ID)), orDash(c.Name), r.Error)
+			case c.Reset == nil || c.Reset.Matched == 0:
+				fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\t-\tno connection to reset\n", c.Node, shortID(c.ID), c.Name)
+			default:
+				for _, conn := range c.Reset.Connections {
+					result := "left open"
+					if conn.Reset {
+						result = "reset with " + c.Reset.Method
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.Node, shortID(c.ID), c.Name, conn.Local, conn.Remote, conn.State, result)
+				}
+			}
+		}
+	}
+}
+
+// parseRampRange parses the start and the end values of a ramp, e.g.
+// 10ms:2000ms
+func parseRampRange(value string) (*RampRange, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid ramp %q, expected from:to", value)
+	}
+	return &RampRange{From: parts[0], To: parts[1]}, nil
+}
+
+// progress describes the progress of the ramp or of the trace replay of
+// a container, the settings of its last step are the current ones
+func progress(ramp *RampStatus, replay *ReplayStatus) string {
+	switch {
+	case ramp != nil:
+		return fmt.Sprintf("ramp %s %d/%d", ramp.curve(), ramp.Step, ramp.Steps)
+	case replay != nil:
+		return fmt.Sprintf("replay %s %d/%d", replay.Trace, replay.Sample, replay.Samples)
+	}
+	return "-"
+}
+
+// profilesTable lists the built-in traces
+func profilesTable(w io.Writer) {
+	fmt.Fprintln(w, "NAME\tSAMPLES\tDURATION\tDELAY\tLOSS\tRATE")
+	for _, name := range profileNames() {
+		t, err := newTrace(name, traceProfiles[name])
+		if err != nil {
+			continue
+		}
+		delays, losses, rates := []string{}, []string{}, []string{}
+		for _, sample := range t.samples {
+			delays = append(delays, sample.Delay)
+			losses = append(losses, sample.Loss)
+			rates = append(rates, sample.Rate)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", name, len(t.samples), t.period, valueRange(delays, parseDelay), valueRange(losses, parsePercentage), valueRange(rates, parseRate))
+	}
+}
+
+func parseDelay(value string) (float64, error) {
+	delay, err := parseTCTime(value)
+	return float64(delay), err
+}
+
+func parseRate(value string) (float64, error) {
+	rate, err := parseTCRate(value)
+	return float64(rate), err
+}
+
+// valueRange returns the lowest and the highest of values, as written
+func valueRange(values []string, parse func(string) (float64, error)) string {
+	low, high := "", ""
+	var min, max float64
+	for _, value := range values {
+		f, err := parse(value)
+		if err != nil {
+			continue
+		}
+		if low == "" || f < min {
+			low, min = value, f
+		}
+		if high == "" || f > max {
+			high, max = value, f
+		}
+	}
+	if low == "" {
+		return "-"
+	}
+	return low + "-" + high
+}
+
+// dnsFaults describes the DNS faults of a container
+func dnsFaults(dns *DNSImpairment) string {
+	if dns == nil {
+		return "-"
+	}
+	return dns.String()
+}
+
+// httpFaults describes the HTTP faults of a container
+func httpFaults(impairment *HTTPImpairment) string {
+	if impairment == nil {
+		return "-"
+	}
+	return impairment.String()
+}
+
+// linkFaults describes the link faults of a container
+func linkFaults(link *LinkImpairment) string {
+	if link == nil {
+		return "-"
+	}
+	return link.String()
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// expiresIn returns the time left before the settings are cleared
+// rounded to the second
+func expiresIn(expires *time.Time) string {
+	if expires == nil {
+		return "-"
+	}
+	left := expires.Sub(time.Now())
+	if left < 0 {
+		left = 0
+	}
+	return (left / time.Second * time.Second).String()
+}
+
+// clientCredentials authenticate the clients of the TCP listener
+type clientCredentials struct {
+	token     string
+	tokenFile string
+	cert      string
+	key       string
+	ca        string
+}
+
+func (c *clientCredentials) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.token, "token", c.token, "bearer token for https:// endpoints")
+	fs.StringVar(&c.tokenFile, "token-file", c.tokenFile, "file containing the bearer token")
+	fs.StringVar(&c.cert, "cert", c.cert, "client certificate for https:// endpoints")
+	fs.StringVar(&c.key, "key", c.key, "key of the client certificate")
+	fs.StringVar(&c.ca, "ca", c.ca, "CA verifying the server certificate, the system CAs by default")
+}
+
+// load reads the token file and returns the TLS configuration
+func (c *clientCredentials) load() (*tls.Config, error) {
+	if c.tokenFile != "" {
+		raw, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		c.token = strings.TrimSpace(string(raw))
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.cert != "" || c.key != "" {
+		cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.ca != "" {
+		pool, err := loadCertPool(c.ca)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// apiClient calls the API of the plugin, or of the coordinator
+type apiClient struct {
+	client   *http.Client
+	endpoint string
+	base     string
+	token    string
+}
+
+// newAPIClient returns a client of the API served at endpoint, a unix
+// socket path or an http:// or https:// URL, credentials are only used
+// with https://
+func newAPIClient(endpoint string, credentials *clientCredentials) (*apiClient, error) {
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		c := &apiClient{
+			client:   &http.Client{Timeout: time.Minute},
+			endpoint: endpoint,
+			base:     strings.TrimSuffix(endpoint, "/"),
+		}
+		if strings.HasPrefix(endpoint, "https://") && credentials != nil {
+			tlsConfig, err := credentials.load()
+			if err != nil {
+				return nil, err
+			}
+			c.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+			c.token = credentials.token
+		}
+		return c, nil
+	}
+	socket := strings.TrimPrefix(endpoint, "unix://")
+	if !filepath.IsAbs(socket) {
+		return nil, fmt.Errorf("endpoint %q is neither an absolute socket path nor an http(s):// URL", endpoint)
+	}
+	return &apiClient{
+		client: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			},
+			Timeout: time.Minute,
+		},
+		endpoint: endpoint,
+		base:     "http://network-control",
+	}, nil
+}
+
+func (c *apiClient) containers(target string) ([]APIContainer, error) {
+	query := url.Values{}
+	if target != "" {
+		query.Set("target", target)
+	}
+	containers := []APIContainer{}
+	err := c.get("containers", query, &containers)
+	return containers, err
+}
+
+func (c *apiClient) get(endpoint string, query url.Values, out interface{}) error {
+	u := c.base + apiPrefix + endpoint
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, out)
+}
+
+func (c *apiClient) post(endpoint string, in, out interface{}) error {
+	raw, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.base+apiPrefix+endpoint, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req, out)
+}
+
+// downloadCapture writes the pcap file of a capture to path, or to the
+// standard output if path is -, until the capture ends
+func (c *apiClient) downloadCapture(id, path string) error {
+	req, err := http.NewRequest("GET", c.base+apiPrefix+"captures/pcap?"+url.Values{"id": {id}}.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	// the download lasts as long as the capture
+	client := *c.client
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach %s: %v", c.endpoint, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return decodeAPIResponse(resp, nil)
+	}
+	defer resp.Body.Close()
+	out := os.Stdout
+	if path != "-" {
+		if out, err = os.Create(path); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return fmt.Errorf("failed to download capture %s: %v", id, err)
+	}
+	return nil
+}
+
+func (c *apiClient) do(req *http.Request, out interface{}) error {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach %s: %v", c.endpoint, err)
+	}
+	return decodeAPIResponse(resp, out)
+}
+
+func decodeAPIResponse(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		res := response{}
+		raw, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err := json.Unmarshal(raw, &res); err != nil || res.Error == "" {
+			return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(raw)))
+		}
+		return fmt.Errorf("%s", res.Error)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	return nil
+}
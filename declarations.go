@@ -0,0 +1,173 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Impairments can be declared in the manifests instead of being applied
+// by hand: in the labels of a container, e.g. network-control.delay=200ms,
+// or in the annotations of a pod, e.g. network-control.weave.works/delay:
+// 200ms. The annotations of a pod win over the labels of its containers.
+// The declarations are applied whenever the containers or the pods
+// change, so a restarted pod gets its impairment back in its new network
+// namespace, and they are cleared once removed.
+
+const (
+	containerLabelPrefix = "network-control."
+	podAnnotationPrefix  = "network-control.weave.works/"
+)
+
+// Declarations applies the impairments declared by the containers and
+// the pods
+type Declarations struct {
+	store      *Store
+	controller *Controller
+	// applied are the impairments applied by network namespace
+	applied map[string]Impairment
+}
+
+// NewDeclarations instantiates a new Declarations
+func NewDeclarations(store *Store, controller *Controller) *Declarations {
+	return &Declarations{
+		store:      store,
+		controller: controller,
+		applied:    map[string]Impairment{},
+	}
+}
+
+// Start applies the declarations whenever the store changes, it never
+// returns
+func (d *Declarations) Start() {
+	changes := d.store.Changes()
+	for {
+		d.reconcile()
+		<-changes
+	}
+}
+
+// declaration is the impairment declared for a network namespace
+type declaration struct {
+	impairment Impairment
+	// source tells which container or pod declared it
+	source string
+}
+
+// reconcile applies the new and changed declarations and clears the
+// removed ones
+func (d *Declarations) reconcile() {
+	containers := map[string]Container{}
+	d.store.ForEach(func(containerID string, container Container) {
+		if container.State == Running && container.NetNSID != "" {
+			containers[containerID] = container
+		}
+	})
+	ids := []string{}
+	for containerID := range containers {
+		ids = append(ids, containerID)
+	}
+	sort.Strings(ids)
+
+	// one running container of each network namespace
+	netNS := map[string]string{}
+	declarations := map[string]declaration{}
+	for _, containerID := range ids {
+		container := containers[containerID]
+		if _, ok := netNS[container.NetNSID]; !ok {
+			netNS[container.NetNSID] = containerID
+		}
+		declared := d.declared(container)
+		if declared.impairment == (Impairment{}) {
+			continue
+		}
+		if previous, ok := declarations[container.NetNSID]; ok {
+			if previous.impairment != declared.impairment {
+				log.Warnf("Ignoring the impairment declared by %s, %s declares another one in the same network namespace", declared.source, previous.source)
+			}
+			continue
+		}
+		declarations[container.NetNSID] = declared
+	}
+
+	for netNSID, declared := range declarations {
+		if applied, ok := d.applied[netNSID]; ok && applied == declared.impairment {
+			continue
+		}
+		containerID := netNS[netNSID]
+		container := containers[containerID]
+		if err := declared.impairment.Validate(); err != nil {
+			log.Errorf("Invalid impairment declared by %s: %v", declared.source, err)
+			continue
+		}
+		if err := currentConfig().Policy.ProtectedNetNS(d.store.Members(containerID, container)); err != nil {
+			log.Warnf("Not applying the impairment declared by %s: %v", declared.source, err)
+			continue
+		}
+		if err := d.controller.Set(d.store.NetNSPID(container), declared.impairment); err != nil {
+			log.Errorf("Failed to apply the impairment declared by %s: %v", declared.source, err)
+			continue
+		}
+		log.Infof("Applied the impairment declared by %s: %s", declared.source, impairmentString(declared.impairment))
+		d.applied[netNSID] = declared.impairment
+	}
+
+	for netNSID := range d.applied {
+		if _, ok := declarations[netNSID]; ok {
+			continue
+		}
+		containerID, ok := netNS[netNSID]
+		if !ok {
+			// the network namespace is gone
+			delete(d.applied, netNSID)
+			continue
+		}
+		container := containers[containerID]
+		if err := d.controller.ClearTrafficControlSettings(d.store.NetNSPID(container)); err != nil {
+			// retried on the next reconciliation
+			log.Errorf("Failed to clear the impairment of %s: %v", container.Name, err)
+			continue
+		}
+		delete(d.applied, netNSID)
+		log.Infof("Cleared the impairment of %s, its declaration was removed", container.Name)
+	}
+}
+
+// declared returns the impairment declared by the pod of container, or
+// else by its labels
+func (d *Declarations) declared(container Container) declaration {
+	if container.Pod != "" && container.Namespace != "" {
+		if annotations, ok := d.store.PodAnnotations(container.Namespace, container.Pod); ok {
+			if impairment := declaredImpairment(annotations, podAnnotationPrefix); impairment != (Impairment{}) {
+				return declaration{impairment, "pod " + podKey(container.Namespace, container.Pod)}
+			}
+		}
+	}
+	return declaration{declaredImpairment(container.Labels, containerLabelPrefix), "container " + container.Name}
+}
+
+// declaredImpairment returns the impairment of the delay, loss and rate
+// keys under prefix
+func declaredImpairment(values map[string]string, prefix string) Impairment {
+	return Impairment{
+		Delay: strings.TrimSpace(values[prefix+"delay"]),
+		Loss:  strings.TrimSpace(values[prefix+"loss"]),
+		Rate:  strings.TrimSpace(values[prefix+"rate"]),
+	}
+}
+
+// impairmentString describes impairment in the logs
+func impairmentString(impairment Impairment) string {
+	settings := []string{}
+	for _, setting := range []struct{ name, value string }{
+		{"delay", impairment.Delay},
+		{"loss", impairment.Loss},
+		{"rate", impairment.Rate},
+	} {
+		if setting.value != "" {
+			settings = append(settings, setting.name+" "+setting.value)
+		}
+	}
+	return strings.Join(settings, ", ")
+}
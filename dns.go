@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DNS faults are injected by a DNS proxy, the DNS traffic of the
+// container, UDP and TCP, is redirected to it. The proxy forwards the
+// queries to the first IPv4 nameserver of the resolv.conf of the
+// container, delaying, dropping, failing or truncating them on the way.
+
+const (
+	// dnsTable is the nftables table redirecting the DNS traffic
+	dnsTable = "network-control-dns"
+	// dnsTimeout bounds the exchanges with the resolver
+	dnsTimeout = 5 * time.Second
+)
+
+// DNS response codes
+const (
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+)
+
+// DNSImpairment is the behaviour of the DNS proxy. The names are glob
+// patterns matched against the queried names in lower case without the
+// trailing dot, e.g. *.example.com.
+type DNSImpairment struct {
+	// Delay is added to every query, e.g. 500ms
+	Delay string `yaml:"delay,omitempty" json:"delay,omitempty"`
+	// Drop is the percentage of queries left unanswered, e.g. 10%
+	Drop string `yaml:"drop,omitempty" json:"drop,omitempty"`
+	// ServFail are the names answered with SERVFAIL
+	ServFail []string `yaml:"servfail,omitempty" json:"servfail,omitempty"`
+	// NXDomain are the names answered with NXDOMAIN
+	NXDomain []string `yaml:"nxdomain,omitempty" json:"nxdomain,omitempty"`
+	// Truncate sets the truncated flag of the answers over UDP and
+	// removes their records, the clients retry over TCP
+	Truncate bool `yaml:"truncate,omitempty" json:"truncate,omitempty"`
+}
+
+// Validate checks the DNS impairment
+func (d *DNSImpairment) Validate() error {
+	if d.Delay == "" && d.Drop == "" && len(d.ServFail) == 0 && len(d.NXDomain) == 0 && !d.Truncate {
+		return fmt.Errorf("no DNS delay, drop, servfail, nxdomain or truncate")
+	}
+	if d.Delay != "" {
+		if _, err := parseTCTime(d.Delay); err != nil {
+			return err
+		}
+	}
+	if d.Drop != "" {
+		if _, err := parsePercentage(d.Drop); err != nil {
+			return err
+		}
+	}
+	for _, pattern := range append(append([]string{}, d.ServFail...), d.NXDomain...) {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("invalid name pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+func (d DNSImpairment) String() string {
+	settings := []string{}
+	if d.Delay != "" {
+		settings = append(settings, "delay "+d.Delay)
+	}
+	if d.Drop != "" {
+		settings = append(settings, "drop "+d.Drop)
+	}
+	if len(d.ServFail) > 0 {
+		settings = append(settings, "servfail "+strings.Join(d.ServFail, " "))
+	}
+	if len(d.NXDomain) > 0 {
+		settings = append(settings, "nxdomain "+strings.Join(d.NXDomain, " "))
+	}
+	if d.Truncate {
+		settings = append(settings, "truncate")
+	}
+	return strings.Join(settings, ", ")
+}
+
+// dnsProxy serves the DNS queries of a network namespace
+type dnsProxy struct {
+	*netNSProxy
+	// resolver is the address of the nameserver of the container
+	resolver *net.TCPAddr
+	udp      *net.UDPConn
+	tcp      *net.TCPListener
+
+	lock       sync.Mutex
+	impairment DNSImpairment
+	delay      time.Duration
+	drop       float64
+}
+
+// startDNSProxy starts a proxy in the network namespace of pid and
+// redirects the DNS traffic to it, gone is called if the network
+// namespace loses its processes
+func startDNSProxy(pid int, netNSID string, impairment DNSImpairment, gone func(p *dnsProxy)) (*dnsProxy, error) {
+	resolver, err := containerResolver(pid)
+	if err != nil {
+		return nil, err
+	}
+	base, err := newNetNSProxy("DNS", pid, netNSID, dnsTable)
+	if err != nil {
+		return nil, err
+	}
+	p := &dnsProxy{netNSProxy: base, resolver: resolver}
+	if err := p.set(impairment); err != nil {
+		p.close()
+		return nil, err
+	}
+	err = p.listen(func() ([]io.Closer, error) {
+		var err error
+		if p.udp, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+			return nil, err
+		}
+		port := p.udp.LocalAddr().(*net.UDPAddr).Port
+		if p.tcp, err = net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}); err != nil {
+			return []io.Closer{p.udp}, err
+		}
+		return []io.Closer{p.udp, p.tcp}, nil
+	})
+	if err == nil {
+		err = p.redirect(dnsRedirectRules(listenerPort(p.udp.LocalAddr()))...)
+	}
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	go p.serveUDP()
+	go p.serveTCP()
+	go p.watch(func() { gone(p) })
+	log.Infof("DNS proxy of network namespace %s listening on port %s, forwarding to %s", netNSID, listenerPort(p.udp.LocalAddr()), resolver.IP)
+	return p, nil
+}
+
+// dnsRedirectRules returns the rules redirecting the DNS traffic to port
+func dnsRedirectRules(port string) []string {
+	return []string{
+		"udp dport 53 redirect to :" + port,
+		"tcp dport 53 redirect to :" + port,
+	}
+}
+
+// containerResolver returns the first IPv4 nameserver of the resolv.conf
+// of the container of pid
+func containerResolver(pid int) (*net.TCPAddr, error) {
+	resolvConf := fmt.Sprintf("/proc/%d/root/etc/resolv.conf", pid)
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the resolv.conf of the container: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil && ip.To4() != nil {
+			return &net.TCPAddr{IP: ip.To4(), Port: 53}, nil
+		}
+	}
+	return nil, fmt.Errorf("no IPv4 nameserver in %s", resolvConf)
+}
+
+// set replaces the impairment of the proxy
+func (p *dnsProxy) set(impairment DNSImpairment) error {
+	var delay time.Duration
+	var drop float64
+	var err error
+	if impairment.Delay != "" {
+		if delay, err = parseTCTime(impairment.Delay); err != nil {
+			return err
+		}
+	}
+	if impairment.Drop != "" {
+		if drop, err = parsePercentage(impairment.Drop); err != nil {
+			return err
+		}
+	}
+	p.lock.Lock()
+	p.impairment, p.delay, p.drop = impairment, delay, drop
+	p.lock.Unlock()
+	return nil
+}
+
+// Impairment returns the impairment of the proxy
+func (p *dnsProxy) Impairment() DNSImpairment {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.impairment
+}
+
+func (p *dnsProxy) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := p.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte{}, buf[:n]...)
+		go func() {
+			if reply := p.handle(query, false); reply != nil {
+				p.udp.WriteToUDP(reply, addr)
+			}
+		}()
+	}
+}
+
+func (p *dnsProxy) serveTCP() {
+	for {
+		conn, err := p.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go p.serveTCPConn(conn)
+	}
+}
+
+// serveTCPConn answers the queries of a TCP connection in order
+func (p *dnsProxy) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTimeout))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		reply := p.handle(query, true)
+		if reply == nil {
+			// dropped, the client times out
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(dnsTimeout))
+		if err := writeTCPMessage(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the reply to query, nil if it is dropped
+func (p *dnsProxy) handle(query []byte, tcp bool) []byte {
+	p.lock.Lock()
+	impairment, delay, drop := p.impairment, p.delay, p.drop
+	p.lock.Unlock()
+	name, end, err := dnsQuestion(query)
+	if err != nil {
+		log.Debugf("DNS proxy of network namespace %s: %v", p.netNSID, err)
+		return nil
+	}
+	if drop > 0 && rand.Float64() < drop {
+		return nil
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	switch {
+	case matchesAny(impairment.NXDomain, name):
+		return dnsReply(query[:end], dnsRcodeNXDomain)
+	case matchesAny(impairment.ServFail, name):
+		return dnsReply(query[:end], dnsRcodeServFail)
+	}
+	answer, err := p.exchange(query, tcp)
+	if err != nil {
+		log.Debugf("DNS proxy of network namespace %s: %s: %v", p.netNSID, name, err)
+		return dnsReply(query[:end], dnsRcodeServFail)
+	}
+	if impairment.Truncate && !tcp {
+		if _, end, err := dnsQuestion(answer); err == nil {
+			answer = dnsTruncate(answer[:end])
+		}
+	}
+	return answer
+}
+
+// exchange forwards query to the resolver and returns its answer
+func (p *dnsProxy) exchange(query []byte, tcp bool) ([]byte, error) {
+	conn, err := p.dial(p.resolver, tcp, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if tcp {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// dnsQuestion returns the name of the first question of msg in lower
+// case without the trailing dot, and the offset of the end of the
+// question
+func dnsQuestion(msg []byte) (string, int, error) {
+	if len(msg) < 12 {
+		return "", 0, fmt.Errorf("short DNS message")
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) == 0 {
+		return "", 0, fmt.Errorf("DNS message without question")
+	}
+	labels := []string{}
+	offset := 12
+	for {
+		if offset >= len(msg) {
+			return "", 0, fmt.Errorf("truncated DNS question")
+		}
+		length := int(msg[offset])
+		offset++
+		if length == 0 {
+			break
+		}
+		// questions are not compressed
+		if length > 63 || offset+length > len(msg) {
+			return "", 0, fmt.Errorf("invalid DNS question")
+		}
+		labels = append(labels, string(msg[offset:offset+length]))
+		offset += length
+	}
+	// type and class
+	offset += 4
+	if offset > len(msg) {
+		return "", 0, fmt.Errorf("truncated DNS question")
+	}
+	return strings.ToLower(strings.Join(labels, ".")), offset, nil
+}
+
+// dnsReply returns a reply to question, a message ending with its first
+// question, with rcode and no record
+func dnsReply(question []byte, rcode byte) []byte {
+	reply := dnsHeaderOnly(question)
+	// response, keeping the opcode and recursion desired
+	reply[2] = 0x80 | question[2]&0x79
+	// recursion available
+	reply[3] = 0x80 | rcode
+	return reply
+}
+
+// dnsTruncate returns answer, a message ending with its first question,
+// without record and with the truncated flag
+func dnsTruncate(answer []byte) []byte {
+	reply := dnsHeaderOnly(answer)
+	reply[2] |= 0x02
+	return reply
+}
+
+// dnsHeaderOnly copies msg, a message ending with its first question,
+// with only one question and no record
+func dnsHeaderOnly(msg []byte) []byte {
+	reply := append([]byte{}, msg...)
+	binary.BigEndian.PutUint16(reply[4:6], 1)
+	for i := 6; i < 12; i++ {
+		reply[i] = 0
+	}
+	return reply
+}
+
+// matchesAny tells whether name matches any of patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if globMatch(strings.ToLower(pattern), name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// dnsMessage builds a DNS message with the given header flags and
+// counts, the question of name for an A record and the raw records
+func dnsMessage(flags uint16, name string, counts [3]uint16, records ...byte) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:2], 0x1234)
+	binary.BigEndian.PutUint16(msg[2:4], flags)
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	for i, count := range counts {
+		binary.BigEndian.PutUint16(msg[6+2*i:8+2*i], count)
+	}
+	msg = append(msg, dnsName(name)...)
+	// type A, class IN
+	msg = append(msg, 0, 1, 0, 1)
+	return append(msg, records...)
+}
+
+func dnsName(name string) []byte {
+	encoded := []byte{}
+	for _, label := range strings.Split(name, ".") {
+		if label != "" {
+			encoded = append(encoded, byte(len(label)))
+			encoded = append(encoded, label...)
+		}
+	}
+	return append(encoded, 0)
+}
+
+// an A record of the name of the question, 93.184.216.34
+var dnsAnswer = []byte{0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0x0e, 0x10, 0, 4, 93, 184, 216, 34}
+
+// an EDNS OPT record
+var dnsOPT = []byte{0, 0, 41, 0x10, 0, 0, 0, 0, 0, 0, 0}
+
+func TestDNSQuestion(t *testing.T) {
+	query := dnsMessage(0x0100, "WWW.Example.com", [3]uint16{})
+	for _, test := range []struct {
+		name     string
+		msg      []byte
+		expected string
+		end      int
+		invalid  bool
+	}{
+		{name: "query", msg: query, expected: "www.example.com", end: len(query)},
+		{name: "with records", msg: dnsMessage(0x0100, "example.com", [3]uint16{0, 0, 1}, dnsOPT...), expected: "example.com", end: 12 + 13 + 4},
+		{name: "root", msg: dnsMessage(0x0100, ".", [3]uint16{}), expected: "", end: 12 + 1 + 4},
+		{name: "short", msg: query[:11], invalid: true},
+		{name: "no question", msg: append(append([]byte{}, query[:4]...), append([]byte{0, 0}, query[6:]...)...), invalid: true},
+		{name: "truncated name", msg: query[:20], invalid: true},
+		{name: "truncated type", msg: query[:len(query)-1], invalid: true},
+		{name: "compressed name", msg: append(append([]byte{}, query[:12]...), 0xc0, 0x0c, 0, 1, 0, 1), invalid: true},
+	} {
+		name, end, err := dnsQuestion(test.msg)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", test.name, name)
+			}
+			continue
+		}
+		if err != nil || name != test.expected || end != test.end {
+			t.Errorf("%s: expected %q ending at %d, got %q ending at %d, %v", test.name, test.expected, test.end, name, end, err)
+		}
+	}
+}
+
+func TestDNSReply(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		query []byte
+		rcode byte
+		flags uint16
+	}{
+		// recursion desired is kept and recursion available set
+		{name: "servfail", query: dnsMessage(0x0100, "example.com", [3]uint16{}), rcode: dnsRcodeServFail, flags: 0x8182},
+		{name: "nxdomain", query: dnsMessage(0x0100, "example.com", [3]uint16{}), rcode: dnsRcodeNXDomain, flags: 0x8183},
+		// the EDNS record is dropped with the rest of the query
+		{name: "edns", query: dnsMessage(0x0100, "example.com", [3]uint16{0, 0, 1}, dnsOPT...), rcode: dnsRcodeServFail, flags: 0x8182},
+		// the opcode is kept, the other flags of the query but
+		// recursion desired are not
+		{name: "opcode", query: dnsMessage(0x1710, "example.com", [3]uint16{}), rcode: dnsRcodeNXDomain, flags: 0x9183},
+	} {
+		original := append([]byte{}, test.query...)
+		_, end, err := dnsQuestion(test.query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		reply := dnsReply(test.query[:end], test.rcode)
+		expected := dnsMessage(test.flags, "example.com", [3]uint16{})
+		if !bytes.Equal(reply, expected) {
+			t.Errorf("%s: expected\n%x\ngot\n%x", test.name, expected, reply)
+		}
+		if !bytes.Equal(test.query, original) {
+			t.Errorf("%s: the query was modified", test.name)
+		}
+	}
+}
+
+func TestDNSTruncate(t *testing.T) {
+	answer := dnsMessage(0x8180, "example.com", [3]uint16{1, 0, 1}, append(append([]byte{}, dnsAnswer...), dnsOPT...)...)
+	original := append([]byte{}, answer...)
+	_, end, err := dnsQuestion(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := dnsTruncate(answer[:end])
+	// the records are removed and the truncated flag set so that the
+	// client retries over TCP
+	expected := dnsMessage(0x8380, "example.com", [3]uint16{})
+	if !bytes.Equal(truncated, expected) {
+		t.Errorf("expected\n%x\ngot\n%x", expected, truncated)
+	}
+	if !bytes.Equal(answer, original) {
+		t.Errorf("the answer was modified")
+	}
+}
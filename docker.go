@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -17,8 +18,8 @@ type DockerClient struct {
 
 
 // NewDockerClient instantiates a new DockerClient
-func NewDockerClient(store *Store) (*DockerClient, error) {
-	dc, err := docker.NewClient("unix:///var/run/docker.sock")
+func NewDockerClient(store *Store, endpoint string) (*DockerClient, error) {
+	dc, err := docker.NewClient(endpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to docker daemon: %v", err)
 	}
@@ -66,11 +67,15 @@ func (c *DockerClient) getContainers() error {
 	}
 
 	for _, apiContainer := range apiContainers {
-		containerState, err := c.getContainerState(apiContainer.ID)
+		dockerContainer, err := c.getContainer(apiContainer.ID)
 		if err != nil {
 			log.Error(err)
 			continue
 		}
+		if dockerContainer == nil {
+			continue
+		}
+		containerState := &dockerContainer.State
 		state := Destroyed
 		switch {
 		case containerState.Dead || containerState.Paused || containerState.Restarting || containerState.OOMKilled:
@@ -78,7 +83,7 @@ func (c *DockerClient) getContainers() error {
 		case containerState.Running:
 			state = Running
 		}
-		c.updateContainer(apiContainer.ID, state, containerState.Pid)
+		c.updateContainer(apiContainer.ID, state, dockerContainer)
 	}
 
 	return nil
@@ -98,28 +103,12 @@ func (c *DockerClient) handleEvent(event *docker.APIEvents) {
 	default:
 		return
 	}
-	pid, err := c.getContainerPID(event.ID)
+	dockerContainer, err := c.getContainer(event.ID)
 	if err != nil {
 		log.Error(err)
 		return
 	}
-	c.updateContainer(event.ID, state, pid)
-}
-
-func (c *DockerClient) getContainerPID(containerID string) (int, error) {
-	containerState, err := c.getContainerState(containerID)
-	if containerState == nil {
-		return 0, err
-	}
-	return containerState.Pid, nil
-}
-
-func (c *DockerClient) getContainerState(containerID string) (*docker.State, error) {
-	dockerContainer, err := c.getContainer(containerID)
-	if dockerContainer == nil {
-		return nil, err
-	}
-	return &dockerContainer.State, nil
+	c.updateContainer(event.ID, state, dockerContainer)
 }
 
 func (c *DockerClient) getContainer(containerID string) (*docker.Container, error) {
@@ -133,14 +122,49 @@ func (c *DockerClient) getContainer(containerID string) (*docker.Container, erro
 	return dockerContainer, nil
 }
 
-func (c *DockerClient) updateContainer(containerID string, state State, pid int) {
-	if state == Destroyed {
+// updateContainer keeps the metadata of dockerContainer in the store, so
+// that the report never has to inspect containers
+func (c *DockerClient) updateContainer(containerID string, state State, dockerContainer *docker.Container) {
+	if state == Destroyed || dockerContainer == nil {
 		c.store.DeleteContainer(containerID)
 		return
 	}
+	pod, err := parsePodName(dockerContainer.Name)
+	if err != nil {
+		pod = ""
+	}
 	cont := Container{
 		State: state,
-		PID:   pid,
+		PID:   dockerContainer.State.Pid,
+		Name:  strings.TrimPrefix(dockerContainer.Name, "/"),
+		Pod:   pod,
+	}
+	if dockerContainer.Config != nil {
+		cont.Image = dockerContainer.Config.Image
+		cont.Labels = dockerContainer.Config.Labels
+	}
+	cont.Namespace = podNamespace(cont.Name, cont.Labels)
+	cont.Sandbox = cont.Labels["io.kubernetes.docker.type"] == "podsandbox" || strings.HasPrefix(cont.Name, "k8s_POD_")
+	if state == Running {
+		if netNSID, err := getNSID(fmt.Sprintf("/proc/%d/ns/net", cont.PID)); err == nil {
+			cont.NetNSID = netNSID
+		} else {
+			log.Warnf("failed to get the network namespace of container %s: %v", cont.Name, err)
+		}
 	}
 	c.store.SetContainer(containerID, cont)
 }
+
+// podNamespace returns the Kubernetes namespace of a container, from
+// the label set by the kubelet or from the name it gives containers,
+// k8s_<container>_<pod>_<namespace>_<uid>_<attempt>
+func podNamespace(name string, labels map[string]string) string {
+	if namespace := labels["io.kubernetes.pod.namespace"]; namespace != "" {
+		return namespace
+	}
+	parts := strings.Split(name, "_")
+	if len(parts) >= 6 && parts[0] == "k8s" {
+		return parts[3]
+	}
+	return ""
+}
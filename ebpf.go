@@ -0,0 +1,513 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The eBPF backend attaches a program to the clsact egress hook of the
+// interface. The program implements delay and rate with earliest
+// departure time (EDT): it sets skb->tstamp and lets the fq qdisc hold
+// packets until then. Packet loss is implemented by dropping packets
+// with a pseudo random probability. Like netem, it only impairs the
+// packets leaving the interface, so that the settings mean the same
+// with both backends.
+//
+// The program is generated for each status, the parameters are
+// embedded as immediates, and pinned in the BPF filesystem so that tc
+// can attach it.
+
+const (
+	bpfFSPath  = "/sys/fs/bpf"
+	bpfFSMagic = 0xcafe4a11
+	bpfPinDir  = bpfFSPath + "/network-control"
+)
+
+// bpf(2) commands, program types and map types
+const (
+	bpfMapCreate     = 0
+	bpfProgLoad      = 5
+	bpfObjPin        = 6
+	bpfProgGetFDByID = 13
+
+	bpfProgTypeSchedCLS = 3
+	bpfMapTypeArray     = 2
+)
+
+// eBPF instruction classes, operations and sources, see
+// include/uapi/linux/bpf.h
+const (
+	bpfLD    = 0x00
+	bpfLDX   = 0x01
+	bpfST    = 0x02
+	bpfSTX   = 0x03
+	bpfJMP   = 0x05
+	bpfALU64 = 0x07
+
+	bpfW   = 0x00
+	bpfDW  = 0x18
+	bpfIMM = 0x00
+	bpfMEM = 0x60
+
+	bpfK = 0x00
+	bpfX = 0x08
+
+	bpfADD = 0x00
+	bpfMUL = 0x20
+	bpfDIV = 0x30
+	bpfMOV = 0xb0
+
+	bpfJA   = 0x00
+	bpfJEQ  = 0x10
+	bpfJGT  = 0x20
+	bpfJGE  = 0x30
+	bpfCALL = 0x80
+	bpfEXIT = 0x90
+
+	bpfPseudoMapFD = 1
+)
+
+// eBPF helpers
+const (
+	bpfFuncMapLookupElem = 1
+	bpfFuncKtimeGetNs    = 5
+	bpfFuncGetPrandomU32 = 7
+)
+
+// tc actions returned by a direct-action classifier
+const (
+	tcActOK   = 0
+	tcActShot = 2
+)
+
+// offsets in struct __sk_buff
+const (
+	skbLenOffset    = 0
+	skbTstampOffset = 152
+)
+
+type bpfInstruction struct {
+	opcode uint8
+	dst    uint8
+	src    uint8
+	off    int16
+	imm    int32
+}
+
+func (i bpfInstruction) encode() []byte {
+	b := make([]byte, 8)
+	b[0] = i.opcode
+	b[1] = i.src<<4 | i.dst&0x0f
+	binary.LittleEndian.PutUint16(b[2:], uint16(i.off))
+	binary.LittleEndian.PutUint32(b[4:], uint32(i.imm))
+	return b
+}
+
+func bpfMovReg(dst, src uint8) []bpfInstruction {
+	return []bpfInstruction{{opcode: bpfALU64 | bpfMOV | bpfX, dst: dst, src: src}}
+}
+
+func bpfMovImm(dst uint8, imm int32) []bpfInstruction {
+	return []bpfInstruction{{opcode: bpfALU64 | bpfMOV | bpfK, dst: dst, imm: imm}}
+}
+
+func bpfALUReg(op, dst, src uint8) []bpfInstruction {
+	return []bpfInstruction{{opcode: bpfALU64 | op | bpfX, dst: dst, src: src}}
+}
+
+func bpfALUImm(op, dst uint8, imm int32) []bpfInstruction {
+	return []bpfInstruction{{opcode: bpfALU64 | op | bpfK, dst: dst, imm: imm}}
+}
+
+// bpfLoadImm64 loads a 64 bits immediate, it takes two instructions
+func bpfLoadImm64(dst uint8, src uint8, imm uint64) []bpfInstruction {
+	return []bpfInstruction{
+		{opcode: bpfLD | bpfDW | bpfIMM, dst: dst, src: src, imm: int32(uint32(imm))},
+		{imm: int32(uint32(imm >> 32))},
+	}
+}
+
+func bpfLoadMem(size, dst, src uint8, off int16) []bpfInstruction {
+	return []bpfInstruction{{opcode: bpfLDX | bpfMEM | size, dst: dst, src: src, off: off}}
+}
+
+func bpfStoreMem(size, dst, src uint8, off int16) []bpfInstruction {
+	return []bpfInstruction{{opcode: bpfSTX | bpfMEM | size, dst: dst, src: src, off: off}}
+}
+
+func bpfStoreImm(size, dst uint8, off int16, imm int32) []bpfInstruction {
+	return []bpfInstruction{{opcode: bpfST | bpfMEM | size, dst: dst, off: off, imm: imm}}
+}
+
+func bpfJumpReg(op, dst, src uint8, off int16) []bpfInstruction {
+	return []bpfInstruction{{opcode: bpfJMP | op | bpfX, dst: dst, src: src, off: off}}
+}
+
+func bpfJumpImm(op, dst uint8, imm int32, off int16) []bpfInstruction {
+	return []bpfInstruction{{opcode: bpfJMP | op | bpfK, dst: dst, imm: imm, off: off}}
+}
+
+func bpfCall(helper int32) []bpfInstruction {
+	return []bpfInstruction{{opcode: bpfJMP | bpfCALL, imm: helper}}
+}
+
+func bpfExit() []bpfInstruction {
+	return []bpfInstruction{{opcode: bpfJMP | bpfEXIT}}
+}
+
+// bpfProgram assembles blocks of instructions
+type bpfProgram struct {
+	instructions []bpfInstruction
+}
+
+func (p *bpfProgram) emit(blocks ...[]bpfInstruction) {
+	for _, block := range blocks {
+		p.instructions = append(p.instructions, block...)
+	}
+}
+
+func blockLen(blocks ...[]bpfInstruction) int16 {
+	n := 0
+	for _, block := range blocks {
+		n += len(block)
+	}
+	return int16(n)
+}
+
+func (p *bpfProgram) bytes() []byte {
+	b := make([]byte, 0, len(p.instructions)*8)
+	for _, i := range p.instructions {
+		b = append(b, i.encode()...)
+	}
+	return b
+}
+
+// ebpfParams are the parameters embedded in the generated program
+type ebpfParams struct {
+	delayNs uint64
+	// bytes per second, 0 means unlimited
+	rate uint64
+	// drop when a random uint32 is below lossThreshold
+	lossThreshold uint64
+}
+
+func newEBPFParams(status *TrafficControlStatus) (ebpfParams, error) {
+	params := ebpfParams{}
+	if isSet(status.latency) {
+		delay, err := parseTCTime(status.latency)
+		if err != nil {
+			return params, err
+		}
+		params.delayNs = uint64(delay.Nanoseconds())
+	}
+	if isSet(status.rate) {
+		rate, err := parseTCRate(status.rate)
+		if err != nil {
+			return params, err
+		}
+		params.rate = rate
+	}
+	if isSet(status.packetLoss) {
+		loss, err := parsePercentage(status.packetLoss)
+		if err != nil {
+			return params, err
+		}
+		params.lossThreshold = uint64(loss * (1 << 32))
+	}
+	return params, nil
+}
+
+// ebpfProgram generates the egress classifier, rateMapFD is the array
+// map keeping the next departure time
+func ebpfProgram(params ebpfParams, rateMapFD int) *bpfProgram {
+	const (
+		r0 = iota
+		r1
+		r2
+		r3
+		r4
+		r5
+		r6
+		r7
+		r8
+		r9
+		r10
+	)
+	p := &bpfProgram{}
+	// r6 = skb
+	p.emit(bpfMovReg(r6, r1))
+
+	if params.lossThreshold > 0 {
+		// if threshold > prandom_u32() then drop
+		drop := [][]bpfInstruction{bpfMovImm(r0, tcActShot), bpfExit()}
+		p.emit(
+			bpfCall(bpfFuncGetPrandomU32),
+			bpfLoadImm64(r1, 0, params.lossThreshold),
+			bpfJumpReg(bpfJGE, r0, r1, 2),
+		)
+		p.emit(drop...)
+	}
+
+	if params.delayNs > 0 || params.rate > 0 {
+		// r7 = now + delay
+		p.emit(
+			bpfCall(bpfFuncKtimeGetNs),
+			bpfMovReg(r7, r0),
+			bpfLoadImm64(r2, 0, params.delayNs),
+			bpfALUReg(bpfADD, r7, r2),
+		)
+		if params.rate > 0 {
+			// r7 = max(r7, next), next = r7 + len * 1e9 / rate
+			update := [][]bpfInstruction{
+				bpfMovReg(r8, r0),
+				bpfLoadMem(bpfDW, r3, r8, 0),
+				bpfJumpReg(bpfJGE, r7, r3, 1),
+				bpfMovReg(r7, r3),
+				bpfLoadMem(bpfW, r4, r6, skbLenOffset),
+				bpfALUImm(bpfMUL, r4, 1000000000),
+				bpfLoadImm64(r5, 0, params.rate),
+				bpfALUReg(bpfDIV, r4, r5),
+				bpfALUReg(bpfADD, r4, r7),
+				bpfStoreMem(bpfDW, r8, r4, 0),
+			}
+			p.emit(
+				bpfStoreImm(bpfW, r10, -4, 0),
+				bpfMovReg(r2, r10),
+				bpfALUImm(bpfADD, r2, -4),
+				bpfLoadImm64(r1, bpfPseudoMapFD, uint64(rateMapFD)),
+				bpfCall(bpfFuncMapLookupElem),
+				bpfJumpImm(bpfJEQ, r0, 0, blockLen(update...)),
+			)
+			p.emit(update...)
+		}
+		// skb->tstamp = r7
+		p.emit(bpfStoreMem(bpfDW, r6, r7, skbTstampOffset))
+	}
+
+	p.emit(bpfMovImm(r0, tcActOK), bpfExit())
+	return p
+}
+
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+	progName    [16]byte
+}
+
+type bpfObjPinAttr struct {
+	pathname  uint64
+	bpfFD     uint32
+	fileFlags uint32
+}
+
+type bpfGetIDAttr struct {
+	id        uint32
+	nextID    uint32
+	openFlags uint32
+}
+
+func bpfCreateArrayMap(valueSize, maxEntries uint32) (int, error) {
+	attr := bpfMapCreateAttr{
+		mapType:    bpfMapTypeArray,
+		keySize:    4,
+		valueSize:  valueSize,
+		maxEntries: maxEntries,
+	}
+	fd, err := bpfSyscall(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("failed to create BPF map: %v", err)
+	}
+	return fd, nil
+}
+
+func bpfLoadProgram(name string, p *bpfProgram) (int, error) {
+	insns := p.bytes()
+	license := []byte("GPL\x00")
+	logBuf := make([]byte, 64*1024)
+	attr := bpfProgLoadAttr{
+		progType: bpfProgTypeSchedCLS,
+		insnCnt:  uint32(len(p.instructions)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel: 1,
+		logSize:  uint32(len(logBuf)),
+		logBuf:   uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+	}
+	copy(attr.progName[:len(attr.progName)-1], name)
+	fd, err := bpfSyscall(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	runtime.KeepAlive(logBuf)
+	if err != nil {
+		verifierLog := strings.TrimRight(string(logBuf), "\x00")
+		return -1, fmt.Errorf("failed to load BPF program %s: %v: %s", name, err, verifierLog)
+	}
+	return fd, nil
+}
+
+func bpfPin(fd int, path string) error {
+	pathname, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	attr := bpfObjPinAttr{
+		pathname: uint64(uintptr(unsafe.Pointer(pathname))),
+		bpfFD:    uint32(fd),
+	}
+	_, err = bpfSyscall(bpfObjPin, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(pathname)
+	if err != nil {
+		return fmt.Errorf("failed to pin BPF object to %s: %v", path, err)
+	}
+	return nil
+}
+
+// bpfProgramFD opens the loaded program whose ID is id
+func bpfProgramFD(id uint32) (int, error) {
+	attr := bpfGetIDAttr{id: id}
+	fd, err := bpfSyscall(bpfProgGetFDByID, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("failed to open BPF program %d: %v", id, err)
+	}
+	return fd, nil
+}
+
+// mountBPFFS makes sure the BPF filesystem is mounted
+func mountBPFFS() error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(bpfFSPath, &stat); err == nil && uint32(stat.Type) == bpfFSMagic {
+		return nil
+	}
+	if err := os.MkdirAll(bpfFSPath, 0700); err != nil {
+		return err
+	}
+	if err := unix.Mount("bpf", bpfFSPath, "bpf", 0, ""); err != nil {
+		return fmt.Errorf("failed to mount the BPF filesystem on %s: %v", bpfFSPath, err)
+	}
+	return nil
+}
+
+// ebpfBackend shapes traffic with an eBPF program attached to clsact
+type ebpfBackend struct{}
+
+func newEBPFBackend() *ebpfBackend {
+	return &ebpfBackend{}
+}
+
+func (b *ebpfBackend) Name() string {
+	return "ebpf"
+}
+
+func (b *ebpfBackend) Requirements() []string {
+	return []string{featureTC, featureFQ, featureClsact, featureBPF, featureCapNetAdmin, featureCapSysAdmin}
+}
+
+// Ingress is set since the clsact qdisc takes the ingress hook too
+func (b *ebpfBackend) Ingress() bool {
+	return true
+}
+
+func (b *ebpfBackend) Apply(iface NetInterface, status *TrafficControlStatus) ([]Operation, error) {
+	if len(iface.ExcludePorts) > 0 {
+		return nil, fmt.Errorf("the ebpf backend cannot leave ports unimpaired, use the netem backend")
+	}
+	params, err := newEBPFParams(status)
+	if err != nil {
+		return nil, fmt.Errorf("invalid traffic control settings: %v", err)
+	}
+	pinDir, err := b.pinDir(iface.NetNS)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := []Operation{
+		{
+			Description: fmt.Sprintf("load the egress program (delay %s, loss %s, rate %s) and pin it in %s", status.latency, status.packetLoss, status.rate, pinDir),
+			run: func() error {
+				return b.load(params, pinDir)
+			},
+		},
+		// fq enforces the departure time set by the egress program
+		commandOperation("replace the root qdisc with fq", "tc", "qdisc", "replace", "dev", iface.Device, "root", "fq"),
+		commandOperation("add the clsact qdisc", "tc", "qdisc", "replace", "dev", iface.Device, "clsact"),
+	}
+	ops = append(ops, commandOperation("attach the egress program",
+		"tc", "filter", "replace", "dev", iface.Device, "egress", "prio", "1", "handle", "1", "bpf", "da", "object-pinned", filepath.Join(pinDir, "egress")))
+	return ops, nil
+}
+
+// load generates the program and pins it in pinDir
+func (b *ebpfBackend) load(params ebpfParams, pinDir string) error {
+	if err := mountBPFFS(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(pinDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", pinDir, err)
+	}
+
+	rateMapFD, err := bpfCreateArrayMap(8, 1)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(rateMapFD)
+
+	fd, err := bpfLoadProgram("nc_egress", ebpfProgram(params, rateMapFD))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	pin := filepath.Join(pinDir, "egress")
+	os.Remove(pin)
+	return bpfPin(fd, pin)
+}
+
+func (b *ebpfBackend) Clear(iface NetInterface) ([]Operation, error) {
+	pinDir, err := b.pinDir(iface.NetNS)
+	if err != nil {
+		return nil, err
+	}
+	ops := []Operation{
+		commandOperation("remove the clsact qdisc and the program", "tc", "qdisc", "del", "dev", iface.Device, "clsact"),
+		commandOperation("remove fq", "tc", "qdisc", "del", "dev", iface.Device, "root"),
+		{
+			Description: "unpin the program from " + pinDir,
+			run: func() error {
+				return os.RemoveAll(pinDir)
+			},
+		},
+	}
+	for i := range ops {
+		ops[i].Optional = true
+	}
+	return ops, nil
+}
+
+func (b *ebpfBackend) pinDir(netNS string) (string, error) {
+	netNSID, err := getNSID(netNS)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(bpfPinDir, netNSID), nil
+}
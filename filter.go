@@ -0,0 +1,404 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/bpf"
+)
+
+// The capture filters are a subset of the tcpdump expressions compiled
+// to classic BPF for Ethernet frames, so that the kernel only hands the
+// matching packets to the capture:
+//
+//	ip, ip6, arp, tcp, udp, icmp, icmp6
+//	[src|dst] host <IPv4 or IPv6 address>
+//	[src|dst] port <port>
+//	not, and, or, parentheses, and the !, && and || aliases
+//
+// The ports are matched on TCP and UDP over IPv4, except on fragments,
+// and over IPv6 without extension headers.
+
+// Offsets in the Ethernet frames
+const (
+	ethTypeOffset = 12
+	l3Offset      = 14
+
+	ipv4ProtocolOffset = l3Offset + 9
+	ipv4FlagsOffset    = l3Offset + 6
+	ipv4SrcOffset      = l3Offset + 12
+	ipv4DstOffset      = l3Offset + 16
+
+	ipv6NextOffset = l3Offset + 6
+	ipv6SrcOffset  = l3Offset + 8
+	ipv6DstOffset  = l3Offset + 24
+	ipv6L4Offset   = l3Offset + 40
+)
+
+const (
+	ethTypeIPv4 = 0x0800
+	ethTypeARP  = 0x0806
+	ethTypeIPv6 = 0x86dd
+
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+// filterMaxInstructions is the size limit of the classic BPF programs,
+// BPF_MAXINSNS in include/uapi/linux/bpf_common.h
+const filterMaxInstructions = 4096
+
+// filterAccept is returned for the matching packets, it is larger than
+// any packet
+const filterAccept = 0x40000
+
+// filterNode is a node of the syntax tree of a filter
+type filterNode interface{}
+
+type filterAnd struct{ left, right filterNode }
+type filterOr struct{ left, right filterNode }
+type filterNot struct{ node filterNode }
+
+// filterTest loads a value in the accumulator and compares it with val
+type filterTest struct {
+	load []bpf.Instruction
+	val  uint32
+}
+
+// compileFilter compiles expr into a program accepting the whole
+// matching packets, their original length is only known before they are
+// truncated. An empty expression accepts every packet.
+func compileFilter(expr string) ([]bpf.RawInstruction, error) {
+	if strings.TrimSpace(expr) == "" {
+		return bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: filterAccept}})
+	}
+	p := &filterParser{tokens: filterTokens(expr)}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token != "" {
+		return nil, fmt.Errorf("unexpected %q in the filter", token)
+	}
+	g := &filterGenerator{}
+	accept, reject := g.label(), g.label()
+	g.node(node, accept, reject)
+	g.place(accept)
+	g.emit(bpf.RetConstant{Val: filterAccept})
+	g.place(reject)
+	g.emit(bpf.RetConstant{Val: 0})
+	program, err := g.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return bpf.Assemble(program)
+}
+
+// filterTokens splits a filter into words, parentheses and operators
+func filterTokens(expr string) []string {
+	for _, op := range []string{"(", ")", "!", "&&", "||"} {
+		expr = strings.Replace(expr, op, " "+op+" ", -1)
+	}
+	tokens := []string{}
+	for _, token := range strings.Fields(expr) {
+		switch token {
+		case "!":
+			token = "not"
+		case "&&":
+			token = "and"
+		case "||":
+			token = "or"
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+type filterParser struct {
+	tokens []string
+}
+
+func (p *filterParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *filterParser) next() string {
+	token := p.peek()
+	if token != "" {
+		p.tokens = p.tokens[1:]
+	}
+	return token
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	switch p.peek() {
+	case "not":
+		p.next()
+		node, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{node}, nil
+	case "(":
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing ) in the filter")
+		}
+		return node, nil
+	}
+	return p.parsePrimitive()
+}
+
+func (p *filterParser) parsePrimitive() (filterNode, error) {
+	token := p.next()
+	switch token {
+	case "":
+		return nil, fmt.Errorf("incomplete filter")
+	case "ip":
+		return etherType(ethTypeIPv4), nil
+	case "ip6":
+		return etherType(ethTypeIPv6), nil
+	case "arp":
+		return etherType(ethTypeARP), nil
+	case "tcp":
+		return transport(protoTCP), nil
+	case "udp":
+		return transport(protoUDP), nil
+	case "icmp":
+		return filterAnd{etherType(ethTypeIPv4), ipv4Protocol(protoICMP)}, nil
+	case "icmp6":
+		return filterAnd{etherType(ethTypeIPv6), ipv6Next(protoICMPv6)}, nil
+	}
+	src, dst := true, true
+	switch token {
+	case "src":
+		dst = false
+		token = p.next()
+	case "dst":
+		src = false
+		token = p.next()
+	}
+	value := p.next()
+	switch token {
+	case "host":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host %q in the filter, an IP address is expected", value)
+		}
+		return hostFilter(ip, src, dst), nil
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q in the filter", value)
+		}
+		return portFilter(uint32(port), src, dst), nil
+	}
+	return nil, fmt.Errorf("unknown %q in the filter", token)
+}
+
+func etherType(ethType uint32) filterNode {
+	return filterTest{[]bpf.Instruction{bpf.LoadAbsolute{Off: ethTypeOffset, Size: 2}}, ethType}
+}
+
+func ipv4Protocol(proto uint32) filterNode {
+	return filterTest{[]bpf.Instruction{bpf.LoadAbsolute{Off: ipv4ProtocolOffset, Size: 1}}, proto}
+}
+
+func ipv6Next(proto uint32) filterNode {
+	return filterTest{[]bpf.Instruction{bpf.LoadAbsolute{Off: ipv6NextOffset, Size: 1}}, proto}
+}
+
+// transport matches the protocol over IPv4 and IPv6
+func transport(proto uint32) filterNode {
+	return filterOr{
+		filterAnd{etherType(ethTypeIPv4), ipv4Protocol(proto)},
+		filterAnd{etherType(ethTypeIPv6), ipv6Next(proto)},
+	}
+}
+
+// either matches the source or the destination test
+func either(src, dst bool, srcTest, dstTest filterNode) filterNode {
+	switch {
+	case src && dst:
+		return filterOr{srcTest, dstTest}
+	case src:
+		return srcTest
+	}
+	return dstTest
+}
+
+func hostFilter(ip net.IP, src, dst bool) filterNode {
+	if ip4 := ip.To4(); ip4 != nil {
+		return filterAnd{etherType(ethTypeIPv4), either(src, dst, addressTest(ipv4SrcOffset, ip4), addressTest(ipv4DstOffset, ip4))}
+	}
+	return filterAnd{etherType(ethTypeIPv6), either(src, dst, addressTest(ipv6SrcOffset, ip), addressTest(ipv6DstOffset, ip))}
+}
+
+// addressTest compares the address at offset word by word
+func addressTest(offset uint32, ip net.IP) filterNode {
+	var node filterNode
+	for i := 0; i < len(ip); i += 4 {
+		word := uint32(ip[i])<<24 | uint32(ip[i+1])<<16 | uint32(ip[i+2])<<8 | uint32(ip[i+3])
+		test := filterTest{[]bpf.Instruction{bpf.LoadAbsolute{Off: offset + uint32(i), Size: 4}}, word}
+		if node == nil {
+			node = test
+			continue
+		}
+		node = filterAnd{node, test}
+	}
+	return node
+}
+
+func portFilter(port uint32, src, dst bool) filterNode {
+	// the ports of the first fragment only, behind the options
+	ipv4 := filterAnd{
+		filterAnd{etherType(ethTypeIPv4), filterOr{ipv4Protocol(protoTCP), ipv4Protocol(protoUDP)}},
+		filterAnd{
+			filterTest{[]bpf.Instruction{
+				bpf.LoadAbsolute{Off: ipv4FlagsOffset, Size: 2},
+				bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x1fff},
+			}, 0},
+			either(src, dst, ipv4PortTest(0, port), ipv4PortTest(2, port)),
+		},
+	}
+	ipv6 := filterAnd{
+		filterAnd{etherType(ethTypeIPv6), filterOr{ipv6Next(protoTCP), ipv6Next(protoUDP)}},
+		either(src, dst,
+			filterTest{[]bpf.Instruction{bpf.LoadAbsolute{Off: ipv6L4Offset, Size: 2}}, port},
+			filterTest{[]bpf.Instruction{bpf.LoadAbsolute{Off: ipv6L4Offset + 2, Size: 2}}, port}),
+	}
+	return filterOr{ipv4, ipv6}
+}
+
+// ipv4PortTest compares the port at offset in the transport header with
+// port, X is loaded with the length of the IPv4 header
+func ipv4PortTest(offset, port uint32) filterNode {
+	return filterTest{[]bpf.Instruction{
+		bpf.LoadMemShift{Off: l3Offset},
+		bpf.LoadIndirect{Off: l3Offset + offset, Size: 2},
+	}, port}
+}
+
+// filterGenerator emits the instructions of a filter, the jumps target
+// labels which are resolved once the program is complete
+type filterGenerator struct {
+	program []filterInstruction
+	// labels are the positions of the labels in the program
+	labels []int
+}
+
+// filterInstruction is an instruction or a comparison of the
+// accumulator with val jumping to the labels ifTrue or ifFalse
+type filterInstruction struct {
+	instruction     bpf.Instruction
+	jump            bool
+	val             uint32
+	ifTrue, ifFalse int
+}
+
+func (g *filterGenerator) label() int {
+	g.labels = append(g.labels, -1)
+	return len(g.labels) - 1
+}
+
+func (g *filterGenerator) place(label int) {
+	g.labels[label] = len(g.program)
+}
+
+func (g *filterGenerator) emit(instruction bpf.Instruction) {
+	g.program = append(g.program, filterInstruction{instruction: instruction})
+}
+
+// node emits the code of node jumping to ifTrue when it matches and to
+// ifFalse otherwise
+func (g *filterGenerator) node(node filterNode, ifTrue, ifFalse int) {
+	switch n := node.(type) {
+	case filterAnd:
+		next := g.label()
+		g.node(n.left, next, ifFalse)
+		g.place(next)
+		g.node(n.right, ifTrue, ifFalse)
+	case filterOr:
+		next := g.label()
+		g.node(n.left, ifTrue, next)
+		g.place(next)
+		g.node(n.right, ifTrue, ifFalse)
+	case filterNot:
+		g.node(n.node, ifFalse, ifTrue)
+	case filterTest:
+		for _, instruction := range n.load {
+			g.emit(instruction)
+		}
+		g.program = append(g.program, filterInstruction{jump: true, val: n.val, ifTrue: ifTrue, ifFalse: ifFalse})
+	}
+}
+
+// resolve replaces the labels by the relative jumps of classic BPF, which
+// only go forward and skip at most 255 instructions when conditional
+func (g *filterGenerator) resolve() ([]bpf.Instruction, error) {
+	program := []bpf.Instruction{}
+	for i, instruction := range g.program {
+		if !instruction.jump {
+			program = append(program, instruction.instruction)
+			continue
+		}
+		skipTrue := g.labels[instruction.ifTrue] - i - 1
+		skipFalse := g.labels[instruction.ifFalse] - i - 1
+		if skipTrue > 255 || skipFalse > 255 {
+			return nil, fmt.Errorf("the filter is too long")
+		}
+		program = append(program, bpf.JumpIf{
+			Cond:      bpf.JumpEqual,
+			Val:       instruction.val,
+			SkipTrue:  uint8(skipTrue),
+			SkipFalse: uint8(skipFalse),
+		})
+	}
+	if len(program) > filterMaxInstructions {
+		return nil, fmt.Errorf("the filter is too long")
+	}
+	return program, nil
+}
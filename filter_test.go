@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+// ethernetFrame returns an Ethernet frame of the given type carrying
+// payload
+func ethernetFrame(ethType uint16, payload []byte) []byte {
+	frame := make([]byte, l3Offset)
+	binary.BigEndian.PutUint16(frame[ethTypeOffset:], ethType)
+	return append(frame, payload...)
+}
+
+// transportHeader returns the first bytes of a TCP or UDP header
+func transportHeader(sport, dport uint16) []byte {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint16(header[0:2], sport)
+	binary.BigEndian.PutUint16(header[2:4], dport)
+	return header
+}
+
+// ipv4Frame returns an IPv4 packet with options bytes of options and
+// the given fragment offset
+func ipv4Frame(proto uint8, src, dst string, options int, fragment uint16, l4 []byte) []byte {
+	header := make([]byte, 20+options)
+	header[0] = 0x40 | uint8(len(header)/4)
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(header)+len(l4)))
+	binary.BigEndian.PutUint16(header[6:8], fragment)
+	header[8] = 64
+	header[9] = proto
+	copy(header[12:16], net.ParseIP(src).To4())
+	copy(header[16:20], net.ParseIP(dst).To4())
+	return ethernetFrame(ethTypeIPv4, append(header, l4...))
+}
+
+func ipv6Frame(next uint8, src, dst string, l4 []byte) []byte {
+	header := make([]byte, 40)
+	header[0] = 0x60
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(l4)))
+	header[6] = next
+	header[7] = 64
+	copy(header[8:24], net.ParseIP(src))
+	copy(header[24:40], net.ParseIP(dst))
+	return ethernetFrame(ethTypeIPv6, append(header, l4...))
+}
+
+var filterFrames = map[string][]byte{
+	"tcp4":         ipv4Frame(protoTCP, "10.0.0.1", "10.0.0.2", 0, 0, transportHeader(1234, 80)),
+	"tcp4 options": ipv4Frame(protoTCP, "10.0.0.1", "10.0.0.2", 8, 0, transportHeader(1234, 80)),
+	// a later fragment whose payload looks like the ports of the
+	// connection
+	"tcp4 fragment": ipv4Frame(protoTCP, "10.0.0.1", "10.0.0.2", 0, 185, transportHeader(1234, 80)),
+	"udp4":          ipv4Frame(protoUDP, "10.0.0.2", "10.0.0.53", 0, 0, transportHeader(40000, 53)),
+	"icmp4":         ipv4Frame(protoICMP, "10.0.0.2", "10.0.0.1", 0, 0, make([]byte, 8)),
+	"tcp6":          ipv6Frame(protoTCP, "fd00::1", "fd00::2", transportHeader(1234, 80)),
+	"udp6":          ipv6Frame(protoUDP, "fd00::2", "fd00::53", transportHeader(40000, 53)),
+	"icmp6":         ipv6Frame(protoICMPv6, "fd00::2", "fd00::1", make([]byte, 8)),
+	"arp":           ethernetFrame(ethTypeARP, make([]byte, 28)),
+	// truncated in the IPv4 header, before the protocol
+	"truncated": ipv4Frame(protoTCP, "10.0.0.1", "10.0.0.2", 0, 0, transportHeader(1234, 80))[:l3Offset+8],
+}
+
+func TestCompileFilter(t *testing.T) {
+	for _, test := range []struct {
+		expr    string
+		matches []string
+	}{
+		{"", []string{"arp", "icmp4", "icmp6", "tcp4", "tcp4 fragment", "tcp4 options", "tcp6", "truncated", "udp4", "udp6"}},
+		{"ip", []string{"icmp4", "tcp4", "tcp4 fragment", "tcp4 options", "truncated", "udp4"}},
+		{"ip6", []string{"icmp6", "tcp6", "udp6"}},
+		{"arp", []string{"arp"}},
+		{"tcp", []string{"tcp4", "tcp4 fragment", "tcp4 options", "tcp6"}},
+		{"udp", []string{"udp4", "udp6"}},
+		{"icmp", []string{"icmp4"}},
+		{"icmp6", []string{"icmp6"}},
+		// the ports of the fragments are unknown
+		{"port 80", []string{"tcp4", "tcp4 options", "tcp6"}},
+		{"src port 1234", []string{"tcp4", "tcp4 options", "tcp6"}},
+		{"dst port 1234", []string{}},
+		{"dst port 53", []string{"udp4", "udp6"}},
+		{"host 10.0.0.2", []string{"icmp4", "tcp4", "tcp4 fragment", "tcp4 options", "udp4"}},
+		{"src host 10.0.0.2", []string{"icmp4", "udp4"}},
+		{"dst host fd00::2", []string{"tcp6"}},
+		{"host fd00::53", []string{"udp6"}},
+		{"tcp and not port 80", []string{"tcp4 fragment"}},
+		{"not (ip or ip6)", []string{"arp"}},
+		{"!tcp && (port 53 || icmp6)", []string{"icmp6", "udp4", "udp6"}},
+		{"ip6 and tcp or arp", []string{"arp", "tcp6"}},
+		{"not not arp", []string{"arp"}},
+	} {
+		raw, err := compileFilter(test.expr)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		program, ok := bpf.Disassemble(raw)
+		if !ok {
+			t.Errorf("%q: cannot disassemble %v", test.expr, raw)
+			continue
+		}
+		vm, err := bpf.NewVM(program)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		matches := []string{}
+		for name, frame := range filterFrames {
+			accepted, err := vm.Run(frame)
+			if err != nil {
+				t.Errorf("%q: %s: %v", test.expr, name, err)
+				continue
+			}
+			// the kernel keeps the whole packet when the program
+			// returns more than its length
+			switch {
+			case accepted == 0:
+			case accepted >= len(frame):
+				matches = append(matches, name)
+			default:
+				t.Errorf("%q: %s: %d bytes of %d accepted", test.expr, name, accepted, len(frame))
+			}
+		}
+		sort.Strings(matches)
+		if strings.Join(matches, ",") != strings.Join(test.matches, ",") {
+			t.Errorf("%q: expected to match %v, matched %v", test.expr, test.matches, matches)
+		}
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"port",
+		"port 0",
+		"port 70000",
+		"host example.com",
+		"src tcp",
+		"tcp and",
+		"(tcp",
+		"tcp)",
+		"tcp udp",
+		"vlan",
+		// the jumps of classic BPF skip 255 instructions at most
+		strings.Repeat("port 1 or ", 100) + "port 1",
+	} {
+		if _, err := compileFilter(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !386
+// +build !386
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// sysGetsockopt is the number of the getsockopt(2) system call
+const sysGetsockopt = unix.SYS_GETSOCKOPT
@@ -0,0 +1,5 @@
+package main
+
+// sysGetsockopt is the number of the getsockopt(2) system call, which
+// 386 only has since Linux 4.3, socketcall(2) aside
+const sysGetsockopt = 365
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// HTTP faults are injected by an HTTP/1.1 proxy, the outbound TCP
+// connections of the container to the selected destination ports are
+// redirected to it. The proxy finds the original destination of each
+// connection, forwards the requests to it and fails, delays, aborts or
+// throttles the ones matching the faults. Connections which do not start
+// with an HTTP request, TLS for instance, are forwarded untouched.
+
+const (
+	// httpTable is the nftables table redirecting the HTTP traffic
+	httpTable = "network-control-http"
+	// httpDialTimeout bounds the connections to the original
+	// destinations
+	httpDialTimeout = 10 * time.Second
+	// soOriginalDst is the socket option returning the destination of
+	// a redirected connection, see include/uapi/linux/netfilter_ipv4.h
+	soOriginalDst = 80
+)
+
+// defaultHTTPPorts are the destination ports intercepted by default
+var defaultHTTPPorts = []int{80}
+
+// HTTPImpairment is the behaviour of the HTTP proxy
+type HTTPImpairment struct {
+	// Ports are the intercepted destination ports, 80 by default
+	Ports []int `yaml:"ports,omitempty" json:"ports,omitempty"`
+	// Faults are tried in order, the first one matching a request
+	// applies
+	Faults []HTTPFault `yaml:"faults" json:"faults"`
+}
+
+// HTTPFault is injected in the requests matching Host and Path
+type HTTPFault struct {
+	// Host is a glob pattern matched against the Host header without
+	// port, e.g. orders*, empty matches every host
+	Host string `yaml:"host,omitempty" json:"host,omitempty"`
+	// Path is a prefix of the path of the requests, e.g. /api/
+	Path string `yaml:"path,omitempty" json:"path,omitempty"`
+	// Percentage of the matching requests which are impaired, all of
+	// them by default
+	Percentage string `yaml:"percentage,omitempty" json:"percentage,omitempty"`
+	// Status answers the requests with this status code instead of
+	// forwarding them, e.g. 503
+	Status int `yaml:"status,omitempty" json:"status,omitempty"`
+	// Delay delays the requests, e.g. 2s
+	Delay string `yaml:"delay,omitempty" json:"delay,omitempty"`
+	// Abort closes the connection instead of answering
+	Abort bool `yaml:"abort,omitempty" json:"abort,omitempty"`
+	// Rate throttles the responses, e.g. 100kbit
+	Rate string `yaml:"rate,omitempty" json:"rate,omitempty"`
+}
+
+// Validate checks the HTTP impairment
+func (h *HTTPImpairment) Validate() error {
+	for _, port := range h.Ports {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	if len(h.Faults) == 0 {
+		return fmt.Errorf("no HTTP fault")
+	}
+	for i := range h.Faults {
+		if err := h.Faults[i].Validate(); err != nil {
+			return fmt.Errorf("fault %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the HTTP fault
+func (f *HTTPFault) Validate() error {
+	if f.Status == 0 && f.Delay == "" && !f.Abort && f.Rate == "" {
+		return fmt.Errorf("no status, delay, abort or rate")
+	}
+	if f.Status != 0 && (f.Status < 100 || f.Status > 599) {
+		return fmt.Errorf("invalid status %d", f.Status)
+	}
+	if f.Status != 0 && f.Abort {
+		return fmt.Errorf("a fault either answers with a status or aborts")
+	}
+	if _, err := path.Match(f.Host, ""); err != nil {
+		return fmt.Errorf("invalid host pattern %q", f.Host)
+	}
+	if f.Path != "" && !strings.HasPrefix(f.Path, "/") {
+		return fmt.Errorf("invalid path %q, it must start with /", f.Path)
+	}
+	if f.Percentage != "" {
+		if _, err := parsePercentage(f.Percentage); err != nil {
+			return err
+		}
+	}
+	if f.Delay != "" {
+		if _, err := parseTCTime(f.Delay); err != nil {
+			return err
+		}
+	}
+	if f.Rate != "" {
+		if _, err := parseTCRate(f.Rate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ports returns the intercepted ports
+func (h HTTPImpairment) ports() []int {
+	if len(h.Ports) == 0 {
+		return defaultHTTPPorts
+	}
+	return h.Ports
+}
+
+func (h HTTPImpairment) String() string {
+	ports := []string{}
+	for _, port := range h.ports() {
+		ports = append(ports, strconv.Itoa(port))
+	}
+	faults := []string{}
+	for _, f := range h.Faults {
+		faults = append(faults, f.String())
+	}
+	return fmt.Sprintf("port %s: %s", strings.Join(ports, ","), strings.Join(faults, "; "))
+}
+
+func (f HTTPFault) String() string {
+	terms := []string{}
+	if f.Host != "" {
+		terms = append(terms, "host "+f.Host)
+	}
+	if f.Path != "" {
+		terms = append(terms, "path "+f.Path)
+	}
+	if f.Percentage != "" {
+		terms = append(terms, f.Percentage)
+	}
+	if f.Delay != "" {
+		terms = append(terms, "delay "+f.Delay)
+	}
+	if f.Status != 0 {
+		terms = append(terms, "status "+strconv.Itoa(f.Status))
+	}
+	if f.Abort {
+		terms = append(terms, "abort")
+	}
+	if f.Rate != "" {
+		terms = append(terms, "rate "+f.Rate)
+	}
+	return strings.Join(terms, " ")
+}
+
+// httpRedirectRules returns the rules redirecting the connections to
+// ports to the port of the proxy
+func httpRedirectRules(ports []int, port string) []string {
+	rules := []string{}
+	for _, p := range ports {
+		rules = append(rules, fmt.Sprintf("tcp dport %d redirect to :%s", p, port))
+	}
+	return rules
+}
+
+// httpProxy serves the redirected HTTP connections of a network
+// namespace
+type httpProxy struct {
+	*netNSProxy
+	listener *net.TCPListener
+
+	lock       sync.Mutex
+	impairment HTTPImpairment
+}
+
+// startHTTPProxy starts a proxy in the network namespace of pid and
+// redirects the connections to the ports of impairment to it, gone is
+// called if the network namespace loses its processes
+func startHTTPProxy(pid int, netNSID string, impairment HTTPImpairment, gone func(p *httpProxy)) (*httpProxy, error) {
+	base, err := newNetNSProxy("HTTP", pid, netNSID, httpTable)
+	if err != nil {
+		return nil, err
+	}
+	p := &httpProxy{netNSProxy: base, impairment: impairment}
+	err = p.listen(func() ([]io.Closer, error) {
+		var err error
+		if p.listener, err = net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+			return nil, err
+		}
+		return []io.Closer{p.listener}, nil
+	})
+	if err == nil {
+		err = p.redirect(httpRedirectRules(impairment.ports(), listenerPort(p.listener.Addr()))...)
+	}
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	go p.serve()
+	go p.watch(func() { gone(p) })
+	log.Infof("HTTP proxy of network namespace %s listening on port %s", netNSID, listenerPort(p.listener.Addr()))
+	return p, nil
+}
+
+// set replaces the impairment of the proxy, the redirection is updated
+// when the ports change
+func (p *httpProxy) set(impairment HTTPImpairment) error {
+	p.lock.Lock()
+	previous := p.impairment
+	p.impairment = impairment
+	p.lock.Unlock()
+	if reflect.DeepEqual(previous.ports(), impairment.ports()) {
+		return nil
+	}
+	return p.redirect(httpRedirectRules(impairment.ports(), listenerPort(p.listener.Addr()))...)
+}
+
+// Impairment returns the impairment of the proxy
+func (p *httpProxy) Impairment() HTTPImpairment {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.impairment
+}
+
+func (p *httpProxy) serve() {
+	for {
+		conn, err := p.listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		go p.serveConn(conn)
+	}
+}
+
+// serveConn forwards the requests of a redirected connection to its
+// original destination
+func (p *httpProxy) serveConn(conn *net.TCPConn) {
+	defer conn.Close()
+	dst, err := originalDestination(conn)
+	if err != nil {
+		log.Debugf("HTTP proxy of network namespace %s: %v", p.netNSID, err)
+		return
+	}
+	upstream, err := p.dial(dst, true, httpDialTimeout)
+	if err != nil {
+		log.Debugf("HTTP proxy of network namespace %s: %v", p.netNSID, err)
+		return
+	}
+	defer upstream.Close()
+
+	client := bufio.NewReader(conn)
+	if !startsWithHTTPMethod(client) {
+		pipe(conn, client, upstream)
+		return
+	}
+	server := bufio.NewReader(upstream)
+	for {
+		req, err := http.ReadRequest(client)
+		if err != nil {
+			return
+		}
+		fault, impaired := p.fault(req)
+		if impaired {
+			if !p.inject(conn, req, fault) {
+				return
+			}
+			if fault.Status != 0 {
+				// the request was answered by the proxy
+				if req.Close {
+					return
+				}
+				continue
+			}
+		}
+		if err := req.Write(upstream); err != nil {
+			return
+		}
+		resp, err := http.ReadResponse(server, req)
+		if err != nil {
+			return
+		}
+		var w io.Writer = conn
+		if impaired && fault.Rate != "" {
+			rate, _ := parseTCRate(fault.Rate)
+			w = &throttledWriter{w: conn, rate: rate}
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// the connection is not HTTP anymore
+			resp.Write(w)
+			pipe(conn, client, upstream)
+			return
+		}
+		err = resp.Write(w)
+		resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// fault returns the fault injected in req, false if it is not impaired
+func (p *httpProxy) fault(req *http.Request) (HTTPFault, bool) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, fault := range p.Impairment().Faults {
+		if !globMatch(strings.ToLower(fault.Host), host) || !strings.HasPrefix(req.URL.Path, fault.Path) {
+			continue
+		}
+		if fault.Percentage != "" {
+			percentage, _ := parsePercentage(fault.Percentage)
+			if rand.Float64() >= percentage {
+				return HTTPFault{}, false
+			}
+		}
+		return fault, true
+	}
+	return HTTPFault{}, false
+}
+
+// inject delays req and answers it with the status of fault, it returns
+// false if the connection must be closed
+func (p *httpProxy) inject(conn net.Conn, req *http.Request, fault HTTPFault) bool {
+	if fault.Delay != "" {
+		delay, _ := parseTCTime(fault.Delay)
+		time.Sleep(delay)
+	}
+	if fault.Abort {
+		return false
+	}
+	if fault.Status == 0 {
+		return true
+	}
+	// the body of the request is not forwarded
+	io.Copy(ioutil.Discard, req.Body)
+	body := fmt.Sprintf("fault injected by network control: %d %s\n", fault.Status, http.StatusText(fault.Status))
+	resp := &http.Response{
+		StatusCode:    fault.Status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         req.Close,
+	}
+	return resp.Write(conn) == nil
+}
+
+// originalDestination returns the destination of conn before its
+// redirection
+func originalDestination(conn *net.TCPConn) (*net.TCPAddr, error) {
+	f, err := conn.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// a struct sockaddr_in fits in the structure
+	mreq, err := syscall.GetsockoptIPv6Mreq(int(f.Fd()), syscall.IPPROTO_IP, soOriginalDst)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the original destination: %v", err)
+	}
+	raw := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(raw[4], raw[5], raw[6], raw[7]).To4(),
+		Port: int(raw[2])<<8 | int(raw[3]),
+	}, nil
+}
+
+// httpMethods are the methods recognized at the start of a connection
+var httpMethods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "PATCH ", "OPTIONS ", "TRACE ", "CONNECT "}
+
+// startsWithHTTPMethod tells whether the connection read by r starts
+// with an HTTP request
+func startsWithHTTPMethod(r *bufio.Reader) bool {
+	start, _ := r.Peek(8)
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(start, []byte(method)) {
+			return true
+		}
+	}
+	return false
+}
+
+// pipe copies the data between the client, read through client, and
+// upstream until both directions are closed
+func pipe(conn *net.TCPConn, client io.Reader, upstream net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, client)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	conn.CloseWrite()
+	<-done
+}
+
+// throttledWriter writes at most rate bytes per second
+type throttledWriter struct {
+	w    io.Writer
+	rate uint64
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	// chunks of a tenth of a second
+	chunk := int(t.rate / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+	written := 0
+	for written < len(b) {
+		end := written + chunk
+		if end > len(b) {
+			end = len(b)
+		}
+		start := time.Now()
+		n, err := t.w.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		time.Sleep(time.Duration(uint64(n)*uint64(time.Second)/t.rate) - time.Since(start))
+	}
+	return written, nil
+}
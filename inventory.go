@@ -0,0 +1,601 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+)
+
+// The inventory is the actual network configuration of the network
+// namespaces of the containers: their interfaces, addresses, routes and
+// neighbours, read over netlink from inside each network namespace. It
+// is read when a network namespace appears and read again whenever its
+// netlink notifications tell that it changed.
+
+const (
+	// inventoryRefreshDelay gathers the notifications of a change, e.g.
+	// the addresses and routes of an interface going up, in one refresh
+	inventoryRefreshDelay = time.Second
+	// inventoryPollInterval is how often a watcher without notifications
+	// checks whether it must stop
+	inventoryPollInterval = time.Second
+)
+
+// netlink and ethtool constants missing from the syscall package, see
+// linux/rtnetlink.h, linux/if_link.h, linux/neighbour.h and
+// linux/ethtool.h
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpNeigh      = 0x4
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6Ifaddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+
+	iflaInfoKind = 1
+
+	ndaDst      = 1
+	ndaLLAddr   = 2
+	nudNoarp    = 0x40
+	sizeofNdMsg = 12
+
+	siocEthtool     = 0x8946
+	ethtoolGDrvinfo = 0x3
+)
+
+// operStates are the names of the IFLA_OPERSTATE values, RFC 2863
+var operStates = []string{"unknown", "notpresent", "down", "lowerlayerdown", "testing", "dormant", "up"}
+
+// neighbourStates are the names of the NUD_* states
+var neighbourStates = []struct {
+	state uint16
+	name  string
+}{
+	{0x01, "incomplete"},
+	{0x02, "reachable"},
+	{0x04, "stale"},
+	{0x08, "delay"},
+	{0x10, "probe"},
+	{0x20, "failed"},
+	{nudNoarp, "noarp"},
+	{0x80, "permanent"},
+}
+
+// NetworkInterface is a link of a network namespace
+type NetworkInterface struct {
+	Index int    `json:"index"`
+	Name  string `json:"name"`
+	// State is the operational state, e.g. up or lowerlayerdown
+	State string `json:"state"`
+	MTU   int    `json:"mtu"`
+	MAC   string `json:"mac,omitempty"`
+	// Driver is the driver reported by ethtool, or else the kind of the
+	// link, e.g. veth
+	Driver string `json:"driver,omitempty"`
+	// Master is the bridge or bond the link is enslaved to
+	Master string `json:"master,omitempty"`
+	// Addresses are the IPv4 and IPv6 addresses with their prefix
+	// length
+	Addresses []string `json:"addresses"`
+}
+
+// NetworkRoute is a route of the main or of another routing table, the
+// routes of the local table are left out
+type NetworkRoute struct {
+	// Destination is a prefix or default
+	Destination string `json:"destination"`
+	Gateway     string `json:"gateway,omitempty"`
+	Device      string `json:"device,omitempty"`
+	// Source is the preferred source address
+	Source string `json:"source,omitempty"`
+	Metric int    `json:"metric,omitempty"`
+	// Table is only set out of the main table
+	Table int `json:"table,omitempty"`
+}
+
+// NetworkNeighbour is an entry of the ARP or NDP cache
+type NetworkNeighbour struct {
+	Address string `json:"address"`
+	MAC     string `json:"mac,omitempty"`
+	Device  string `json:"device"`
+	State   string `json:"state"`
+}
+
+// NetworkInventory is the network configuration of a network namespace
+type NetworkInventory struct {
+	NetNS      string             `json:"netns"`
+	Updated    time.Time          `json:"updated"`
+	Interfaces []NetworkInterface `json:"interfaces"`
+	Routes     []NetworkRoute     `json:"routes"`
+	Neighbours []NetworkNeighbour `json:"neighbours"`
+	// Error is set when the configuration could not be read
+	Error string `json:"error,omitempty"`
+}
+
+// inventoryWatcher keeps the inventory of a network namespace, the
+// handle of the network namespace keeps it alive until the watcher stops
+type inventoryWatcher struct {
+	name  string
+	netNS ns.NetNS
+	// changed is called after each refresh
+	changed func()
+
+	lock      sync.Mutex
+	inventory NetworkInventory
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Inventories keeps the inventory of the network namespaces of the
+// running containers
+type Inventories struct {
+	store   *Store
+	changes chan struct{}
+
+	lock     sync.Mutex
+	watchers map[string]*inventoryWatcher
+}
+
+// NewInventories instantiates a new Inventories
+func NewInventories(store *Store) *Inventories {
+	return &Inventories{
+		store:    store,
+		changes:  make(chan struct{}, 1),
+		watchers: map[string]*inventoryWatcher{},
+	}
+}
+
+// Changes returns the channel receiving a value when inventories were
+// read since the last receive, it is not shared
+func (i *Inventories) Changes() <-chan struct{} {
+	return i.changes
+}
+
+func (i *Inventories) notify() {
+	select {
+	case i.changes <- struct{}{}:
+	default:
+	}
+}
+
+// Start watches the network namespaces of the running containers as
+// they come and go, it never returns
+func (i *Inventories) Start() {
+	changes := i.store.Changes()
+	for {
+		i.reconcile()
+		<-changes
+	}
+}
+
+// Get returns the inventory of a network namespace
+func (i *Inventories) Get(netNSID string) (NetworkInventory, bool) {
+	i.lock.Lock()
+	w, ok := i.watchers[netNSID]
+	i.lock.Unlock()
+	if !ok {
+		return NetworkInventory{}, false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.inventory, true
+}
+
+// reconcile starts watching the new network namespaces and stops
+// watching the ones without running containers
+func (i *Inventories) reconcile() {
+	running := map[string]Container{}
+	i.store.ForEach(func(containerID string, container Container) {
+		if container.State != Running || container.NetNSID == "" {
+			return
+		}
+		if _, ok := running[container.NetNSID]; !ok || container.Sandbox {
+			running[container.NetNSID] = container
+		}
+	})
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for netNSID, w := range i.watchers {
+		if _, ok := running[netNSID]; !ok {
+			delete(i.watchers, netNSID)
+			w.stop()
+		}
+	}
+	for netNSID, container := range running {
+		if _, ok := i.watchers[netNSID]; ok {
+			continue
+		}
+		w, err := i.watch(i.store.NetNSPID(container), container)
+		if err != nil {
+			log.Warnf("Failed to read the network configuration of %s: %v", container.Name, err)
+			continue
+		}
+		i.watchers[netNSID] = w
+	}
+}
+
+// watch reads the inventory of the network namespace of pid and reads
+// it again on its netlink notifications
+func (i *Inventories) watch(pid int, container Container) (*inventoryWatcher, error) {
+	netNS, err := ns.GetNS(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return nil, err
+	}
+	// the socket stays in the network namespace it is created in
+	fd := -1
+	err = netNS.Do(func(ns.NetNS) error {
+		var err error
+		fd, err = subscribeNetlink()
+		return err
+	})
+	if err != nil {
+		netNS.Close()
+		return nil, err
+	}
+	w := &inventoryWatcher{
+		name:    container.Name,
+		netNS:   netNS,
+		changed: i.notify,
+		done:    make(chan struct{}),
+	}
+	w.refresh(container.NetNSID)
+	go w.run(fd, container.NetNSID)
+	return w, nil
+}
+
+// subscribeNetlink opens a netlink socket in the current network
+// namespace receiving the changes of the links, addresses, routes and
+// neighbours
+func subscribeNetlink() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+	groups := uint32(rtmgrpLink | rtmgrpNeigh | rtmgrpIPv4Ifaddr | rtmgrpIPv4Route | rtmgrpIPv6Ifaddr | rtmgrpIPv6Route)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		syscall.Close(fd)
+		return -1, os.NewSyscallError("bind", err)
+	}
+	// a blocked read does not return when the socket is closed
+	tv := syscall.NsecToTimeval(int64(inventoryPollInterval))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return -1, os.NewSyscallError("setsockopt", err)
+	}
+	return fd, nil
+}
+
+// run reads the inventory again after the notifications until the
+// watcher stops
+func (w *inventoryWatcher) run(fd int, netNSID string) {
+	defer syscall.Close(fd)
+	buf := make([]byte, syscall.Getpagesize())
+	var pending time.Time
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		_, _, err := syscall.Recvfrom(fd, buf, 0)
+		switch err {
+		case nil:
+			if pending.IsZero() {
+				pending = time.Now()
+			}
+		case syscall.EAGAIN, syscall.EINTR:
+		case syscall.ENOBUFS:
+			// notifications were lost, the refresh sees their changes
+			pending = time.Now()
+		default:
+			log.Errorf("Failed to receive the netlink notifications of %s: %v", w.name, err)
+			return
+		}
+		if !pending.IsZero() && time.Since(pending) >= inventoryRefreshDelay {
+			pending = time.Time{}
+			w.refresh(netNSID)
+		}
+	}
+}
+
+func (w *inventoryWatcher) stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+		w.netNS.Close()
+	})
+}
+
+// refresh reads the inventory
+func (w *inventoryWatcher) refresh(netNSID string) {
+	inventory := NetworkInventory{}
+	err := w.netNS.Do(func(ns.NetNS) error {
+		var err error
+		inventory, err = readInventory()
+		return err
+	})
+	inventory.NetNS = netNSID
+	inventory.Updated = time.Now()
+	if err != nil {
+		log.Errorf("Failed to read the network configuration of %s: %v", w.name, err)
+		inventory.Error = err.Error()
+	}
+	w.lock.Lock()
+	w.inventory = inventory
+	w.lock.Unlock()
+	w.changed()
+}
+
+// readInventory reads the configuration of the current network namespace
+func readInventory() (NetworkInventory, error) {
+	inventory := NetworkInventory{
+		Interfaces: []NetworkInterface{},
+		Routes:     []NetworkRoute{},
+		Neighbours: []NetworkNeighbour{},
+	}
+	links, err := netlinkDump(syscall.RTM_GETLINK, syscall.RTM_NEWLINK)
+	if err != nil {
+		return inventory, fmt.Errorf("failed to list the links: %v", err)
+	}
+	names := map[int]string{}
+	masters := map[int]int{}
+	for _, m := range links {
+		if len(m.Data) < syscall.SizeofIfInfomsg {
+			continue
+		}
+		info := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+		attrs := netlinkAttrs(m.Data[syscall.SizeofIfInfomsg:])
+		iface := NetworkInterface{
+			Index:     int(info.Index),
+			Name:      attrString(attrs[syscall.IFLA_IFNAME]),
+			State:     operStates[0],
+			MTU:       int(attrUint32(attrs[syscall.IFLA_MTU])),
+			Addresses: []string{},
+		}
+		if state := attrs[syscall.IFLA_OPERSTATE]; len(state) > 0 && int(state[0]) < len(operStates) {
+			iface.State = operStates[state[0]]
+		}
+		if mac := attrs[syscall.IFLA_ADDRESS]; len(mac) == 6 {
+			iface.MAC = net.HardwareAddr(mac).String()
+		}
+		if iface.Driver = ethtoolDriver(iface.Name); iface.Driver == "" {
+			iface.Driver = attrString(netlinkAttrs(attrs[syscall.IFLA_LINKINFO])[iflaInfoKind])
+		}
+		if master := attrs[syscall.IFLA_MASTER]; len(master) == 4 {
+			masters[iface.Index] = int(attrUint32(master))
+		}
+		names[iface.Index] = iface.Name
+		inventory.Interfaces = append(inventory.Interfaces, iface)
+	}
+	// the masters are listed with the other links
+	for n, iface := range inventory.Interfaces {
+		if master, ok := masters[iface.Index]; ok {
+			inventory.Interfaces[n].Master = names[master]
+		}
+	}
+	sort.Sort(byIndex(inventory.Interfaces))
+
+	addrs, err := netlinkDump(syscall.RTM_GETADDR, syscall.RTM_NEWADDR)
+	if err != nil {
+		return inventory, fmt.Errorf("failed to list the addresses: %v", err)
+	}
+	for _, m := range addrs {
+		if len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		info := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+		attrs := netlinkAttrs(m.Data[syscall.SizeofIfAddrmsg:])
+		// IFA_LOCAL is the address of a point to point link, IFA_ADDRESS
+		// the one of its peer
+		ip := net.IP(attrs[syscall.IFA_LOCAL])
+		if ip == nil {
+			ip = net.IP(attrs[syscall.IFA_ADDRESS])
+		}
+		if ip == nil {
+			continue
+		}
+		address := fmt.Sprintf("%s/%d", ip, info.Prefixlen)
+		for n := range inventory.Interfaces {
+			if inventory.Interfaces[n].Index == int(info.Index) {
+				inventory.Interfaces[n].Addresses = append(inventory.Interfaces[n].Addresses, address)
+			}
+		}
+	}
+
+	routes, err := netlinkDump(syscall.RTM_GETROUTE, syscall.RTM_NEWROUTE)
+	if err != nil {
+		return inventory, fmt.Errorf("failed to list the routes: %v", err)
+	}
+	for _, m := range routes {
+		if len(m.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		info := (*syscall.RtMsg)(unsafe.Pointer(&m.Data[0]))
+		attrs := netlinkAttrs(m.Data[syscall.SizeofRtMsg:])
+		table := int(info.Table)
+		if t := attrs[syscall.RTA_TABLE]; len(t) == 4 {
+			table = int(attrUint32(t))
+		}
+		if table == syscall.RT_TABLE_LOCAL {
+			continue
+		}
+		route := NetworkRoute{
+			Destination: "default",
+			Gateway:     ipString(attrs[syscall.RTA_GATEWAY]),
+			Device:      names[int(attrUint32(attrs[syscall.RTA_OIF]))],
+			Source:      ipString(attrs[syscall.RTA_PREFSRC]),
+			Metric:      int(attrUint32(attrs[syscall.RTA_PRIORITY])),
+		}
+		if dst := attrs[syscall.RTA_DST]; dst != nil {
+			route.Destination = fmt.Sprintf("%s/%d", net.IP(dst), info.Dst_len)
+		}
+		if info.Type != syscall.RTN_UNICAST {
+			// e.g. blackhole or unreachable
+			route.Destination = fmt.Sprintf("%s %s", routeType(info.Type), route.Destination)
+		}
+		if table != syscall.RT_TABLE_MAIN {
+			route.Table = table
+		}
+		inventory.Routes = append(inventory.Routes, route)
+	}
+
+	neighbours, err := netlinkDump(syscall.RTM_GETNEIGH, syscall.RTM_NEWNEIGH)
+	if err != nil {
+		return inventory, fmt.Errorf("failed to list the neighbours: %v", err)
+	}
+	for _, m := range neighbours {
+		if len(m.Data) < sizeofNdMsg {
+			continue
+		}
+		// struct ndmsg: family, padding, ifindex, state, flags and type
+		index := int(int32(binary.LittleEndian.Uint32(m.Data[4:8])))
+		state := binary.LittleEndian.Uint16(m.Data[8:10])
+		attrs := netlinkAttrs(m.Data[sizeofNdMsg:])
+		ip := ipString(attrs[ndaDst])
+		// the multicast addresses are not resolved
+		if ip == "" || state == nudNoarp {
+			continue
+		}
+		neighbour := NetworkNeighbour{
+			Address: ip,
+			Device:  names[index],
+			State:   neighbourState(state),
+		}
+		if mac := attrs[ndaLLAddr]; len(mac) == 6 {
+			neighbour.MAC = net.HardwareAddr(mac).String()
+		}
+		inventory.Neighbours = append(inventory.Neighbours, neighbour)
+	}
+	return inventory, nil
+}
+
+// netlinkDump dumps the objects of a netlink request in the current
+// network namespace and returns the messages of type typ
+func netlinkDump(request, typ int) ([]syscall.NetlinkMessage, error) {
+	raw, err := syscall.NetlinkRIB(request, syscall.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := syscall.ParseNetlinkMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	selected := []syscall.NetlinkMessage{}
+	for _, m := range messages {
+		if int(m.Header.Type) == typ {
+			selected = append(selected, m)
+		}
+	}
+	return selected, nil
+}
+
+// netlinkAttrs parses the route attributes of b by type, the nested
+// attributes are left to parse
+func netlinkAttrs(b []byte) map[uint16][]byte {
+	attrs := map[uint16][]byte{}
+	for len(b) >= syscall.SizeofRtAttr {
+		length := int(binary.LittleEndian.Uint16(b[0:2]))
+		typ := binary.LittleEndian.Uint16(b[2:4]) &^ syscall.NLA_F_NESTED
+		if length < syscall.SizeofRtAttr || length > len(b) {
+			break
+		}
+		attrs[typ] = b[syscall.SizeofRtAttr:length]
+		aligned := (length + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return attrs
+}
+
+func attrString(b []byte) string {
+	return strings.TrimRight(string(b), "\x00")
+}
+
+func attrUint32(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+// ipString formats an IPv4 or IPv6 address attribute, empty if there is
+// none
+func ipString(b []byte) string {
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return ""
+	}
+	return net.IP(b).String()
+}
+
+// routeType names the route types other than unicast
+func routeType(typ uint8) string {
+	switch typ {
+	case syscall.RTN_BLACKHOLE:
+		return "blackhole"
+	case syscall.RTN_UNREACHABLE:
+		return "unreachable"
+	case syscall.RTN_PROHIBIT:
+		return "prohibit"
+	case syscall.RTN_MULTICAST:
+		return "multicast"
+	}
+	return fmt.Sprintf("type %d", typ)
+}
+
+// neighbourState names the NUD_* flags of state
+func neighbourState(state uint16) string {
+	names := []string{}
+	for _, s := range neighbourStates {
+		if state&s.state != 0 {
+			names = append(names, s.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// ethtoolDriver returns the driver of an interface of the current
+// network namespace, empty if it has none, e.g. the loopback
+func ethtoolDriver(name string) string {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return ""
+	}
+	defer syscall.Close(fd)
+	// struct ethtool_drvinfo, the driver follows the command, it is
+	// allocated on the heap since the kernel gets its address in ifreq
+	info := make([]byte, 196)
+	binary.LittleEndian.PutUint32(info[0:], ethtoolGDrvinfo)
+	// struct ifreq, the name and a pointer to the data
+	var ifreq struct {
+		name [syscall.IFNAMSIZ]byte
+		data uintptr
+		_    [16]byte
+	}
+	copy(ifreq.name[:syscall.IFNAMSIZ-1], name)
+	ifreq.data = uintptr(unsafe.Pointer(&info[0]))
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocEthtool, uintptr(unsafe.Pointer(&ifreq))); errno != 0 {
+		return ""
+	}
+	return attrString(info[4:36])
+}
+
+type byIndex []NetworkInterface
+
+func (s byIndex) Len() int           { return len(s) }
+func (s byIndex) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byIndex) Less(i, j int) bool { return s[i].Index < s[j].Index }
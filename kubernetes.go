@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The Kubernetes client watches the pods scheduled on the node through
+// the API server and keeps their network control annotations in the
+// store. It lists the pods, then watches them from the version of the
+// list until the API server ends the watch, and starts again.
+
+const (
+	// watchTimeout is how long the API server keeps a watch open
+	watchTimeout = 5 * time.Minute
+	// watchRetryInterval is the delay before listing the pods again
+	// after a failure
+	watchRetryInterval = 10 * time.Second
+)
+
+type k8sObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Annotations     map[string]string `json:"annotations"`
+}
+
+type k8sPod struct {
+	Metadata k8sObjectMeta `json:"metadata"`
+	Status   k8sPodStatus  `json:"status"`
+}
+
+type k8sPodStatus struct {
+	Phase string `json:"phase"`
+	PodIP string `json:"podIP"`
+}
+
+type k8sPodList struct {
+	Metadata k8sObjectMeta `json:"metadata"`
+	Items    []k8sPod      `json:"items"`
+}
+
+type k8sWatchEvent struct {
+	// Type is ADDED, MODIFIED, DELETED or ERROR
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type k8sStatus struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+// k8sAPI requests the API server
+type k8sAPI struct {
+	client *http.Client
+	url    string
+	token  string
+}
+
+// newK8sAPI instantiates a new k8sAPI requesting the API server of cfg
+func newK8sAPI(cfg KubernetesConfig) (*k8sAPI, error) {
+	apiURL := cfg.URL
+	if apiURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("not running in a pod, the URL of the API server is required")
+		}
+		apiURL = "https://" + net.JoinHostPort(host, port)
+	}
+	c := &k8sAPI{
+		client: &http.Client{},
+		url:    strings.TrimSuffix(apiURL, "/"),
+	}
+	if cfg.TokenFile != "" {
+		raw, err := ioutil.ReadFile(cfg.TokenFile)
+		switch {
+		case err == nil:
+			c.token = strings.TrimSpace(string(raw))
+		case !os.IsNotExist(err):
+			return nil, fmt.Errorf("failed to read the token: %v", err)
+		}
+	}
+	if strings.HasPrefix(c.url, "https://") && cfg.CA != "" {
+		pool, err := loadCertPool(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+		c.client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		}
+	}
+	return c, nil
+}
+
+// get requests path, it fails unless the API server answers OK
+func (c *k8sAPI) get(path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.url+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		status := k8sStatus{}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return nil, fmt.Errorf("the API server returned %s: %s", resp.Status, status.Message)
+	}
+	return resp, nil
+}
+
+// KubernetesClient watches the pods of the node
+type KubernetesClient struct {
+	store *Store
+	api   *k8sAPI
+	node  string
+}
+
+// NewKubernetesClient instantiates a new KubernetesClient watching the
+// pods of node
+func NewKubernetesClient(store *Store, cfg KubernetesConfig, node string) (*KubernetesClient, error) {
+	api, err := newK8sAPI(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &KubernetesClient{
+		store: store,
+		api:   api,
+		node:  node,
+	}, nil
+}
+
+// Start watches the pods, it never returns
+func (c *KubernetesClient) Start() {
+	log.Infof("Watching the pods of node %s on %s", c.node, c.api.url)
+	for {
+		if err := c.watch(); err != nil {
+			log.Errorf("Failed to watch the pods: %v", err)
+			time.Sleep(watchRetryInterval)
+		}
+	}
+}
+
+// watch lists the pods and watches them until the API server ends the
+// watch
+func (c *KubernetesClient) watch() error {
+	resp, err := c.get(url.Values{})
+	if err != nil {
+		return err
+	}
+	list := k8sPodList{}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("invalid pod list: %v", err)
+	}
+	pods := map[string]map[string]string{}
+	for _, pod := range list.Items {
+		pods[podKey(pod.Metadata.Namespace, pod.Metadata.Name)] = networkControlAnnotations(pod.Metadata.Annotations)
+	}
+	c.store.SetPods(pods)
+
+	resp, err = c.get(url.Values{
+		"watch":           {"true"},
+		"resourceVersion": {list.Metadata.ResourceVersion},
+		"timeoutSeconds":  {fmt.Sprintf("%d", int(watchTimeout.Seconds()))},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := k8sWatchEvent{}
+		if err := decoder.Decode(&event); err != nil {
+			// the API server ended the watch
+			return nil
+		}
+		if event.Type == "ERROR" {
+			status := k8sStatus{}
+			json.Unmarshal(event.Object, &status)
+			// 410 Gone: the version is too old, list again
+			if status.Code == http.StatusGone {
+				return nil
+			}
+			return fmt.Errorf("watch error: %s", status.Message)
+		}
+		pod := k8sPod{}
+		if err := json.Unmarshal(event.Object, &pod); err != nil {
+			return fmt.Errorf("invalid pod: %v", err)
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			c.store.SetPod(pod.Metadata.Namespace, pod.Metadata.Name, networkControlAnnotations(pod.Metadata.Annotations))
+		case "DELETED":
+			c.store.DeletePod(pod.Metadata.Namespace, pod.Metadata.Name)
+		}
+	}
+}
+
+// get requests the pods of the node
+func (c *KubernetesClient) get(query url.Values) (*http.Response, error) {
+	query.Set("fieldSelector", "spec.nodeName="+c.node)
+	return c.api.get("/api/v1/pods", query)
+}
+
+// networkControlAnnotations returns the annotations of a pod which
+// declare impairments
+func networkControlAnnotations(annotations map[string]string) map[string]string {
+	filtered := map[string]string{}
+	for key, value := range annotations {
+		if strings.HasPrefix(key, podAnnotationPrefix) {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
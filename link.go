@@ -0,0 +1,537 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+)
+
+// Link faults act on the interface of the container itself: it is set
+// down for a while, flapped down and up or given a lower MTU, and the
+// ICMP fragmentation-needed messages can be dropped so that path MTU
+// discovery fails and the large packets are black-holed. The original
+// state and MTU of the interface are restored when the faults are
+// cleared, when they expire and when the plugin stops.
+
+const (
+	// linkTable is the nftables table dropping the ICMP
+	// fragmentation-needed messages
+	linkTable = "network-control-link"
+	// minMTU is the smallest MTU of an IPv4 interface
+	minMTU = 68
+	// defaultFlapDuty is the part of the flap period the interface is
+	// down by default
+	defaultFlapDuty = "50%"
+)
+
+// linkRequirements are the preflight features the link faults need,
+// blocking the fragmentation-needed messages needs nft too
+var linkRequirements = []string{featureIP, featureCapNetAdmin, featureCapSysAdmin}
+
+// LinkImpairment is a set of link faults. Down and flapping are
+// exclusive, the MTU and the blocking of the fragmentation-needed
+// messages combine with either.
+type LinkImpairment struct {
+	// Down sets the interface down for this duration, e.g. 30s, it is
+	// set up again afterwards
+	Down string `yaml:"down,omitempty" json:"down,omitempty"`
+	// FlapPeriod sets the interface down and up again every period,
+	// e.g. 10s, until the faults are cleared
+	FlapPeriod string `yaml:"flap_period,omitempty" json:"flap_period,omitempty"`
+	// FlapDuty is the percentage of the period the interface is down,
+	// 50% by default
+	FlapDuty string `yaml:"flap_duty,omitempty" json:"flap_duty,omitempty"`
+	// MTU replaces the MTU of the interface, it must be lower
+	MTU int `yaml:"mtu,omitempty" json:"mtu,omitempty"`
+	// BlockFragNeeded drops the ICMP fragmentation-needed messages
+	// received and sent by the container
+	BlockFragNeeded bool `yaml:"block_frag_needed,omitempty" json:"block_frag_needed,omitempty"`
+}
+
+// Validate checks the link faults
+func (l *LinkImpairment) Validate() error {
+	if l.Down == "" && l.FlapPeriod == "" && l.MTU == 0 && !l.BlockFragNeeded {
+		return fmt.Errorf("no link down, flap period, MTU or frag-needed blocking")
+	}
+	if l.Down != "" && l.FlapPeriod != "" {
+		return fmt.Errorf("the link is either set down or flapped")
+	}
+	if l.Down != "" {
+		if _, err := parseLinkDuration(l.Down); err != nil {
+			return err
+		}
+	}
+	if l.FlapPeriod != "" {
+		if _, err := parseLinkDuration(l.FlapPeriod); err != nil {
+			return err
+		}
+	}
+	if l.FlapDuty != "" {
+		if l.FlapPeriod == "" {
+			return fmt.Errorf("a flap duty needs a flap period")
+		}
+		if duty, err := parsePercentage(l.FlapDuty); err != nil || duty == 0 || duty == 1 {
+			return fmt.Errorf("invalid flap duty %q, the link must be down and up during the period", l.FlapDuty)
+		}
+	}
+	if l.MTU < 0 || l.MTU > 0 && l.MTU < minMTU {
+		return fmt.Errorf("invalid MTU %d, it must be at least %d", l.MTU, minMTU)
+	}
+	return nil
+}
+
+// requirements returns the preflight features the faults need
+func (l *LinkImpairment) requirements() []string {
+	if l.BlockFragNeeded {
+		return append(append([]string{}, linkRequirements...), featureNFT)
+	}
+	return linkRequirements
+}
+
+func (l LinkImpairment) String() string {
+	settings := []string{}
+	if l.Down != "" {
+		settings = append(settings, "down "+l.Down)
+	}
+	if l.FlapPeriod != "" {
+		settings = append(settings, fmt.Sprintf("flap every %s, down %s", l.FlapPeriod, l.duty()))
+	}
+	if l.MTU > 0 {
+		settings = append(settings, fmt.Sprintf("mtu %d", l.MTU))
+	}
+	if l.BlockFragNeeded {
+		settings = append(settings, "frag-needed blocked")
+	}
+	return strings.Join(settings, ", ")
+}
+
+func (l LinkImpairment) duty() string {
+	if l.FlapDuty == "" {
+		return defaultFlapDuty
+	}
+	return l.FlapDuty
+}
+
+// parseLinkDuration parses the duration the link is down or the flap
+// period
+func parseLinkDuration(value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return duration, nil
+}
+
+// linkState is the state of an interface the link faults change. The
+// kernel removes the routes through the interface and its static IPv6
+// addresses when it goes down and only adds the prefix routes of the
+// remaining addresses back when it comes up.
+type linkState struct {
+	Up            bool
+	MTU           int
+	IPv6Addresses []string
+	Routes        []linkRoute
+}
+
+// linkRoute is a route through an interface as ip shows it, without
+// the flags ip does not take back
+type linkRoute struct {
+	// Family is -4 or -6
+	Family string
+	Route  string
+}
+
+// routeFlags are the words of the routes shown by ip which are states
+// rather than arguments
+var routeFlags = map[string]bool{
+	"linkdown": true,
+	"dead":     true,
+}
+
+// readLinkState returns the state of device in the network namespace
+// netNS
+func readLinkState(netNS, device string) (linkState, error) {
+	var state linkState
+	err := ns.WithNetNSPath(netNS, func(ns.NetNS) error {
+		iface, err := net.InterfaceByName(device)
+		if err != nil {
+			return err
+		}
+		state = linkState{Up: iface.Flags&net.FlagUp != 0, MTU: iface.MTU}
+		return nil
+	})
+	if err != nil {
+		return linkState{}, fmt.Errorf("failed to read the state of %s: %v", device, err)
+	}
+	if state.IPv6Addresses, err = readIPv6Addresses(netNS, device); err != nil {
+		return linkState{}, err
+	}
+	if state.Routes, err = readLinkRoutes(netNS, device); err != nil {
+		return linkState{}, err
+	}
+	return state, nil
+}
+
+// readIPv6Addresses returns the static global IPv6 addresses of device
+// in the network namespace netNS, with their prefix length
+func readIPv6Addresses(netNS, device string) ([]string, error) {
+	output, err := commandOutput(netNS, []string{"ip", "-6", "address", "show", "dev", device, "scope", "global", "permanent"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the addresses of %s: %v", device, err)
+	}
+	addresses := []string{}
+	for _, line := range nonEmptyLines(output) {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "inet6" {
+			addresses = append(addresses, fields[1])
+		}
+	}
+	return addresses, nil
+}
+
+// readLinkRoutes returns the IPv4 and IPv6 routes of the main table
+// through device in the network namespace netNS
+func readLinkRoutes(netNS, device string) ([]linkRoute, error) {
+	routes := []linkRoute{}
+	for _, family := range []string{"-4", "-6"} {
+		output, err := commandOutput(netNS, []string{"ip", family, "route", "show"})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the routes through %s: %v", device, err)
+		}
+		routes = append(routes, parseLinkRoutes(family, device, output)...)
+	}
+	return routes, nil
+}
+
+// parseLinkRoutes returns the routes through device in the output of
+// ip route show
+func parseLinkRoutes(family, device, output string) []linkRoute {
+	routes := []linkRoute{}
+	for _, line := range nonEmptyLines(output) {
+		words := []string{}
+		through := false
+		fields := strings.Fields(line)
+		for i, field := range fields {
+			if field == "dev" && i+1 < len(fields) && fields[i+1] == device {
+				through = true
+			}
+			if !routeFlags[field] {
+				words = append(words, field)
+			}
+		}
+		if through {
+			routes = append(routes, linkRoute{Family: family, Route: strings.Join(words, " ")})
+		}
+	}
+	return routes
+}
+
+// missingRouteCommands returns the ip commands adding back the routes
+// of original which are not in current, in their original order so
+// that the gateways are reachable when their routes are added
+func missingRouteCommands(original, current []linkRoute) [][]string {
+	present := map[linkRoute]bool{}
+	for _, route := range current {
+		present[route] = true
+	}
+	cmds := [][]string{}
+	for _, route := range original {
+		if !present[route] {
+			cmd := []string{"ip", route.Family, "route", "replace"}
+			cmds = append(cmds, append(cmd, strings.Fields(route.Route)...))
+		}
+	}
+	return cmds
+}
+
+// linkStateCommand returns the ip command setting device up or down
+func linkStateCommand(device string, up bool) []string {
+	if up {
+		return []string{"ip", "link", "set", "dev", device, "up"}
+	}
+	return []string{"ip", "link", "set", "dev", device, "down"}
+}
+
+// linkMTUCommand returns the ip command setting the MTU of device
+func linkMTUCommand(device string, mtu int) []string {
+	return []string{"ip", "link", "set", "dev", device, "mtu", strconv.Itoa(mtu)}
+}
+
+// blockFragNeededCommands returns the nftables commands dropping the
+// ICMP fragmentation-needed messages in and out of the network
+// namespace
+func blockFragNeededCommands() [][]string {
+	cmds := [][]string{{"nft", "add", "table", "ip", linkTable}}
+	for _, hook := range []string{"input", "output"} {
+		cmds = append(cmds,
+			[]string{"nft", "add", "chain", "ip", linkTable, hook, "{", "type", "filter", "hook", hook, "priority", "0", ";", "}"},
+			[]string{"nft", "add", "rule", "ip", linkTable, hook, "icmp", "type", "destination-unreachable", "icmp", "code", "frag-needed", "drop"},
+		)
+	}
+	return cmds
+}
+
+// linkFault is the link faults of a network namespace and the original
+// state of its interface
+type linkFault struct {
+	netNSID    string
+	netNS      string
+	device     string
+	impairment LinkImpairment
+	original   linkState
+
+	lock sync.Mutex
+	// down is whether the fault currently holds the interface down
+	down bool
+
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// startLinkFault injects impairment on the interface iface,
+// ended is called once the faults are over by themselves, after the
+// link was down for the requested duration or because the network
+// namespace is gone
+func startLinkFault(iface NetInterface, netNSID string, impairment LinkImpairment, ended func(*linkFault)) (*linkFault, error) {
+	original, err := readLinkState(iface.NetNS, iface.Device)
+	if err != nil {
+		return nil, err
+	}
+	if impairment.MTU >= original.MTU {
+		return nil, fmt.Errorf("MTU %d is not lower than the MTU %d of %s", impairment.MTU, original.MTU, iface.Device)
+	}
+	f := &linkFault{
+		netNSID:    netNSID,
+		netNS:      iface.NetNS,
+		device:     iface.Device,
+		impairment: impairment,
+		original:   original,
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	cmds := [][]string{}
+	if impairment.BlockFragNeeded {
+		// a table left by a previous instance of the plugin is replaced
+		runCommands(f.netNS, [][]string{removeRedirectCommand(linkTable)})
+		cmds = append(cmds, blockFragNeededCommands()...)
+	}
+	if impairment.MTU > 0 {
+		cmds = append(cmds, linkMTUCommand(f.device, impairment.MTU))
+	}
+	// the link goes down right away, then run sets it up
+	f.down = impairment.Down != "" || impairment.FlapPeriod != ""
+	if f.down {
+		cmds = append(cmds, linkStateCommand(f.device, false))
+	}
+	if err := runCommands(f.netNS, cmds); err != nil {
+		close(f.stopped)
+		f.restore()
+		return nil, err
+	}
+	if !f.down {
+		close(f.stopped)
+		return f, nil
+	}
+	go f.run(ended)
+	return f, nil
+}
+
+// Impairment returns the faults still in effect, the link is no longer
+// down once the duration is over
+func (f *linkFault) Impairment() LinkImpairment {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.impairment
+}
+
+// run sets the link, already down, up and down again until the faults
+// are stopped, ended is called if they end by themselves
+func (f *linkFault) run(ended func(*linkFault)) {
+	defer close(f.stopped)
+	if f.impairment.Down != "" {
+		duration, _ := parseLinkDuration(f.impairment.Down)
+		if !f.wait(duration) || !f.setDown(false) {
+			f.end(ended)
+			return
+		}
+		log.Infof("link of network namespace %s is up again after %s", f.netNSID, f.impairment.Down)
+		f.lock.Lock()
+		f.impairment.Down = ""
+		over := f.impairment == (LinkImpairment{})
+		f.lock.Unlock()
+		if over {
+			f.end(ended)
+		}
+		return
+	}
+	period, _ := parseLinkDuration(f.impairment.FlapPeriod)
+	duty, _ := parsePercentage(f.impairment.duty())
+	down := time.Duration(float64(period) * duty)
+	for f.wait(down) && f.setDown(false) && f.wait(period-down) && f.setDown(true) {
+	}
+	f.end(ended)
+}
+
+// end calls ended unless the faults were stopped
+func (f *linkFault) end(ended func(*linkFault)) {
+	select {
+	case <-f.done:
+	default:
+		ended(f)
+	}
+}
+
+// alive tells whether the network namespace still has the process the
+// faults were injected through
+func (f *linkFault) alive() bool {
+	link, err := os.Readlink(f.netNS)
+	return err == nil && link == "net:["+f.netNSID+"]"
+}
+
+// setDown sets the link down or up, false if the faults are over
+func (f *linkFault) setDown(down bool) bool {
+	select {
+	case <-f.done:
+		return false
+	default:
+	}
+	if !f.alive() {
+		log.Infof("link faults of network namespace %s stopped, the network namespace is gone", f.netNSID)
+		return false
+	}
+	if err := runCommands(f.netNS, [][]string{linkStateCommand(f.device, !down)}); err != nil {
+		log.Errorf("failed to set the link of network namespace %s down or up: %v", f.netNSID, err)
+		return false
+	}
+	f.lock.Lock()
+	f.down = down
+	f.lock.Unlock()
+	if !down {
+		if err := f.restoreAddressing(); err != nil {
+			log.Error(err)
+		}
+	}
+	return true
+}
+
+// restoreAddressing adds back the original IPv6 addresses and routes of
+// the interface the kernel removed while it was down
+func (f *linkFault) restoreAddressing() error {
+	addresses, err := readIPv6Addresses(f.netNS, f.device)
+	if err != nil {
+		return err
+	}
+	present := map[string]bool{}
+	for _, address := range addresses {
+		present[address] = true
+	}
+	cmds := [][]string{}
+	for _, address := range f.original.IPv6Addresses {
+		if !present[address] {
+			cmds = append(cmds, []string{"ip", "-6", "address", "replace", address, "dev", f.device})
+		}
+	}
+	// the prefix routes of the addresses are back before the others
+	if err := runCommands(f.netNS, cmds); err != nil {
+		return fmt.Errorf("failed to restore the addresses of network namespace %s: %v", f.netNSID, err)
+	}
+	current, err := readLinkRoutes(f.netNS, f.device)
+	if err != nil {
+		return err
+	}
+	errs := []string{}
+	// the other routes are restored even if one fails
+	for _, cmd := range missingRouteCommands(f.original.Routes, current) {
+		if err := runCommands(f.netNS, [][]string{cmd}); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to restore the routes of network namespace %s: %s", f.netNSID, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// wait waits for duration, false if the faults are stopped meanwhile
+func (f *linkFault) wait(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-f.done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Stop stops setting the link down and up and restores the original
+// state of the interface
+func (f *linkFault) Stop() error {
+	f.stopOnce.Do(func() {
+		close(f.done)
+	})
+	<-f.stopped
+	return f.restore()
+}
+
+// restore restores the original state of the interface and removes
+// the blocking of the fragmentation-needed messages, it goes on after
+// a failure so that as much as possible is restored
+func (f *linkFault) restore() error {
+	if !f.alive() {
+		// the network namespace is gone with its interface
+		return nil
+	}
+	f.lock.Lock()
+	impairment, down := f.impairment, f.down
+	f.lock.Unlock()
+	cmds := [][]string{}
+	if impairment.MTU > 0 {
+		cmds = append(cmds, linkMTUCommand(f.device, f.original.MTU))
+	}
+	linkChanged := down || impairment.FlapPeriod != ""
+	if linkChanged {
+		cmds = append(cmds, linkStateCommand(f.device, f.original.Up))
+	}
+	if impairment.BlockFragNeeded {
+		cmds = append(cmds, removeRedirectCommand(linkTable))
+	}
+	errs := []string{}
+	for _, cmd := range cmds {
+		if err := runCommands(f.netNS, [][]string{cmd}); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if linkChanged && f.original.Up {
+		if err := f.restoreAddressing(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to restore the link of network namespace %s: %s", f.netNSID, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// plannedLinkCommands returns the commands injecting impairment on
+// device, logged in dry-run mode
+func plannedLinkCommands(device string, impairment LinkImpairment) [][]string {
+	cmds := [][]string{}
+	if impairment.BlockFragNeeded {
+		cmds = append(cmds, blockFragNeededCommands()...)
+	}
+	if impairment.MTU > 0 {
+		cmds = append(cmds, linkMTUCommand(device, impairment.MTU))
+	}
+	if impairment.Down != "" || impairment.FlapPeriod != "" {
+		cmds = append(cmds, linkStateCommand(device, false), linkStateCommand(device, true))
+	}
+	return cmds
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The TCP listener serves the same endpoints as the unix socket to
+// remote clients. It always uses TLS, clients authenticate with a
+// bearer token or with a certificate signed by the client CA, and their
+// credential grants the read, the apply or the node permission.
+
+// readOnlyPaths are the endpoints allowed by the read permission, the
+// packets captured hold the payloads and require the apply permission
+var readOnlyPaths = map[string]bool{
+	"/report":                true,
+	apiPrefix + "status":     true,
+	apiPrefix + "containers": true,
+	apiPrefix + "plan":       true,
+	apiPrefix + "node":       true,
+	apiPrefix + "captures":   true,
+	apiPrefix + "probes":     true,
+	apiPrefix + "throughput": true,
+	apiPrefix + "interfaces": true,
+}
+
+const (
+	// the remote clients must send their requests within these times,
+	// there is no write timeout since the captures are streamed while
+	// they run
+	listenerReadHeaderTimeout = 10 * time.Second
+	listenerReadTimeout       = time.Minute
+	listenerIdleTimeout       = 2 * time.Minute
+)
+
+// requiredPermission returns the permission needed to call path, the
+// node endpoints require the node permission and the others the apply
+// permission
+func requiredPermission(path string) string {
+	switch {
+	case readOnlyPaths[path]:
+		return permissionRead
+	case strings.HasPrefix(path, apiPrefix+"node/"):
+		return permissionNode
+	}
+	return permissionApply
+}
+
+// setupTCPListener listens on the address of the configuration with TLS
+func setupTCPListener(cfg ListenConfig) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.ClientCA != "" {
+		pool, err := loadCertPool(cfg.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		// clients may authenticate with a token instead
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.ClientCAs = pool
+	}
+	listener, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %q: %v", cfg.Address, err)
+	}
+	log.Infof("Listening on: tcp://%s", cfg.Address)
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// newTCPServer returns the server of the TCP listener, authenticating
+// the requests before handler
+func newTCPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           authenticate(handler),
+		ReadHeaderTimeout: listenerReadHeaderTimeout,
+		ReadTimeout:       listenerReadTimeout,
+		IdleTimeout:       listenerIdleTimeout,
+	}
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no certificate in %s", file)
+	}
+	return pool, nil
+}
+
+// authenticate wraps handler, requests must present a credential with
+// the permission the endpoint requires
+func authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credential, ok := findCredential(r, currentConfig().Listen.Credentials)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="network-control"`)
+			sendAPIResponse(w, nil, &apiError{code: http.StatusUnauthorized, err: fmt.Errorf("authentication required")})
+			return
+		}
+		required := requiredPermission(r.URL.Path)
+		if permissionRanks[credential.Permission] < permissionRanks[required] {
+			log.Warnf("%s: %s %s denied, %s permission only", credential.Name, r.Method, r.URL.Path, credential.Permission)
+			sendAPIResponse(w, nil, &apiError{code: http.StatusForbidden, err: fmt.Errorf("credential %q is not allowed to %s %s, it requires the %s permission", credential.Name, r.Method, r.URL.Path, required)})
+			return
+		}
+		if required != permissionRead {
+			log.Infof("%s: %s %s from %s", credential.Name, r.Method, r.URL.Path, r.RemoteAddr)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// findCredential returns the credential matching the verified client
+// certificate or the bearer token of r
+func findCredential(r *http.Request, credentials []Credential) (Credential, bool) {
+	commonName := ""
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		commonName = r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	token := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	for _, c := range credentials {
+		if c.CommonName != "" && c.CommonName == commonName {
+			return c, true
+		}
+		if c.Token != "" && token != "" && subtle.ConstantTimeCompare([]byte(c.Token), []byte(token)) == 1 {
+			return c, true
+		}
+	}
+	return Credential{}, false
+}
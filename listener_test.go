@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"testing"
+)
+
+func TestRequiredPermission(t *testing.T) {
+	for _, test := range []struct {
+		path     string
+		expected string
+	}{
+		{"/report", permissionRead},
+		{apiPrefix + "status", permissionRead},
+		{apiPrefix + "containers", permissionRead},
+		{apiPrefix + "plan", permissionRead},
+		{apiPrefix + "node", permissionRead},
+		{apiPrefix + "captures", permissionRead},
+		{apiPrefix + "probes", permissionRead},
+		{apiPrefix + "throughput", permissionRead},
+		{apiPrefix + "interfaces", permissionRead},
+		// the packets captured hold the payloads
+		{apiPrefix + "captures/pcap", permissionApply},
+		{apiPrefix + "captures/start", permissionApply},
+		{apiPrefix + "captures/remove", permissionApply},
+		{apiPrefix + "apply", permissionApply},
+		{apiPrefix + "clear", permissionApply},
+		{apiPrefix + "reset", permissionApply},
+		{apiPrefix + "probes/start", permissionApply},
+		{apiPrefix + "throughput/start", permissionApply},
+		{"/control", permissionApply},
+		{apiPrefix + "node/apply", permissionNode},
+		{apiPrefix + "node/clear", permissionNode},
+		{apiPrefix + "node/plan", permissionNode},
+		// the paths are not cleaned
+		{apiPrefix + "status/", permissionApply},
+		{"/api/v1//status", permissionApply},
+		{apiPrefix + "unknown", permissionApply},
+	} {
+		if permission := requiredPermission(test.path); permission != test.expected {
+			t.Errorf("%s: expected the %s permission, got %s", test.path, test.expected, permission)
+		}
+	}
+}
+
+func TestFindCredential(t *testing.T) {
+	credentials := []Credential{
+		{Name: "reader", Token: "read-token", Permission: permissionRead},
+		{Name: "ci", CommonName: "ci.example.com", Permission: permissionApply},
+		{Name: "ops", Token: "ops-token", Permission: permissionNode},
+	}
+	verified := func(commonName string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	for _, test := range []struct {
+		name          string
+		authorization string
+		tls           *tls.ConnectionState
+		expected      string
+	}{
+		{name: "token", authorization: "Bearer read-token", expected: "reader"},
+		{name: "other token", authorization: "Bearer ops-token", expected: "ops"},
+		{name: "token with spaces", authorization: "Bearer  ops-token ", expected: "ops"},
+		{name: "wrong token", authorization: "Bearer ops"},
+		{name: "empty token", authorization: "Bearer "},
+		{name: "basic authentication", authorization: "Basic cmVhZC10b2tlbg=="},
+		{name: "token without scheme", authorization: "read-token"},
+		{name: "nothing"},
+		{name: "certificate", tls: verified("ci.example.com"), expected: "ci"},
+		{name: "unknown certificate", tls: verified("other.example.com")},
+		{
+			name: "certificate not verified",
+			tls: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "ci.example.com"}}},
+			},
+		},
+		{name: "certificate without common name", tls: verified("")},
+		// the first credential matching wins
+		{name: "certificate and token", authorization: "Bearer ops-token", tls: verified("ci.example.com"), expected: "ci"},
+		{name: "unknown certificate and token", authorization: "Bearer ops-token", tls: verified("other.example.com"), expected: "ops"},
+	} {
+		r, err := http.NewRequest("GET", "https://node-1:8443"+apiPrefix+"status", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		r.TLS = test.tls
+		credential, ok := findCredential(r, credentials)
+		if ok != (test.expected != "") || credential.Name != test.expected {
+			t.Errorf("%s: expected credential %q, got %q, %v", test.name, test.expected, credential.Name, ok)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"net"
 	"net/http"
@@ -15,30 +16,16 @@ import (
 
 // TODO:
 //
-// do not try to install the qdics on the network interface ever
-// time, skip this step if it is already installed (currently we do
-// "replace" instead of "add", but this check may be a way of avoiding
-// more one-time installation steps in future).
-//
 // somehow inform the user about the current traffic control state
 // (either add some metadata about latency or maybe add background
 // color to buttons jhortcut reports as a part of a response to the
 // control request
 //
-// detect if ip and tc binaries are in $PATH
-//
-// detect if required sch_netem kernel module is loaded; note that in
-// some (rare) cases this might be compiled in the kernel instead of
-// being a separate module; probably check if tc works, if it does not
-// return something like "not implemented".
-//
 // add traffic control on ingress traffic too (ifb kernel module will
 // be required)
 //
 // currently we can control latency, add controls for packet loss and
 // bandwidth
-//
-// port to eBPF?
 
 type containerClient interface {
 	Start()
@@ -47,15 +34,16 @@ type containerClient interface {
 // Plugin is the internal data structure
 type Plugin struct {
 	reporter *Reporter
+	api      *API
 
 	clients []containerClient
 }
 
 // TrafficControlStatus keeps track of parameters status
 type TrafficControlStatus struct {
-	dpod	   string
 	latency    string
 	packetLoss string
+	rate       string
 }
 
 
@@ -71,14 +59,14 @@ type NetworkControlStatus struct {
 // String is useful to easily create a string of the traffic control plugin internal status.
 // Useful for debugging
 func (tcs *TrafficControlStatus) String() string {
-	return fmt.Sprintf("%s %s", tcs.latency, tcs.packetLoss)
+	return fmt.Sprintf("%s %s %s", tcs.latency, tcs.packetLoss, tcs.rate)
 }
 
 // SetLatency sets the latency value
 // the convention is that empty latency is represented by '-'
 func (tcs *TrafficControlStatus) SetLatency(latency string) {
 	if latency == "" {
-		tcs.latency = "-"
+		latency = "-"
 	}
 	tcs.latency = latency
 }
@@ -87,37 +75,92 @@ func (tcs *TrafficControlStatus) SetLatency(latency string) {
 // the convention is that empty packet loss is represented by '-'
 func (tcs *TrafficControlStatus) SetPacketLoss(packetLoss string) {
 	if packetLoss == "" {
-		tcs.packetLoss = "-"
+		packetLoss = "-"
 	}
 	tcs.packetLoss = packetLoss
 }
 
+// SetRate sets the rate value
+// the convention is that empty rate is represented by '-'
+func (tcs *TrafficControlStatus) SetRate(rate string) {
+	if rate == "" {
+		rate = "-"
+	}
+	tcs.rate = rate
+}
+
 // TrafficControlStatusInit initializes with the convention that empty values are '-'
 func TrafficControlStatusInit() *TrafficControlStatus {
 	return &TrafficControlStatus{
-		dpod:	"-",
 		latency:    "-",
 		packetLoss: "-",
+		rate:       "-",
 	}
 }
 
 // TrafficControlStatusCache implements status caching
-var trafficControlStatusCache map[string]*TrafficControlStatus
 var neworkControlStatusCache map[string]*NetworkControlStatus
 
 func main() {
-	// We put the socket in a sub-directory to have more control on the permissions
-	const socketPath = "/var/run/scope/plugins/network-control/network-control.sock"
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ctl":
+			os.Exit(runCtl(os.Args[2:]))
+		case "coordinator":
+			os.Exit(runCoordinator(os.Args[2:]))
+		}
+	}
+	configPath := flag.String("config", defaultConfigPath, "path of the configuration file")
+	for _, o := range configOptions {
+		flag.Var(&optionFlag{boolean: o.boolean}, o.name, fmt.Sprintf("%s (env %s)", o.usage, o.env()))
+	}
+	flag.Parse()
+	flags := map[string]string{}
+	configPathSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			configPathSet = true
+			return
+		}
+		flags[f.Name] = f.Value.String()
+	})
+
+	loader := NewConfigLoader(*configPath, configPathSet, flags)
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatalf("Failed to load the configuration: %v", err)
+	}
+	setConfig(cfg)
+	socketPath := cfg.Socket
+
+	backend, err := NewBackend(cfg.Backend)
+	if err != nil {
+		log.Fatalf("Failed to create a backend: %v", err)
+	}
+	log.Infof("Using the %s traffic control backend", backend.Name())
+
+	snapshots, err := NewSnapshotStore(cfg.SnapshotDir)
+	if err != nil {
+		log.Fatalf("Failed to load the qdisc snapshots: %v", err)
+	}
+
+	captures, err := NewCaptures(cfg.Capture.Dir)
+	if err != nil {
+		log.Fatalf("Failed to load the packet captures: %v", err)
+	}
+	probes := NewProbes()
+	throughput := NewThroughputs()
+	controller := NewController(backend, snapshots)
 
-	// Handle the exit signal
-	setupSignals(socketPath)
+	// Handle the exit and reload signals
+	setupSignals(socketPath, loader, controller)
 
 	listener, err := setupSocket(socketPath)
 	if err != nil {
 		log.Fatalf("Failed to setup socket: %v", err)
 	}
 
-	plugin, err := NewPlugin()
+	plugin, err := NewPlugin(controller, captures, probes, throughput)
 	if err != nil {
 		log.Fatalf("Failed to create a plugin: %v", err)
 	}
@@ -135,40 +178,95 @@ func main() {
 	controlHandler := http.HandlerFunc(plugin.control)
 	trafficControlServeMux.Handle("/control", controlHandler)
 
+	// API used by the ctl command
+	plugin.api.Register(trafficControlServeMux)
+
+	if cfg.Listen.Address != "" {
+		tcpListener, err := setupTCPListener(cfg.Listen)
+		if err != nil {
+			log.Fatalf("Failed to setup TCP listener: %v", err)
+		}
+		go func() {
+			if err := newTCPServer(trafficControlServeMux).Serve(tcpListener); err != nil {
+				log.Fatalf("failed to serve on %s: %v", cfg.Listen.Address, err)
+			}
+		}()
+	}
+
 	log.Println("Listening...")
 	if err = http.Serve(listener, trafficControlServeMux); err != nil {
-		fmt.Errorf("failed to serve: %v", err)
 		log.Fatalf("failed to serve: %v", err)
 	}
 }
 
-func setupSignals(socketPath string) {
+func setupSignals(socketPath string, loader *ConfigLoader, controller *Controller) {
 	log.Debugf("enter setupSignals for socketPath %s", socketPath)  // billzhang 2017-04-04
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-interrupt
+		controller.Shutdown()
 		os.RemoveAll(filepath.Dir(socketPath))
 		os.Exit(0)
 	}()
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			loader.Reload()
+		}
+	}()
 }
 
-func NewPlugin() (*Plugin, error) {
+func NewPlugin(controller *Controller, captures *Captures, probes *Probes, throughput *Throughputs) (*Plugin, error) {
 	store := NewStore()
-	dockerClient, err := NewDockerClient(store)
+	dockerClient, err := NewDockerClient(store, currentConfig().DockerEndpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create a docker client: %v", err)
 	}
-	reporter := NewReporter(store)
+	preflight := SkipPreflight()
+	if currentConfig().Features.Preflight {
+		preflight = RunPreflight()
+	}
+	inventories := NewInventories(store)
+	resets := NewResets(controller)
+	reporter := NewReporter(store, preflight, controller, captures, probes, throughput, inventories, resets)
 	plugin := &Plugin{
 		reporter: reporter,
+		api:      NewAPI(store, preflight, controller, captures, probes, throughput, inventories, resets, reporter),
 		clients: []containerClient{
 			dockerClient,
 		},
 	}
+	if currentConfig().Kubernetes.Watch {
+		kubernetesClient, err := NewKubernetesClient(store, currentConfig().Kubernetes, currentConfig().NodeName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a kubernetes client: %v", err)
+		}
+		plugin.clients = append(plugin.clients, kubernetesClient)
+	}
 	for _, client := range plugin.clients {
 		go client.Start()
 	}
+	go reporter.Start()
+	// the inodes of the network namespaces of the destroyed containers
+	// are reused, what the controller knows about them must go
+	go func() {
+		destroyed := store.Destroyed()
+		for range destroyed {
+			controller.Prune()
+		}
+	}()
+	if currentConfig().Features.AutoApply {
+		go NewDeclarations(store, controller).Start()
+	}
+	if currentConfig().Features.Inventory {
+		if len(preflight.Missing(featureCapSysAdmin)) > 0 {
+			log.Warnf("Not reading the network configuration of the containers, missing %s", featureCapSysAdmin)
+		} else {
+			go inventories.Start()
+		}
+	}
 	return plugin, nil
 }
 
@@ -223,7 +321,9 @@ func (p *Plugin) control(w http.ResponseWriter, r *http.Request) {
 		sendResponse(w, fmt.Errorf("failed to get handler: %v", err))
 		return
 	}
-	if err := handler(); err != nil {
+	err = handler()
+	p.reporter.Refresh()
+	if err != nil {
 		sendResponse(w, fmt.Errorf("handler failed: %v", err))
 		return
 	}
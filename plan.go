@@ -0,0 +1,409 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Backends describe the changes they make to an interface as a list of
+// operations, which are either executed or, in dry-run mode or when
+// asked for a plan, only reported together with the qdisc tree the
+// interface would end up with.
+
+// Operation is a step of a change to a network namespace
+type Operation struct {
+	Description string `json:"description"`
+	// Command is the tc or ip command executed in the network
+	// namespace, it is empty for the operations performed by the plugin
+	// itself
+	Command []string `json:"command,omitempty"`
+	// Optional operations may fail without stopping the change, e.g.
+	// removing a qdisc which was already removed
+	Optional bool `json:"optional,omitempty"`
+
+	run func() error
+}
+
+// commandOperation returns an operation executing cmd in the network
+// namespace
+func commandOperation(description string, cmd ...string) Operation {
+	if len(cmd) == 1 {
+		cmd = strings.Fields(cmd[0])
+	}
+	return Operation{Description: description, Command: cmd}
+}
+
+func (o Operation) String() string {
+	if len(o.Command) == 0 {
+		return o.Description
+	}
+	return fmt.Sprintf("%s: %s", o.Description, strings.Join(o.Command, " "))
+}
+
+// execute performs ops in order in the network namespace netNS, it
+// stops at the first failure of an operation which is not optional
+func execute(netNS string, ops []Operation) error {
+	for _, op := range ops {
+		var err error
+		if op.run != nil {
+			err = op.run()
+		} else {
+			err = runCommands(netNS, [][]string{op.Command})
+		}
+		if err == nil {
+			continue
+		}
+		if !op.Optional {
+			return err
+		}
+		log.Warnf("%s: failed to %s: %v", netNS, op.Description, err)
+	}
+	return nil
+}
+
+// Plan describes a change to the interface of a network namespace
+type Plan struct {
+	NetNS  string `json:"netns"`
+	Device string `json:"device"`
+	// Current and Intended are the qdiscs, classes and filters of the
+	// interface before and after the change
+	Current    []string    `json:"current"`
+	Intended   []string    `json:"intended"`
+	Operations []Operation `json:"operations"`
+}
+
+// newPlan reads the tree of dev in netNS and simulates ops on it
+func newPlan(netNS, netNSID, dev string, ops []Operation) (*Plan, error) {
+	tree, err := readTCTree(netNS, dev)
+	if err != nil {
+		return nil, err
+	}
+	return tree.plan(netNSID, dev, ops)
+}
+
+// plan simulates ops on the tree, which ends up as the intended tree
+func (t *tcTree) plan(netNSID, dev string, ops []Operation) (*Plan, error) {
+	plan := &Plan{
+		NetNS:      netNSID,
+		Device:     dev,
+		Current:    t.lines(),
+		Operations: ops,
+	}
+	for _, op := range ops {
+		if len(op.Command) == 0 {
+			continue
+		}
+		if err := t.simulate(op.Command); err != nil {
+			return nil, fmt.Errorf("failed to simulate %q: %v", strings.Join(op.Command, " "), err)
+		}
+	}
+	plan.Intended = t.lines()
+	return plan, nil
+}
+
+// Log writes the plan to the log, line by line
+func (p *Plan) Log(action string) {
+	log.Infof("dry-run: %s network namespace %s, %s", action, p.NetNS, p.Device)
+	for _, line := range p.Current {
+		log.Infof("dry-run:   current:  %s", line)
+	}
+	for _, line := range p.Intended {
+		log.Infof("dry-run:   intended: %s", line)
+	}
+	for i, op := range p.Operations {
+		log.Infof("dry-run:   %d. %s", i+1, op)
+	}
+}
+
+// treeNode is a qdisc, a class or a filter
+type treeNode struct {
+	Type    string
+	Kind    string
+	ID      string
+	Parent  string
+	Options []string
+}
+
+func (n treeNode) String() string {
+	fields := []string{n.Type}
+	if n.Kind != "" {
+		fields = append(fields, n.Kind)
+	}
+	if n.ID != "" {
+		fields = append(fields, n.ID)
+	}
+	switch {
+	case n.Type == "filter" && (n.Parent == "ingress" || n.Parent == "egress"):
+		fields = append(fields, n.Parent)
+	case n.Parent == "":
+		fields = append(fields, "root")
+	default:
+		fields = append(fields, "parent", n.Parent)
+	}
+	return strings.Join(append(fields, n.Options...), " ")
+}
+
+func (n treeNode) hook() bool {
+	return n.Type == "qdisc" && (n.Kind == "ingress" || n.Kind == "clsact")
+}
+
+func (n treeNode) root() bool {
+	return n.Type == "qdisc" && n.Parent == ""
+}
+
+// tcTree is the traffic control configuration of an interface, it
+// understands the tc commands used by the backends and the snapshots
+type tcTree struct {
+	nodes []treeNode
+	// defaultRoot is the qdisc the kernel attaches when the root is
+	// deleted
+	defaultRoot treeNode
+}
+
+// readTCTree reads the qdiscs and classes of dev and their filters,
+// the ones of the ingress and egress hooks included
+func readTCTree(netNS, dev string) (*tcTree, error) {
+	tree := &tcTree{
+		defaultRoot: treeNode{Type: "qdisc", Kind: "default", ID: "0:"},
+	}
+	for _, object := range []string{"qdisc", "class"} {
+		output, err := commandOutput(netNS, []string{"tc", object, "show", "dev", dev})
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range nonEmptyLines(output) {
+			o, err := parseTCObject(line)
+			if err != nil {
+				return nil, err
+			}
+			n := treeNode{Type: object, Kind: o.Kind, ID: o.ID, Parent: o.Parent, Options: o.Options}
+			if o.kernelDefault() && o.Parent == "" {
+				tree.defaultRoot = n
+			}
+			tree.nodes = append(tree.nodes, n)
+		}
+	}
+	parents := [][]string{}
+	for _, n := range tree.nodes {
+		switch {
+		case n.hook():
+			parents = append(parents, []string{"ingress"})
+			if n.Kind == "clsact" {
+				parents = append(parents, []string{"egress"})
+			}
+		case n.Type == "qdisc" && n.ID != "0:", n.Type == "class" && restorableClasses[n.Kind]:
+			// the filters of the objects a snapshot restores
+			parents = append(parents, []string{"parent", n.ID})
+		}
+	}
+	for _, parent := range parents {
+		output, err := commandOutput(netNS, append([]string{"tc", "filter", "show", "dev", dev}, parent...))
+		if err != nil {
+			return nil, err
+		}
+		if err := tree.addFilters(parent[len(parent)-1], output); err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+// addFilters adds the filters tc shows for parent, the indented lines
+// following a filter, e.g. the matches of u32, are part of its options
+func (t *tcTree) addFilters(parent, output string) error {
+	shown, err := splitTCFilters(output)
+	if err != nil {
+		return err
+	}
+	for _, s := range shown {
+		// tc prints a summary line per priority before the filters
+		if _, rest, err := s.header(parent); err == nil && len(rest) == 0 {
+			continue
+		}
+		options := s.fields[1:]
+		for _, line := range s.more {
+			options = append(options, strings.Fields(line)...)
+		}
+		t.nodes = append(t.nodes, treeNode{Type: "filter", Parent: parent, Options: options})
+	}
+	return nil
+}
+
+func (t *tcTree) lines() []string {
+	lines := []string{}
+	for _, n := range t.nodes {
+		lines = append(lines, n.String())
+	}
+	return lines
+}
+
+// remove deletes the nodes matching match and their descendants, the
+// children of the classes of a removed qdisc included even if the
+// classes are not in the tree, e.g. the bands of prio
+func (t *tcTree) remove(match func(n treeNode) bool) {
+	removed := map[string]bool{}
+	kept := []treeNode{}
+	for _, n := range t.nodes {
+		if match(n) {
+			if n.ID != "" {
+				removed[n.ID] = true
+			}
+			continue
+		}
+		kept = append(kept, n)
+	}
+	for {
+		remaining := []treeNode{}
+		for _, n := range kept {
+			if removed[n.Parent] || removed[strings.SplitAfter(n.Parent, ":")[0]] {
+				if n.ID != "" {
+					removed[n.ID] = true
+				}
+				continue
+			}
+			remaining = append(remaining, n)
+		}
+		if len(remaining) == len(kept) {
+			break
+		}
+		kept = remaining
+	}
+	t.nodes = kept
+}
+
+// simulate applies a tc command to the tree
+func (t *tcTree) simulate(cmd []string) error {
+	if len(cmd) < 5 || cmd[0] != "tc" || cmd[3] != "dev" {
+		return fmt.Errorf("unsupported command")
+	}
+	object, verb, args := cmd[1], cmd[2], cmd[5:]
+	n := treeNode{Type: object}
+	root := false
+	for len(args) > 0 && n.Kind == "" {
+		switch args[0] {
+		case "root":
+			root = true
+			args = args[1:]
+			continue
+		case "parent", "handle", "classid":
+			if len(args) < 2 {
+				return fmt.Errorf("missing value after %s", args[0])
+			}
+			if args[0] == "parent" {
+				n.Parent = args[1]
+			} else {
+				n.ID = args[1]
+			}
+			args = args[2:]
+			continue
+		}
+		if object == "filter" {
+			break
+		}
+		n.Kind = args[0]
+		args = args[1:]
+	}
+	n.Options = args
+
+	switch object {
+	case "qdisc":
+		return t.simulateQdisc(verb, n, root)
+	case "class":
+		if verb != "add" && verb != "replace" {
+			return fmt.Errorf("unsupported class operation %s", verb)
+		}
+		t.remove(func(c treeNode) bool { return c.Type == "class" && c.ID == n.ID })
+		t.nodes = append(t.nodes, n)
+		return nil
+	case "filter":
+		if len(n.Options) > 0 && (n.Options[0] == "ingress" || n.Options[0] == "egress") {
+			n.Parent, n.Options = n.Options[0], n.Options[1:]
+		}
+		if verb == "del" {
+			prio := filterPriority(n)
+			t.remove(func(f treeNode) bool {
+				return f.Type == "filter" && f.Parent == n.Parent && (prio == "" || filterPriority(f) == prio)
+			})
+			return nil
+		}
+		if verb == "replace" {
+			prio := filterPriority(n)
+			t.remove(func(f treeNode) bool {
+				return f.Type == "filter" && f.Parent == n.Parent && filterPriority(f) == prio
+			})
+		}
+		t.nodes = append(t.nodes, n)
+		return nil
+	}
+	return fmt.Errorf("unsupported object %s", object)
+}
+
+func (t *tcTree) simulateQdisc(verb string, n treeNode, root bool) error {
+	if n.Kind == "clsact" || n.Kind == "ingress" {
+		n.ID, n.Parent = "ffff:", "ffff:fff1"
+		hook := func(q treeNode) bool { return q.hook() }
+		switch verb {
+		case "add", "replace":
+			for _, q := range t.nodes {
+				if q.hook() && q.Kind == n.Kind {
+					return nil
+				}
+			}
+			t.removeHook(hook)
+			t.nodes = append(t.nodes, n)
+		case "del":
+			t.removeHook(hook)
+		default:
+			return fmt.Errorf("unsupported qdisc operation %s", verb)
+		}
+		return nil
+	}
+
+	attached := func(q treeNode) bool {
+		if root {
+			return q.root()
+		}
+		return q.Type == "qdisc" && !q.hook() && q.Parent == n.Parent
+	}
+	switch verb {
+	case "add", "replace":
+		t.remove(attached)
+		t.nodes = append(t.nodes, n)
+	case "change":
+		for i, q := range t.nodes {
+			if attached(q) {
+				t.nodes[i].Options = n.Options
+				return nil
+			}
+		}
+		return fmt.Errorf("no qdisc to change")
+	case "del":
+		t.remove(attached)
+		if root {
+			t.nodes = append([]treeNode{t.defaultRoot}, t.nodes...)
+		}
+	default:
+		return fmt.Errorf("unsupported qdisc operation %s", verb)
+	}
+	return nil
+}
+
+// removeHook removes the hook qdiscs and their filters
+func (t *tcTree) removeHook(match func(n treeNode) bool) {
+	t.remove(func(n treeNode) bool {
+		return match(n) || (n.Type == "filter" && (n.Parent == "ingress" || n.Parent == "egress"))
+	})
+}
+
+// filterPriority returns the priority of a filter as given to tc or as
+// printed by tc
+func filterPriority(n treeNode) string {
+	for i := 0; i+1 < len(n.Options); i++ {
+		if n.Options[i] == "prio" || n.Options[i] == "pref" {
+			return n.Options[i+1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestTree builds the tree tc would show with the given qdiscs and
+// classes, the way readTCTree does
+func newTestTree(t *testing.T, lines ...string) *tcTree {
+	tree := &tcTree{
+		defaultRoot: treeNode{Type: "qdisc", Kind: "default", ID: "0:"},
+	}
+	for _, line := range lines {
+		o, err := parseTCObject(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := treeNode{Type: strings.Fields(line)[0], Kind: o.Kind, ID: o.ID, Parent: o.Parent, Options: o.Options}
+		if o.kernelDefault() && o.Parent == "" {
+			tree.defaultRoot = n
+		}
+		tree.nodes = append(tree.nodes, n)
+	}
+	return tree
+}
+
+func TestTCTreeSimulate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		current  []string
+		commands []string
+		intended []string
+		invalid  bool
+	}{
+		{
+			name:     "replace the root",
+			current:  []string{"qdisc noqueue 0: root refcnt 2"},
+			commands: []string{"tc qdisc replace dev eth0 root handle 1: netem", "tc qdisc change dev eth0 root handle 1: netem delay 100ms"},
+			intended: []string{"qdisc netem 1: root delay 100ms"},
+		},
+		{
+			name: "delete the root and its descendants",
+			current: []string{
+				"qdisc htb 1: root refcnt 2 r2q 10 default 0x10 direct_packets_stat 0 direct_qlen 1000",
+				"class htb 1:1 root rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b",
+				"class htb 1:10 parent 1:1 rate 5Mbit ceil 10Mbit burst 1600b cburst 1600b",
+				"qdisc netem 10: parent 1:10 delay 10ms",
+			},
+			commands: []string{"tc qdisc del dev eth0 root"},
+			intended: []string{"qdisc default 0: root"},
+		},
+		{
+			name:    "the kernel default comes back",
+			current: []string{"qdisc noqueue 0: root refcnt 2"},
+			commands: []string{
+				"tc qdisc replace dev eth0 root fq",
+				"tc qdisc del dev eth0 root",
+			},
+			intended: []string{"qdisc noqueue 0: root"},
+		},
+		{
+			name:    "classes and a qdisc in a class",
+			current: []string{"qdisc noqueue 0: root refcnt 2"},
+			commands: []string{
+				"tc qdisc add dev eth0 root handle 1: htb default 10",
+				"tc class add dev eth0 parent 1: classid 1:10 htb rate 1mbit",
+				"tc class replace dev eth0 parent 1: classid 1:10 htb rate 2mbit",
+				"tc qdisc add dev eth0 parent 1:10 handle 10: netem loss 1%",
+			},
+			intended: []string{
+				"qdisc htb 1: root default 10",
+				"class htb 1:10 parent 1: rate 2mbit",
+				"qdisc netem 10: parent 1:10 loss 1%",
+			},
+		},
+		{
+			name:    "hook and its filters",
+			current: []string{"qdisc noqueue 0: root refcnt 2"},
+			commands: []string{
+				"tc qdisc replace dev eth0 clsact",
+				"tc qdisc replace dev eth0 clsact",
+				"tc filter replace dev eth0 egress prio 1 handle 1 bpf da object-pinned /sys/fs/bpf/nc/egress",
+				"tc filter replace dev eth0 egress prio 1 handle 1 bpf da object-pinned /sys/fs/bpf/nc/egress",
+				"tc filter add dev eth0 ingress prio 2 handle 1 bpf da object-pinned /sys/fs/bpf/nc/ingress",
+			},
+			intended: []string{
+				"qdisc noqueue 0: root",
+				"qdisc clsact ffff: parent ffff:fff1",
+				"filter egress prio 1 handle 1 bpf da object-pinned /sys/fs/bpf/nc/egress",
+				"filter ingress prio 2 handle 1 bpf da object-pinned /sys/fs/bpf/nc/ingress",
+			},
+		},
+		{
+			name:    "delete the hook",
+			current: []string{"qdisc noqueue 0: root refcnt 2", "qdisc clsact ffff: parent ffff:fff1"},
+			commands: []string{
+				"tc filter add dev eth0 egress prio 1 handle 1 bpf da object-pinned /sys/fs/bpf/nc/egress",
+				"tc qdisc del dev eth0 clsact",
+			},
+			intended: []string{"qdisc noqueue 0: root"},
+		},
+		{
+			name:    "delete the filters of a priority",
+			current: []string{"qdisc prio 1: root refcnt 2 bands 2"},
+			commands: []string{
+				"tc filter add dev eth0 parent 1: prio 1 protocol ip u32 match ip sport 53 0xffff flowid 1:1",
+				"tc filter add dev eth0 parent 1: prio 2 protocol ipv6 u32 match ip6 sport 53 0xffff flowid 1:1",
+				"tc filter del dev eth0 parent 1: prio 1",
+			},
+			intended: []string{
+				"qdisc prio 1: root bands 2",
+				"filter parent 1: prio 2 protocol ipv6 u32 match ip6 sport 53 0xffff flowid 1:1",
+			},
+		},
+		{
+			name:     "change without qdisc",
+			current:  []string{"qdisc noqueue 0: root refcnt 2"},
+			commands: []string{"tc qdisc change dev eth0 parent 1:2 handle 10: netem delay 1ms"},
+			invalid:  true,
+		},
+		{
+			name:     "not tc",
+			commands: []string{"ip link set dev eth0 down"},
+			invalid:  true,
+		},
+		{
+			name:     "missing value",
+			commands: []string{"tc qdisc add dev eth0 parent"},
+			invalid:  true,
+		},
+		{
+			name:     "class deletion",
+			commands: []string{"tc class del dev eth0 classid 1:1"},
+			invalid:  true,
+		},
+	} {
+		tree := newTestTree(t, test.current...)
+		var err error
+		for _, cmd := range test.commands {
+			if err = tree.simulate(strings.Fields(cmd)); err != nil {
+				break
+			}
+		}
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v", test.name, tree.lines())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if lines := tree.lines(); !reflect.DeepEqual(lines, test.intended) {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, strings.Join(test.intended, "\n"), strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func TestTCTreeFilters(t *testing.T) {
+	tree := newTestTree(t,
+		"qdisc htb 1: root refcnt 2 r2q 10 default 0x10 direct_packets_stat 0 direct_qlen 1000",
+		"qdisc clsact ffff: parent ffff:fff1",
+		"class htb 1:1 root rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b",
+	)
+	for _, filters := range []struct {
+		parent string
+		output []string
+	}{
+		{
+			parent: "1:",
+			output: []string{
+				"filter protocol ip pref 1 u32 chain 0 ",
+				"filter protocol ip pref 1 u32 chain 0 fh 800: ht divisor 1 ",
+				"filter protocol ip pref 1 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 *flowid 1:1 not_in_hw ",
+				"  match 00350000/ffff0000 at 20",
+				"  match 0a000000/ff000000 at 16",
+			},
+		},
+		{
+			parent: "1:1",
+			output: []string{
+				"filter protocol ip pref 6 bpf chain 0 ",
+				"filter protocol ip pref 6 bpf chain 0 handle 0x1 not_in_hw bytecode '1,6 0 0 4294967295'",
+			},
+		},
+		{
+			parent: "egress",
+			output: []string{
+				"filter protocol all pref 1 bpf chain 0 ",
+				"filter protocol all pref 1 bpf chain 0 handle 0x1 egress:[*fsobj] direct-action not_in_hw id 118 tag 59f4a931744dcdc6 jited ",
+			},
+		},
+	} {
+		if err := tree.addFilters(filters.parent, strings.Join(filters.output, "\n")); err != nil {
+			t.Fatalf("%s: %v", filters.parent, err)
+		}
+	}
+	expected := []string{
+		"qdisc htb 1: root r2q 10 default 0x10 direct_qlen 1000",
+		"qdisc clsact ffff: parent ffff:fff1",
+		"class htb 1:1 parent 1: rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b",
+		"filter parent 1: protocol ip pref 1 u32 chain 0 fh 800: ht divisor 1",
+		"filter parent 1: protocol ip pref 1 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 *flowid 1:1 not_in_hw match 00350000/ffff0000 at 20 match 0a000000/ff000000 at 16",
+		"filter parent 1:1 protocol ip pref 6 bpf chain 0 handle 0x1 not_in_hw bytecode '1,6 0 0 4294967295'",
+		"filter egress protocol all pref 1 bpf chain 0 handle 0x1 egress:[*fsobj] direct-action not_in_hw id 118 tag 59f4a931744dcdc6 jited",
+	}
+	if lines := tree.lines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+
+	// the filters go along with their qdisc, the hooks are untouched
+	if err := tree.simulate(strings.Fields("tc qdisc del dev eth0 root")); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"qdisc default 0: root",
+		"qdisc clsact ffff: parent ffff:fff1",
+		"filter egress protocol all pref 1 bpf chain 0 handle 0x1 egress:[*fsobj] direct-action not_in_hw id 118 tag 59f4a931744dcdc6 jited",
+	}
+	if lines := tree.lines(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+func TestNetemPlan(t *testing.T) {
+	priomap := strings.TrimSpace(strings.Repeat("1 ", 16))
+	for _, test := range []struct {
+		name     string
+		iface    NetInterface
+		status   TrafficControlStatus
+		clear    bool
+		current  []string
+		intended []string
+	}{
+		{
+			name:     "apply",
+			iface:    NetInterface{Device: "eth0"},
+			status:   TrafficControlStatus{latency: "100ms", packetLoss: "1%", rate: "-"},
+			current:  []string{"qdisc noqueue 0: root refcnt 2"},
+			intended: []string{"qdisc netem 1: root delay 100ms loss 1%"},
+		},
+		{
+			name:    "apply over a previous setting",
+			iface:   NetInterface{Device: "eth0"},
+			status:  TrafficControlStatus{latency: "-", packetLoss: "-", rate: "1mbit"},
+			current: []string{"qdisc netem 1: root refcnt 2 limit 1000 delay 100ms"},
+			// netem change replaces every parameter
+			intended: []string{"qdisc netem 1: root rate 1mbit"},
+		},
+		{
+			name:    "apply with excluded ports",
+			iface:   NetInterface{Device: "eth0", ExcludePorts: []int{53}},
+			status:  TrafficControlStatus{latency: "50ms", packetLoss: "-", rate: "-"},
+			current: []string{"qdisc noqueue 0: root refcnt 2"},
+			intended: []string{
+				"qdisc prio 1: root bands 2 priomap " + priomap,
+				"qdisc netem 10: parent 1:2 delay 50ms",
+				"filter parent 1: prio 1 protocol ip u32 match ip sport 53 0xffff flowid 1:1",
+				"filter parent 1: prio 1 protocol ip u32 match ip dport 53 0xffff flowid 1:1",
+				"filter parent 1: prio 2 protocol ipv6 u32 match ip6 sport 53 0xffff flowid 1:1",
+				"filter parent 1: prio 2 protocol ipv6 u32 match ip6 dport 53 0xffff flowid 1:1",
+			},
+		},
+		{
+			name:  "clear",
+			iface: NetInterface{Device: "eth0"},
+			clear: true,
+			current: []string{
+				"qdisc prio 1: root refcnt 2 bands 2 priomap " + priomap,
+				"qdisc netem 10: parent 1:2 limit 1000 delay 50ms",
+				"class prio 1:1 parent 1: ",
+				"class prio 1:2 parent 1: leaf 10: ",
+			},
+			intended: []string{"qdisc default 0: root"},
+		},
+		{
+			// the prio bands are not in the tree after an apply
+			name:     "clear without the classes",
+			iface:    NetInterface{Device: "eth0"},
+			clear:    true,
+			current:  []string{"qdisc prio 1: root refcnt 2 bands 2 priomap " + priomap, "qdisc netem 10: parent 1:2 limit 1000 delay 50ms"},
+			intended: []string{"qdisc default 0: root"},
+		},
+	} {
+		backend := &netemBackend{}
+		var ops []Operation
+		var err error
+		if test.clear {
+			ops, err = backend.Clear(test.iface)
+		} else {
+			ops, err = backend.Apply(test.iface, &test.status)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		plan, err := newTestTree(t, test.current...).plan("4026532350", test.iface.Device, ops)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if plan.NetNS != "4026532350" || plan.Device != "eth0" || len(plan.Operations) != len(ops) {
+			t.Errorf("%s: unexpected plan %+v", test.name, plan)
+		}
+		if len(plan.Current) != len(test.current) {
+			t.Errorf("%s: expected the current tree to have %d lines, got %v", test.name, len(test.current), plan.Current)
+		}
+		if !reflect.DeepEqual(plan.Intended, test.intended) {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, strings.Join(test.intended, "\n"), strings.Join(plan.Intended, "\n"))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The policy is checked before any impairment: the controls of the
+// protected containers are disabled in Scope and the API refuses to
+// touch them. Clearing is always allowed, it only restores the original
+// settings.
+
+// Protected returns an error telling why container may not be impaired,
+// nil if it may
+func (p *PolicyConfig) Protected(container Container) error {
+	if container.PID == os.Getpid() {
+		return fmt.Errorf("container %s is protected: it runs the network control plugin", container.Name)
+	}
+	for _, rule := range p.Deny {
+		if rule.Matches(container) {
+			return fmt.Errorf("container %s is protected: it matches the deny rule %s", container.Name, rule)
+		}
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	for _, rule := range p.Allow {
+		if rule.Matches(container) {
+			return nil
+		}
+	}
+	return fmt.Errorf("container %s is protected: it matches no allow rule", container.Name)
+}
+
+// ProtectedNetNS returns an error if any of containers, which share a
+// network namespace, is protected: impairing one impairs them all. The
+// sandbox of a pod only holds the namespace, it is ignored unless it is
+// alone.
+func (p *PolicyConfig) ProtectedNetNS(containers map[string]Container) error {
+	ids := []string{}
+	for containerID, container := range containers {
+		if container.Sandbox && len(containers) > 1 {
+			continue
+		}
+		ids = append(ids, containerID)
+	}
+	sort.Strings(ids)
+	for _, containerID := range ids {
+		if err := p.Protected(containers[containerID]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches tells whether container matches all the patterns of the rule
+func (r PolicyRule) Matches(container Container) bool {
+	if !globMatch(r.Namespace, container.Namespace) || !globMatch(r.Name, container.Name) || !globMatch(r.Image, container.Image) {
+		return false
+	}
+	for key, pattern := range r.Labels {
+		value, ok := container.Labels[key]
+		if !ok || !globMatch(pattern, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r PolicyRule) String() string {
+	terms := []string{}
+	for _, field := range []struct{ key, pattern string }{
+		{"namespace", r.Namespace},
+		{"name", r.Name},
+		{"image", r.Image},
+	} {
+		if field.pattern != "" {
+			terms = append(terms, fmt.Sprintf("%s=%s", field.key, field.pattern))
+		}
+	}
+	labels := []string{}
+	for key, pattern := range r.Labels {
+		labels = append(labels, fmt.Sprintf("label %s=%s", key, pattern))
+	}
+	sort.Strings(labels)
+	return strings.Join(append(terms, labels...), ",")
+}
+
+// globMatch tells whether value matches pattern, an empty pattern
+// matches everything
+func globMatch(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
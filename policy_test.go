@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var policyContainers = map[string]Container{
+	"web": {
+		Name:      "k8s_web_web-1_shop_0",
+		Namespace: "shop",
+		Image:     "registry.example.com/shop/web:1.2",
+		Labels:    map[string]string{"app": "web", "chaos": "enabled"},
+	},
+	"db": {
+		Name:      "k8s_db_db-0_shop_0",
+		Namespace: "shop",
+		Image:     "postgres:10",
+		Labels:    map[string]string{"app": "db"},
+	},
+	"dns": {
+		Name:      "k8s_coredns_coredns-1_kube-system_0",
+		Namespace: "kube-system",
+		Image:     "coredns/coredns:1.1",
+	},
+	"scope": {
+		Name:  "weavescope",
+		Image: "weaveworks/scope:1.13",
+	},
+	"plain": {
+		Name:  "nginx",
+		Image: "nginx",
+	},
+	"plugin": {
+		Name:  "network-control",
+		Image: "example/scope-network-control:latest",
+		PID:   os.Getpid(),
+	},
+}
+
+func policyContainerIDs() []string {
+	ids := []string{}
+	for id := range policyContainers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestPolicyRuleMatches(t *testing.T) {
+	for _, test := range []struct {
+		rule    PolicyRule
+		matches []string
+	}{
+		{PolicyRule{Namespace: "shop"}, []string{"db", "web"}},
+		{PolicyRule{Namespace: "kube-*"}, []string{"dns"}},
+		{PolicyRule{Namespace: "*"}, []string{"db", "dns", "plain", "plugin", "scope", "web"}},
+		{PolicyRule{Name: "k8s_*_shop_*"}, []string{"db", "web"}},
+		{PolicyRule{Name: "nginx"}, []string{"plain"}},
+		// the patterns match whole values
+		{PolicyRule{Name: "ngin"}, []string{}},
+		// * does not match the slashes of the images
+		{PolicyRule{Image: "*/scope*"}, []string{"plugin", "scope"}},
+		{PolicyRule{Image: "*/*/web:*"}, []string{"web"}},
+		{PolicyRule{Image: "postgres:1?"}, []string{"db"}},
+		{PolicyRule{Image: "postgres:[2-9]*"}, []string{}},
+		{PolicyRule{Labels: map[string]string{"app": "web"}}, []string{"web"}},
+		{PolicyRule{Labels: map[string]string{"app": "*"}}, []string{"db", "web"}},
+		{PolicyRule{Labels: map[string]string{"app": "[dw]*", "chaos": "enabled"}}, []string{"web"}},
+		// a label must be set, even to match an empty pattern
+		{PolicyRule{Labels: map[string]string{"chaos": ""}}, []string{"web"}},
+		{PolicyRule{Labels: map[string]string{"tier": "*"}}, []string{}},
+		{PolicyRule{Namespace: "shop", Labels: map[string]string{"app": "db"}}, []string{"db"}},
+		{PolicyRule{Namespace: "kube-system", Labels: map[string]string{"app": "db"}}, []string{}},
+	} {
+		matches := []string{}
+		for _, id := range policyContainerIDs() {
+			if test.rule.Matches(policyContainers[id]) {
+				matches = append(matches, id)
+			}
+		}
+		if strings.Join(matches, ",") != strings.Join(test.matches, ",") {
+			t.Errorf("%s: expected to match %v, matched %v", test.rule, test.matches, matches)
+		}
+	}
+}
+
+func TestPolicyProtected(t *testing.T) {
+	defaultPolicy := DefaultConfig().Policy
+	chaos := PolicyConfig{
+		Allow: []PolicyRule{{Labels: map[string]string{"chaos": "enabled"}}, {Name: "nginx"}},
+		Deny:  []PolicyRule{{Image: "nginx"}},
+	}
+	for _, test := range []struct {
+		name      string
+		policy    PolicyConfig
+		protected []string
+	}{
+		{"no rule", PolicyConfig{}, []string{"plugin"}},
+		{"default rules", defaultPolicy, []string{"dns", "plugin", "scope"}},
+		// deny wins over allow
+		{"allow and deny rules", chaos, []string{"db", "dns", "plain", "plugin", "scope"}},
+		{"allow rule", PolicyConfig{Allow: []PolicyRule{{Namespace: "shop"}}}, []string{"dns", "plain", "plugin", "scope"}},
+	} {
+		protected := []string{}
+		for _, id := range policyContainerIDs() {
+			err := test.policy.Protected(policyContainers[id])
+			if err != nil {
+				protected = append(protected, id)
+				if !strings.Contains(err.Error(), policyContainers[id].Name) {
+					t.Errorf("%s: %s: the error does not name the container: %v", test.name, id, err)
+				}
+			}
+		}
+		if strings.Join(protected, ",") != strings.Join(test.protected, ",") {
+			t.Errorf("%s: expected %v to be protected, got %v", test.name, test.protected, protected)
+		}
+	}
+}
+
+func TestPolicyProtectedNetNS(t *testing.T) {
+	policy := PolicyConfig{
+		Allow: []PolicyRule{{Labels: map[string]string{"chaos": "enabled"}}},
+	}
+	sandbox := Container{Name: "k8s_POD_web-1_shop_0", Namespace: "shop", Image: "k8s.gcr.io/pause:3.1", Sandbox: true}
+	for _, test := range []struct {
+		name       string
+		containers map[string]Container
+		protected  bool
+	}{
+		{"allowed container", map[string]Container{"web": policyContainers["web"]}, false},
+		{"protected container", map[string]Container{"db": policyContainers["db"]}, true},
+		// the sandbox only holds the namespace of the pod
+		{"pod", map[string]Container{"pause": sandbox, "web": policyContainers["web"]}, false},
+		{"pod with a protected container", map[string]Container{"pause": sandbox, "web": policyContainers["web"], "db": policyContainers["db"]}, true},
+		// without its containers, the sandbox is checked
+		{"sandbox alone", map[string]Container{"pause": sandbox}, true},
+		{"allowed sandbox alone", map[string]Container{"pause": func() Container {
+			c := sandbox
+			c.Labels = map[string]string{"chaos": "enabled"}
+			return c
+		}()}, false},
+		{"protected sandbox", map[string]Container{"pause": func() Container {
+			c := sandbox
+			c.PID = os.Getpid()
+			return c
+		}(), "web": policyContainers["web"]}, false},
+		{"no container", map[string]Container{}, false},
+	} {
+		err := policy.ProtectedNetNS(test.containers)
+		if (err != nil) != test.protected {
+			t.Errorf("%s: expected protected %v, got %v", test.name, test.protected, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"golang.org/x/sys/unix"
+)
+
+// Features probed at startup
+const (
+	featureTC          = "tc"
+	featureIP          = "ip"
+	featureNetem       = "sch_netem"
+	featureFQ          = "sch_fq"
+	featureClsact      = "clsact"
+	featureIFB         = "ifb"
+	featureBPF         = "bpf"
+	featureNFT         = "nft"
+	featureNFTNat      = "nft_nat"
+	featureCapNetAdmin = "CAP_NET_ADMIN"
+	featureCapNetRaw   = "CAP_NET_RAW"
+	featureCapSysAdmin = "CAP_SYS_ADMIN"
+)
+
+// capabilities bits, see include/uapi/linux/capability.h
+var capabilities = map[string]uint{
+	featureCapNetAdmin: 12,
+	featureCapNetRaw:   13,
+	featureCapSysAdmin: 21,
+}
+
+type preflightProbe struct {
+	feature string
+	cmds    []string
+}
+
+type preflightResult struct {
+	feature string
+	err     error
+}
+
+// Preflight keeps the result of probing the host for the binaries,
+// kernel features and capabilities the plugin needs
+type Preflight struct {
+	skipped bool
+	results []preflightResult
+}
+
+// SkipPreflight returns a Preflight assuming every feature is available
+func SkipPreflight() *Preflight {
+	log.Warnf("preflight disabled, assuming every feature is available")
+	return &Preflight{skipped: true}
+}
+
+// RunPreflight probes the host. Qdisc kinds and link types are probed by
+// creating them in a scratch network namespace, which covers both
+// kernel modules and built-in features.
+func RunPreflight() *Preflight {
+	p := &Preflight{}
+	for _, binary := range []string{featureTC, featureIP, featureNFT} {
+		_, err := exec.LookPath(binary)
+		p.add(binary, err)
+	}
+
+	effective, err := effectiveCapabilities()
+	for _, name := range []string{featureCapNetAdmin, featureCapNetRaw, featureCapSysAdmin} {
+		if err == nil && effective&(1<<capabilities[name]) == 0 {
+			p.add(name, fmt.Errorf("not in the effective capability set"))
+			continue
+		}
+		p.add(name, err)
+	}
+
+	probes := []preflightProbe{
+		{featureNetem, []string{"tc qdisc add dev lo root handle 1: netem delay 1ms"}},
+		{featureFQ, []string{"tc qdisc replace dev lo root fq"}},
+		{featureClsact, []string{"tc qdisc add dev lo clsact"}},
+		{featureIFB, []string{"ip link add nc-preflight type ifb"}},
+	}
+	if missing := p.Missing(featureNFT); len(missing) > 0 {
+		p.add(featureNFTNat, fmt.Errorf("cannot be probed without nft"))
+	} else {
+		probes = append(probes, preflightProbe{featureNFTNat, []string{
+			"nft add table ip nc-preflight",
+			"nft -- add chain ip nc-preflight output { type nat hook output priority -110 ; }",
+		}})
+	}
+	if missing := p.Missing(featureTC, featureIP, featureCapNetAdmin, featureCapSysAdmin); len(missing) > 0 {
+		for _, probe := range probes {
+			p.add(probe.feature, fmt.Errorf("cannot be probed without %s", strings.Join(missing, ", ")))
+		}
+	} else {
+		p.probeInScratchNS(probes)
+	}
+
+	p.add(featureBPF, probeBPF())
+
+	for _, r := range p.results {
+		if r.err != nil {
+			log.Warnf("preflight: %s is not available: %v", r.feature, r.err)
+		} else {
+			log.Infof("preflight: %s is available", r.feature)
+		}
+	}
+	return p
+}
+
+func (p *Preflight) probeInScratchNS(probes []preflightProbe) {
+	scratchNS, err := ns.NewNS()
+	if err != nil {
+		for _, probe := range probes {
+			p.add(probe.feature, fmt.Errorf("failed to create a scratch network namespace: %v", err))
+		}
+		return
+	}
+	defer scratchNS.Close()
+	for _, probe := range probes {
+		cmds := [][]string{}
+		for _, cmd := range probe.cmds {
+			cmds = append(cmds, strings.Fields(cmd))
+		}
+		p.add(probe.feature, runCommands(scratchNS.Path(), cmds))
+	}
+}
+
+func (p *Preflight) add(feature string, err error) {
+	p.results = append(p.results, preflightResult{feature: feature, err: err})
+}
+
+// Missing returns the features among the given ones that are not
+// available
+func (p *Preflight) Missing(features ...string) []string {
+	missing := []string{}
+	if p.skipped {
+		return missing
+	}
+	for _, feature := range features {
+		found := false
+		for _, r := range p.results {
+			if r.feature == feature {
+				found = true
+				if r.err != nil {
+					missing = append(missing, feature)
+				}
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, feature)
+		}
+	}
+	return missing
+}
+
+// Status describes the preflight result for the given required
+// features, it is shown in the plugin list of Scope
+func (p *Preflight) Status(required ...string) string {
+	missing := p.Missing(required...)
+	if len(missing) == 0 {
+		return "ok"
+	}
+	return fmt.Sprintf("missing %s", strings.Join(missing, ", "))
+}
+
+func effectiveCapabilities() (uint64, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "CapEff:" {
+			return strconv.ParseUint(fields[1], 16, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no CapEff in /proc/self/status")
+}
+
+// probeBPF loads a program returning TC_ACT_OK
+func probeBPF() error {
+	p := &bpfProgram{}
+	p.emit(bpfMovImm(0, tcActOK), bpfExit())
+	fd, err := bpfLoadProgram("nc_preflight", p)
+	if err != nil {
+		return err
+	}
+	return unix.Close(fd)
+}
@@ -0,0 +1,762 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Probes measure the round trip time and the loss between a container
+// and its peers, from the network namespace of the container, so that
+// the effect of an impairment can be checked against its settings. A
+// peer given with a port is probed with TCP connections, the time to
+// connect being the round trip time, and a peer without port with ICMP
+// echo requests. Without peers, the probes take the peers of the recent
+// connections of the network namespace, as seen in conntrack. Only IPv4
+// peers are probed.
+
+const (
+	probeICMP = "icmp"
+	probeTCP  = "tcp"
+	// minProbeInterval bounds the traffic of the probes
+	minProbeInterval = 100 * time.Millisecond
+	// probePeersInterval is how often the peers seen in conntrack are
+	// refreshed
+	probePeersInterval = 30 * time.Second
+	// probePayload is the data of the echo requests
+	probePayload = "network-control"
+)
+
+// probeRequirements are the preflight features the probes need, the TCP
+// connections carry proxyMark to escape the HTTP faults
+var probeRequirements = []string{featureCapNetRaw, featureCapNetAdmin, featureCapSysAdmin}
+
+// ProbeOptions are the settings of the probes of a network namespace
+type ProbeOptions struct {
+	// Peers are IPv4 addresses, probed with ICMP, or address:port,
+	// probed with TCP. The peers seen in conntrack by default.
+	Peers []string `json:"peers,omitempty"`
+	// Interval is the time between two probes of a peer, the interval of
+	// the configuration by default, e.g. 1s
+	Interval string `json:"interval,omitempty"`
+}
+
+// ProbeStats are the results of the probes of the window
+type ProbeStats struct {
+	Sent int    `json:"sent"`
+	Lost int    `json:"lost"`
+	Loss string `json:"loss,omitempty"`
+	// P50, P90 and P99 are the percentiles of the round trip time of
+	// the probes answered, e.g. 101.3ms
+	P50 string `json:"rtt_p50,omitempty"`
+	P90 string `json:"rtt_p90,omitempty"`
+	P99 string `json:"rtt_p99,omitempty"`
+}
+
+// rtt describes the round trip times
+func (s ProbeStats) rtt() string {
+	switch {
+	case s.Sent == 0:
+		return "-"
+	case s.P50 == "":
+		return "no answer"
+	}
+	return fmt.Sprintf("p50 %s, p90 %s, p99 %s", s.P50, s.P90, s.P99)
+}
+
+// loss describes the loss
+func (s ProbeStats) loss() string {
+	if s.Sent == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%s (%d of %d)", s.Loss, s.Lost, s.Sent)
+}
+
+func (s ProbeStats) String() string {
+	switch {
+	case s.Sent == 0:
+		return "-"
+	case s.P50 == "":
+		return fmt.Sprintf("%s lost", s.Loss)
+	}
+	return fmt.Sprintf("p50 %s p99 %s, %s lost", s.P50, s.P99, s.Loss)
+}
+
+// PeerStats are the results of the probes of a peer
+type PeerStats struct {
+	Peer   string `json:"peer"`
+	Method string `json:"method"`
+	ProbeStats
+	// Error is the last error, timeouts aside
+	Error string `json:"error,omitempty"`
+}
+
+// Probe describes the probes of a network namespace
+type Probe struct {
+	Node        string `json:"node"`
+	ContainerID string `json:"container_id"`
+	Container   string `json:"container"`
+	NetNS       string `json:"netns"`
+	ProbeOptions
+	// Conntrack tells that the peers are the ones seen in conntrack
+	Conntrack bool      `json:"conntrack,omitempty"`
+	Started   time.Time `json:"started"`
+	// ProbeStats are the results of all the peers and Results the ones
+	// of each peer
+	ProbeStats
+	Results []PeerStats `json:"results"`
+}
+
+// probeResult is the result of one probe
+type probeResult struct {
+	rtt  time.Duration
+	lost bool
+}
+
+// probePeer is a peer and the results of its last probes, a port of 0
+// means ICMP
+type probePeer struct {
+	addr    *net.TCPAddr
+	results []probeResult
+	err     string
+	// connecting is set while a TCP probe is in progress
+	connecting bool
+}
+
+func (p *probePeer) method() string {
+	if p.addr.Port == 0 {
+		return probeICMP
+	}
+	return probeTCP
+}
+
+func (p *probePeer) String() string {
+	if p.addr.Port == 0 {
+		return p.addr.IP.String()
+	}
+	return p.addr.String()
+}
+
+// record keeps result, and the results of the window before it
+func (p *probePeer) record(result probeResult) {
+	p.results = append(p.results, result)
+	if window := currentConfig().Probe.Window; len(p.results) > window {
+		p.results = append([]probeResult{}, p.results[len(p.results)-window:]...)
+	}
+}
+
+// echoRequest is an echo request waiting for its reply
+type echoRequest struct {
+	peer *probePeer
+	sent time.Time
+}
+
+// probe runs the probes of a network namespace, the handle of the
+// network namespace keeps it alive until the probe stops
+type probe struct {
+	info     Probe
+	pid      int
+	netNS    ns.NetNS
+	interval time.Duration
+	conn     *icmp.PacketConn
+	echoID   int
+
+	lock    sync.Mutex
+	peers   []*probePeer
+	pending map[int]echoRequest
+	seq     int
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Probes runs the probes of the network namespaces
+type Probes struct {
+	lock   sync.Mutex
+	probes map[string]*probe
+}
+
+// NewProbes instantiates a new Probes
+func NewProbes() *Probes {
+	return &Probes{
+		probes: map[string]*probe{},
+	}
+}
+
+// List returns the probes sorted by container name
+func (p *Probes) List() []Probe {
+	p.lock.Lock()
+	probes := []*probe{}
+	for _, pr := range p.probes {
+		probes = append(probes, pr)
+	}
+	p.lock.Unlock()
+	list := []Probe{}
+	for _, pr := range probes {
+		list = append(list, pr.snapshot())
+	}
+	sort.Sort(byContainer(list))
+	return list
+}
+
+// Get returns the probe of a network namespace
+func (p *Probes) Get(netNSID string) (Probe, bool) {
+	p.lock.Lock()
+	pr, ok := p.probes[netNSID]
+	p.lock.Unlock()
+	if !ok {
+		return Probe{}, false
+	}
+	return pr.snapshot(), true
+}
+
+// Start probes the peers of the network namespace of pid in the
+// background, it replaces the probes running there
+func (p *Probes) Start(pid int, containerID string, container Container, options ProbeOptions) (Probe, error) {
+	interval, peers, err := options.resolve(currentConfig().Probe)
+	if err != nil {
+		return Probe{}, err
+	}
+	netNS, err := ns.GetNS(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return Probe{}, err
+	}
+	// the socket stays in the network namespace it is created in
+	var conn *icmp.PacketConn
+	err = netNS.Do(func(ns.NetNS) error {
+		var err error
+		conn, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+		return err
+	})
+	if err != nil {
+		netNS.Close()
+		return Probe{}, fmt.Errorf("failed to open the ICMP socket: %v", err)
+	}
+	pr := &probe{
+		info: Probe{
+			Node:         currentConfig().NodeName,
+			ContainerID:  containerID,
+			Container:    container.Name,
+			NetNS:        container.NetNSID,
+			ProbeOptions: options,
+			Conntrack:    len(peers) == 0,
+			Started:      time.Now(),
+		},
+		pid:      pid,
+		netNS:    netNS,
+		interval: interval,
+		conn:     conn,
+		echoID:   rand.Intn(1 << 16),
+		pending:  map[int]echoRequest{},
+		done:     make(chan struct{}),
+	}
+	for _, addr := range peers {
+		pr.peers = append(pr.peers, &probePeer{addr: addr})
+	}
+	p.lock.Lock()
+	if running, ok := p.probes[container.NetNSID]; ok {
+		running.stop()
+	}
+	p.probes[container.NetNSID] = pr
+	p.lock.Unlock()
+	log.Infof("Probing the peers of %s every %s", container.Name, options.Interval)
+
+	go pr.receive()
+	go p.run(pr)
+	return pr.snapshot(), nil
+}
+
+// Stop stops the probes of a network namespace, it tells whether there
+// were any
+func (p *Probes) Stop(netNSID string) (Probe, bool) {
+	p.lock.Lock()
+	pr, ok := p.probes[netNSID]
+	delete(p.probes, netNSID)
+	p.lock.Unlock()
+	if !ok {
+		return Probe{}, false
+	}
+	pr.stop()
+	log.Infof("Stopped probing the peers of %s", pr.info.Container)
+	return pr.snapshot(), true
+}
+
+// Toggle stops the probes of a network namespace or starts probing the
+// peers seen in conntrack
+func (p *Probes) Toggle(pid int, containerID string, container Container) error {
+	if _, ok := p.Stop(container.NetNSID); ok {
+		return nil
+	}
+	_, err := p.Start(pid, containerID, container, ProbeOptions{})
+	return err
+}
+
+// resolve sets the defaults of the options and returns the interval of
+// the probes and the peers, none if they are taken from conntrack
+func (o *ProbeOptions) resolve(cfg ProbeConfig) (time.Duration, []*net.TCPAddr, error) {
+	if o.Interval == "" {
+		o.Interval = cfg.Interval
+	}
+	interval, err := time.ParseDuration(o.Interval)
+	if err != nil || interval < minProbeInterval {
+		return 0, nil, fmt.Errorf("invalid interval %q, it must be at least %s", o.Interval, minProbeInterval)
+	}
+	if len(o.Peers) > cfg.MaxPeers {
+		return 0, nil, fmt.Errorf("%d peers exceed the limit of %d", len(o.Peers), cfg.MaxPeers)
+	}
+	peers := []*net.TCPAddr{}
+	for _, peer := range o.Peers {
+		addr, err := parsePeer(peer)
+		if err != nil {
+			return 0, nil, err
+		}
+		peers = append(peers, addr)
+	}
+	return interval, peers, nil
+}
+
+// parsePeer parses an IPv4 address or address:port
+func parsePeer(peer string) (*net.TCPAddr, error) {
+	host, port := peer, 0
+	if net.ParseIP(peer) == nil {
+		h, p, err := net.SplitHostPort(peer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer %q: %v", peer, err)
+		}
+		if port, err = strconv.Atoi(p); err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port in peer %q", peer)
+		}
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("invalid peer %q, only IPv4 addresses are probed", peer)
+	}
+	return &net.TCPAddr{IP: ip.To4(), Port: port}, nil
+}
+
+// run sends the probes until they are stopped or their network
+// namespace is gone
+func (p *Probes) run(pr *probe) {
+	ticker := time.NewTicker(pr.interval)
+	defer ticker.Stop()
+	var refreshed time.Time
+	for {
+		link, err := os.Readlink(fmt.Sprintf("/proc/%d/ns/net", pr.pid))
+		if err != nil || link != "net:["+pr.info.NetNS+"]" {
+			log.Infof("Stopped probing the peers of %s, the network namespace is gone", pr.info.Container)
+			p.lock.Lock()
+			if p.probes[pr.info.NetNS] == pr {
+				delete(p.probes, pr.info.NetNS)
+			}
+			p.lock.Unlock()
+			pr.stop()
+			return
+		}
+		if pr.info.Conntrack && time.Since(refreshed) >= probePeersInterval {
+			refreshed = time.Now()
+			pr.refreshPeers()
+		}
+		pr.send()
+		select {
+		case <-pr.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (pr *probe) stop() {
+	pr.stopOnce.Do(func() {
+		close(pr.done)
+		pr.conn.Close()
+		pr.netNS.Close()
+	})
+}
+
+// send counts the echo requests left unanswered as lost and probes
+// every peer
+func (pr *probe) send() {
+	timeout, _ := time.ParseDuration(currentConfig().Probe.Timeout)
+	now := time.Now()
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	for seq, req := range pr.pending {
+		if now.Sub(req.sent) > timeout {
+			delete(pr.pending, seq)
+			req.peer.record(probeResult{lost: true})
+		}
+	}
+	for _, peer := range pr.peers {
+		switch {
+		case peer.addr.Port == 0:
+			pr.sendEcho(peer, now)
+		case !peer.connecting:
+			peer.connecting = true
+			go pr.connect(peer, timeout)
+		}
+	}
+}
+
+// sendEcho sends an echo request to peer, pr.lock is held
+func (pr *probe) sendEcho(peer *probePeer, now time.Time) {
+	pr.seq = (pr.seq + 1) & 0xffff
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: pr.echoID, Seq: pr.seq, Data: []byte(probePayload)},
+	}
+	raw, err := msg.Marshal(nil)
+	if err == nil {
+		_, err = pr.conn.WriteTo(raw, &net.IPAddr{IP: peer.addr.IP})
+	}
+	if err != nil {
+		peer.err = err.Error()
+		peer.record(probeResult{lost: true})
+		return
+	}
+	pr.pending[pr.seq] = echoRequest{peer: peer, sent: now}
+}
+
+// receive matches the echo replies with the requests until the probe
+// stops
+func (pr *probe) receive() {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := pr.conn.ReadFrom(buf)
+		received := time.Now()
+		if err != nil {
+			select {
+			case <-pr.done:
+			default:
+				log.Errorf("Failed to receive the echo replies of %s: %v", pr.info.Container, err)
+			}
+			return
+		}
+		msg, err := icmp.ParseMessage(ipv4.ICMPTypeEchoReply.Protocol(), buf[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		// the socket receives the ICMP messages of the whole network
+		// namespace
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok || echo.ID != pr.echoID {
+			continue
+		}
+		pr.lock.Lock()
+		if req, ok := pr.pending[echo.Seq]; ok && from.String() == req.peer.addr.IP.String() {
+			delete(pr.pending, echo.Seq)
+			req.peer.err = ""
+			req.peer.record(probeResult{rtt: received.Sub(req.sent)})
+		}
+		pr.lock.Unlock()
+	}
+}
+
+// connect probes peer with a TCP connection
+func (pr *probe) connect(peer *probePeer, timeout time.Duration) {
+	started := time.Now()
+	var conn net.Conn
+	err := pr.netNS.Do(func(ns.NetNS) error {
+		var err error
+		conn, err = dialMarked(peer.addr, true, timeout)
+		return err
+	})
+	result := probeResult{rtt: time.Since(started)}
+	message := ""
+	switch errno := syscallErrno(err); {
+	case err == nil:
+		conn.Close()
+	case errno == syscall.ECONNREFUSED:
+		// the reset answers as fast as the peer would accept
+	case errno == syscall.EINPROGRESS || errno == syscall.ETIMEDOUT:
+		result.lost = true
+	default:
+		result.lost = true
+		message = err.Error()
+	}
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	peer.connecting = false
+	peer.err = message
+	peer.record(result)
+}
+
+// syscallErrno returns the errno of a system call error, 0 for another
+// error
+func syscallErrno(err error) syscall.Errno {
+	if e, ok := err.(*os.SyscallError); ok {
+		err = e.Err
+	}
+	errno, _ := err.(syscall.Errno)
+	return errno
+}
+
+// refreshPeers replaces the peers with the ones seen in conntrack, the
+// results of the peers still seen are kept
+func (pr *probe) refreshPeers() {
+	var local []net.Addr
+	err := pr.netNS.Do(func(ns.NetNS) error {
+		var err error
+		local, err = net.InterfaceAddrs()
+		return err
+	})
+	var addrs []*net.TCPAddr
+	if err == nil {
+		addrs, err = connectionPeers(pr.pid, local, currentConfig().Probe.MaxPeers)
+	}
+	if err != nil {
+		log.Warnf("Failed to find the peers of %s: %v", pr.info.Container, err)
+		return
+	}
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	known := map[string]*probePeer{}
+	for _, peer := range pr.peers {
+		known[peer.String()] = peer
+	}
+	pr.peers = nil
+	for _, addr := range addrs {
+		peer, ok := known[(&probePeer{addr: addr}).String()]
+		if !ok {
+			peer = &probePeer{addr: addr}
+		}
+		pr.peers = append(pr.peers, peer)
+	}
+}
+
+// snapshot describes the probe and the results of its peers
+func (pr *probe) snapshot() Probe {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	info := pr.info
+	info.Results = []PeerStats{}
+	all := []probeResult{}
+	for _, peer := range pr.peers {
+		info.Results = append(info.Results, PeerStats{
+			Peer:       peer.String(),
+			Method:     peer.method(),
+			ProbeStats: probeStats(peer.results),
+			Error:      peer.err,
+		})
+		all = append(all, peer.results...)
+	}
+	info.ProbeStats = probeStats(all)
+	return info
+}
+
+// probeStats computes the loss and the round trip time percentiles of
+// results
+func probeStats(results []probeResult) ProbeStats {
+	stats := ProbeStats{Sent: len(results)}
+	if stats.Sent == 0 {
+		return stats
+	}
+	rtts := durations{}
+	for _, r := range results {
+		if r.lost {
+			stats.Lost++
+			continue
+		}
+		rtts = append(rtts, r.rtt)
+	}
+	stats.Loss = fmt.Sprintf("%.1f%%", 100*float64(stats.Lost)/float64(stats.Sent))
+	if len(rtts) == 0 {
+		return stats
+	}
+	sort.Sort(rtts)
+	stats.P50 = formatRTT(rtts.percentile(50))
+	stats.P90 = formatRTT(rtts.percentile(90))
+	stats.P99 = formatRTT(rtts.percentile(99))
+	return stats
+}
+
+// formatRTT formats a round trip time in milliseconds
+func formatRTT(rtt time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(rtt)/float64(time.Millisecond))
+}
+
+// connectionPeers returns the IPv4 peers of the connections of the
+// network namespace of pid, the most frequent first. The peers reached
+// from the network namespace are probed on the port they were connected
+// to with TCP, the others with ICMP. The connections are read from
+// conntrack, or from the TCP sockets when conntrack has none.
+func connectionPeers(pid int, local []net.Addr, max int) ([]*net.TCPAddr, error) {
+	locals := map[string]bool{}
+	for _, addr := range local {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			locals[ipNet.IP.String()] = true
+		}
+	}
+	counts := map[string]int{}
+	peers := map[string]*net.TCPAddr{}
+	add := func(ip net.IP, port int) {
+		if ip == nil || ip.To4() == nil || ip.IsLoopback() || ip.IsMulticast() || ip.IsUnspecified() || locals[ip.String()] {
+			return
+		}
+		peer := &net.TCPAddr{IP: ip.To4(), Port: port}
+		key := (&probePeer{addr: peer}).String()
+		peers[key] = peer
+		counts[key]++
+	}
+	raw, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/net/nf_conntrack", pid))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(raw), "\n") {
+		// ipv4 2 tcp 6 431999 ESTABLISHED src=... dst=... sport=...
+		// dport=... src=... the first keys are the ones of the original
+		// direction
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "ipv4" {
+			continue
+		}
+		values := map[string]string{}
+		for _, field := range fields[3:] {
+			kv := strings.SplitN(field, "=", 2)
+			if _, ok := values[kv[0]]; len(kv) == 2 && !ok {
+				values[kv[0]] = kv[1]
+			}
+		}
+		src, dst := net.ParseIP(values["src"]), net.ParseIP(values["dst"])
+		switch {
+		case src != nil && locals[src.String()]:
+			port := 0
+			if fields[2] == "tcp" {
+				port, _ = strconv.Atoi(values["dport"])
+			}
+			add(dst, port)
+		case dst != nil && locals[dst.String()]:
+			add(src, 0)
+		}
+	}
+	// conntrack is not loaded, or it does not track the network
+	// namespace because no rule needs it
+	if len(peers) == 0 {
+		connections, listening, err := tcpConnections(pid)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range connections {
+			if listening[c[0].Port] {
+				add(c[1].IP, 0)
+			} else {
+				add(c[1].IP, c[1].Port)
+			}
+		}
+	}
+	keys := []string{}
+	for key := range peers {
+		keys = append(keys, key)
+	}
+	sort.Sort(byCount{keys: keys, counts: counts})
+	if len(keys) > max {
+		keys = keys[:max]
+	}
+	addrs := []*net.TCPAddr{}
+	for _, key := range keys {
+		addrs = append(addrs, peers[key])
+	}
+	return addrs, nil
+}
+
+// tcpConnections returns the local and remote addresses of the
+// established IPv4 TCP connections of the network namespace of pid, and
+// its listening ports
+func tcpConnections(pid int) ([][2]*net.TCPAddr, map[int]bool, error) {
+	raw, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/net/tcp", pid))
+	if err != nil {
+		return nil, nil, err
+	}
+	connections := [][2]*net.TCPAddr{}
+	listening := map[int]bool{}
+	for _, line := range strings.Split(string(raw), "\n") {
+		// sl local_address rem_address st ...
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		localAddr, err := parseProcNetAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		remoteAddr, err := parseProcNetAddr(fields[2])
+		if err != nil {
+			continue
+		}
+		switch fields[3] {
+		case "01": // TCP_ESTABLISHED
+			connections = append(connections, [2]*net.TCPAddr{localAddr, remoteAddr})
+		case "0A": // TCP_LISTEN
+			listening[localAddr.Port] = true
+		}
+	}
+	return connections, listening, nil
+}
+
+// parseProcNetAddr parses an address of /proc/net/tcp, e.g.
+// 0100007F:1F90 for 127.0.0.1:8080
+func parseProcNetAddr(value string) (*net.TCPAddr, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 || len(parts[0]) != 8 {
+		return nil, fmt.Errorf("invalid address %q", value)
+	}
+	ip, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q", value)
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q", value)
+	}
+	// the address is in the byte order of the host, little endian on
+	// the supported architectures
+	return &net.TCPAddr{IP: net.IPv4(byte(ip), byte(ip>>8), byte(ip>>16), byte(ip>>24)).To4(), Port: int(port)}, nil
+}
+
+type durations []time.Duration
+
+func (s durations) Len() int           { return len(s) }
+func (s durations) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s durations) Less(i, j int) bool { return s[i] < s[j] }
+
+// percentile returns the nearest rank percentile of sorted durations
+func (s durations) percentile(p int) time.Duration {
+	rank := (p*len(s) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return s[rank-1]
+}
+
+type byCount struct {
+	keys   []string
+	counts map[string]int
+}
+
+func (s byCount) Len() int      { return len(s.keys) }
+func (s byCount) Swap(i, j int) { s.keys[i], s.keys[j] = s.keys[j], s.keys[i] }
+func (s byCount) Less(i, j int) bool {
+	if s.counts[s.keys[i]] != s.counts[s.keys[j]] {
+		return s.counts[s.keys[i]] > s.counts[s.keys[j]]
+	}
+	return s.keys[i] < s.keys[j]
+}
+
+type byContainer []Probe
+
+func (s byContainer) Len() int           { return len(s) }
+func (s byContainer) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byContainer) Less(i, j int) bool { return s[i].Container < s[j].Container }
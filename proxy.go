@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+)
+
+// The DNS and HTTP faults are injected by proxies embedded in the
+// plugin. A proxy listens on the loopback interface of the network
+// namespace of the container and an nftables table of that network
+// namespace redirects the traffic to it, except the traffic of the proxy
+// itself which carries proxyMark.
+
+const (
+	// proxyMark marks the connections of the proxies
+	proxyMark = 0x6e63
+	// proxyWatchInterval is how often a proxy checks that its network
+	// namespace still has a process
+	proxyWatchInterval = 10 * time.Second
+)
+
+// proxyRequirements are the preflight features the proxies need
+var proxyRequirements = []string{featureNFT, featureNFTNat, featureCapNetAdmin, featureCapSysAdmin}
+
+// netNSProxy is the part common to the proxies: the network namespace
+// they serve, their listeners and their redirection
+type netNSProxy struct {
+	// name is used in the logs, e.g. DNS
+	name    string
+	pid     int
+	netNSID string
+	netNS   ns.NetNS
+	// table is the nftables table redirecting the traffic
+	table     string
+	listeners []io.Closer
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newNetNSProxy opens the network namespace of pid, the handle keeps it
+// alive until the proxy is closed
+func newNetNSProxy(name string, pid int, netNSID, table string) (*netNSProxy, error) {
+	netNS, err := ns.GetNS(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return nil, err
+	}
+	return &netNSProxy{
+		name:    name,
+		pid:     pid,
+		netNSID: netNSID,
+		netNS:   netNS,
+		table:   table,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (p *netNSProxy) netNSPath() string {
+	return fmt.Sprintf("/proc/%d/ns/net", p.pid)
+}
+
+// listen runs listen in the network namespace, the sockets stay in the
+// network namespace they are created in
+func (p *netNSProxy) listen(listen func() ([]io.Closer, error)) error {
+	err := p.netNS.Do(func(ns.NetNS) error {
+		listeners, err := listen()
+		p.listeners = append(p.listeners, listeners...)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to listen in the network namespace: %v", err)
+	}
+	return nil
+}
+
+// redirect replaces the table of the proxy, left by a previous instance
+// of the plugin for instance, with one redirecting the traffic matching
+// rules
+func (p *netNSProxy) redirect(rules ...string) error {
+	remove := [][]string{removeRedirectCommand(p.table)}
+	runCommands(p.netNSPath(), remove)
+	if err := runCommands(p.netNSPath(), redirectCommands(p.table, rules)); err != nil {
+		runCommands(p.netNSPath(), remove)
+		return err
+	}
+	return nil
+}
+
+// redirectCommands returns the nftables commands creating table with
+// rules in its output nat chain. The rules are given without their
+// leading words and apply to the traffic not carrying proxyMark.
+func redirectCommands(table string, rules []string) [][]string {
+	cmds := [][]string{
+		{"nft", "add", "table", "ip", table},
+		// before the nat rules of Docker, which rewrite the DNS
+		// queries to its embedded DNS server
+		{"nft", "--", "add", "chain", "ip", table, "output", "{", "type", "nat", "hook", "output", "priority", "-110", ";", "}"},
+	}
+	for _, rule := range rules {
+		cmds = append(cmds, append([]string{"nft", "add", "rule", "ip", table, "output", "meta", "mark", "!=", fmt.Sprintf("%#x", proxyMark)}, strings.Fields(rule)...))
+	}
+	return cmds
+}
+
+// removeRedirectCommand returns the nftables command removing table
+func removeRedirectCommand(table string) []string {
+	return []string{"nft", "delete", "table", "ip", table}
+}
+
+// removeStaleRedirect removes table from netNS, left by an instance of
+// the plugin which did not stop its proxy. The table is usually not
+// there, the error is ignored.
+func removeStaleRedirect(netNS, table string) {
+	if _, err := commandOutput(netNS, removeRedirectCommand(table)); err == nil {
+		log.Infof("%s: removed the stale table %s", netNS, table)
+	}
+}
+
+// Stop removes the redirection and stops the proxy
+func (p *netNSProxy) Stop() error {
+	err := runCommands(p.netNSPath(), [][]string{removeRedirectCommand(p.table)})
+	p.close()
+	return err
+}
+
+func (p *netNSProxy) close() {
+	p.stopOnce.Do(func() {
+		close(p.done)
+		for _, listener := range p.listeners {
+			listener.Close()
+		}
+		p.netNS.Close()
+	})
+}
+
+// watch stops the proxy once its network namespace has no process
+// left, the proxy itself keeps it alive, and then calls gone
+func (p *netNSProxy) watch(gone func()) {
+	ticker := time.NewTicker(proxyWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		link, err := os.Readlink(p.netNSPath())
+		if err == nil && link == "net:["+p.netNSID+"]" {
+			continue
+		}
+		log.Infof("%s proxy of network namespace %s stopped, the network namespace is gone", p.name, p.netNSID)
+		p.close()
+		gone()
+		return
+	}
+}
+
+// dial connects to addr from the network namespace with a socket
+// carrying proxyMark, within timeout
+func (p *netNSProxy) dial(addr *net.TCPAddr, tcp bool, timeout time.Duration) (net.Conn, error) {
+	var conn net.Conn
+	err := p.netNS.Do(func(ns.NetNS) error {
+		var err error
+		conn, err = dialMarked(addr, tcp, timeout)
+		return err
+	})
+	return conn, err
+}
+
+// dialMarked connects to addr from the current network namespace with a
+// socket carrying proxyMark
+func dialMarked(addr *net.TCPAddr, tcp bool, timeout time.Duration) (net.Conn, error) {
+	fd, err := connectMarked(addr, tcp, timeout)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "proxy")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// connectMarked returns a blocking socket carrying proxyMark connected to
+// addr from the current network namespace, its sends time out after
+// timeout like the connection
+func connectMarked(addr *net.TCPAddr, tcp bool, timeout time.Duration) (int, error) {
+	sotype := syscall.SOCK_DGRAM
+	if tcp {
+		sotype = syscall.SOCK_STREAM
+	}
+	fd, err := syscall.Socket(syscall.AF_INET, sotype|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, proxyMark); err != nil {
+		syscall.Close(fd)
+		return -1, os.NewSyscallError("setsockopt", err)
+	}
+	// bounds the connection
+	tv := syscall.NsecToTimeval(int64(timeout))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return -1, os.NewSyscallError("setsockopt", err)
+	}
+	sa := &syscall.SockaddrInet4{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To4())
+	if err := syscall.Connect(fd, sa); err != nil {
+		syscall.Close(fd)
+		return -1, os.NewSyscallError("connect", err)
+	}
+	return fd, nil
+}
+
+// listenerPort returns the port of a listener on the loopback interface
+func listenerPort(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return strconv.Itoa(a.Port)
+	case *net.TCPAddr:
+		return strconv.Itoa(a.Port)
+	}
+	return ""
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Ramps change the delay, the loss or the rate of a network namespace
+// gradually, from a start value to an end value over a duration, one
+// step at a time, the way real degradations creep in. The end values
+// stay once the ramp is over, until they are cleared.
+
+const (
+	rampLinear      = "linear"
+	rampExponential = "exponential"
+	rampSine        = "sine"
+	// defaultRampStep is the interval between two steps by default and
+	// minRampStep the shortest one, every step changes the qdiscs
+	defaultRampStep = 5 * time.Second
+	minRampStep     = time.Second
+	// rampExponent is the growth rate of the exponential curve, the
+	// value covers about 2% of the range at half of the duration
+	rampExponent = 8
+)
+
+// RampRange are the start and the end values of a setting
+type RampRange struct {
+	From string `yaml:"from" json:"from"`
+	To   string `yaml:"to" json:"to"`
+}
+
+func (r *RampRange) String() string {
+	return r.From + " to " + r.To
+}
+
+// Ramp changes the settings which have a range from their start value
+// to their end value over Duration
+type Ramp struct {
+	// Delay are tc times, e.g. 10ms to 2000ms
+	Delay *RampRange `yaml:"delay,omitempty" json:"delay,omitempty"`
+	// Loss are percentages, e.g. 0% to 20%
+	Loss *RampRange `yaml:"loss,omitempty" json:"loss,omitempty"`
+	// Rate are tc rates, e.g. 10mbit to 500kbit
+	Rate *RampRange `yaml:"rate,omitempty" json:"rate,omitempty"`
+	// Duration is how long the ramp takes, e.g. 10m
+	Duration string `yaml:"duration" json:"duration"`
+	// Step is the interval between two changes, 5s by default
+	Step string `yaml:"step,omitempty" json:"step,omitempty"`
+	// Curve is linear, exponential or sine, linear by default:
+	// exponential starts slowly and accelerates, sine eases in and out
+	Curve string `yaml:"curve,omitempty" json:"curve,omitempty"`
+}
+
+// Validate checks the ramp
+func (r *Ramp) Validate() error {
+	if r.Delay == nil && r.Loss == nil && r.Rate == nil {
+		return fmt.Errorf("no delay, loss or rate to ramp")
+	}
+	if r.Delay != nil {
+		if _, _, err := r.Delay.times(); err != nil {
+			return err
+		}
+	}
+	if r.Loss != nil {
+		if _, _, err := r.Loss.percentages(); err != nil {
+			return err
+		}
+	}
+	if r.Rate != nil {
+		from, to, err := r.Rate.rates()
+		if err != nil {
+			return err
+		}
+		if from == 0 || to == 0 {
+			return fmt.Errorf("a rate cannot be 0")
+		}
+	}
+	duration, step, err := r.timing()
+	if err != nil {
+		return err
+	}
+	if step > duration {
+		return fmt.Errorf("the step %s is longer than the ramp %s", step, duration)
+	}
+	switch r.Curve {
+	case "", rampLinear, rampExponential, rampSine:
+	default:
+		return fmt.Errorf("unknown curve %q, expected %s, %s or %s", r.Curve, rampLinear, rampExponential, rampSine)
+	}
+	return nil
+}
+
+func (r Ramp) String() string {
+	settings := []string{}
+	if r.Delay != nil {
+		settings = append(settings, "delay "+r.Delay.String())
+	}
+	if r.Loss != nil {
+		settings = append(settings, "loss "+r.Loss.String())
+	}
+	if r.Rate != nil {
+		settings = append(settings, "rate "+r.Rate.String())
+	}
+	return fmt.Sprintf("%s, %s over %s", strings.Join(settings, ", "), r.curve(), r.Duration)
+}
+
+func (r *Ramp) curve() string {
+	if r.Curve == "" {
+		return rampLinear
+	}
+	return r.Curve
+}
+
+// timing returns the duration of the ramp and the interval between two
+// steps
+func (r *Ramp) timing() (time.Duration, time.Duration, error) {
+	duration, err := time.ParseDuration(r.Duration)
+	if err != nil || duration <= 0 {
+		return 0, 0, fmt.Errorf("invalid ramp duration %q", r.Duration)
+	}
+	step := defaultRampStep
+	if r.Step != "" {
+		if step, err = time.ParseDuration(r.Step); err != nil || step < minRampStep {
+			return 0, 0, fmt.Errorf("invalid ramp step %q, it must be at least %s", r.Step, minRampStep)
+		}
+	}
+	return duration, step, nil
+}
+
+// steps returns the number of steps after the first one, at the start
+// values, the last one sets the end values
+func (r *Ramp) steps() int {
+	duration, step, _ := r.timing()
+	return int(math.Ceil(float64(duration) / float64(step)))
+}
+
+// progress returns the part of the ranges covered at the fraction t of
+// the duration
+func (r *Ramp) progress(t float64) float64 {
+	switch r.Curve {
+	case rampExponential:
+		return (math.Exp(rampExponent*t) - 1) / (math.Exp(rampExponent) - 1)
+	case rampSine:
+		return (1 - math.Cos(math.Pi*t)) / 2
+	}
+	return t
+}
+
+// at returns the settings of the step of the ramp, the ones without
+// range are left empty
+func (r *Ramp) at(step int) Impairment {
+	p := r.progress(math.Min(float64(step)/float64(r.steps()), 1))
+	impairment := Impairment{}
+	if r.Delay != nil {
+		from, to, _ := r.Delay.times()
+		delay := float64(from) + (float64(to)-float64(from))*p
+		impairment.Delay = fmt.Sprintf("%.1fms", delay/float64(time.Millisecond))
+	}
+	if r.Loss != nil {
+		from, to, _ := r.Loss.percentages()
+		impairment.Loss = fmt.Sprintf("%.2f%%", 100*(from+(to-from)*p))
+	}
+	if r.Rate != nil {
+		from, to, _ := r.Rate.rates()
+		rate := float64(from) + (float64(to)-float64(from))*p
+		impairment.Rate = fmt.Sprintf("%dkbit", int64(math.Max(1, math.Floor(rate*8/1000+0.5))))
+	}
+	return impairment
+}
+
+// clears returns the change removing the settings the ramp drives
+func (r *Ramp) clears() func(status *TrafficControlStatus) {
+	return func(status *TrafficControlStatus) {
+		if r.Delay != nil {
+			status.SetLatency("")
+		}
+		if r.Loss != nil {
+			status.SetPacketLoss("")
+		}
+		if r.Rate != nil {
+			status.SetRate("")
+		}
+	}
+}
+
+func (r *RampRange) times() (time.Duration, time.Duration, error) {
+	from, err := parseTCTime(r.From)
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := parseTCTime(r.To)
+	return from, to, err
+}
+
+func (r *RampRange) percentages() (float64, float64, error) {
+	from, err := parsePercentage(r.From)
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := parsePercentage(r.To)
+	return from, to, err
+}
+
+func (r *RampRange) rates() (uint64, uint64, error) {
+	from, err := parseTCRate(r.From)
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := parseTCRate(r.To)
+	return from, to, err
+}
+
+// RampStatus is the progress of the ramp of a network namespace
+type RampStatus struct {
+	Ramp
+	Started time.Time `json:"started"`
+	// Step is the last step applied, Steps the one setting the end
+	// values
+	Step  int `json:"step"`
+	Steps int `json:"steps"`
+	// Current are the settings of the last step
+	Current Impairment `json:"current"`
+}
+
+func (s RampStatus) String() string {
+	return fmt.Sprintf("%s, step %d of %d", s.Ramp, s.Step, s.Steps)
+}
+
+// ramp drives the steps of a ramp
+type ramp struct {
+	pid  int
+	spec Ramp
+
+	lock   sync.Mutex
+	status RampStatus
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newRamp(pid int, spec Ramp) *ramp {
+	return &ramp{
+		pid:  pid,
+		spec: spec,
+		status: RampStatus{
+			Ramp:    spec,
+			Started: time.Now(),
+			Steps:   spec.steps(),
+		},
+		done: make(chan struct{}),
+	}
+}
+
+// Status returns the progress of the ramp
+func (r *ramp) Status() RampStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.status
+}
+
+// stepped records that the settings of step are applied
+func (r *ramp) stepped(step int, impairment Impairment) {
+	r.lock.Lock()
+	r.status.Step = step
+	r.status.Current = impairment
+	r.lock.Unlock()
+}
+
+func (r *ramp) stop() {
+	r.stopOnce.Do(func() {
+		close(r.done)
+	})
+}
+
+// run applies the steps after the first one until the last one or
+// until the ramp is stopped
+func (r *ramp) run(c *Controller) {
+	_, interval, _ := r.spec.timing()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	steps := r.spec.steps()
+	for step := 1; step <= steps; step++ {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+		}
+		if err := c.rampStep(r, step); err != nil {
+			log.Errorf("ramp of process %d stopped at step %d: %v", r.pid, step, err)
+			c.endRamp(r)
+			return
+		}
+	}
+	log.Infof("ramp of process %d is over: %s", r.pid, r.spec)
+	c.endRamp(r)
+}
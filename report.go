@@ -4,12 +4,24 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 	log "github.com/Sirupsen/logrus"
 )
 
 const (
 	networkControlTablePrefix = "network-control-table-"
+	// interfacesTablePrefix and routesTablePrefix are the prefixes of
+	// the rows of the multicolumn tables of the inventory, a row is
+	// keyed by prefix, row ID, tableEntryKeySeparator and column ID
+	interfacesTablePrefix  = "network-control-interfaces-"
+	routesTablePrefix      = "network-control-routes-"
+	tableEntryKeySeparator = "___"
+	multicolumnTableType   = "multicolumn-table"
+	// collectInterval is the period between two collections of the
+	// report, changes of the containers or of their settings trigger a
+	// collection immediately
+	collectInterval = 5 * time.Second
 )
 
 type report struct {
@@ -28,6 +40,15 @@ type tableTemplate struct {
 	ID     string `json:"id"`
 	Label  string `json:"label"`
 	Prefix string `json:"prefix"`
+	// Type and Columns are only set for the multicolumn tables
+	Type    string        `json:"type,omitempty"`
+	Columns []tableColumn `json:"columns,omitempty"`
+}
+
+type tableColumn struct {
+	ID       string `json:"id"`
+	Label    string `json:"label"`
+	Datatype string `json:"dataType,omitempty"`
 }
 
 type metadataTemplate struct {
@@ -71,23 +92,116 @@ type pluginSpec struct {
 	Description string   `json:"description,omitempty"`
 	Interfaces  []string `json:"interfaces"`
 	APIVersion  string   `json:"api_version,omitempty"`
+	Status      string   `json:"status,omitempty"`
 }
 
 // Reporter internal data structure
 type Reporter struct {
-	store *Store
+	store       *Store
+	preflight   *Preflight
+	controller  *Controller
+	captures    *Captures
+	probes      *Probes
+	throughput  *Throughputs
+	inventories *Inventories
+	resets      *Resets
+
+	lock    sync.RWMutex
+	raw     []byte
+	refresh chan struct{}
+
+	// statuses are the statuses of the pods queried by the last
+	// collections, each is queried at most once per collectInterval
+	statusLock sync.Mutex
+	statuses   map[string]cachedStatus
+}
+
+type cachedStatus struct {
+	status  *NetworkControlStatus
+	err     error
+	queried time.Time
 }
 
 // NewReporter instantiates a new Reporter
-func NewReporter(store *Store) *Reporter {
+func NewReporter(store *Store, preflight *Preflight, controller *Controller, captures *Captures, probes *Probes, throughput *Throughputs, inventories *Inventories, resets *Resets) *Reporter {
 	return &Reporter{
-		store: store,
+		store:       store,
+		preflight:   preflight,
+		controller:  controller,
+		captures:    captures,
+		probes:      probes,
+		throughput:  throughput,
+		inventories: inventories,
+		resets:      resets,
+		refresh:     make(chan struct{}, 1),
+		statuses:    map[string]cachedStatus{},
+	}
+}
+
+// podStatus returns the status of pod, queried again only once the
+// previous query is older than collectInterval
+func (r *Reporter) podStatus(pod string) (*NetworkControlStatus, error) {
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	now := time.Now()
+	if cached, ok := r.statuses[pod]; ok && now.Sub(cached.queried) < collectInterval {
+		return cached.status, cached.err
+	}
+	for p, cached := range r.statuses {
+		if now.Sub(cached.queried) >= collectInterval {
+			delete(r.statuses, p)
+		}
+	}
+	status, err := getStatusByPod(pod)
+	r.statuses[pod] = cachedStatus{status: status, err: err, queried: now}
+	return status, err
+}
+
+// Start collects the report in the background, every collectInterval
+// and when the containers, their settings or their network
+// configuration change and when a ramp or a replay steps
+func (r *Reporter) Start() {
+	ticker := time.NewTicker(collectInterval)
+	defer ticker.Stop()
+	changes := r.store.Changes()
+	for {
+		if _, err := r.collect(); err != nil {
+			log.Error(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-r.refresh:
+		case <-changes:
+		case <-r.inventories.Changes():
+		case <-r.controller.Changes():
+		}
+	}
+}
+
+// Refresh asks for a new collection of the report without waiting for it
+func (r *Reporter) Refresh() {
+	select {
+	case r.refresh <- struct{}{}:
+	default:
 	}
 }
 
-// RawReport returns a report
+// RawReport returns the last collected report, it only collects it
+// if there is none yet
 func (r *Reporter) RawReport() ([]byte, error) {
 	log.Debugf("enter RawReport")  // billzhang 2017-04-04
+	r.lock.RLock()
+	raw := r.raw
+	r.lock.RUnlock()
+	if raw != nil {
+		return raw, nil
+	}
+	return r.collect()
+}
+
+// collect builds the report and caches it serialized, the cached
+// report is never modified
+func (r *Reporter) collect() ([]byte, error) {
 	rpt := &report{
 		Container: topology{
 			Nodes:             r.getContainerNodes(),
@@ -102,6 +216,7 @@ func (r *Reporter) RawReport() ([]byte, error) {
 				Description: "Adds Network controls to the running Docker containers",
 				Interfaces:  []string{"reporter", "controller"},
 				APIVersion:  "1",
+				Status:      r.preflight.Status(r.controller.Backend().Requirements()...),
 			},
 		},
 	}
@@ -109,33 +224,72 @@ func (r *Reporter) RawReport() ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal the report: %v", err)
 	}
+	r.lock.Lock()
+	r.raw = raw
+	r.lock.Unlock()
 	return raw, nil
 }
 
 // GetHandler returns the function performing the action specified by controlID
 func (r *Reporter) GetHandler(nodeID, controlID string) (func() error, error) {
-	log.Debugf("enter GetHandler for nodeID %d", nodeID)  // billzhang 2017-04-04
+	log.Debugf("enter GetHandler for nodeID %s", nodeID)  // billzhang 2017-04-04
 	log.Debugf("enter GetHandler for controlID %s", controlID)  // billzhang 2017-04-04
 	containerID, err := nodeIDToContainerID(nodeID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get container ID from node ID %q: %v", nodeID, err)
 	}
+	if !currentConfig().Features.Controls {
+		return nil, fmt.Errorf("controls are disabled")
+	}
 	container, found := r.store.Container(containerID)
 	if !found {
 		return nil, fmt.Errorf("container %s not found", containerID)
 	}
-	var handler func(pid int) error
+	backend := r.controller.Backend()
+	if missing := r.preflight.Missing(backend.Requirements()...); len(missing) > 0 {
+		return nil, fmt.Errorf("the %s backend cannot work on this host, missing %s", backend.Name(), strings.Join(missing, ", "))
+	}
+	var handler func(c *Controller, pid int) error
+	var requirements []string
+	known := false
 	for _, c := range getControls() {
 		if c.control.ID == controlID {
 			handler = c.handler
+			requirements = c.requirements
+			known = true
 			break
 		}
 	}
-	if handler == nil {
+	if !known {
 		return nil, fmt.Errorf("unknown control ID %q for node ID %q", controlID, nodeID)
 	}
+	if missing := r.preflight.Missing(requirements...); len(missing) > 0 {
+		return nil, fmt.Errorf("the control cannot work on this host, missing %s", strings.Join(missing, ", "))
+	}
+	if controlID != networkControlTablePrefix+clearControlID {
+		if err := currentConfig().Policy.ProtectedNetNS(r.store.Members(containerID, container)); err != nil {
+			return nil, err
+		}
+	}
+	// the containers of a pod share the network namespace of its sandbox
+	pid := r.store.NetNSPID(container)
+	switch controlID {
+	case networkControlTablePrefix + captureControlID:
+		return func() error {
+			return r.captures.Toggle(pid, containerID, container)
+		}, nil
+	case networkControlTablePrefix + probeControlID:
+		return func() error {
+			return r.probes.Toggle(pid, containerID, container)
+		}, nil
+	case networkControlTablePrefix + resetControlID:
+		return func() error {
+			_, err := r.resets.Reset(pid, containerID, container, ResetOptions{})
+			return err
+		}, nil
+	}
 	return func() error {
-		return handler(container.PID)
+		return handler(r.controller, pid)
 	}, nil
 }
 
@@ -148,8 +302,57 @@ func (r *Reporter) getContainerNodes() map[string]node {
 	var err error
 	nodes := map[string]node{}
 	timestamp := time.Now()
+	disabled := r.disabledControls()
+	settings := r.controller.Snapshot()
+	dns := r.controller.DNSSnapshot()
+	http := r.controller.HTTPSnapshot()
+	link := r.controller.LinkSnapshot()
+	ramps := r.controller.RampSnapshot()
+	replays := r.controller.ReplaySnapshot()
+	captures := map[string]Capture{}
+	for _, capture := range r.captures.List() {
+		if _, ok := captures[capture.NetNS]; !ok {
+			captures[capture.NetNS] = capture
+		}
+	}
+	probes := map[string]Probe{}
+	for _, probe := range r.probes.List() {
+		probes[probe.NetNS] = probe
+	}
+	// the last test of a network namespace, from either end
+	tests := map[string]ThroughputTest{}
+	for _, test := range r.throughput.List() {
+		for _, netNSID := range []string{test.SourceNetNS, test.DestinationNetNS} {
+			if _, ok := tests[netNSID]; !ok {
+				tests[netNSID] = test
+			}
+		}
+	}
+	policy := currentConfig().Policy
+	// the containers of the host network are never impaired through
+	// Scope
+	hostID, err := hostNetNSID()
+	if err != nil {
+		log.Error(err)
+	}
+	// the containers sharing a network namespace share its settings
+	// and its protection
+	groups := map[string]map[string]Container{}
 	r.store.ForEach(func(containerID string, container Container) {
-		dead := false
+		if container.NetNSID == "" {
+			return
+		}
+		if groups[container.NetNSID] == nil {
+			groups[container.NetNSID] = map[string]Container{}
+		}
+		groups[container.NetNSID][containerID] = container
+	})
+	r.store.ForEach(func(containerID string, container Container) {
+		members := map[string]Container{containerID: container}
+		if container.NetNSID != "" {
+			members = groups[container.NetNSID]
+		}
+		dead := policy.ProtectedNetNS(members) != nil
 		switch container.State {
 		case Created, Destroyed:
 		// do nothing, to prevent adding a stale node
@@ -159,32 +362,135 @@ func (r *Reporter) getContainerNodes() map[string]node {
 			fallthrough
 		case Running:
 			nodeID := containerIDToNodeID(containerID)
-			spod, _ := getPod(containerID)
-			if status, err = getStatusByPod(spod); err != nil {
-				if err != nil {
-					log.Fatalf("unexpected error.  expected %v, actual %v", nil, err)
+			setting := *TrafficControlStatusInit()
+			ramp, replay, dnsFaults, httpFaults, linkFaults, capture, throughput, resets := "-", "-", "-", "-", "-", "-", "-", "-"
+			// the round trip time and the loss observed by the
+			// probes, next to the settings
+			observed := ProbeStats{}
+			if netNSID := container.NetNSID; netNSID != "" {
+				if s, ok := settings[netNSID]; ok {
+					setting = s
+				}
+				if s, ok := ramps[netNSID]; ok {
+					ramp = s.String()
+				}
+				if s, ok := replays[netNSID]; ok {
+					replay = s.String()
+				}
+				if d, ok := dns[netNSID]; ok {
+					dnsFaults = d.String()
+				}
+				if h, ok := http[netNSID]; ok {
+					httpFaults = h.String()
+				}
+				if l, ok := link[netNSID]; ok {
+					linkFaults = l.String()
+				}
+				if c, ok := captures[netNSID]; ok {
+					capture = c.String()
 				}
-			} else if status == nil {
-				fmt.Errorf("status for pod %s does not exist", spod)
+				if p, ok := probes[netNSID]; ok {
+					observed = p.ProbeStats
+				}
+				if t, ok := tests[netNSID]; ok {
+					throughput = t.describe(netNSID)
+				}
+				if reset, ok := r.resets.Get(netNSID); ok {
+					resets = reset.String()
+				}
+				if netNSID == hostID {
+					dead = true
+				}
+			}
+			spod := container.Pod
+			if status, err = r.podStatus(spod); err != nil {
+				log.Errorf("failed to get the status of pod %s: %v", spod, err)
+				status = &NetworkControlStatus{dpod: "-", bandwidth: "-", latency: "-", packet: "-"}
 			}
 
 			nodes[nodeID] = node{
-				LatestControls: getTrafficNodeControls(timestamp, dead),
+				LatestControls: getTrafficNodeControls(timestamp, dead, disabled),
 				Latest: map[string]stringEntry{
+					"network-control-latency": {
+						Timestamp: timestamp,
+						Value:     setting.latency,
+					},
+					"network-control-observed-rtt": {
+						Timestamp: timestamp,
+						Value:     observed.rtt(),
+					},
+					"network-control-pktloss": {
+						Timestamp: timestamp,
+						Value:     setting.packetLoss,
+					},
+					"network-control-observed-loss": {
+						Timestamp: timestamp,
+						Value:     observed.loss(),
+					},
+					"network-control-rate": {
+						Timestamp: timestamp,
+						Value:     setting.rate,
+					},
+					"network-control-ramp": {
+						Timestamp: timestamp,
+						Value:     ramp,
+					},
+					"network-control-replay": {
+						Timestamp: timestamp,
+						Value:     replay,
+					},
+					"network-control-dns": {
+						Timestamp: timestamp,
+						Value:     dnsFaults,
+					},
+					"network-control-http": {
+						Timestamp: timestamp,
+						Value:     httpFaults,
+					},
+					"network-control-link": {
+						Timestamp: timestamp,
+						Value:     linkFaults,
+					},
+					"network-control-capture": {
+						Timestamp: timestamp,
+						Value:     capture,
+					},
+					"network-control-resets": {
+						Timestamp: timestamp,
+						Value:     resets,
+					},
 				        fmt.Sprintf("%s%s", networkControlTablePrefix, "dst-pod"): {
 						Timestamp: timestamp,
 						Value:     status.dpod,
 					},
 					fmt.Sprintf("%s%s", networkControlTablePrefix, "net-bandwidth"): {
 						Timestamp: timestamp,
-						Value:     status.latency,
+						Value:     status.bandwidth,
 					},
 					fmt.Sprintf("%s%s", networkControlTablePrefix, "net-packet"): {
 						Timestamp: timestamp,
 						Value:     status.packet,
 					},
+					fmt.Sprintf("%s%s", networkControlTablePrefix, "throughput"): {
+						Timestamp: timestamp,
+						Value:     throughput,
+					},
 				},
 			}
+			if inventory, ok := r.inventories.Get(container.NetNSID); ok {
+				for key, value := range inventoryRows(inventory) {
+					nodes[nodeID].Latest[key] = stringEntry{
+						Timestamp: timestamp,
+						Value:     value,
+					}
+				}
+			}
+			if shared := sharedWith(containerID, members); len(shared) > 0 {
+				nodes[nodeID].Latest["network-control-shared"] = stringEntry{
+					Timestamp: timestamp,
+					Value:     strings.Join(shared, ", "),
+				}
+			}
 		}
 	})
 	return nodes
@@ -201,6 +507,14 @@ func getMetadataTemplate() map[string]metadataTemplate {
 			Priority: 13.5,
 			From:     "latest",
 		},
+		"network-control-observed-rtt": {
+			ID:       "network-control-observed-rtt",
+			Label:    "Observed RTT",
+			Truncate: 0,
+			Datatype: "",
+			Priority: 13.55,
+			From:     "latest",
+		},
 		"network-control-pktloss": {
 			ID:       "network-control-pktloss",
 			Label:    "Packet Loss",
@@ -209,6 +523,86 @@ func getMetadataTemplate() map[string]metadataTemplate {
 			Priority: 13.6,
 			From:     "latest",
 		},
+		"network-control-observed-loss": {
+			ID:       "network-control-observed-loss",
+			Label:    "Observed Loss",
+			Truncate: 0,
+			Datatype: "",
+			Priority: 13.65,
+			From:     "latest",
+		},
+		"network-control-rate": {
+			ID:       "network-control-rate",
+			Label:    "Bandwidth Limit",
+			Truncate: 0,
+			Datatype: "",
+			Priority: 13.7,
+			From:     "latest",
+		},
+		"network-control-ramp": {
+			ID:       "network-control-ramp",
+			Label:    "Ramp",
+			Truncate: 0,
+			Datatype: "",
+			Priority: 13.71,
+			From:     "latest",
+		},
+		"network-control-replay": {
+			ID:       "network-control-replay",
+			Label:    "Trace Replay",
+			Truncate: 0,
+			Datatype: "",
+			Priority: 13.72,
+			From:     "latest",
+		},
+		"network-control-dns": {
+			ID:       "network-control-dns",
+			Label:    "DNS Faults",
+			Truncate: 0,
+			Datatype: "",
+			Priority: 13.75,
+			From:     "latest",
+		},
+		"network-control-http": {
+			ID:       "network-control-http",
+			Label:    "HTTP Faults",
+			Truncate: 0,
+			Datatype: "",
+			Priority: 13.76,
+			From:     "latest",
+		},
+		"network-control-link": {
+			ID:       "network-control-link",
+			Label:    "Link Faults",
+			Truncate: 0,
+			Datatype: "",
+			Priority: 13.765,
+			From:     "latest",
+		},
+		"network-control-capture": {
+			ID:       "network-control-capture",
+			Label:    "Packet Capture",
+			Truncate: 0,
+			Datatype: "",
+			Priority: 13.77,
+			From:     "latest",
+		},
+		"network-control-resets": {
+			ID:       "network-control-resets",
+			Label:    "Connections Reset",
+			Truncate: 0,
+			Datatype: "",
+			Priority: 13.775,
+			From:     "latest",
+		},
+		"network-control-shared": {
+			ID:       "network-control-shared",
+			Label:    "Network Shared With",
+			Truncate: 0,
+			Datatype: "",
+			Priority: 13.8,
+			From:     "latest",
+		},
 	}
 }
 
@@ -219,26 +613,111 @@ func getTableTemplate() map[string]tableTemplate {
 			Label:  "Network Control",
 			Prefix: networkControlTablePrefix,
 		},
+		"network-control-interfaces": {
+			ID:     "network-control-interfaces",
+			Label:  "Interfaces",
+			Prefix: interfacesTablePrefix,
+			Type:   multicolumnTableType,
+			Columns: []tableColumn{
+				{ID: "name", Label: "Name"},
+				{ID: "state", Label: "State"},
+				{ID: "mtu", Label: "MTU", Datatype: "number"},
+				{ID: "addresses", Label: "Addresses"},
+				{ID: "mac", Label: "MAC"},
+				{ID: "driver", Label: "Driver"},
+			},
+		},
+		"network-control-routes": {
+			ID:     "network-control-routes",
+			Label:  "Routes",
+			Prefix: routesTablePrefix,
+			Type:   multicolumnTableType,
+			Columns: []tableColumn{
+				{ID: "destination", Label: "Destination"},
+				{ID: "gateway", Label: "Gateway"},
+				{ID: "device", Label: "Device"},
+				{ID: "source", Label: "Source"},
+				{ID: "metric", Label: "Metric", Datatype: "number"},
+			},
+		},
 	}
 }
 
-func getTrafficNodeControls(timestamp time.Time, dead bool) map[string]controlEntry {
+// inventoryRows returns the rows of the Interfaces and Routes tables of
+// an inventory by key
+func inventoryRows(inventory NetworkInventory) map[string]string {
+	rows := map[string]string{}
+	set := func(prefix, row string, columns map[string]string) {
+		for column, value := range columns {
+			rows[prefix+row+tableEntryKeySeparator+column] = value
+		}
+	}
+	for _, iface := range inventory.Interfaces {
+		driver := orDash(iface.Driver)
+		if iface.Master != "" {
+			driver = fmt.Sprintf("%s (master %s)", driver, iface.Master)
+		}
+		set(interfacesTablePrefix, fmt.Sprintf("%04d", iface.Index), map[string]string{
+			"name":      iface.Name,
+			"state":     iface.State,
+			"mtu":       fmt.Sprint(iface.MTU),
+			"addresses": orDash(strings.Join(iface.Addresses, ", ")),
+			"mac":       orDash(iface.MAC),
+			"driver":    driver,
+		})
+	}
+	for i, route := range inventory.Routes {
+		destination := route.Destination
+		if route.Table != 0 {
+			destination = fmt.Sprintf("%s table %d", destination, route.Table)
+		}
+		set(routesTablePrefix, fmt.Sprintf("%04d", i), map[string]string{
+			"destination": destination,
+			"gateway":     orDash(route.Gateway),
+			"device":      orDash(route.Device),
+			"source":      orDash(route.Source),
+			"metric":      fmt.Sprint(route.Metric),
+		})
+	}
+	return rows
+}
+
+// getTrafficNodeControls returns the controls of a container, all of
+// them are dead if dead is set and the ones in disabled are dead anyway
+func getTrafficNodeControls(timestamp time.Time, dead bool, disabled map[string]bool) map[string]controlEntry {
 	log.Debugf("enter getTrafficNodeControls")  // billzhang 2017-04-04
 	controls := map[string]controlEntry{}
-	entry := controlEntry{
-		Timestamp: timestamp,
-		Value: controlData{
-			Dead: dead,
-		},
+	if !currentConfig().Features.Controls {
+		return controls
 	}
 	for _, c := range getControls() {
-		controls[c.control.ID] = entry
+		controls[c.control.ID] = controlEntry{
+			Timestamp: timestamp,
+			Value: controlData{
+				Dead: dead || disabled[c.control.ID],
+			},
+		}
 	}
 	return controls
 }
 
+// disabledControls returns the controls which cannot work on this host,
+// missing the requirements of the backend or their own ones, GetHandler
+// refuses them
+func (r *Reporter) disabledControls() map[string]bool {
+	backend := len(r.preflight.Missing(r.controller.Backend().Requirements()...)) > 0
+	disabled := map[string]bool{}
+	for _, c := range getControls() {
+		disabled[c.control.ID] = backend || len(r.preflight.Missing(c.requirements...)) > 0
+	}
+	return disabled
+}
+
 func getTrafficControls() map[string]control {
 	controls := map[string]control{}
+	if !currentConfig().Features.Controls {
+		return controls
+	}
 	for _, c := range getControls() {
 		controls[c.control.ID] = c.control
 	}
@@ -247,89 +726,122 @@ func getTrafficControls() map[string]control {
 
 type extControl struct {
 	control control
-	handler func(pid int) error
+	handler func(c *Controller, pid int) error
+	// requirements are the preflight features the handler needs on top
+	// of the ones of the backend
+	requirements []string
 }
 
-func getLatencyControls() []extControl {
-	log.Debugf("enter getLatencyControls")  // billzhang 2017-04-04
-	return []extControl{
-		{
+// clearControlID is the ID of the control removing the settings,
+// captureControlID the one starting and stopping a packet capture,
+// probeControlID the one starting and stopping the probes and
+// resetControlID the one resetting the TCP connections, they are always
+// shown after the presets
+const (
+	clearControlID   = "clear"
+	captureControlID = "capture"
+	probeControlID   = "probe"
+	resetControlID   = "reset"
+)
+
+// getControls generates the controls from the presets of the
+// configuration
+func getControls() []extControl {
+	controls := []extControl{}
+	rank := 0
+	for _, preset := range currentConfig().Presets {
+		impairment := preset.Impairment
+		ext := extControl{
 			control: control{
-				ID:    fmt.Sprintf("%s%s", networkControlTablePrefix, "slow"),
-				Human: "Traffic speed: slow",
-				Icon:  "fa-hourglass-1",
-				Rank:  20,
+				ID:    fmt.Sprintf("%s%s", networkControlTablePrefix, preset.ID),
+				Human: preset.Label,
+				Icon:  preset.Icon,
+				Rank:  preset.Rank,
 			},
-			handler: func(pid int) error {
-				return ApplyLatency(pid, "2000ms")
+			handler: func(c *Controller, pid int) error {
+				return c.Apply(pid, impairment, 0)
 			},
+		}
+		// clicking the control again stops the ramp or the replay or
+		// removes the DNS, HTTP or link faults
+		switch {
+		case preset.Ramp != nil:
+			ramp := *preset.Ramp
+			ext.handler = func(c *Controller, pid int) error {
+				return c.ToggleRamp(pid, ramp)
+			}
+		case preset.Replay != nil:
+			replay := *preset.Replay
+			ext.handler = func(c *Controller, pid int) error {
+				return c.ToggleReplay(pid, replay)
+			}
+		case preset.DNS != nil:
+			dns := *preset.DNS
+			ext.handler = func(c *Controller, pid int) error {
+				return c.ToggleDNS(pid, dns)
+			}
+			ext.requirements = proxyRequirements
+		case preset.HTTP != nil:
+			http := *preset.HTTP
+			ext.handler = func(c *Controller, pid int) error {
+				return c.ToggleHTTP(pid, http)
+			}
+			ext.requirements = proxyRequirements
+		case preset.Link != nil:
+			link := *preset.Link
+			ext.handler = func(c *Controller, pid int) error {
+				return c.ToggleLink(pid, link)
+			}
+			ext.requirements = link.requirements()
+		}
+		controls = append(controls, ext)
+		if preset.Rank >= rank {
+			rank = preset.Rank + 1
+		}
+	}
+	controls = append(controls, extControl{
+		control: control{
+			ID:    fmt.Sprintf("%s%s", networkControlTablePrefix, clearControlID),
+			Human: "Clear traffic control settings",
+			Icon:  "fa-times-circle",
+			Rank:  rank,
 		},
-		{
-			control: control{
-				ID:    fmt.Sprintf("%s%s", networkControlTablePrefix, "medium"),
-				Human: "Traffic speed: medium",
-				Icon:  "fa-hourglass-2",
-				Rank:  21,
-			},
-			handler: func(pid int) error {
-				return ApplyLatency(pid, "1000ms")
-			},
+		handler: func(c *Controller, pid int) error {
+			return c.ClearTrafficControlSettings(pid)
 		},
-		{
-			control: control{
-				ID:    fmt.Sprintf("%s%s", networkControlTablePrefix, "fast"),
-				Human: "Traffic speed: fast",
-				Icon:  "fa-hourglass-3",
-				Rank:  22,
-			},
-			handler: func(pid int) error {
-				return ApplyLatency(pid, "500ms")
-			},
+	})
+	// the reporter handles the captures, clicking the control again
+	// stops the capture
+	controls = append(controls, extControl{
+		control: control{
+			ID:    fmt.Sprintf("%s%s", networkControlTablePrefix, captureControlID),
+			Human: "Capture packets, see ctl capture to download them",
+			Icon:  "fa-video-camera",
+			Rank:  rank + 1,
 		},
-	}
-}
-
-func getPacketLossControls() []extControl {
-	return []extControl{
-		{
-			control: control{
-				ID:    fmt.Sprintf("%s%s", networkControlTablePrefix, "pkt-drop-low"),
-				Human: "Packet drop: low",
-				Icon:  "fa-cut",
-				Rank:  23,
-			},
-			handler: func(pid int) error {
-				return ApplyPacketLoss(pid, "10%")
-			},
+		requirements: captureRequirements,
+	})
+	// the reporter handles the probes too, they probe the peers seen in
+	// conntrack
+	controls = append(controls, extControl{
+		control: control{
+			ID:    fmt.Sprintf("%s%s", networkControlTablePrefix, probeControlID),
+			Human: "Probe the peers, shows the observed RTT and loss",
+			Icon:  "fa-heartbeat",
+			Rank:  rank + 2,
 		},
-	}
-}
-
-func getGeneralControls() []extControl {
-	return []extControl{
-		{
-			control: control{
-				ID:    fmt.Sprintf("%s%s", networkControlTablePrefix, "clear"),
-				Human: "Clear traffic control settings",
-				Icon:  "fa-times-circle",
-				Rank:  24,
-			},
-			handler: func(pid int) error {
-				return ClearTrafficControlSettings(pid)
-			},
+		requirements: probeRequirements,
+	})
+	// and the connection resets
+	controls = append(controls, extControl{
+		control: control{
+			ID:    fmt.Sprintf("%s%s", networkControlTablePrefix, resetControlID),
+			Human: "Reset the TCP connections",
+			Icon:  "fa-bolt",
+			Rank:  rank + 3,
 		},
-	}
-}
-
-func getControls() []extControl {
-	controls := getLatencyControls()
-	// TODO alepuccetti why append(controls, getPacketLossControls()) does not work?
-	for _, ctrl := range getPacketLossControls() {
-		controls = append(controls, ctrl)
-	}
-	for _, ctrl := range getGeneralControls() {
-		controls = append(controls, ctrl)
-	}
+		requirements: resetRequirements,
+	})
 	return controls
 }
 
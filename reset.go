@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+)
+
+// Connection resets tear the TCP connections of a container down
+// without restarting it, to test the reconnection logic of the
+// applications. The connections are enumerated with sock_diag in the
+// network namespace of the container and destroyed with SOCK_DESTROY,
+// which needs a kernel built with CONFIG_INET_DIAG_DESTROY. Without it,
+// the next segment each connection receives on the interface of the
+// container is turned into a RST by a tc pedit action, the connections
+// which receive nothing for resetRSTTimeout are left alone.
+
+const (
+	resetDestroy = "sock_destroy"
+	resetRST     = "rst"
+	// sock_diag message types
+	sockDiagByFamily = 20
+	sockDestroy      = 21
+	// sizeofInetDiagReqV2 is the size of struct inet_diag_req_v2 and
+	// sizeofInetDiagSockID the one of struct inet_diag_sockid
+	sizeofInetDiagReqV2  = 56
+	sizeofInetDiagSockID = 48
+	// resetRSTTimeout is how long the tc filters wait for the
+	// connections to receive a segment
+	resetRSTTimeout = 5 * time.Second
+	// resetPollInterval is how often the connections still open are
+	// checked meanwhile
+	resetPollInterval = 100 * time.Millisecond
+)
+
+// resetStates are the TCP states of the connections reset, the
+// listening sockets and the ones already closing in TIME_WAIT are left
+// alone
+var resetStates = map[uint8]string{
+	1:  "ESTABLISHED",
+	2:  "SYN-SENT",
+	3:  "SYN-RECV",
+	4:  "FIN-WAIT-1",
+	5:  "FIN-WAIT-2",
+	8:  "CLOSE-WAIT",
+	9:  "LAST-ACK",
+	11: "CLOSING",
+}
+
+// resetFilterPrefs are the preferences of the tc filters turning the
+// segments into RSTs, by family since the kernel refuses filters of
+// another protocol at the same preference
+var resetFilterPrefs = map[uint8]string{
+	syscall.AF_INET:  "49",
+	syscall.AF_INET6: "50",
+}
+
+// resetRequirements are the preflight features the connection resets
+// need, the RST fallback needs tc too
+var resetRequirements = []string{featureCapNetAdmin, featureCapSysAdmin}
+
+// ResetOptions select the connections to reset, all the TCP connections
+// of the network namespace by default
+type ResetOptions struct {
+	// Peer is the address of the remote end or a CIDR, e.g. 10.0.0.0/8
+	Peer string `json:"peer,omitempty"`
+	// Port is the local or the remote port of the connections
+	Port int `json:"port,omitempty"`
+}
+
+// resolve parses the peer, nil if the connections are not filtered by
+// peer
+func (o *ResetOptions) resolve() (*net.IPNet, error) {
+	if o.Port < 0 || o.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", o.Port)
+	}
+	if o.Peer == "" {
+		return nil, nil
+	}
+	if _, peer, err := net.ParseCIDR(o.Peer); err == nil {
+		return peer, nil
+	}
+	ip := net.ParseIP(o.Peer)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid peer %q, expected an address or a CIDR", o.Peer)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// TCPConnection is a connection matched by a reset
+type TCPConnection struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+	State  string `json:"state"`
+	Reset  bool   `json:"reset"`
+}
+
+// ConnectionReset is the last reset of the connections of a network
+// namespace
+type ConnectionReset struct {
+	Node        string `json:"node"`
+	ContainerID string `json:"container_id"`
+	Container   string `json:"container"`
+	NetNS       string `json:"netns"`
+	ResetOptions
+	Time time.Time `json:"time"`
+	// Method is sock_destroy, or rst when the kernel cannot destroy the
+	// sockets
+	Method      string          `json:"method,omitempty"`
+	Matched     int             `json:"matched"`
+	Reset       int             `json:"reset"`
+	Connections []TCPConnection `json:"connections"`
+}
+
+func (r ConnectionReset) String() string {
+	if r.Matched == 0 {
+		return fmt.Sprintf("no connection to reset at %s", r.Time.Format("15:04:05"))
+	}
+	return fmt.Sprintf("%d of %d reset with %s at %s", r.Reset, r.Matched, r.Method, r.Time.Format("15:04:05"))
+}
+
+// tcpSocket is a socket listed by sock_diag
+type tcpSocket struct {
+	family uint8
+	state  uint8
+	local  *net.TCPAddr
+	remote *net.TCPAddr
+	// id is the inet_diag_sockid identifying the socket, its cookie
+	// included
+	id []byte
+}
+
+func (s *tcpSocket) connection() TCPConnection {
+	return TCPConnection{Local: s.local.String(), Remote: s.remote.String(), State: resetStates[s.state]}
+}
+
+// Resets resets the connections of the network namespaces and keeps the
+// last reset of each of them
+type Resets struct {
+	lock       sync.Mutex
+	controller *Controller
+	resets     map[string]ConnectionReset
+}
+
+// NewResets instantiates a new Resets, the RST fallback goes through the
+// queue of controller since it modifies the tc configuration
+func NewResets(controller *Controller) *Resets {
+	return &Resets{
+		controller: controller,
+		resets:     map[string]ConnectionReset{},
+	}
+}
+
+// Get returns the last reset of a network namespace
+func (r *Resets) Get(netNSID string) (ConnectionReset, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	reset, ok := r.resets[netNSID]
+	return reset, ok
+}
+
+// Reset resets the connections of the network namespace of pid matching
+// options and waits for the result
+func (r *Resets) Reset(pid int, containerID string, container Container, options ResetOptions) (ConnectionReset, error) {
+	peer, err := options.resolve()
+	if err != nil {
+		return ConnectionReset{}, err
+	}
+	netNS := fmt.Sprintf("/proc/%d/ns/net", pid)
+	reset := ConnectionReset{
+		Node:         currentConfig().NodeName,
+		ContainerID:  containerID,
+		Container:    container.Name,
+		NetNS:        container.NetNSID,
+		ResetOptions: options,
+		Time:         time.Now(),
+		Connections:  []TCPConnection{},
+	}
+	var sockets, left []*tcpSocket
+	err = ns.WithNetNSPath(netNS, func(ns.NetNS) error {
+		all, err := listTCPSockets()
+		if err != nil {
+			return err
+		}
+		for _, s := range all {
+			if peer != nil && !peer.Contains(s.remote.IP) {
+				continue
+			}
+			if options.Port != 0 && s.local.Port != options.Port && s.remote.Port != options.Port {
+				continue
+			}
+			sockets = append(sockets, s)
+		}
+		if len(sockets) == 0 {
+			return nil
+		}
+		reset.Method = resetDestroy
+		left, err = destroyTCPSockets(sockets)
+		return err
+	})
+	if err == nil && len(left) > 0 {
+		log.Infof("the kernel cannot destroy the sockets of network namespace %s, resetting %d connections with RSTs", container.NetNSID, len(left))
+		reset.Method = resetRST
+		err = r.controller.do(pid, func(iface NetInterface, netNSID string) error {
+			var err error
+			left, err = rstTCPSockets(iface.NetNS, left)
+			return err
+		})
+	}
+	if err != nil {
+		return ConnectionReset{}, fmt.Errorf("failed to reset the connections: %v", err)
+	}
+	remaining := map[string]bool{}
+	for _, s := range left {
+		remaining[string(s.id)] = true
+	}
+	for _, s := range sockets {
+		c := s.connection()
+		c.Reset = !remaining[string(s.id)]
+		if c.Reset {
+			reset.Reset++
+		}
+		reset.Connections = append(reset.Connections, c)
+	}
+	reset.Matched = len(sockets)
+	sort.Sort(byLocal(reset.Connections))
+	log.Infof("%d of the %d connections of network namespace %s matching the reset were reset", reset.Reset, reset.Matched, container.NetNSID)
+	r.lock.Lock()
+	r.resets[container.NetNSID] = reset
+	r.lock.Unlock()
+	return reset, nil
+}
+
+// destroyTCPSockets destroys sockets with SOCK_DESTROY and returns the
+// ones left, all of them if the kernel cannot destroy sockets. It runs
+// in the network namespace of the sockets.
+func destroyTCPSockets(sockets []*tcpSocket) ([]*tcpSocket, error) {
+	fd, err := openSockDiag()
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	left := []*tcpSocket{}
+	for i, s := range sockets {
+		req := inetDiagRequest(s.family, 0, s.id)
+		err := sockDiagExchange(fd, sockDestroy, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK, req, nil)
+		switch err {
+		case nil:
+		case syscall.EOPNOTSUPP:
+			return append(left, sockets[i:]...), nil
+		case syscall.ENOENT:
+			// the connection was closed meanwhile
+		default:
+			log.Warningf("failed to destroy the socket of %s to %s: %v", s.local, s.remote, err)
+			left = append(left, s)
+		}
+	}
+	return left, nil
+}
+
+// rstTCPSockets turns the next segment the sockets receive on the
+// interface of the container into a RST, for resetRSTTimeout at most,
+// and returns the ones left. The connections over the loopback
+// interface are left alone. It runs in the queue of the controller.
+func rstTCPSockets(netNS string, sockets []*tcpSocket) ([]*tcpSocket, error) {
+	qdiscs, err := commandOutput(netNS, []string{"tc", "qdisc", "show", "dev", containerDevice})
+	if err != nil {
+		return nil, err
+	}
+	// the filters are added to the ingress hook, a clsact qdisc is
+	// added for them if there is none
+	parent, added := "ffff:fff2", false
+	switch {
+	case strings.Contains(qdiscs, "qdisc clsact"):
+	case strings.Contains(qdiscs, "qdisc ingress"):
+		parent = "ffff:"
+	default:
+		if err := runCommands(netNS, [][]string{{"tc", "qdisc", "add", "dev", containerDevice, "clsact"}}); err != nil {
+			return nil, err
+		}
+		added = true
+	}
+	prefs := map[string]bool{}
+	defer func() {
+		if added {
+			runCommands(netNS, [][]string{{"tc", "qdisc", "del", "dev", containerDevice, "clsact"}})
+			return
+		}
+		for pref := range prefs {
+			runCommands(netNS, [][]string{{"tc", "filter", "del", "dev", containerDevice, "parent", parent, "pref", pref}})
+		}
+	}()
+	left := map[string]*tcpSocket{}
+	cmds := [][]string{}
+	for _, s := range sockets {
+		if s.remote.IP.IsLoopback() || s.local.IP.Equal(s.remote.IP) {
+			continue
+		}
+		left[string(s.id)] = s
+		prefs[resetFilterPrefs[s.family]] = true
+		cmds = append(cmds, rstFilterCommand(parent, s))
+	}
+	if err := runCommands(netNS, cmds); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(resetRSTTimeout)
+	for len(left) > 0 && time.Now().Before(deadline) {
+		time.Sleep(resetPollInterval)
+		var open []*tcpSocket
+		err := ns.WithNetNSPath(netNS, func(ns.NetNS) error {
+			var err error
+			open, err = listTCPSockets()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		still := map[string]*tcpSocket{}
+		for _, s := range open {
+			if _, ok := left[string(s.id)]; ok {
+				still[string(s.id)] = s
+			}
+		}
+		left = still
+	}
+	// the loopback connections are left too
+	remaining := []*tcpSocket{}
+	for _, s := range sockets {
+		if _, ok := left[string(s.id)]; ok || s.remote.IP.IsLoopback() || s.local.IP.Equal(s.remote.IP) {
+			remaining = append(remaining, s)
+		}
+	}
+	return remaining, nil
+}
+
+// rstFilterCommand returns the tc command setting the RST and ACK flags
+// of the segments received by s, IP options aside
+func rstFilterCommand(parent string, s *tcpSocket) []string {
+	protocol, match, bits, flags := "ip", "ip", "32", 20+13
+	if s.family == syscall.AF_INET6 {
+		protocol, match, bits, flags = "ipv6", "ip6", "128", 40+13
+	}
+	return []string{"tc", "filter", "add", "dev", containerDevice, "parent", parent, "pref", resetFilterPrefs[s.family], "protocol", protocol, "u32",
+		"match", match, "protocol", strconv.Itoa(syscall.IPPROTO_TCP), "0xff",
+		"match", match, "src", s.remote.IP.String() + "/" + bits,
+		"match", match, "dst", s.local.IP.String() + "/" + bits,
+		"match", match, "sport", strconv.Itoa(s.remote.Port), "0xffff",
+		"match", match, "dport", strconv.Itoa(s.local.Port), "0xffff",
+		"action", "pedit", "munge", "offset", strconv.Itoa(flags), "u8", "set", "0x14", "pipe",
+		"action", "csum", "tcp"}
+}
+
+// listTCPSockets lists the IPv4 and IPv6 TCP sockets in the states of
+// resetStates, it runs in their network namespace
+func listTCPSockets() ([]*tcpSocket, error) {
+	fd, err := openSockDiag()
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	states := uint32(0)
+	for state := range resetStates {
+		states |= 1 << state
+	}
+	sockets := []*tcpSocket{}
+	for _, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		req := inetDiagRequest(family, states, make([]byte, sizeofInetDiagSockID))
+		err := sockDiagExchange(fd, sockDiagByFamily, syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP, req, func(m syscall.NetlinkMessage) {
+			if s := parseInetDiagMsg(m.Data); s != nil {
+				sockets = append(sockets, s)
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the TCP sockets: %v", err)
+		}
+	}
+	return sockets, nil
+}
+
+func openSockDiag() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_INET_DIAG)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open a sock_diag socket: %v", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return -1, fmt.Errorf("failed to bind the sock_diag socket: %v", err)
+	}
+	return fd, nil
+}
+
+// inetDiagRequest returns a struct inet_diag_req_v2 for TCP
+func inetDiagRequest(family uint8, states uint32, id []byte) []byte {
+	b := make([]byte, sizeofInetDiagReqV2)
+	b[0] = family
+	b[1] = syscall.IPPROTO_TCP
+	binary.LittleEndian.PutUint32(b[4:8], states)
+	copy(b[8:], id)
+	return b
+}
+
+// parseInetDiagMsg parses a struct inet_diag_msg, nil if it is not a
+// TCP socket of resetStates
+func parseInetDiagMsg(b []byte) *tcpSocket {
+	if len(b) < 4+sizeofInetDiagSockID {
+		return nil
+	}
+	s := &tcpSocket{
+		family: b[0],
+		state:  b[1],
+		id:     append([]byte{}, b[4:4+sizeofInetDiagSockID]...),
+	}
+	if _, ok := resetStates[s.state]; !ok {
+		return nil
+	}
+	length := net.IPv4len
+	if s.family == syscall.AF_INET6 {
+		length = net.IPv6len
+	}
+	id := s.id
+	s.local = &net.TCPAddr{IP: net.IP(append([]byte{}, id[4:4+length]...)), Port: int(binary.BigEndian.Uint16(id[0:2]))}
+	s.remote = &net.TCPAddr{IP: net.IP(append([]byte{}, id[20:20+length]...)), Port: int(binary.BigEndian.Uint16(id[2:4]))}
+	return s
+}
+
+// sockDiagExchange sends a sock_diag request and passes the messages of
+// the answer to handle until it is done, the error of an acknowledgment
+// is returned as is
+func sockDiagExchange(fd int, typ uint16, flags uint16, req []byte, handle func(syscall.NetlinkMessage)) error {
+	b := make([]byte, syscall.NLMSG_HDRLEN+len(req))
+	binary.LittleEndian.PutUint32(b[0:4], uint32(len(b)))
+	binary.LittleEndian.PutUint16(b[4:6], typ)
+	binary.LittleEndian.PutUint16(b[6:8], flags)
+	binary.LittleEndian.PutUint32(b[8:12], 1)
+	copy(b[syscall.NLMSG_HDRLEN:], req)
+	if err := syscall.Sendto(fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	buf := make([]byte, 8*os.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		messages, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return fmt.Errorf("truncated netlink error")
+				}
+				if errno := -int32(binary.LittleEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return syscall.Errno(errno)
+				}
+				return nil
+			}
+			if handle != nil {
+				handle(m)
+			}
+		}
+	}
+}
+
+type byLocal []TCPConnection
+
+func (s byLocal) Len() int           { return len(s) }
+func (s byLocal) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLocal) Less(i, j int) bool { return s[i].Local < s[j].Local }
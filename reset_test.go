@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// inetDiagMsg builds the struct inet_diag_msg of a TCP socket
+func inetDiagMsg(family, state uint8, local, remote *net.TCPAddr, cookie uint64) []byte {
+	b := make([]byte, 4+sizeofInetDiagSockID+20)
+	b[0], b[1] = family, state
+	id := b[4 : 4+sizeofInetDiagSockID]
+	binary.BigEndian.PutUint16(id[0:2], uint16(local.Port))
+	binary.BigEndian.PutUint16(id[2:4], uint16(remote.Port))
+	ip := func(addr *net.TCPAddr) net.IP {
+		if family == syscall.AF_INET {
+			return addr.IP.To4()
+		}
+		return addr.IP.To16()
+	}
+	copy(id[4:20], ip(local))
+	copy(id[20:36], ip(remote))
+	// interface
+	binary.LittleEndian.PutUint32(id[36:40], 2)
+	binary.LittleEndian.PutUint64(id[40:48], cookie)
+	// inode
+	binary.LittleEndian.PutUint32(b[len(b)-4:], 4242)
+	return b
+}
+
+func TestParseInetDiagMsg(t *testing.T) {
+	local4 := &net.TCPAddr{IP: net.ParseIP("10.32.0.5"), Port: 43512}
+	remote4 := &net.TCPAddr{IP: net.ParseIP("10.96.0.1"), Port: 443}
+	local6 := &net.TCPAddr{IP: net.ParseIP("fd00::5"), Port: 8080}
+	remote6 := &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 51000}
+	for _, test := range []struct {
+		name       string
+		msg        []byte
+		connection TCPConnection
+		ignored    bool
+	}{
+		{
+			name:       "IPv4 established",
+			msg:        inetDiagMsg(syscall.AF_INET, 1, local4, remote4, 7),
+			connection: TCPConnection{Local: "10.32.0.5:43512", Remote: "10.96.0.1:443", State: "ESTABLISHED"},
+		},
+		{
+			name:       "IPv6 close wait",
+			msg:        inetDiagMsg(syscall.AF_INET6, 8, local6, remote6, 8),
+			connection: TCPConnection{Local: "[fd00::5]:8080", Remote: "[fd00::1]:51000", State: "CLOSE-WAIT"},
+		},
+		{
+			name:       "syn sent",
+			msg:        inetDiagMsg(syscall.AF_INET, 2, local4, remote4, 9),
+			connection: TCPConnection{Local: "10.32.0.5:43512", Remote: "10.96.0.1:443", State: "SYN-SENT"},
+		},
+		{name: "time wait", msg: inetDiagMsg(syscall.AF_INET, 6, local4, remote4, 10), ignored: true},
+		{name: "listening", msg: inetDiagMsg(syscall.AF_INET6, 10, local6, &net.TCPAddr{IP: net.IPv6zero}, 11), ignored: true},
+		{name: "truncated", msg: inetDiagMsg(syscall.AF_INET, 1, local4, remote4, 12)[:4+sizeofInetDiagSockID-1], ignored: true},
+	} {
+		s := parseInetDiagMsg(test.msg)
+		if test.ignored {
+			if s != nil {
+				t.Errorf("%s: expected the socket to be ignored, got %+v", test.name, s.connection())
+			}
+			continue
+		}
+		if s == nil {
+			t.Errorf("%s: socket ignored", test.name)
+			continue
+		}
+		if connection := s.connection(); connection != test.connection {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.connection, connection)
+		}
+		// the identifier, the cookie included, is sent back to destroy
+		// the socket and must not share the buffer of the answer
+		id := append([]byte{}, test.msg[4:4+sizeofInetDiagSockID]...)
+		for i := range test.msg {
+			test.msg[i] = 0
+		}
+		if !bytes.Equal(s.id, id) {
+			t.Errorf("%s: expected id %x, got %x", test.name, id, s.id)
+		}
+	}
+}
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"golang.org/x/sys/unix"
+)
+
+// Before touching an interface for the first time the plugin takes a
+// snapshot of its qdiscs, classes and filters, clearing the settings
+// restores it. Snapshots are persisted so that they survive restarts of
+// the plugin.
+
+const defaultSnapshotDir = "/var/run/network-control/snapshots"
+
+// qdiscs whose options, as printed by tc, can be given back to tc
+var restorableQdiscs = map[string]bool{
+	"netem":    true,
+	"tbf":      true,
+	"htb":      true,
+	"prio":     true,
+	"pfifo":    true,
+	"bfifo":    true,
+	"sfq":      true,
+	"fq":       true,
+	"fq_codel": true,
+}
+
+// classes of the other qdiscs are created implicitly
+var restorableClasses = map[string]bool{
+	"htb": true,
+}
+
+// statistics printed among the options, with the number of values
+var tcStatistics = map[string]int{
+	"refcnt":              1,
+	"direct_packets_stat": 1,
+	"leaf":                1,
+}
+
+var packetCount = regexp.MustCompile(`^[0-9]+p$`)
+
+// tcObject is a qdisc or a class
+type tcObject struct {
+	Class   bool
+	Kind    string
+	ID      string
+	Parent  string
+	Options []string
+}
+
+// hook tells whether the object is the ingress or clsact qdisc
+func (o tcObject) hook() bool {
+	return !o.Class && (o.Kind == "ingress" || o.Kind == "clsact")
+}
+
+// kernelDefault tells whether the qdisc was created by the kernel
+func (o tcObject) kernelDefault() bool {
+	return !o.Class && o.ID == "0:"
+}
+
+func parseTCObject(line string) (tcObject, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || (fields[0] != "qdisc" && fields[0] != "class") {
+		return tcObject{}, fmt.Errorf("unexpected tc output %q", line)
+	}
+	o := tcObject{
+		Class: fields[0] == "class",
+		Kind:  fields[1],
+		ID:    fields[2],
+	}
+	rest := fields[3:]
+	switch rest[0] {
+	case "root":
+		rest = rest[1:]
+		if o.Class {
+			// the parent of a root class is the qdisc
+			o.Parent = strings.SplitAfter(o.ID, ":")[0]
+		}
+	case "parent":
+		if len(rest) < 2 {
+			return tcObject{}, fmt.Errorf("unexpected tc output %q", line)
+		}
+		o.Parent = rest[1]
+		rest = rest[2:]
+	default:
+		return tcObject{}, fmt.Errorf("unexpected tc output %q", line)
+	}
+	for i := 0; i < len(rest); i++ {
+		if n, ok := tcStatistics[rest[i]]; ok {
+			i += n
+			continue
+		}
+		option := rest[i]
+		if strings.Trim(option, "-") == "" {
+			continue
+		}
+		if packetCount.MatchString(option) {
+			option = strings.TrimSuffix(option, "p")
+		}
+		o.Options = append(o.Options, option)
+	}
+	return o, nil
+}
+
+// addCommand returns the tc command creating the object on dev
+func (o tcObject) addCommand(dev string) []string {
+	switch {
+	case o.Class:
+		cmd := []string{"tc", "class", "add", "dev", dev, "parent", o.Parent, "classid", o.ID, o.Kind}
+		return append(cmd, o.Options...)
+	case o.Parent == "":
+		cmd := []string{"tc", "qdisc", "add", "dev", dev, "root", "handle", o.ID, o.Kind}
+		return append(cmd, o.Options...)
+	default:
+		cmd := []string{"tc", "qdisc", "add", "dev", dev, "parent", o.Parent, "handle", o.ID, o.Kind}
+		return append(cmd, o.Options...)
+	}
+}
+
+// tcFilter is a filter of a qdisc or a class
+type tcFilter struct {
+	Parent   string
+	Protocol string
+	Pref     string
+	Handle   string `json:",omitempty"`
+	Kind     string
+	Options  []string
+	// ProgramID is the eBPF program of a bpf filter, the snapshot pins
+	// it to Pin so that it outlives the filter
+	ProgramID uint32 `json:",omitempty"`
+	Pin       string `json:",omitempty"`
+}
+
+// addCommand returns the tc command creating the filter on dev
+func (f tcFilter) addCommand(dev string) []string {
+	cmd := []string{"tc", "filter", "add", "dev", dev, "parent", f.Parent, "protocol", f.Protocol, "pref", f.Pref}
+	if f.Handle != "" {
+		cmd = append(cmd, "handle", f.Handle)
+	}
+	cmd = append(cmd, f.Kind)
+	if f.Pin != "" {
+		cmd = append(cmd, "object-pinned", f.Pin)
+	}
+	return append(cmd, f.Options...)
+}
+
+// shownFilter is a filter as printed by tc filter show: the fields of
+// its line and the indented lines following it, e.g. the keys of u32
+type shownFilter struct {
+	fields []string
+	more   []string
+}
+
+// splitTCFilters groups the output of tc filter show by filter
+func splitTCFilters(output string) ([]shownFilter, error) {
+	filters := []shownFilter{}
+	for _, line := range nonEmptyLines(output) {
+		fields := strings.Fields(line)
+		if fields[0] == "filter" {
+			filters = append(filters, shownFilter{fields: fields})
+			continue
+		}
+		if len(filters) == 0 {
+			return nil, fmt.Errorf("unexpected tc output %q", line)
+		}
+		last := &filters[len(filters)-1]
+		last.more = append(last.more, strings.TrimSpace(line))
+	}
+	return filters, nil
+}
+
+// header parses the fields common to all the filters, it returns the
+// fields specific to the kind. They are empty for the summary line tc
+// prints per priority.
+func (s shownFilter) header(parent string) (tcFilter, []string, error) {
+	f := tcFilter{Parent: parent}
+	rest := s.fields[1:]
+	for len(rest) > 0 && f.Kind == "" {
+		switch rest[0] {
+		case "parent", "protocol", "pref", "chain":
+			if len(rest) < 2 {
+				return tcFilter{}, nil, fmt.Errorf("unexpected tc output %q", strings.Join(s.fields, " "))
+			}
+			switch rest[0] {
+			case "protocol":
+				f.Protocol = rest[1]
+			case "pref":
+				f.Pref = rest[1]
+			}
+			rest = rest[2:]
+		default:
+			f.Kind, rest = rest[0], rest[1:]
+		}
+	}
+	if f.Protocol == "" || f.Pref == "" || f.Kind == "" {
+		return tcFilter{}, nil, fmt.Errorf("unexpected tc output %q", strings.Join(s.fields, " "))
+	}
+	if len(rest) >= 2 && rest[0] == "chain" {
+		if rest[1] != "0" {
+			return tcFilter{}, nil, fmt.Errorf("filter chains cannot be restored")
+		}
+		rest = rest[2:]
+	}
+	return f, rest, nil
+}
+
+// parseTCFilters parses the filters tc shows for parent, it fails on
+// the ones it cannot restore
+func parseTCFilters(parent, output string) ([]tcFilter, error) {
+	shown, err := splitTCFilters(output)
+	if err != nil {
+		return nil, err
+	}
+	filters := []tcFilter{}
+	// the priorities of u32 with their hash table
+	tables := map[string]bool{}
+	for _, s := range shown {
+		f, rest, err := s.header(parent)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			continue
+		}
+		switch f.Kind {
+		case "u32":
+			if len(rest) == 5 && rest[2] == "ht" && rest[3] == "divisor" {
+				// u32 creates a hash table of one bucket per
+				// priority, the filters are its keys
+				if rest[4] != "1" || tables[f.Pref] {
+					return nil, fmt.Errorf("u32 hash tables of priority %s cannot be restored", f.Pref)
+				}
+				tables[f.Pref] = true
+				continue
+			}
+			err = f.parseU32(rest, s.more)
+		case "bpf":
+			err = f.parseBPF(rest, s.more)
+		default:
+			err = fmt.Errorf("%s filters cannot be restored", f.Kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("filter %s of %s: %v", f.Pref, parent, err)
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// parseU32 sets the options of a u32 key, the kernel allocates its
+// handle again
+func (f *tcFilter) parseU32(rest, more []string) error {
+	for _, line := range more {
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[0] != "match" || fields[2] != "at" {
+			return fmt.Errorf("%q cannot be restored", line)
+		}
+		value := strings.Split(fields[1], "/")
+		if len(value) != 2 {
+			return fmt.Errorf("unexpected tc output %q", line)
+		}
+		f.Options = append(f.Options, "match", "u32", "0x"+value[0], "0x"+value[1], "at", fields[3])
+	}
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case "not_in_hw", "in_hw":
+		case "fh", "order", "in_hw_count":
+			i++
+		case "key":
+			// key ht 800 bkt 0
+			if i+4 >= len(rest) || rest[i+3] != "bkt" || rest[i+4] != "0" {
+				return fmt.Errorf("u32 hash tables cannot be restored")
+			}
+			i += 4
+		case "flowid", "*flowid", "classid", "*classid":
+			if i+1 >= len(rest) {
+				return fmt.Errorf("missing value after %s", rest[i])
+			}
+			f.Options = append(f.Options, "flowid", rest[i+1])
+			i++
+		case "skip_hw", "skip_sw":
+			f.Options = append(f.Options, rest[i])
+		default:
+			return fmt.Errorf("u32 option %s cannot be restored", rest[i])
+		}
+	}
+	return nil
+}
+
+// parseBPF sets the options of a bpf filter running classic BPF
+// bytecode or a loaded eBPF program
+func (f *tcFilter) parseBPF(rest, more []string) error {
+	if len(more) > 0 {
+		return fmt.Errorf("%q cannot be restored", more[0])
+	}
+	bytecode := false
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case "not_in_hw", "in_hw", "jited":
+			continue
+		case "direct-action":
+			f.Options = append(f.Options, "da")
+			continue
+		case "skip_hw", "skip_sw":
+			f.Options = append(f.Options, rest[i])
+			continue
+		case "bytecode":
+			// the instructions are quoted and separated by spaces
+			code := []string{}
+			for i++; i < len(rest); i++ {
+				code = append(code, rest[i])
+				if strings.HasSuffix(rest[i], "'") {
+					break
+				}
+			}
+			f.Options = append(f.Options, "bytecode", strings.Trim(strings.Join(code, " "), "'"))
+			bytecode = true
+			continue
+		case "handle", "flowid", "classid", "id", "name", "tag", "in_hw_count":
+		default:
+			// the object file and section the program was loaded from
+			if strings.Contains(rest[i], ":[") {
+				continue
+			}
+			return fmt.Errorf("bpf option %s cannot be restored", rest[i])
+		}
+		if i+1 >= len(rest) {
+			return fmt.Errorf("missing value after %s", rest[i])
+		}
+		switch rest[i] {
+		case "handle":
+			f.Handle = rest[i+1]
+		case "flowid", "classid":
+			f.Options = append(f.Options, "flowid", rest[i+1])
+		case "id":
+			id, err := strconv.ParseUint(rest[i+1], 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid program ID %q", rest[i+1])
+			}
+			f.ProgramID = uint32(id)
+		}
+		i++
+	}
+	if !bytecode && f.ProgramID == 0 {
+		return fmt.Errorf("bpf filter without program")
+	}
+	return nil
+}
+
+// interfaceSnapshot is the traffic control configuration of an
+// interface before the plugin touched it
+type interfaceSnapshot struct {
+	NetNSID string
+	Device  string
+	// Objects to create to restore the configuration, ordered so that
+	// parents come before their children. It is empty when the
+	// interface only has the default qdiscs of the kernel.
+	Objects []tcObject
+	// Filters of the objects, created once the objects exist
+	Filters []tcFilter
+}
+
+// restoreCommands returns the commands restoring the snapshot on dev
+func (s *interfaceSnapshot) restoreCommands(dev string) [][]string {
+	cmds := [][]string{}
+	for _, o := range s.Objects {
+		cmds = append(cmds, o.addCommand(dev))
+	}
+	for _, f := range s.Filters {
+		cmds = append(cmds, f.addCommand(dev))
+	}
+	return cmds
+}
+
+// snapshotPinDir is where the snapshot of netNSID pins the eBPF
+// programs of its filters
+func snapshotPinDir(netNSID string) string {
+	return filepath.Join(bpfPinDir, "snapshots", netNSID)
+}
+
+// pinPrograms pins the eBPF programs of the bpf filters, the filters
+// are deleted along with their qdisc and their programs with them
+func (s *interfaceSnapshot) pinPrograms() error {
+	for i := range s.Filters {
+		f := &s.Filters[i]
+		if f.ProgramID == 0 {
+			continue
+		}
+		if err := mountBPFFS(); err != nil {
+			return err
+		}
+		dir := snapshotPinDir(s.NetNSID)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create %s: %v", dir, err)
+		}
+		fd, err := bpfProgramFD(f.ProgramID)
+		if err != nil {
+			return err
+		}
+		f.Pin = filepath.Join(dir, strconv.Itoa(i))
+		err = bpfPin(fd, f.Pin)
+		unix.Close(fd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpinPrograms removes the programs pinned by pinPrograms
+func (s *interfaceSnapshot) unpinPrograms() {
+	if err := os.RemoveAll(snapshotPinDir(s.NetNSID)); err != nil {
+		log.Errorf("failed to unpin the programs of the snapshot: %v", err)
+	}
+}
+
+// takeSnapshot reads the configuration of dev in netNS, it fails when
+// the configuration cannot be restored exactly: unknown qdiscs or
+// filters or, if ingress is set, an ingress hook already in use. The
+// eBPF programs of the filters are pinned until the snapshot is
+// forgotten.
+func takeSnapshot(netNS, netNSID, dev string, ingress bool) (*interfaceSnapshot, error) {
+	qdiscs, err := commandOutput(netNS, []string{"tc", "qdisc", "show", "dev", dev})
+	if err != nil {
+		return nil, err
+	}
+	classes, err := commandOutput(netNS, []string{"tc", "class", "show", "dev", dev})
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []tcObject{}
+	hookInUse := false
+	for _, line := range nonEmptyLines(qdiscs + "\n" + classes) {
+		o, err := parseTCObject(line)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, o)
+		hookInUse = hookInUse || o.hook()
+	}
+	if ingress && hookInUse {
+		return nil, fmt.Errorf("refusing to modify %s: its ingress hook is already in use", dev)
+	}
+
+	ordered, err := objectsToRestore(objects)
+	if err != nil {
+		return nil, fmt.Errorf("refusing to modify %s: %v", dev, err)
+	}
+	// the hooks and their filters are left untouched
+	filters := []tcFilter{}
+	for _, o := range ordered {
+		output, err := commandOutput(netNS, []string{"tc", "filter", "show", "dev", dev, "parent", o.ID})
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseTCFilters(o.ID, output)
+		if err != nil {
+			return nil, fmt.Errorf("refusing to modify %s: %v", dev, err)
+		}
+		filters = append(filters, parsed...)
+	}
+
+	snapshot := &interfaceSnapshot{
+		NetNSID: netNSID,
+		Device:  dev,
+		Objects: ordered,
+		Filters: filters,
+	}
+	if err := snapshot.pinPrograms(); err != nil {
+		snapshot.unpinPrograms()
+		return nil, fmt.Errorf("refusing to modify %s: %v", dev, err)
+	}
+	if err := snapshot.validate(); err != nil {
+		snapshot.unpinPrograms()
+		return nil, fmt.Errorf("refusing to modify %s: its configuration cannot be restored: %v", dev, err)
+	}
+	return snapshot, nil
+}
+
+// objectsToRestore returns the objects recreating the configuration, in
+// the order to create them. The kernel default qdiscs, the hooks and the
+// classes created implicitly with their qdisc, e.g. the bands of mq or
+// prio, are left out.
+func objectsToRestore(objects []tcObject) ([]tcObject, error) {
+	rootDefault := false
+	for _, o := range objects {
+		if !o.Class && o.Parent == "" {
+			rootDefault = o.kernelDefault()
+		}
+	}
+	toRestore := []tcObject{}
+	for _, o := range objects {
+		switch {
+		case o.kernelDefault() || o.hook():
+			// the hooks are left untouched unless they are unused
+			continue
+		case o.Class && !restorableClasses[o.Kind]:
+			continue
+		case rootDefault:
+			return nil, fmt.Errorf("qdisc %s %s is attached to a default root qdisc", o.Kind, o.ID)
+		case !o.Class && !restorableQdiscs[o.Kind]:
+			return nil, fmt.Errorf("qdisc %s %s cannot be restored", o.Kind, o.ID)
+		}
+		toRestore = append(toRestore, o)
+	}
+	return parentsFirst(toRestore)
+}
+
+// parentsFirst orders objects so that the parents come before their
+// children, keeping the order of tc otherwise. The classes which are not
+// restored, e.g. the bands of prio, exist once their qdisc does.
+func parentsFirst(objects []tcObject) ([]tcObject, error) {
+	ids := map[string]bool{}
+	for _, o := range objects {
+		ids[o.ID] = true
+	}
+	ordered := []tcObject{}
+	created := map[string]bool{"": true}
+	exists := func(parent string) bool {
+		qdisc := strings.SplitAfter(parent, ":")[0]
+		return created[parent] || !ids[parent] && qdisc != parent && created[qdisc]
+	}
+	for len(objects) > 0 {
+		remaining := []tcObject{}
+		for _, o := range objects {
+			if exists(o.Parent) {
+				ordered = append(ordered, o)
+				created[o.ID] = true
+			} else {
+				remaining = append(remaining, o)
+			}
+		}
+		if len(remaining) == len(objects) {
+			return nil, fmt.Errorf("cannot find the parent of %s %s", remaining[0].Kind, remaining[0].ID)
+		}
+		objects = remaining
+	}
+	return ordered, nil
+}
+
+// validate replays the snapshot on the loopback interface of a scratch
+// network namespace
+func (s *interfaceSnapshot) validate() error {
+	if len(s.Objects) == 0 {
+		return nil
+	}
+	scratchNS, err := ns.NewNS()
+	if err != nil {
+		return fmt.Errorf("failed to create a scratch network namespace: %v", err)
+	}
+	defer scratchNS.Close()
+	return runCommands(scratchNS.Path(), s.restoreCommands("lo"))
+}
+
+// SnapshotStore keeps the snapshots by network namespace
+type SnapshotStore struct {
+	lock      sync.Mutex
+	dir       string
+	snapshots map[string]*interfaceSnapshot
+}
+
+// NewSnapshotStore instantiates a SnapshotStore persisted in dir and
+// loads the snapshots already there
+func NewSnapshotStore(dir string) (*SnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create directory %q: %v", dir, err)
+	}
+	s := &SnapshotStore{
+		dir:       dir,
+		snapshots: map[string]*interfaceSnapshot{},
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		snapshot := &interfaceSnapshot{}
+		if err := json.Unmarshal(raw, snapshot); err != nil {
+			log.Errorf("ignoring invalid snapshot %s: %v", file, err)
+			continue
+		}
+		s.snapshots[snapshot.NetNSID] = snapshot
+	}
+	// the network namespaces which died while the plugin was stopped
+	// may have their inode reused already
+	live, err := liveNetNSIDs()
+	if err != nil {
+		log.Errorf("keeping all the snapshots: %v", err)
+		return s, nil
+	}
+	s.Prune(live)
+	return s, nil
+}
+
+// Prune forgets the snapshots of the network namespaces not in live
+func (s *SnapshotStore) Prune(live map[string]bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for netNSID := range s.snapshots {
+		if !live[netNSID] {
+			log.Infof("forgetting the snapshot of network namespace %s, it is gone", netNSID)
+			s.forget(netNSID)
+		}
+	}
+}
+
+// Ensure takes the snapshot of dev in netNS unless it has one already
+func (s *SnapshotStore) Ensure(netNS, netNSID, dev string, ingress bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.snapshots[netNSID]; ok {
+		return nil
+	}
+	snapshot, err := takeSnapshot(netNS, netNSID, dev, ingress)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.path(netNSID), raw, 0600); err != nil {
+		snapshot.unpinPrograms()
+		return fmt.Errorf("failed to save the snapshot: %v", err)
+	}
+	s.snapshots[netNSID] = snapshot
+	return nil
+}
+
+// Restore recreates the configuration saved for netNS and forgets it,
+// the settings of the plugin must have been removed already. It
+// returns false if there is no snapshot.
+func (s *SnapshotStore) Restore(netNS, netNSID string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	snapshot, ok := s.snapshots[netNSID]
+	if !ok {
+		return false, nil
+	}
+	if err := runCommands(netNS, snapshot.restoreCommands(snapshot.Device)); err != nil {
+		return true, fmt.Errorf("failed to restore the original configuration: %v", err)
+	}
+	s.forget(netNSID)
+	return true, nil
+}
+
+// Get returns the snapshot of netNSID
+func (s *SnapshotStore) Get(netNSID string) (*interfaceSnapshot, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	snapshot, ok := s.snapshots[netNSID]
+	return snapshot, ok
+}
+
+// Has tells whether there is a snapshot for netNSID
+func (s *SnapshotStore) Has(netNSID string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.snapshots[netNSID]
+	return ok
+}
+
+func (s *SnapshotStore) forget(netNSID string) {
+	if snapshot, ok := s.snapshots[netNSID]; ok {
+		snapshot.unpinPrograms()
+	}
+	delete(s.snapshots, netNSID)
+	if err := os.Remove(s.path(netNSID)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("failed to remove snapshot: %v", err)
+	}
+}
+
+func (s *SnapshotStore) path(netNSID string) string {
+	return filepath.Join(s.dir, netNSID+".json")
+}
+
+// liveNetNSIDs returns the IDs of the network namespaces of the running
+// processes and of the ones bound in /var/run/netns
+func liveNetNSIDs() (map[string]bool, error) {
+	links, err := filepath.Glob("/proc/[0-9]*/ns/net")
+	if err != nil {
+		return nil, err
+	}
+	if len(links) == 0 {
+		return nil, fmt.Errorf("no process found in /proc")
+	}
+	live := map[string]bool{}
+	for _, link := range links {
+		// the processes exit meanwhile
+		if target, err := os.Readlink(link); err == nil && strings.HasPrefix(target, "net:[") {
+			live[strings.TrimSuffix(strings.TrimPrefix(target, "net:["), "]")] = true
+		}
+	}
+	bound, _ := filepath.Glob("/var/run/netns/*")
+	for _, path := range bound {
+		if info, err := os.Stat(path); err == nil {
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				live[strconv.FormatUint(stat.Ino, 10)] = true
+			}
+		}
+	}
+	return live, nil
+}
+
+func nonEmptyLines(output string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
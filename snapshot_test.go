@@ -0,0 +1,322 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTCObject(t *testing.T) {
+	for _, test := range []struct {
+		line     string
+		expected tcObject
+		invalid  bool
+	}{
+		{
+			line: "qdisc htb 1: root refcnt 2 r2q 10 default 0x10 direct_packets_stat 0 direct_qlen 1000",
+			expected: tcObject{
+				Kind:    "htb",
+				ID:      "1:",
+				Options: []string{"r2q", "10", "default", "0x10", "direct_qlen", "1000"},
+			},
+		},
+		{
+			line: "class htb 1:1 root rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b ",
+			expected: tcObject{
+				Class:   true,
+				Kind:    "htb",
+				ID:      "1:1",
+				Parent:  "1:",
+				Options: []string{"rate", "10Mbit", "ceil", "10Mbit", "burst", "1600b", "cburst", "1600b"},
+			},
+		},
+		{
+			line: "class htb 1:10 parent 1:1 leaf 10: prio 0 rate 5Mbit ceil 10Mbit burst 1600b cburst 1600b",
+			expected: tcObject{
+				Class:   true,
+				Kind:    "htb",
+				ID:      "1:10",
+				Parent:  "1:1",
+				Options: []string{"prio", "0", "rate", "5Mbit", "ceil", "10Mbit", "burst", "1600b", "cburst", "1600b"},
+			},
+		},
+		{
+			// the packet counts are given back without their suffix
+			line: "qdisc sfq 10: parent 1:10 limit 127p quantum 1514b depth 127 divisor 1024 perturb 10sec",
+			expected: tcObject{
+				Kind:    "sfq",
+				ID:      "10:",
+				Parent:  "1:10",
+				Options: []string{"limit", "127", "quantum", "1514b", "depth", "127", "divisor", "1024", "perturb", "10sec"},
+			},
+		},
+		{
+			line:     "qdisc noqueue 0: root refcnt 2",
+			expected: tcObject{Kind: "noqueue", ID: "0:"},
+		},
+		{
+			line:     "qdisc clsact ffff: parent ffff:fff1 ",
+			expected: tcObject{Kind: "clsact", ID: "ffff:", Parent: "ffff:fff1"},
+		},
+		{line: "filter parent 1: protocol ip pref 1 u32", invalid: true},
+		{line: "qdisc htb 1:", invalid: true},
+		{line: "qdisc htb 1: parent", invalid: true},
+		{line: "qdisc htb 1: sideways 1:1", invalid: true},
+	} {
+		o, err := parseTCObject(test.line)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", test.line, o)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(o, test.expected) {
+			t.Errorf("%q: expected %+v, got %+v", test.line, test.expected, o)
+		}
+	}
+}
+
+func TestSnapshotRestoreCommands(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		output   []string
+		expected []string
+		invalid  bool
+	}{
+		{
+			name: "children listed before their parents",
+			output: []string{
+				"qdisc sfq 10: parent 1:10 limit 127p",
+				"qdisc htb 1: root refcnt 2 r2q 10 default 0x10 direct_packets_stat 0 direct_qlen 1000",
+				"class htb 1:10 parent 1:1 leaf 10: prio 0 rate 5Mbit ceil 10Mbit burst 1600b cburst 1600b",
+				"class htb 1:1 root rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b",
+			},
+			expected: []string{
+				"tc qdisc add dev eth0 root handle 1: htb r2q 10 default 0x10 direct_qlen 1000",
+				"tc class add dev eth0 parent 1: classid 1:1 htb rate 10Mbit ceil 10Mbit burst 1600b cburst 1600b",
+				"tc class add dev eth0 parent 1:1 classid 1:10 htb prio 0 rate 5Mbit ceil 10Mbit burst 1600b cburst 1600b",
+				"tc qdisc add dev eth0 parent 1:10 handle 10: sfq limit 127",
+			},
+		},
+		{
+			name: "siblings keep the order of tc",
+			output: []string{
+				"qdisc prio 1: root refcnt 2 bands 3 priomap 1 2 2 2 1 2 0 0 1 1 1 1 1 1 1 1",
+				"qdisc pfifo 30: parent 1:3 limit 100p",
+				"qdisc tbf 10: parent 1:1 rate 1Mbit burst 1600b lat 50ms",
+			},
+			expected: []string{
+				"tc qdisc add dev eth0 root handle 1: prio bands 3 priomap 1 2 2 2 1 2 0 0 1 1 1 1 1 1 1 1",
+				"tc qdisc add dev eth0 parent 1:3 handle 30: pfifo limit 100",
+				"tc qdisc add dev eth0 parent 1:1 handle 10: tbf rate 1Mbit burst 1600b lat 50ms",
+			},
+		},
+		{
+			name:     "nothing to restore",
+			output:   []string{},
+			expected: []string{},
+		},
+		{
+			// the default root of multiqueue devices, the bands of mq
+			// and the flows of fq_codel are classes
+			name: "mq root",
+			output: []string{
+				"qdisc mq 0: root",
+				"qdisc fq_codel 0: parent :2 limit 10240p flows 1024 quantum 1514 target 5ms interval 100ms memory_limit 32Mb ecn drop_batch 64",
+				"qdisc fq_codel 0: parent :1 limit 10240p flows 1024 quantum 1514 target 5ms interval 100ms memory_limit 32Mb ecn drop_batch 64",
+				"class mq :1 root",
+				"class mq :2 root",
+				"class fq_codel :3f8 parent :1",
+			},
+			expected: []string{},
+		},
+		{
+			name: "qdisc in a band of a default mq root",
+			output: []string{
+				"qdisc mq 0: root",
+				"qdisc netem 8001: parent :1 limit 1000 delay 10ms",
+				"qdisc fq_codel 0: parent :2 limit 10240p flows 1024 quantum 1514 target 5ms interval 100ms memory_limit 32Mb ecn drop_batch 64",
+				"class mq :1 root leaf 8001:",
+				"class mq :2 root",
+			},
+			invalid: true,
+		},
+		{
+			name: "unknown qdisc",
+			output: []string{
+				"qdisc cake 8001: root refcnt 2 bandwidth unlimited",
+			},
+			invalid: true,
+		},
+		{
+			name: "orphan",
+			output: []string{
+				"qdisc htb 1: root refcnt 2 r2q 10 default 0",
+				"qdisc sfq 10: parent 2:10 limit 127p",
+			},
+			invalid: true,
+		},
+	} {
+		objects := []tcObject{}
+		for _, line := range test.output {
+			o, err := parseTCObject(line)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			objects = append(objects, o)
+		}
+		ordered, err := objectsToRestore(objects)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, ordered)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		snapshot := &interfaceSnapshot{Device: "eth0", Objects: ordered}
+		cmds := []string{}
+		for _, cmd := range snapshot.restoreCommands("eth0") {
+			cmds = append(cmds, strings.Join(cmd, " "))
+		}
+		if !reflect.DeepEqual(cmds, test.expected) {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, strings.Join(test.expected, "\n"), strings.Join(cmds, "\n"))
+		}
+	}
+}
+
+func TestParseTCFilters(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		output   []string
+		expected []string
+		invalid  bool
+	}{
+		{
+			name: "u32 keys",
+			output: []string{
+				"filter protocol ip pref 1 u32 chain 0 ",
+				"filter protocol ip pref 1 u32 chain 0 fh 800: ht divisor 1 ",
+				"filter protocol ip pref 1 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 *flowid 1:10 not_in_hw ",
+				"  match 00000035/0000ffff at 20",
+				"filter protocol ip pref 1 u32 chain 0 fh 800::801 order 2049 key ht 800 bkt 0 *flowid 1:1 not_in_hw ",
+				"  match 00350000/ffff0000 at 20",
+				"  match 0a000000/ff000000 at 16",
+				"filter protocol ipv6 pref 2 u32 chain 0 ",
+				"filter protocol ipv6 pref 2 u32 chain 0 fh 801: ht divisor 1 ",
+				"filter protocol ipv6 pref 2 u32 chain 0 fh 801::800 order 2048 key ht 801 bkt 0 *flowid 1:10 skip_hw not_in_hw ",
+				"  match 00000035/0000ffff at 40",
+			},
+			expected: []string{
+				"tc filter add dev eth0 parent 1: protocol ip pref 1 u32 match u32 0x00000035 0x0000ffff at 20 flowid 1:10",
+				"tc filter add dev eth0 parent 1: protocol ip pref 1 u32 match u32 0x00350000 0xffff0000 at 20 match u32 0x0a000000 0xff000000 at 16 flowid 1:1",
+				"tc filter add dev eth0 parent 1: protocol ipv6 pref 2 u32 match u32 0x00000035 0x0000ffff at 40 flowid 1:10 skip_hw",
+			},
+		},
+		{
+			name: "bpf programs",
+			output: []string{
+				"filter protocol all pref 5 bpf chain 0 ",
+				"filter protocol all pref 5 bpf chain 0 handle 0x1 flowid 1:10 prog.o:[classifier] direct-action not_in_hw id 118 name cls tag 59f4a931744dcdc6 jited ",
+				"filter protocol ip pref 6 bpf chain 0 ",
+				"filter protocol ip pref 6 bpf chain 0 handle 0x1 flowid 1:1 not_in_hw bytecode '2,6 0 0 0,6 0 0 4294967295'",
+			},
+			expected: []string{
+				"tc filter add dev eth0 parent 1: protocol all pref 5 handle 0x1 bpf object-pinned /pin flowid 1:10 da",
+				"tc filter add dev eth0 parent 1: protocol ip pref 6 handle 0x1 bpf flowid 1:1 bytecode 2,6 0 0 0,6 0 0 4294967295",
+			},
+		},
+		{
+			name:     "no filter",
+			output:   []string{},
+			expected: []string{},
+		},
+		{
+			name: "u32 hash table",
+			output: []string{
+				"filter protocol ip pref 9 u32 chain 0 ",
+				"filter protocol ip pref 9 u32 chain 0 fh 2: ht divisor 256 ",
+				"filter protocol ip pref 9 u32 chain 0 fh 804: ht divisor 1 ",
+			},
+			invalid: true,
+		},
+		{
+			name: "u32 tables of one bucket",
+			output: []string{
+				"filter protocol ip pref 9 u32 chain 0 fh 2: ht divisor 1 ",
+				"filter protocol ip pref 9 u32 chain 0 fh 804: ht divisor 1 ",
+			},
+			invalid: true,
+		},
+		{
+			name: "u32 link",
+			output: []string{
+				"filter protocol ip pref 1 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 link 2: not_in_hw ",
+				"  match 00060000/00ff0000 at 8",
+			},
+			invalid: true,
+		},
+		{
+			name: "u32 action",
+			output: []string{
+				"filter protocol ip pref 1 u32 chain 0 fh 800::800 order 2048 key ht 800 bkt 0 terminal flowid ??? not_in_hw ",
+				"  match 00060000/00ff0000 at 8",
+				"	action order 1: gact action drop",
+			},
+			invalid: true,
+		},
+		{
+			name: "bpf action",
+			output: []string{
+				"filter protocol all pref 5 bpf chain 0 handle 0x1 prog.o:[classifier] not_in_hw id 118 tag 59f4a931744dcdc6 jited ",
+				"	action order 1: gact action drop",
+			},
+			invalid: true,
+		},
+		{
+			name: "other chain",
+			output: []string{
+				"filter protocol ip pref 6 bpf chain 1 handle 0x1 flowid 1:1 bytecode '1,6 0 0 4294967295'",
+			},
+			invalid: true,
+		},
+		{
+			name: "other kind",
+			output: []string{
+				"filter protocol all pref 49152 matchall chain 0 handle 0x1 flowid 1:10 ",
+			},
+			invalid: true,
+		},
+	} {
+		filters, err := parseTCFilters("1:", strings.Join(test.output, "\n"))
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, filters)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		snapshot := &interfaceSnapshot{Device: "eth0", Filters: filters}
+		for i := range snapshot.Filters {
+			if snapshot.Filters[i].ProgramID != 0 {
+				snapshot.Filters[i].Pin = "/pin"
+			}
+		}
+		cmds := []string{}
+		for _, cmd := range snapshot.restoreCommands("eth0") {
+			cmds = append(cmds, strings.Join(cmd, " "))
+		}
+		if !reflect.DeepEqual(cmds, test.expected) {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, strings.Join(test.expected, "\n"), strings.Join(cmds, "\n"))
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"sync"
 )
 
@@ -18,22 +19,93 @@ const (
 	Destroyed
 )
 
+func (s State) String() string {
+	switch s {
+	case Created:
+		return "created"
+	case Running:
+		return "running"
+	case Stopped:
+		return "stopped"
+	case Destroyed:
+		return "destroyed"
+	}
+	return "unknown"
+}
+
 // Container data structure
 type Container struct {
 	State State
 	PID   int
+	// Name of the container as given by the runtime
+	Name string
+	// Pod is the name of the Kubernetes pod, empty if the container
+	// does not belong to a pod
+	Pod string
+	// Namespace is the Kubernetes namespace of the pod
+	Namespace string
+	Image     string
+	Labels    map[string]string
+	// NetNSID is the inode of the network namespace of a running
+	// container, the containers of a pod share it
+	NetNSID string
+	// Sandbox is set for the pause container of a pod, which holds its
+	// network namespace
+	Sandbox bool
 }
 
 // Store data structure
 type Store struct {
 	lock       sync.Mutex
 	containers map[string]Container
+	// netNS indexes the IDs of the containers by network namespace
+	netNS map[string]map[string]bool
+	// pods are the annotations of the Kubernetes pods by
+	// namespace/name, when they are watched
+	pods      map[string]map[string]string
+	changes   []chan struct{}
+	destroyed []chan struct{}
 }
 
 // NewStore instantiates a new Store
 func NewStore() *Store {
 	return &Store{
 		containers: map[string]Container{},
+		netNS:      map[string]map[string]bool{},
+		pods:       map[string]map[string]string{},
+	}
+}
+
+// Changes returns a new channel receiving a value when containers or
+// pods were set or deleted since the last receive
+func (s *Store) Changes() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	changes := make(chan struct{}, 1)
+	s.changes = append(s.changes, changes)
+	return changes
+}
+
+// Destroyed returns a new channel receiving a value when containers
+// were destroyed since the last receive
+func (s *Store) Destroyed() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	destroyed := make(chan struct{}, 1)
+	s.destroyed = append(s.destroyed, destroyed)
+	return destroyed
+}
+
+func (s *Store) notify() {
+	notifyAll(s.changes)
+}
+
+func notifyAll(channels []chan struct{}) {
+	for _, c := range channels {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
 	}
 }
 
@@ -49,14 +121,109 @@ func (s *Store) Container(containerID string) (Container, bool) {
 func (s *Store) SetContainer(containerID string, container Container) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	s.unindex(containerID)
 	s.containers[containerID] = container
+	if container.NetNSID != "" {
+		if s.netNS[container.NetNSID] == nil {
+			s.netNS[container.NetNSID] = map[string]bool{}
+		}
+		s.netNS[container.NetNSID][containerID] = true
+	}
+	s.notify()
 }
 
 // DeleteContainer deletes a container from the store
 func (s *Store) DeleteContainer(containerID string) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	s.unindex(containerID)
 	delete(s.containers, containerID)
+	s.notify()
+	notifyAll(s.destroyed)
+}
+
+func (s *Store) unindex(containerID string) {
+	previous, ok := s.containers[containerID]
+	if !ok || previous.NetNSID == "" {
+		return
+	}
+	delete(s.netNS[previous.NetNSID], containerID)
+	if len(s.netNS[previous.NetNSID]) == 0 {
+		delete(s.netNS, previous.NetNSID)
+	}
+}
+
+// Members returns the containers sharing the network namespace of
+// container by ID, including container itself
+func (s *Store) Members(containerID string, container Container) map[string]Container {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	members := map[string]Container{containerID: container}
+	if container.NetNSID == "" {
+		return members
+	}
+	for memberID := range s.netNS[container.NetNSID] {
+		members[memberID] = s.containers[memberID]
+	}
+	return members
+}
+
+// NetNSPID returns the PID through which the network namespace of
+// container is entered: the PID of the sandbox holding it when it is
+// known, it outlives the other containers of the pod
+func (s *Store) NetNSPID(container Container) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for containerID := range s.netNS[container.NetNSID] {
+		if member := s.containers[containerID]; member.Sandbox && member.State == Running {
+			return member.PID
+		}
+	}
+	return container.PID
+}
+
+func podKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// SetPod sets the annotations of a pod
+func (s *Store) SetPod(namespace, name string, annotations map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := podKey(namespace, name)
+	if previous, ok := s.pods[key]; ok && reflect.DeepEqual(previous, annotations) {
+		return
+	}
+	s.pods[key] = annotations
+	s.notify()
+}
+
+// DeletePod deletes a pod from the store
+func (s *Store) DeletePod(namespace, name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.pods, podKey(namespace, name))
+	s.notify()
+}
+
+// SetPods replaces all the pods by namespace/name
+func (s *Store) SetPods(pods map[string]map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if reflect.DeepEqual(s.pods, pods) {
+		return
+	}
+	s.pods = pods
+	s.notify()
+}
+
+// PodAnnotations returns the annotations of a pod, false if the pod is
+// not known
+func (s *Store) PodAnnotations(namespace, name string) (map[string]string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	annotations, ok := s.pods[podKey(namespace, name)]
+	return annotations, ok
 }
 
 // ForEach execute a function on each container in the store
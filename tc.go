@@ -4,17 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"os/exec"
 	"strings"
 	"math/rand"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/influxdata/influxdb/client"
-	dockerClient "github.com/fsouza/go-dockerclient"
-	"net/http"
-	"net/http/httptest"
 	"net/url"
 	"strconv"
 
@@ -25,149 +20,6 @@ func random(min, max int) int {
 	return rand.Intn(max - min) + min
 }
 
-const db = "ican"
-
-// applyTrafficControlRules set the network policies
-func applyTrafficControlRules(pid int, rules []string) (netNSID string, err error) {
-	log.Printf("enter applyTrafficControlRules for pid %d", pid)  // billzhang 2017-04-04
-	cmds := [][]string{
-		strings.Fields("tc qdisc replace dev eth0 root handle 1: netem"),
-	}
-	cmd := strings.Fields("tc qdisc change dev eth0 root handle 1: netem")
-	cmd = append(cmd, rules...)
-	cmds = append(cmds, cmd)
-
-	netNS := fmt.Sprintf("/proc/%d/ns/net", pid)
-	log.Printf("/proc/%d/ns/net", pid)  // billzhang 2017-04-04
-
-	err = ns.WithNetNSPath(netNS, func(hostNS ns.NetNS) error {
-		for _, cmd := range cmds {
-			if output, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
-				log.Error(string(output))
-				return fmt.Errorf("failed to execute command: %v", err)
-			}
-		}
-		return nil
-	})
-	if err != nil {
-		return "", fmt.Errorf("failed to perform traffic control: %v", err)
-	}
-	log.Printf("call getNSID for netNS %s", netNS)  // billzhang 2017-04-04
-	netNSID, err = getNSID(netNS)
-
-	if err != nil {
-		return "", err
-	}
-	return netNSID, nil
-}
-
-// ApplyLatency sets the latency
-func ApplyLatency(pid int, latency string) error {
-	if latency == "" {
-		return nil
-	}
-	rules := strings.Fields(fmt.Sprintf("delay %s", latency))
-
-	// Get cached packet loss
-	packetLoss, err := getPacketLoss(pid)
-	if err != nil {
-		return err
-	}
-	if packetLoss != "-" {
-		rules = append(rules, strings.Fields(fmt.Sprintf("loss %s", packetLoss))...)
-	}
-
-	netNSID, err := applyTrafficControlRules(pid, rules)
-
-	// Update cached values
-	if trafficControlStatusCache[netNSID] == nil {
-		trafficControlStatusCache[netNSID] = TrafficControlStatusInit()
-	}
-	trafficControlStatusCache[netNSID].SetLatency(latency)
-	trafficControlStatusCache[netNSID].SetPacketLoss(packetLoss)
-
-	return nil
-}
-
-// ApplyPacketLoss sets the packet loss
-func ApplyPacketLoss(pid int, packetLoss string) error {
-	if packetLoss == "" {
-		return nil
-	}
-	rules := strings.Fields(fmt.Sprintf("loss %s", packetLoss))
-
-	// Get cached latency
-	// latency, err := getLatency(pid)
-	// latency, err := getLatency(pid)
-	latency := strconv.Itoa(random(700, 34000));
-
-	rules = append(rules, strings.Fields(fmt.Sprintf("delay %s", latency))...)
-
-	netNSID, _ := applyTrafficControlRules(pid, rules)
-
-	// Update cached values
-	if trafficControlStatusCache[netNSID] == nil {
-		trafficControlStatusCache[netNSID] = TrafficControlStatusInit()
-	}
-	trafficControlStatusCache[netNSID].SetLatency(latency)
-	trafficControlStatusCache[netNSID].SetPacketLoss(packetLoss)
-
-	return nil
-}
-
-// ClearTrafficControlSettings clear all parameters of the qdisc with tc
-func ClearTrafficControlSettings(pid int) error {
-	log.Printf("enter ClearTrafficControlSettings for pid %d", pid)  // billzhang 2017-04-04
-	cmds := [][]string{
-		strings.Fields("tc qdisc replace dev eth0 root handle 1: netem"),
-	}
-	netNS := fmt.Sprintf("/proc/%d/ns/net", pid)
-	err := ns.WithNetNSPath(netNS, func(hostNS ns.NetNS) error {
-		for _, cmd := range cmds {
-			if output, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
-				log.Error(string(output))
-				return fmt.Errorf("failed to execute command: %v", err)
-			}
-		}
-		return nil
-	})
-	if err != nil {
-		return fmt.Errorf("failed to perform traffic control: %v", err)
-	}
-	// clear cached parameters
-	log.Printf("call getNSID for netNS %s", netNS)  // billzhang 2017-04-04
-	netNSID, err := getNSID(netNS)
-	if err != nil {
-		log.Error(netNSID)
-		return fmt.Errorf("failed to get network namespace ID: %v", err)
-	}
-	delete(trafficControlStatusCache, netNSID)
-	return nil
-}
-
-func getPod(containerID string) (string, error) {
-	log.Debugf("get Pod name by containerID using fsouza/go-dockerclient  %s",containerID)  // billzhang 2017-04-12
-
-	dc, err := dockerClient.NewClient("unix:///var/run/docker.sock")
-	if err != nil {
-		fmt.Errorf("failed to create a docker client: %v", err)
-	}
-
-	container, err:= dc.InspectContainer(containerID);
-	if err != nil {
-		fmt.Errorf("failed to inspect container with context: %v", err)
-	}
-	log.Debugf("container.Name : ", container.Name)
-
-	pod, err := parsePodName(container.Name); // user-468431046-ktrt4
-	if err != nil {
-		fmt.Errorf("failed to ParseDockerName: %v", err)
-	}
-
-	log.Debugf("pod is %s", pod)
-	return pod, nil
-}
-
 // Unpacks a container name, returning the pod full name.
 // If we are unable to parse the name, an error is returned.
 // https://github.com/kubernetes/kubernetes/blob/cda109d22480bc6dea3c06cef21bd4c4fca6fca2/pkg/kubelet/dockertools/docker.go
@@ -193,7 +45,7 @@ func parsePodName(name string) (podName string, err error) {
 
 	nameParts := strings.Split(parts[1], ".")
 	containerName := nameParts[0]
-	log.Printf(containerName)
+	log.Printf("%s", containerName)
 	if len(nameParts) > 1 {
 		if err != nil {
 			log.Warningf("invalid container hash %q in container %q", nameParts[1], name)
@@ -231,151 +83,65 @@ func getPacketByPod(pod string) (string, error) {
 
 
 
-func getPacketLoss(pid int) (string, error) {
-	log.Debugf("enter getPacketLoss for PID %d", pid)  // billzhang 2017-04-04
-	var status *TrafficControlStatus
-	var err error
-	if status, err = getStatus(pid); err != nil {
-		return "-", err
-	} else if status == nil {
-		return "-", fmt.Errorf("status for PID %d does not exist", pid)
-	}
-	return status.packetLoss, nil
-}
-
-
-func queryInfluxDB(db string, command string) (*client.Response, error) {
+func queryInfluxDB(cfg InfluxDBConfig, command string) (*client.Response, error) {
 	log.Printf("queryInfluxDB")
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var data client.Response
-		w.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(w).Encode(data)
-	}))
-	defer ts.Close()
-
-	u, _ := url.Parse(ts.URL)
-	log.Debugf(u.Host)
-
-	u.Host = "localhost:8086"  // set to InfluxDB default port : 8086
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid InfluxDB URL %q: %v", cfg.URL, err)
+	}
 
 	config := client.Config{URL: *u}
 	c, err := client.NewClient(config)
 	if err != nil {
-		log.Fatalf("unexpected error for client.NewClient.  expected %v, actual %v", nil, err)
-		return nil, err
+		return nil, fmt.Errorf("failed to create an InfluxDB client: %v", err)
 	}
 
 	query := client.Query{}
-	query.Database = db
+	query.Database = cfg.Database
 	query.Command = command
 
-
 	res, err := c.Query(query)
-
 	if err != nil {
-		log.Info(res)
-		log.Printf("unexpected error.  expected %v, actual %v", nil, err)
 		return nil, err
 	}
-	return res, nil;
-}
-
-func getStatus(pid int) (*TrafficControlStatus, error) {
-	// var cmd = "select * from p2prxbyte, p2prxpkt"
-	var cmd = "select * from p2ptxbyte, p2ptxpkt";
-	netNS := fmt.Sprintf("/proc/%d/ns/net", pid)
-
-	netNSID, err := getNSID(netNS)
-	log.Debugf("getStatus for PID %d, netNSID %s", pid, netNSID)  // billzhang 2017-04-04
-	if err != nil {
-		log.Error(netNSID)
-		return nil, fmt.Errorf("failed to get network namespace ID: %v", err)
-	}
-	if status, ok := trafficControlStatusCache[netNSID]; ok {
-		return status, nil
-	}
-
-	// query dpod_name, bandwidth, packet
-	res, err := queryInfluxDB(db, cmd)
-	result := parseAttribute(res)
-
-
-	if err != nil {
-		log.Error(netNSID)
-		return nil, fmt.Errorf("failed to get data from InfluxDB: %v", err)
-	}
-
-	// cache parameters
-	trafficControlStatusCache[netNSID] = &TrafficControlStatus{
-		dpod:        result[0], // output_pod
-		latency:    result[1], // output_bandWidth
-		packetLoss: result[2],  // output_packet
-	}
-	status, _ := trafficControlStatusCache[netNSID]
-
-	return status, err
+	return res, nil
 }
 
-
+// getStatusByPod returns the values of the Network Control table of
+// dpod from the configured metrics source
 func getStatusByPod(dpod string) (*NetworkControlStatus, error) {
-	var cmd = "select * from p2prxbyte, p2prxpkt"
-	// select * from  p2prxpkt where dpod_name='redis-sfhcz'
-	log.Printf("getStatusByPod for dpod: %s", cmd)  // billzhang 2017-05-12
-	log.Printf("getStatusByPod for dpod: %s", dpod)  // billzhang 2017-04-04
-	//if status, ok := neworkControlStatusCache[dpod]; ok {
-	//	return status, nil
-	//}
-	//
-	// cmd  = cmd + " where dpod_name = '" +  spod + "' " + " order by time desc limit 1"
-	//// cmd  = cmd + " order by time desc limit 1"
-	//log.Printf("query InfluxDB by : %s ", cmd)
-	//
-	//// query dpod_name, bandwidth, packet
-	//resp, err := queryInfluxDB(db, cmd)
-	//// parse dpod_name, bandwidth, packet from InfluxDB response
-	//// result := parseAttribute(resp)
-	//
-	//if err != nil {
-	//	log.Error(err)
-	//	return nil, fmt.Errorf("failed to get data from InfluxDB: %v", err)
-	//}
-	//
-	//status := parseStatus(resp)
-	//log.Printf("status: ", status)
-
-
-	// cache parameters
-	/*if (status != nil) {
-		neworkControlStatusCache[spod] = &NetworkControlStatus{
-			dpod:       status.dpod, // output_pod
-			bandwidth:  status.bandwidth, // output_bandWidth
-			latency:    random(140, 230), // output_latency
-			packet:     status.packet,  // output_packet
-		}
-
-	} else {
-		neworkControlStatusCache[dpod] = &NetworkControlStatus{
-			dpod:       status.dpod, // output_pod
-			bandwidth:  random(700, 34000), // output_bandWidth
-			latency:    random(140, 230), // output_latency
-			packet:     random(5, 80),  // output_packet
+	metrics := currentConfig().Metrics
+	switch metrics.Source {
+	case metricsInfluxDB:
+		cmd := fmt.Sprintf("select * from p2prxbyte, p2prxpkt where dpod_name = '%s' order by time desc limit 1", strings.Replace(dpod, "'", "", -1))
+		log.Debugf("query InfluxDB by: %s", cmd)
+		resp, err := queryInfluxDB(metrics.InfluxDB, cmd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get data from InfluxDB: %v", err)
 		}
+		result := parseAttribute(resp)
+		return &NetworkControlStatus{
+			dpod:      result[0], // output_pod
+			bandwidth: result[1], // output_bandWidth
+			packet:    result[2], // output_packet
+		}, nil
+	case metricsRandom:
+		return &NetworkControlStatus{
+			dpod:       dpod, // output_pod
+			bandwidth:  strconv.Itoa(random(700, 34000)), // output_bandWidth
+			latency:    strconv.Itoa(random(140, 230)),  // output_latency
+			packet:     strconv.Itoa(random(5, 80)),  // output_packet
+		}, nil
+	default:
+		return &NetworkControlStatus{
+			dpod:      "-",
+			bandwidth: "-",
+			latency:   "-",
+			packet:    "-",
+		}, nil
 	}
-	status, _ = neworkControlStatusCache[spod] */
-
-	var status = &NetworkControlStatus{
-		dpod:       dpod, // output_pod
-		bandwidth:  strconv.Itoa(random(700, 34000)), // output_bandWidth
-		latency:    strconv.Itoa(random(140, 230)),  // output_latency
-		packet:     strconv.Itoa(random(5, 80)),  // output_packet
-	}
-	log.Printf("status: ", status)
-
-	return status, nil
 }
 
-
-
 /*
   parse dpod_name, bandwidth and packet from InfluxDB response
  */
@@ -439,7 +205,7 @@ func parseAttribute(resp *client.Response) ([]string) {
 	//fmt.Println("spod_namespace: ", myData[0][6])
 	//fmt.Println("src: ", myData[0][7])
 	//fmt.Println("value: ", myData[0][8])
-	if (resp != nil) {
+	if (resp != nil && len(resp.Results) > 0) {
 		log.Printf("Inside, len(resp.Results) = %d ", len(resp.Results))
 		log.Info(resp.Results[0])
 
@@ -451,7 +217,7 @@ func parseAttribute(resp *client.Response) ([]string) {
 				log.Printf("spod_name : %s ", resp.Results[0].Series[0].Values[0][5].(string))
 				result[0] = dpod
 			} else {
-				log.Printf("failed convert series data to dpod_name , status: ", ok)
+				log.Printf("failed convert series data to dpod_name , status: %v", ok)
 			}
 
 			bandwidth, err := resp.Results[0].Series[0].Values[0][8].(json.Number).Int64()
@@ -465,7 +231,7 @@ func parseAttribute(resp *client.Response) ([]string) {
 		}
 
 	} else {
-		log.Printf("resp is :  ", resp)
+		log.Printf("resp is :  %v", resp)
 	}
 	return result
 
@@ -482,9 +248,9 @@ top
 
  */
 func getNSID(nsPath string) (string, error) {
-	log.Printf("enter getNSID for nsPath %s", nsPath)  // billzhang 2017-04-04
+	log.Debugf("enter getNSID for nsPath %s", nsPath)  // billzhang 2017-04-04
 	nsID, err := os.Readlink(nsPath)
-	log.Printf("nsID %s", nsID)  // billzhang 2017-04-04
+	log.Debugf("nsID %s", nsID)  // billzhang 2017-04-04
 	if err != nil {
 		log.Errorf("failed read \"%s\": %v", nsPath, err)
 		return "", fmt.Errorf("failed read \"%s\": %v", nsPath, err)
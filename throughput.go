@@ -0,0 +1,559 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/containernetworking/cni/pkg/ns"
+	"golang.org/x/sys/unix"
+)
+
+// A throughput test sends data from a container to another one of the
+// node for a while, the way iperf does, without any tool in their
+// images: a sink listens in the network namespace of the destination
+// and a sender connects to it from the network namespace of the source.
+// Both run in the plugin, they share its clock and need no control
+// connection. Over TCP the test reports the goodput and the segments
+// retransmitted by the sender, over UDP the goodput, the loss and the
+// jitter of the datagrams, sent at a fixed rate. The tests are kept in
+// memory only.
+
+const (
+	throughputTCP = "tcp"
+	throughputUDP = "udp"
+	// throughputBufferSize is the size of the writes of the TCP sender
+	// and of the reads of the sink
+	throughputBufferSize = 128 << 10
+	// throughputDatagramSize is the size of the UDP datagrams, they fit
+	// in the MTU of the usual interfaces
+	throughputDatagramSize = 1400
+	// throughputHeaderLen is the size of the header of the datagrams,
+	// their sequence number and the time they were sent
+	throughputHeaderLen = 16
+	// throughputConnectTimeout bounds the connection of the sender
+	throughputConnectTimeout = 5 * time.Second
+	// throughputPollInterval is how often a blocked sender checks
+	// whether the test ended, and how often ctl checks its result
+	throughputPollInterval = 200 * time.Millisecond
+	// throughputDrain is how long the sink waits for the data in flight
+	// when the sender stops
+	throughputDrain = 5 * time.Second
+	// throughputGrace is how long the sink waits for the last datagrams
+	throughputGrace = 500 * time.Millisecond
+)
+
+// Throughput test states
+const (
+	throughputRunning = "running"
+	throughputDone    = "done"
+	throughputFailed  = "failed"
+)
+
+// throughputRequirements are the preflight features the throughput
+// tests need, the sender carries proxyMark to escape the HTTP faults
+var throughputRequirements = []string{featureCapNetAdmin, featureCapSysAdmin}
+
+// ThroughputOptions are the settings of a throughput test
+type ThroughputOptions struct {
+	// Protocol is tcp, the default, or udp
+	Protocol string `json:"protocol,omitempty"`
+	// Duration is the time the sender sends, the duration of the
+	// configuration by default, e.g. 10s
+	Duration string `json:"duration,omitempty"`
+	// Rate is the sending rate of a UDP test, the rate of the
+	// configuration by default, e.g. 10mbit
+	Rate string `json:"rate,omitempty"`
+}
+
+// ThroughputTest describes a throughput test
+type ThroughputTest struct {
+	ID               string `json:"id"`
+	Node             string `json:"node"`
+	SourceID         string `json:"source_id"`
+	Source           string `json:"source"`
+	SourceNetNS      string `json:"source_netns"`
+	DestinationID    string `json:"destination_id"`
+	Destination      string `json:"destination"`
+	DestinationNetNS string `json:"destination_netns"`
+	// Address is the address the sink listens on
+	Address string `json:"address"`
+	ThroughputOptions
+	Started time.Time  `json:"started"`
+	Ended   *time.Time `json:"ended,omitempty"`
+	State   string     `json:"state"`
+	Error   string     `json:"error,omitempty"`
+	// Bytes is the data received by the sink and Goodput its rate, e.g.
+	// 94.1mbit
+	Bytes   int64  `json:"bytes"`
+	Goodput string `json:"goodput,omitempty"`
+	// Retransmits are the segments retransmitted by a TCP sender
+	Retransmits int `json:"retransmits,omitempty"`
+	// Sent and Received are the datagrams of a UDP test, Jitter the
+	// variation of their transit time (RFC 3550)
+	Sent     int    `json:"sent,omitempty"`
+	Received int    `json:"received,omitempty"`
+	Loss     string `json:"loss,omitempty"`
+	Jitter   string `json:"jitter,omitempty"`
+}
+
+// describe describes the test from the side of the network namespace
+// netNSID
+func (t ThroughputTest) describe(netNSID string) string {
+	peer := "to " + t.Destination
+	if netNSID == t.DestinationNetNS {
+		peer = "from " + t.Source
+	}
+	switch t.State {
+	case throughputRunning:
+		return fmt.Sprintf("%s test %s running", t.Protocol, peer)
+	case throughputFailed:
+		return fmt.Sprintf("%s test %s failed: %s", t.Protocol, peer, t.Error)
+	case throughputDone:
+		if t.Protocol == throughputUDP {
+			return fmt.Sprintf("%s %s %s, %s lost, %s jitter", t.Goodput, t.Protocol, peer, t.Loss, t.Jitter)
+		}
+		return fmt.Sprintf("%s %s %s, %d retransmits", t.Goodput, t.Protocol, peer, t.Retransmits)
+	}
+	return "-"
+}
+
+// throughputResult is what the sink and the sender measured
+type throughputResult struct {
+	bytes       int64
+	last        time.Time
+	retransmits int
+	sent        int
+	received    int
+	jitter      time.Duration
+}
+
+// Throughputs runs the throughput tests and keeps their results
+type Throughputs struct {
+	lock  sync.Mutex
+	tests map[string]*ThroughputTest
+}
+
+// NewThroughputs instantiates a new Throughputs
+func NewThroughputs() *Throughputs {
+	return &Throughputs{
+		tests: map[string]*ThroughputTest{},
+	}
+}
+
+// List returns the tests, the most recent first
+func (t *Throughputs) List() []ThroughputTest {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	list := []ThroughputTest{}
+	for _, test := range t.tests {
+		list = append(list, *test)
+	}
+	sort.Sort(byTestStarted(list))
+	return list
+}
+
+// Get returns the test id
+func (t *Throughputs) Get(id string) (ThroughputTest, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	test, ok := t.tests[id]
+	if !ok {
+		return ThroughputTest{}, false
+	}
+	return *test, true
+}
+
+// Start runs a test in the background from the network namespace of
+// the process sourcePID to the one of destinationPID, it returns once
+// the sender is connected
+func (t *Throughputs) Start(sourcePID int, sourceID string, source Container, destinationPID int, destinationID string, destination Container, options ThroughputOptions) (ThroughputTest, error) {
+	duration, rate, err := options.resolve(currentConfig().Throughput)
+	if err != nil {
+		return ThroughputTest{}, err
+	}
+	if source.NetNSID == destination.NetNSID {
+		return ThroughputTest{}, fmt.Errorf("%s and %s share a network namespace", source.Name, destination.Name)
+	}
+	sinkNS, err := ns.GetNS(fmt.Sprintf("/proc/%d/ns/net", destinationPID))
+	if err != nil {
+		return ThroughputTest{}, err
+	}
+	defer sinkNS.Close()
+	senderNS, err := ns.GetNS(fmt.Sprintf("/proc/%d/ns/net", sourcePID))
+	if err != nil {
+		return ThroughputTest{}, err
+	}
+	defer senderNS.Close()
+
+	// the sockets stay in the network namespace they are created in
+	var tcpSink *net.TCPListener
+	var udpSink *net.UDPConn
+	var addr *net.TCPAddr
+	err = sinkNS.Do(func(ns.NetNS) error {
+		ip, err := sinkAddress()
+		if err != nil {
+			return err
+		}
+		if options.Protocol == throughputUDP {
+			udpSink, err = net.ListenUDP("udp4", &net.UDPAddr{IP: ip})
+			if err != nil {
+				return err
+			}
+			addr = &net.TCPAddr{IP: ip, Port: udpSink.LocalAddr().(*net.UDPAddr).Port}
+			return nil
+		}
+		tcpSink, err = net.ListenTCP("tcp4", &net.TCPAddr{IP: ip})
+		if err != nil {
+			return err
+		}
+		addr = tcpSink.Addr().(*net.TCPAddr)
+		return nil
+	})
+	if err != nil {
+		return ThroughputTest{}, fmt.Errorf("failed to start the sink in %s: %v", destination.Name, err)
+	}
+	closeSink := func() {
+		if tcpSink != nil {
+			tcpSink.Close()
+		} else {
+			udpSink.Close()
+		}
+	}
+	fd := -1
+	err = senderNS.Do(func(ns.NetNS) error {
+		var err error
+		fd, err = connectMarked(addr, options.Protocol == throughputTCP, throughputConnectTimeout)
+		return err
+	})
+	if err != nil {
+		closeSink()
+		return ThroughputTest{}, fmt.Errorf("failed to connect from %s to %s: %v", source.Name, addr, err)
+	}
+	// a blocked sender checks the end of the test
+	tv := syscall.NsecToTimeval(int64(throughputPollInterval))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv); err != nil {
+		closeSink()
+		syscall.Close(fd)
+		return ThroughputTest{}, fmt.Errorf("failed to set the send timeout: %v", err)
+	}
+
+	started := time.Now()
+	test := &ThroughputTest{
+		ID:                fmt.Sprintf("%s-%06x", started.UTC().Format("20060102-150405"), rand.Intn(1<<24)),
+		Node:              currentConfig().NodeName,
+		SourceID:          sourceID,
+		Source:            source.Name,
+		SourceNetNS:       source.NetNSID,
+		DestinationID:     destinationID,
+		Destination:       destination.Name,
+		DestinationNetNS:  destination.NetNSID,
+		Address:           addr.String(),
+		ThroughputOptions: options,
+		Started:           started,
+		State:             throughputRunning,
+	}
+	t.lock.Lock()
+	t.tests[test.ID] = test
+	info := *test
+	t.lock.Unlock()
+	log.Infof("Testing the %s throughput from %s to %s at %s in test %s", options.Protocol, source.Name, destination.Name, addr, test.ID)
+
+	deadline := started.Add(duration)
+	if tcpSink != nil {
+		go t.runTCP(test, tcpSink, fd, deadline)
+	} else {
+		go t.runUDP(test, udpSink, fd, deadline, rate)
+	}
+	return info, nil
+}
+
+// resolve sets the defaults of the options and checks them against the
+// limits of the configuration, it returns the duration of the test and
+// the rate of a UDP test in bytes per second
+func (o *ThroughputOptions) resolve(cfg ThroughputConfig) (time.Duration, uint64, error) {
+	switch o.Protocol {
+	case "":
+		o.Protocol = throughputTCP
+	case throughputTCP, throughputUDP:
+	default:
+		return 0, 0, fmt.Errorf("invalid protocol %q, expected %s or %s", o.Protocol, throughputTCP, throughputUDP)
+	}
+	if o.Duration == "" {
+		o.Duration = cfg.Duration
+	}
+	duration, err := time.ParseDuration(o.Duration)
+	if err != nil || duration <= 0 {
+		return 0, 0, fmt.Errorf("invalid duration %q", o.Duration)
+	}
+	if maxDuration, _ := time.ParseDuration(cfg.MaxDuration); duration > maxDuration {
+		return 0, 0, fmt.Errorf("the duration %s exceeds the limit of %s", o.Duration, cfg.MaxDuration)
+	}
+	if o.Protocol == throughputTCP {
+		if o.Rate != "" {
+			return 0, 0, fmt.Errorf("a rate only applies to the UDP tests, TCP sends as fast as it can")
+		}
+		return duration, 0, nil
+	}
+	if o.Rate == "" {
+		o.Rate = cfg.UDPRate
+	}
+	rate, err := parseTCRate(o.Rate)
+	if err != nil {
+		return 0, 0, err
+	}
+	if maxRate, _ := parseTCRate(cfg.MaxUDPRate); rate > maxRate {
+		return 0, 0, fmt.Errorf("the rate %s exceeds the limit of %s", o.Rate, cfg.MaxUDPRate)
+	}
+	return duration, rate, nil
+}
+
+// sinkAddress returns the IPv4 address of eth0 in the current network
+// namespace, or the first one of another interface up
+func sinkAddress() (net.IP, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var found net.IP
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			if iface.Name == defaultCaptureInterface {
+				return ipNet.IP.To4(), nil
+			}
+			if found == nil {
+				found = ipNet.IP.To4()
+			}
+			break
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no IPv4 address")
+	}
+	return found, nil
+}
+
+// runTCP sends until deadline, the sink counts the data until the
+// sender closes the connection
+func (t *Throughputs) runTCP(test *ThroughputTest, listener *net.TCPListener, fd int, deadline time.Time) {
+	defer syscall.Close(fd)
+	sunk := make(chan throughputResult, 1)
+	sinkErr := make(chan error, 1)
+	go func() {
+		defer listener.Close()
+		listener.SetDeadline(time.Now().Add(throughputConnectTimeout))
+		conn, err := listener.Accept()
+		if err != nil {
+			sinkErr <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(deadline.Add(throughputDrain))
+		result := throughputResult{}
+		buf := make([]byte, throughputBufferSize)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				result.bytes += int64(n)
+				result.last = time.Now()
+			}
+			if err != nil {
+				// EOF, or the data still in flight is not waited for
+				break
+			}
+		}
+		sunk <- result
+	}()
+
+	buf := make([]byte, throughputBufferSize)
+	var err error
+	for time.Now().Before(deadline) {
+		_, err = syscall.Write(fd, buf)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			err = nil
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to send: %v", err)
+			break
+		}
+	}
+	syscall.Shutdown(fd, syscall.SHUT_WR)
+	var result throughputResult
+	select {
+	case result = <-sunk:
+	case sinkErr := <-sinkErr:
+		err = fmt.Errorf("the sink failed: %v", sinkErr)
+	}
+	// read once the data is acknowledged, or given up on
+	if info, infoErr := tcpInfo(fd); infoErr == nil {
+		result.retransmits = int(info.Total_retrans)
+	}
+	t.finish(test, result, err)
+}
+
+// runUDP sends datagrams at rate until deadline, the sink reads them
+// until throughputGrace after it
+func (t *Throughputs) runUDP(test *ThroughputTest, sink *net.UDPConn, fd int, deadline time.Time, rate uint64) {
+	defer syscall.Close(fd)
+	sunk := make(chan throughputResult, 1)
+	go func() {
+		defer sink.Close()
+		sink.SetReadDeadline(deadline.Add(throughputGrace))
+		result := throughputResult{}
+		var transit, jitter float64
+		buf := make([]byte, throughputDatagramSize)
+		for {
+			n, err := sink.Read(buf)
+			if err != nil {
+				break
+			}
+			received := time.Now()
+			if n < throughputHeaderLen {
+				continue
+			}
+			sent := int64(binary.BigEndian.Uint64(buf[8:throughputHeaderLen]))
+			// interarrival jitter, see RFC 3550 section 6.4.1
+			current := float64(received.UnixNano() - sent)
+			if result.received > 0 {
+				d := current - transit
+				if d < 0 {
+					d = -d
+				}
+				jitter += (d - jitter) / 16
+			}
+			transit = current
+			result.received++
+			result.bytes += int64(n)
+			result.last = received
+		}
+		result.jitter = time.Duration(jitter)
+		sunk <- result
+	}()
+
+	// the datagrams are sent in bursts keeping up with the rate
+	perSecond := float64(rate) / throughputDatagramSize
+	buf := make([]byte, throughputDatagramSize)
+	started := time.Now()
+	sent := 0
+	var err error
+	for now := started; now.Before(deadline); now = time.Now() {
+		for due := int(now.Sub(started).Seconds()*perSecond) + 1; sent < due && err == nil; {
+			binary.BigEndian.PutUint64(buf, uint64(sent))
+			binary.BigEndian.PutUint64(buf[8:], uint64(time.Now().UnixNano()))
+			_, err = syscall.Write(fd, buf)
+			switch err {
+			case nil:
+				sent++
+			case syscall.EAGAIN, syscall.EINTR, syscall.ENOBUFS:
+				// the queue of the interface is full, the datagram
+				// is sent again
+				err = nil
+				time.Sleep(time.Millisecond)
+			case syscall.ECONNREFUSED:
+				// an earlier datagram was refused, the sink is gone
+				err = fmt.Errorf("the sink is unreachable: %v", err)
+			default:
+				err = fmt.Errorf("failed to send: %v", err)
+			}
+		}
+		if err != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	result := <-sunk
+	result.sent = sent
+	t.finish(test, result, err)
+}
+
+// finish records the result of a test
+func (t *Throughputs) finish(test *ThroughputTest, result throughputResult, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ended := time.Now()
+	test.Ended = &ended
+	test.State = throughputDone
+	if err != nil {
+		test.State = throughputFailed
+		test.Error = err.Error()
+	}
+	test.Bytes = result.bytes
+	if elapsed := result.last.Sub(test.Started); result.bytes > 0 && elapsed > 0 {
+		test.Goodput = formatRate(float64(result.bytes) / elapsed.Seconds())
+	} else {
+		test.Goodput = formatRate(0)
+	}
+	if test.Protocol == throughputTCP {
+		test.Retransmits = result.retransmits
+	} else {
+		test.Sent = result.sent
+		test.Received = result.received
+		lost := result.sent - result.received
+		if lost < 0 {
+			// duplicated datagrams
+			lost = 0
+		}
+		if result.sent > 0 {
+			test.Loss = fmt.Sprintf("%.1f%%", 100*float64(lost)/float64(result.sent))
+		}
+		// finer than the round trip times, jitter is often in the
+		// microseconds
+		test.Jitter = fmt.Sprintf("%.3fms", float64(result.jitter)/float64(time.Millisecond))
+	}
+	if err != nil {
+		log.Errorf("Throughput test %s from %s to %s failed: %v", test.ID, test.Source, test.Destination, err)
+	} else {
+		log.Infof("Throughput test %s from %s to %s: %s", test.ID, test.Source, test.Destination, test.describe(test.SourceNetNS))
+	}
+	t.prune()
+}
+
+// prune removes the oldest finished tests beyond the number kept,
+// t.lock is held
+func (t *Throughputs) prune() {
+	finished := []ThroughputTest{}
+	for _, test := range t.tests {
+		if test.State != throughputRunning {
+			finished = append(finished, *test)
+		}
+	}
+	sort.Sort(byTestStarted(finished))
+	for i := currentConfig().Throughput.Keep; i < len(finished); i++ {
+		delete(t.tests, finished[i].ID)
+	}
+}
+
+// tcpInfo returns the TCP_INFO of the socket fd
+func tcpInfo(fd int) (*unix.TCPInfo, error) {
+	info := &unix.TCPInfo{}
+	size := uint32(unix.SizeofTCPInfo)
+	_, _, errno := unix.Syscall6(sysGetsockopt, uintptr(fd), unix.IPPROTO_TCP, unix.TCP_INFO, uintptr(unsafe.Pointer(info)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	return info, nil
+}
+
+type byTestStarted []ThroughputTest
+
+func (s byTestStarted) Len() int           { return len(s) }
+func (s byTestStarted) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTestStarted) Less(i, j int) bool { return s[i].Started.After(s[j].Started) }
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Traces are time series of the delay, the loss and the rate recorded
+// on real networks, replayed onto a network namespace in real time: each
+// sample is applied at its offset from the start, divided by the speed.
+// The last sample stays once the replay is over, unless it loops.
+
+const (
+	// maxTraceSamples bounds the samples of a trace, they are sent in
+	// the requests
+	maxTraceSamples = 100000
+	// maxReplaySpeed bounds the speed-up, the samples due while the
+	// previous one is applied are skipped anyway
+	maxReplaySpeed = 100
+)
+
+// TraceSample are the settings of a trace from an offset, the empty
+// ones are left unchanged
+type TraceSample struct {
+	// At is the offset from the start of the trace, a duration or a
+	// number of seconds, e.g. 1.5s or 1.5
+	At         string `yaml:"at" json:"at"`
+	Impairment `yaml:",inline"`
+}
+
+// Replay replays a trace, either a built-in profile, a file of the
+// host of the plugin or the samples themselves
+type Replay struct {
+	// Profile is a built-in trace, e.g. lte
+	Profile string `yaml:"profile,omitempty" json:"profile,omitempty"`
+	// File is a CSV or JSON trace, see loadTrace
+	File    string        `yaml:"file,omitempty" json:"file,omitempty"`
+	Samples []TraceSample `yaml:"samples,omitempty" json:"samples,omitempty"`
+	// Name names the samples in the report, e.g. the file they come
+	// from
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	// Loop restarts the trace once over instead of keeping its last
+	// sample
+	Loop bool `yaml:"loop,omitempty" json:"loop,omitempty"`
+	// Speed speeds the trace up, 1 by default
+	Speed float64 `yaml:"speed,omitempty" json:"speed,omitempty"`
+}
+
+// Validate checks the replay and its trace
+func (r *Replay) Validate() error {
+	if r.Speed < 0 || r.Speed > maxReplaySpeed {
+		return fmt.Errorf("invalid speed %g, it must be between 0 and %d", r.Speed, maxReplaySpeed)
+	}
+	_, err := r.trace()
+	return err
+}
+
+// trace returns the samples to replay
+func (r *Replay) trace() (*trace, error) {
+	set := 0
+	for _, ok := range []bool{r.Profile != "", r.File != "", len(r.Samples) > 0} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("a replay has either a profile, a file or samples")
+	}
+	switch {
+	case r.Profile != "":
+		samples, ok := traceProfiles[r.Profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q, expected one of %s", r.Profile, strings.Join(profileNames(), ", "))
+		}
+		return newTrace(r.Profile, samples)
+	case r.File != "":
+		samples, err := loadTrace(r.File)
+		if err != nil {
+			return nil, err
+		}
+		return newTrace(filepath.Base(r.File), samples)
+	}
+	name := r.Name
+	if name == "" {
+		name = "samples"
+	}
+	return newTrace(name, r.Samples)
+}
+
+func (r *Replay) speed() float64 {
+	if r.Speed == 0 {
+		return 1
+	}
+	return r.Speed
+}
+
+// trace is a validated trace
+type trace struct {
+	name    string
+	offsets []time.Duration
+	samples []Impairment
+	// period is the time between two loops, the last sample lasts as
+	// long as the gap before it
+	period time.Duration
+}
+
+func newTrace(name string, samples []TraceSample) (*trace, error) {
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("trace %s has no samples", name)
+	}
+	if len(samples) > maxTraceSamples {
+		return nil, fmt.Errorf("trace %s has %d samples, at most %d are replayed", name, len(samples), maxTraceSamples)
+	}
+	t := &trace{name: name}
+	for i, sample := range samples {
+		offset, err := parseTraceOffset(sample.At)
+		if err != nil {
+			return nil, fmt.Errorf("sample %d of trace %s: %v", i+1, name, err)
+		}
+		if i > 0 && offset < t.offsets[i-1] {
+			return nil, fmt.Errorf("sample %d of trace %s is before the previous one", i+1, name)
+		}
+		if err := sample.Impairment.Validate(); err != nil {
+			return nil, fmt.Errorf("sample %d of trace %s: %v", i+1, name, err)
+		}
+		t.offsets = append(t.offsets, offset)
+		t.samples = append(t.samples, sample.Impairment)
+	}
+	last := len(t.offsets) - 1
+	t.period = t.offsets[last] + time.Second
+	if last > 0 && t.offsets[last] > t.offsets[last-1] {
+		t.period = 2*t.offsets[last] - t.offsets[last-1]
+	}
+	return t, nil
+}
+
+// at returns the offset from the start of the replay of the position
+// k, which counts the samples of the previous loops too
+func (t *trace) at(k int) time.Duration {
+	n := len(t.samples)
+	return time.Duration(k/n)*t.period + t.offsets[k%n]
+}
+
+// clears returns the change removing the settings the trace sets
+func (t *trace) clears() func(status *TrafficControlStatus) {
+	return func(status *TrafficControlStatus) {
+		for _, sample := range t.samples {
+			if sample.Delay != "" {
+				status.SetLatency("")
+			}
+			if sample.Loss != "" {
+				status.SetPacketLoss("")
+			}
+			if sample.Rate != "" {
+				status.SetRate("")
+			}
+		}
+	}
+}
+
+// parseTraceOffset parses the offset of a sample, a duration or a
+// number of seconds
+func parseTraceOffset(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	offset, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid offset %q", value)
+	}
+	return offset, nil
+}
+
+// loadTrace reads a trace file: a JSON array of samples if its name
+// ends with .json, CSV otherwise
+func loadTrace(path string) ([]TraceSample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.HasSuffix(strings.ToLower(path), ".json") {
+		samples := []TraceSample{}
+		if err := json.NewDecoder(f).Decode(&samples); err != nil {
+			return nil, fmt.Errorf("invalid trace %s: %v", path, err)
+		}
+		return samples, nil
+	}
+	samples, err := readCSVTrace(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trace %s: %v", path, err)
+	}
+	return samples, nil
+}
+
+// traceColumns are the columns of the CSV traces and their aliases, the
+// unit of the values without one: seconds for time, milliseconds for
+// delay, percents for loss and kbit for rate
+var traceColumns = map[string]string{
+	"time":      "time",
+	"at":        "time",
+	"delay":     "delay",
+	"rtt":       "delay",
+	"loss":      "loss",
+	"rate":      "rate",
+	"bandwidth": "rate",
+}
+
+// readCSVTrace reads a CSV trace, its header names the columns, the
+// unknown ones are ignored and the lines starting with # are comments
+func readCSVTrace(r io.Reader) ([]TraceSample, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("no header: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		if column, ok := traceColumns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[column] = i
+		}
+	}
+	if _, ok := columns["time"]; !ok {
+		return nil, fmt.Errorf("no time column")
+	}
+	if len(columns) == 1 {
+		return nil, fmt.Errorf("no delay, loss or rate column")
+	}
+	cell := func(record []string, column, unit string) string {
+		i, ok := columns[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		value := strings.TrimSpace(record[i])
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			value += unit
+		}
+		return value
+	}
+	samples := []TraceSample{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(samples) == maxTraceSamples {
+			return nil, fmt.Errorf("more than %d samples", maxTraceSamples)
+		}
+		samples = append(samples, TraceSample{
+			At: cell(record, "time", ""),
+			Impairment: Impairment{
+				Delay: cell(record, "delay", "ms"),
+				Loss:  cell(record, "loss", "%"),
+				Rate:  cell(record, "rate", "kbit"),
+			},
+		})
+	}
+}
+
+// writeCSVTrace writes samples as a CSV trace
+func writeCSVTrace(w io.Writer, samples []TraceSample) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"time", "delay", "loss", "rate"})
+	for _, sample := range samples {
+		writer.Write([]string{sample.At, sample.Delay, sample.Loss, sample.Rate})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// readTraceFile reads the trace of a request, a file of the client or
+// else a profile, the samples are sent since the plugin may run on
+// another host
+func readTraceFile(path string) (*Replay, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, ok := traceProfiles[path]; ok {
+			return &Replay{Profile: path}, nil
+		}
+	}
+	samples, err := loadTrace(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Replay{Name: filepath.Base(path), Samples: samples}, nil
+}
+
+// ReplayStatus is the progress of the replay of a network namespace
+type ReplayStatus struct {
+	Trace   string    `json:"trace"`
+	Loop    bool      `json:"loop,omitempty"`
+	Speed   float64   `json:"speed"`
+	Started time.Time `json:"started"`
+	// Sample is the last sample applied, from 1, of Samples, and Loops
+	// the loops over
+	Sample  int `json:"sample"`
+	Samples int `json:"samples"`
+	Loops   int `json:"loops,omitempty"`
+	// Current are the settings of the last sample
+	Current Impairment `json:"current"`
+}
+
+func (s ReplayStatus) String() string {
+	description := fmt.Sprintf("%s, sample %d of %d", s.Trace, s.Sample, s.Samples)
+	if s.Loop {
+		description += fmt.Sprintf(", loop %d", s.Loops+1)
+	}
+	if s.Speed != 1 {
+		description += fmt.Sprintf(", %gx", s.Speed)
+	}
+	return description
+}
+
+// replay drives the samples of a trace
+type replay struct {
+	pid   int
+	spec  Replay
+	trace *trace
+
+	lock   sync.Mutex
+	status ReplayStatus
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newReplay(pid int, spec Replay, t *trace) *replay {
+	return &replay{
+		pid:   pid,
+		spec:  spec,
+		trace: t,
+		status: ReplayStatus{
+			Trace:   t.name,
+			Loop:    spec.Loop,
+			Speed:   spec.speed(),
+			Started: time.Now(),
+			Samples: len(t.samples),
+		},
+		done: make(chan struct{}),
+	}
+}
+
+// Status returns the progress of the replay
+func (r *replay) Status() ReplayStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.status
+}
+
+// sample returns the settings of the position k
+func (r *replay) sample(k int) Impairment {
+	return r.trace.samples[k%len(r.trace.samples)]
+}
+
+// replayed records that the settings of the position k are applied
+func (r *replay) replayed(k int) {
+	n := len(r.trace.samples)
+	r.lock.Lock()
+	r.status.Sample = k%n + 1
+	r.status.Loops = k / n
+	r.status.Current = r.sample(k)
+	r.lock.Unlock()
+}
+
+func (r *replay) stop() {
+	r.stopOnce.Do(func() {
+		close(r.done)
+	})
+}
+
+// due returns when the position k is due
+func (r *replay) due(started time.Time, k int) time.Time {
+	return started.Add(time.Duration(float64(r.trace.at(k)) / r.spec.speed()))
+}
+
+// run applies the samples after the first one until the last one,
+// forever if the replay loops, or until the replay is stopped. The
+// samples due while the previous one is applied are skipped.
+func (r *replay) run(c *Controller) {
+	started := r.Status().Started
+	n := len(r.trace.samples)
+	for k := 1; r.spec.Loop || k < n; k++ {
+		timer := time.NewTimer(r.due(started, k).Sub(time.Now()))
+		select {
+		case <-r.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		for (r.spec.Loop || k+1 < n) && !r.due(started, k+1).After(time.Now()) {
+			k++
+		}
+		if err := c.replayStep(r, k); err != nil {
+			log.Errorf("replay of process %d stopped at sample %d: %v", r.pid, k%n+1, err)
+			c.endReplay(r)
+			return
+		}
+	}
+	log.Infof("replay of process %d is over: %s", r.pid, r.trace.name)
+	c.endReplay(r)
+}
+
+// traceProfiles are the built-in traces, one sample every 5 seconds
+// over a minute and a half, they loop smoothly. The delay is applied to
+// the traffic leaving the container, it adds up to its round trip time.
+var traceProfiles = map[string][]TraceSample{
+	// 3g is a HSPA connection on the move, with the occasional stall
+	// of a cell handover
+	"3g": traceProfile(5*time.Second, [][3]string{
+		{"150ms", "1%", "1500kbit"},
+		{"180ms", "1%", "1200kbit"},
+		{"220ms", "1.5%", "900kbit"},
+		{"200ms", "1%", "1000kbit"},
+		{"350ms", "3%", "400kbit"},
+		{"600ms", "5%", "200kbit"},
+		{"250ms", "2%", "800kbit"},
+		{"170ms", "1%", "1400kbit"},
+		{"160ms", "0.5%", "1800kbit"},
+		{"190ms", "1%", "1300kbit"},
+		{"240ms", "2%", "700kbit"},
+		{"210ms", "1.5%", "900kbit"},
+		{"180ms", "1%", "1100kbit"},
+		{"160ms", "0.5%", "1600kbit"},
+		{"170ms", "1%", "1500kbit"},
+		{"150ms", "1%", "1700kbit"},
+		{"160ms", "1%", "1600kbit"},
+		{"155ms", "1%", "1500kbit"},
+	}),
+	// lte is a 4G connection with a good signal fading for a while
+	"lte": traceProfile(5*time.Second, [][3]string{
+		{"45ms", "0.1%", "20mbit"},
+		{"50ms", "0.1%", "18mbit"},
+		{"40ms", "0%", "24mbit"},
+		{"55ms", "0.2%", "15mbit"},
+		{"70ms", "0.5%", "8mbit"},
+		{"90ms", "1%", "4mbit"},
+		{"80ms", "0.5%", "6mbit"},
+		{"60ms", "0.2%", "12mbit"},
+		{"50ms", "0.1%", "18mbit"},
+		{"45ms", "0%", "22mbit"},
+		{"40ms", "0%", "25mbit"},
+		{"50ms", "0.1%", "20mbit"},
+		{"65ms", "0.3%", "10mbit"},
+		{"55ms", "0.2%", "14mbit"},
+		{"45ms", "0.1%", "19mbit"},
+		{"40ms", "0%", "23mbit"},
+		{"50ms", "0.1%", "21mbit"},
+		{"45ms", "0.1%", "20mbit"},
+	}),
+	// satellite is a geostationary link, rain fading it in the middle
+	"satellite": traceProfile(5*time.Second, [][3]string{
+		{"600ms", "0.2%", "10mbit"},
+		{"610ms", "0.2%", "10mbit"},
+		{"620ms", "0.3%", "9mbit"},
+		{"600ms", "0.2%", "10mbit"},
+		{"640ms", "0.5%", "8mbit"},
+		{"680ms", "1%", "6mbit"},
+		{"720ms", "2%", "4mbit"},
+		{"750ms", "3%", "2mbit"},
+		{"720ms", "2%", "3mbit"},
+		{"680ms", "1%", "5mbit"},
+		{"650ms", "0.5%", "7mbit"},
+		{"620ms", "0.3%", "9mbit"},
+		{"600ms", "0.2%", "10mbit"},
+		{"610ms", "0.2%", "10mbit"},
+		{"605ms", "0.2%", "10mbit"},
+		{"615ms", "0.3%", "9mbit"},
+		{"600ms", "0.2%", "10mbit"},
+		{"600ms", "0.2%", "10mbit"},
+	}),
+	// lossy-wifi is a congested access point far away, with bursts of
+	// interference
+	"lossy-wifi": traceProfile(5*time.Second, [][3]string{
+		{"10ms", "3%", "20mbit"},
+		{"15ms", "5%", "15mbit"},
+		{"40ms", "12%", "5mbit"},
+		{"20ms", "6%", "12mbit"},
+		{"8ms", "2%", "25mbit"},
+		{"12ms", "4%", "18mbit"},
+		{"60ms", "15%", "3mbit"},
+		{"35ms", "10%", "6mbit"},
+		{"15ms", "5%", "14mbit"},
+		{"10ms", "3%", "22mbit"},
+		{"25ms", "8%", "9mbit"},
+		{"12ms", "4%", "17mbit"},
+		{"9ms", "2%", "24mbit"},
+		{"45ms", "12%", "4mbit"},
+		{"18ms", "6%", "12mbit"},
+		{"10ms", "3%", "21mbit"},
+		{"14ms", "4%", "16mbit"},
+		{"10ms", "3%", "20mbit"},
+	}),
+}
+
+// traceProfile returns the samples of a built-in trace, delay, loss
+// and rate every interval
+func traceProfile(interval time.Duration, values [][3]string) []TraceSample {
+	samples := make([]TraceSample, len(values))
+	for i, v := range values {
+		samples[i] = TraceSample{
+			At:         (time.Duration(i) * interval).String(),
+			Impairment: Impairment{Delay: v[0], Loss: v[1], Rate: v[2]},
+		}
+	}
+	return samples
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(traceProfiles))
+	for name := range traceProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
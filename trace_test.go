@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewTrace(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		at      []string
+		offsets []time.Duration
+		period  time.Duration
+		invalid bool
+	}{
+		{
+			name:    "seconds",
+			at:      []string{"0", "1", "3"},
+			offsets: []time.Duration{0, time.Second, 3 * time.Second},
+			// the last sample lasts as long as the gap before it
+			period: 5 * time.Second,
+		},
+		{
+			name:    "durations and seconds",
+			at:      []string{"2s", "2.5", "3500ms"},
+			offsets: []time.Duration{2 * time.Second, 2500 * time.Millisecond, 3500 * time.Millisecond},
+			period:  4500 * time.Millisecond,
+		},
+		{
+			name:    "one sample",
+			at:      []string{"0"},
+			offsets: []time.Duration{0},
+			period:  time.Second,
+		},
+		{
+			name:    "last samples at the same offset",
+			at:      []string{"0", "500ms", "500ms"},
+			offsets: []time.Duration{0, 500 * time.Millisecond, 500 * time.Millisecond},
+			period:  1500 * time.Millisecond,
+		},
+		{name: "no samples", at: []string{}, invalid: true},
+		{name: "backwards", at: []string{"0", "2", "1"}, invalid: true},
+		{name: "negative", at: []string{"-1"}, invalid: true},
+		{name: "invalid offset", at: []string{"soon"}, invalid: true},
+	} {
+		samples := []TraceSample{}
+		for _, at := range test.at {
+			samples = append(samples, TraceSample{At: at, Impairment: Impairment{Delay: "10ms"}})
+		}
+		tr, err := newTrace(test.name, samples)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, tr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(tr.offsets, test.offsets) || tr.period != test.period {
+			t.Errorf("%s: expected offsets %v and period %s, got %v and %s", test.name, test.offsets, test.period, tr.offsets, tr.period)
+		}
+	}
+
+	if _, err := newTrace("invalid sample", []TraceSample{{At: "0", Impairment: Impairment{Loss: "200%"}}}); err == nil {
+		t.Errorf("expected an error for an invalid sample")
+	}
+}
+
+func TestTraceLoop(t *testing.T) {
+	tr, err := newTrace("loop", []TraceSample{
+		{At: "0", Impairment: Impairment{Delay: "10ms"}},
+		{At: "1", Impairment: Impairment{Delay: "20ms"}},
+		{At: "3", Impairment: Impairment{Delay: "30ms"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, expected := range []time.Duration{0, time.Second, 3 * time.Second, 5 * time.Second, 6 * time.Second, 8 * time.Second, 10 * time.Second} {
+		if at := tr.at(k); at != expected {
+			t.Errorf("position %d: expected %s, got %s", k, expected, at)
+		}
+	}
+}
+
+func TestReadCSVTrace(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		csv      string
+		expected []TraceSample
+		invalid  bool
+	}{
+		{
+			name: "default units",
+			csv:  "time,delay,loss,rate\n0,20,0.5,1000\n1.5,40,1,500\n",
+			expected: []TraceSample{
+				{At: "0", Impairment: Impairment{Delay: "20ms", Loss: "0.5%", Rate: "1000kbit"}},
+				{At: "1.5", Impairment: Impairment{Delay: "40ms", Loss: "1%", Rate: "500kbit"}},
+			},
+		},
+		{
+			name: "aliases, units, comments and unknown columns",
+			csv:  "# recorded on a train\nAt, RTT, signal, bandwidth\n0s, 100ms, -80, 2mbit\n# tunnel\n2s, 1s, -110, 100kbit\n",
+			expected: []TraceSample{
+				{At: "0s", Impairment: Impairment{Delay: "100ms", Rate: "2mbit"}},
+				{At: "2s", Impairment: Impairment{Delay: "1s", Rate: "100kbit"}},
+			},
+		},
+		{
+			name: "empty cells are left unchanged",
+			csv:  "time,delay,loss\n0,10,\n1,,5\n",
+			expected: []TraceSample{
+				{At: "0", Impairment: Impairment{Delay: "10ms"}},
+				{At: "1", Impairment: Impairment{Loss: "5%"}},
+			},
+		},
+		{name: "empty", csv: "", invalid: true},
+		{name: "no time", csv: "delay,loss\n10,1\n", invalid: true},
+		{name: "only time", csv: "time,signal\n0,-80\n", invalid: true},
+		{name: "ragged", csv: "time,delay\n0,10\n1\n", invalid: true},
+	} {
+		samples, err := readCSVTrace(strings.NewReader(test.csv))
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", test.name, samples)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(samples, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, samples)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tc time and rate units, see tc(8) "PARAMETERS"
+var tcTimeUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	{"usecs", time.Microsecond},
+	{"usec", time.Microsecond},
+	{"us", time.Microsecond},
+	{"msecs", time.Millisecond},
+	{"msec", time.Millisecond},
+	{"ms", time.Millisecond},
+	{"secs", time.Second},
+	{"sec", time.Second},
+	{"s", time.Second},
+}
+
+var tcRateUnits = []struct {
+	suffix string
+	// bytes per second
+	unit float64
+}{
+	{"kibps", 1024},
+	{"mibps", 1024 * 1024},
+	{"gibps", 1024 * 1024 * 1024},
+	{"kibit", 1024 / 8.},
+	{"mibit", 1024 * 1024 / 8.},
+	{"gibit", 1024 * 1024 * 1024 / 8.},
+	{"kbps", 1000},
+	{"mbps", 1000 * 1000},
+	{"gbps", 1000 * 1000 * 1000},
+	{"kbit", 1000 / 8.},
+	{"mbit", 1000 * 1000 / 8.},
+	{"gbit", 1000 * 1000 * 1000 / 8.},
+	{"bps", 1},
+	{"bit", 1 / 8.},
+}
+
+// parseTCTime parses a time the way tc does, a value without unit
+// is expressed in microseconds
+func parseTCTime(value string) (time.Duration, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	unit := time.Microsecond
+	for _, u := range tcTimeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value = strings.TrimSuffix(value, u.suffix)
+			unit = u.unit
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return time.Duration(f * float64(unit)), nil
+}
+
+// parseTCRate parses a rate the way tc does and returns it in bytes
+// per second, a value without unit is expressed in bits per second
+func parseTCRate(value string) (uint64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	unit := 1 / 8.
+	for _, u := range tcRateUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value = strings.TrimSuffix(value, u.suffix)
+			unit = u.unit
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	return uint64(f * unit), nil
+}
+
+// parsePercentage parses a percentage like "10%" or "0.5" and returns
+// it as a fraction between 0 and 1
+func parsePercentage(value string) (float64, error) {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+	if err != nil || f < 0 || f > 100 {
+		return 0, fmt.Errorf("invalid percentage %q", value)
+	}
+	return f / 100, nil
+}
+
+// tc size units, in bytes
+var tcSizeUnits = []struct {
+	suffix string
+	unit   int64
+}{
+	{"kb", 1024},
+	{"mb", 1024 * 1024},
+	{"gb", 1024 * 1024 * 1024},
+	{"k", 1024},
+	{"m", 1024 * 1024},
+	{"g", 1024 * 1024 * 1024},
+	{"b", 1},
+}
+
+// parseSize parses a size the way tc does and returns it in bytes, a
+// value without unit is expressed in bytes
+func parseSize(value string) (int64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	unit := int64(1)
+	for _, u := range tcSizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value = strings.TrimSuffix(value, u.suffix)
+			unit = u.unit
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f <= 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(f * float64(unit)), nil
+}
+
+// formatSize formats a size in bytes with the largest unit it reaches
+func formatSize(size int64) string {
+	for i := 2; i >= 0; i-- {
+		u := tcSizeUnits[i]
+		if size >= u.unit {
+			return fmt.Sprintf("%.1f%s", float64(size)/float64(u.unit), strings.ToUpper(u.suffix))
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+// formatRate formats a rate in bytes per second in bits per second, with
+// the largest decimal unit it reaches
+func formatRate(rate float64) string {
+	for i := 11; i >= 9; i-- {
+		u := tcRateUnits[i]
+		if rate >= u.unit {
+			return fmt.Sprintf("%.1f%s", rate/u.unit, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%.0fbit", rate*8)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTCTime(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected time.Duration
+		invalid  bool
+	}{
+		{value: "100ms", expected: 100 * time.Millisecond},
+		{value: "100msec", expected: 100 * time.Millisecond},
+		{value: "1.5s", expected: 1500 * time.Millisecond},
+		{value: "2secs", expected: 2 * time.Second},
+		{value: "250us", expected: 250 * time.Microsecond},
+		{value: "250usecs", expected: 250 * time.Microsecond},
+		// tc reads a time without unit in microseconds
+		{value: "1000", expected: time.Millisecond},
+		{value: " 10MS ", expected: 10 * time.Millisecond},
+		{value: "0ms", expected: 0},
+		{value: "-1ms", invalid: true},
+		{value: "ms", invalid: true},
+		{value: "10m", invalid: true},
+		{value: "", invalid: true},
+	} {
+		d, err := parseTCTime(test.value)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %s", test.value, d)
+			}
+			continue
+		}
+		if err != nil || d != test.expected {
+			t.Errorf("%q: expected %s, got %s, %v", test.value, test.expected, d, err)
+		}
+	}
+}
+
+func TestParseTCRate(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected uint64
+		invalid  bool
+	}{
+		{value: "1mbit", expected: 125000},
+		{value: "1Mbit", expected: 125000},
+		{value: "1mibit", expected: 131072},
+		{value: "100kbit", expected: 12500},
+		{value: "1gbit", expected: 125000000},
+		{value: "1kbps", expected: 1000},
+		{value: "1kibps", expected: 1024},
+		{value: "500bps", expected: 500},
+		{value: "800bit", expected: 100},
+		// tc reads a rate without unit in bits per second
+		{value: "8000", expected: 1000},
+		{value: "0.5mbit", expected: 62500},
+		{value: "0mbit", invalid: true},
+		{value: "-1mbit", invalid: true},
+		{value: "mbit", invalid: true},
+		{value: "fast", invalid: true},
+	} {
+		rate, err := parseTCRate(test.value)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %d", test.value, rate)
+			}
+			continue
+		}
+		if err != nil || rate != test.expected {
+			t.Errorf("%q: expected %d bytes/s, got %d, %v", test.value, test.expected, rate, err)
+		}
+	}
+}
+
+func TestParsePercentage(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected float64
+		invalid  bool
+	}{
+		{value: "10%", expected: 0.1},
+		{value: "0.5%", expected: 0.005},
+		{value: "100%", expected: 1},
+		{value: "0%", expected: 0},
+		{value: "25", expected: 0.25},
+		{value: " 50% ", expected: 0.5},
+		{value: "101%", invalid: true},
+		{value: "-1%", invalid: true},
+		{value: "%", invalid: true},
+		{value: "ten", invalid: true},
+	} {
+		f, err := parsePercentage(test.value)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %f", test.value, f)
+			}
+			continue
+		}
+		if err != nil || f != test.expected {
+			t.Errorf("%q: expected %f, got %f, %v", test.value, test.expected, f, err)
+		}
+	}
+}